@@ -1,4 +1,4 @@
-.PHONY: client, subscribe, publish
+.PHONY: client, publish-batch, publish-delayed, publish-ttl, init-producer, publish-idempotent, publish-acks-all, describe-topic, metadata, begin-transaction, commit-transaction, abort-transaction, metrics, consumers, subscribe, subscribe-group, subscribe-since, offsets-for-times, redrive, publish, create-topic, list-topics
 
 client:
 	@go run cmd/broker_client/main.go \
@@ -9,12 +9,86 @@ publish: _http-publish _grpc-publish
 _http-publish:
 	@echo "HTTP Publish: "
 	@curl localhost:$(HTTP_PORT)/mq.Broker/Publish --silent \
-  		-X POST -H "Content-Type: application/json" | jq
+  		-X POST -H "Content-Type: application/json" \
+  		-d '{"topic": "topic1", "key": "a2V5", "body": "aGVsbG8=", "headers": {"content-type": "dGV4dC9wbGFpbg=="}}' | jq
 
 _grpc-publish:
 	@echo "gRPC Publish: "
-	@grpcurl -plaintext localhost:$(GRPC_PORT) mq.Broker/Publish | jq
+	@grpcurl -d '{"topic": "topic1", "key": "a2V5", "body": "aGVsbG8=", "headers": {"content-type": "dGV4dC9wbGFpbg=="}}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/Publish | jq
+
+publish-batch:
+	@grpcurl -d '{"topic": "topic1", "messages": [{"body": "aGVsbG8="}, {"body": "d29ybGQ="}]}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/PublishBatch | jq
+
+publish-delayed:
+	@grpcurl -d '{"topic": "topic1", "body": "aGVsbG8=", "deliver_after": "15s"}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/Publish | jq
+
+publish-ttl:
+	@grpcurl -d '{"topic": "topic1", "body": "aGVsbG8=", "ttl": "60s"}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/Publish | jq
+
+init-producer:
+	@grpcurl -d '{}' -plaintext localhost:$(GRPC_PORT) mq.Broker/InitProducer | jq
+
+publish-idempotent:
+	@grpcurl -d '{"topic": "topic1", "body": "aGVsbG8=", "partition": 0, "producer_id": "$(PRODUCER_ID)", "producer_epoch": $(PRODUCER_EPOCH), "sequence": $(SEQUENCE)}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/Publish | jq
+
+publish-acks-all:
+	@grpcurl -d '{"topic": "topic1", "body": "aGVsbG8=", "partition": 0, "acks": "ACKS_ALL"}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/Publish | jq
+
+describe-topic:
+	@grpcurl -d '{"name": "$(TOPIC)"}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/DescribeTopic | jq
+
+metadata:
+	@grpcurl -d '{}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/Metadata | jq
+
+begin-transaction:
+	@grpcurl -d '{"producer_id": "$(PRODUCER_ID)", "producer_epoch": $(PRODUCER_EPOCH)}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/BeginTransaction | jq
+
+commit-transaction:
+	@grpcurl -d '{"producer_id": "$(PRODUCER_ID)", "producer_epoch": $(PRODUCER_EPOCH)}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/Commit | jq
+
+abort-transaction:
+	@grpcurl -d '{"producer_id": "$(PRODUCER_ID)", "producer_epoch": $(PRODUCER_EPOCH)}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/Abort | jq
+
+metrics:
+	@curl localhost:$(HTTP_PORT)/debug/vars --silent | jq '."broker.expired_messages"'
+
+consumers:
+	@curl localhost:$(HTTP_PORT)/debug/vars --silent | jq '{consumers: ."broker.consumers", dropped: ."broker.dropped_messages"}'
 
 subscribe:
-	@grpcurl -d '{"topic": "topic1"}' \
+	@grpcurl -d '{"topic": "topic1", "policy": "EARLIEST"}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/Subscribe
+
+create-topic:
+	@grpcurl -d '{"name": "$(TOPIC)", "partitions": $(PARTITIONS)}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/CreateTopic | jq
+
+list-topics:
+	@grpcurl -plaintext localhost:$(GRPC_PORT) mq.Broker/ListTopics | jq
+
+subscribe-group:
+	@grpcurl -d '{"topic": "$(TOPIC)", "group_id": "group1", "policy": "EARLIEST"}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/Subscribe
+
+subscribe-since:
+	@grpcurl -d '{"topic": "topic1", "policy": "TIMESTAMP", "timestamp": "$(SINCE)"}' \
 	-plaintext localhost:$(GRPC_PORT) mq.Broker/Subscribe
+
+offsets-for-times:
+	@grpcurl -d '{"topic": "$(TOPIC)", "timestamp": "$(SINCE)"}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/OffsetsForTimes | jq
+
+redrive:
+	@grpcurl -d '{"dead_letter_topic": "$(TOPIC)"}' \
+	-plaintext localhost:$(GRPC_PORT) mq.Broker/Redrive | jq
@@ -10,3 +10,31 @@ endif
 ifndef GRPC_PORT
 	GRPC_PORT=8081
 endif
+
+ifndef TOPIC
+	TOPIC=topic4
+endif
+
+ifndef PARTITIONS
+	PARTITIONS=3
+endif
+
+ifndef STORAGE
+	STORAGE=memory
+endif
+
+ifndef FSYNC
+	FSYNC=os
+endif
+
+ifndef SINCE
+	SINCE=1970-01-01T00:00:00Z
+endif
+
+ifndef BROKERS
+	BROKERS=0=localhost:9081,1=localhost:9083,2=localhost:9085
+endif
+
+ifndef PEERS
+	PEERS=0=localhost:9180,1=localhost:9182,2=localhost:9184
+endif
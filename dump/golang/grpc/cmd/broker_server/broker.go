@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/internal/service"
+)
+
+// initBroker creates the single broker, or joins the cluster, when its brokers are configured.
+// The part of the broker called by the other brokers is returned in the cluster only.
+func initBroker(cfg *config, storage repo.Storage) (service.Broker, service.Peer, error) {
+	if cfg.brokers == "" {
+		b, err := service.NewBroker(storage)
+		return b, nil, err
+	}
+
+	brokers, err := parseBrokers(cfg.brokers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	peers, err := parseBrokers(cfg.peers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The metadata log is kept next to the topics, when they are kept in files.
+	metadataDir := ""
+	if cfg.storage == "file" {
+		metadataDir = cfg.dataDir
+	}
+
+	b, err := service.NewClusterBroker(storage, service.ClusterOptions{
+		BrokerID:          int32(cfg.brokerID),
+		Brokers:           brokers,
+		Peers:             peers,
+		ReplicationFactor: cfg.replicationFactor,
+		MinInsyncReplicas: cfg.minInsyncReplicas,
+		ReplicaLagMax:     cfg.replicaLagMax,
+		AckTimeout:        cfg.ackTimeout,
+		SessionTimeout:    cfg.sessionTimeout,
+		MetadataDir:       metadataDir,
+		Topics:            cfg.topics,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return b, b, nil
+}
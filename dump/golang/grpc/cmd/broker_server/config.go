@@ -2,12 +2,65 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"github.com/fadyat/grpc-broker/internal/repo"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type config struct {
 	grpcPort int
 	httpPort int
+
+	// topics is the list of topics, which are created on the broker start.
+	topics []string
+
+	// storage is the kind of the storage: memory or file.
+	storage string
+
+	// dataDir is the directory of the file storage.
+	dataDir string
+
+	// sync is the durability level of the file storage.
+	sync repo.SyncPolicy
+
+	// cleanupInterval is the time between the removals of the messages exceeding the retention.
+	cleanupInterval time.Duration
+
+	// brokerID is the id of the broker in the cluster.
+	brokerID int
+
+	// brokers are the gRPC addresses of the cluster brokers, like 0=localhost:8081,1=localhost:8083,
+	// the broker runs alone, when they are empty.
+	brokers string
+
+	// peers are the addresses of the cluster listeners of the brokers, like 0=localhost:8082,1=localhost:8084,
+	// the brokers call each other there. This broker listens on its own one.
+	peers string
+
+	// replicationFactor is the number of the brokers keeping every partition.
+	replicationFactor int
+
+	// minInsyncReplicas is the number of the in-sync replicas required by the publishes with all acks.
+	minInsyncReplicas int
+
+	// replicaLagMax is the time, after which the lagging follower is out of sync.
+	replicaLagMax time.Duration
+
+	// ackTimeout limits the waiting for the in-sync replicas.
+	ackTimeout time.Duration
+
+	// sessionTimeout is the time without the response to the controller, after which the broker is lost.
+	sessionTimeout time.Duration
+
+	// clientQuota and topicQuota are the limits per second of every client and every topic,
+	// like produce_bytes=1048576,consume_bytes=2097152,requests=100, they are unlimited, when empty.
+	clientQuota string
+	topicQuota  string
+
+	// trustClientID limits the clients by the x-client-id header instead of their certificates or addresses.
+	trustClientID bool
 }
 
 func getPort(port int) string {
@@ -22,13 +75,99 @@ func (c *config) HTTPPort() string {
 	return getPort(c.httpPort)
 }
 
+// PeerAddr returns the address of the cluster listener of this broker.
+func (c *config) PeerAddr() (string, error) {
+	peers, err := parseBrokers(c.peers)
+	if err != nil {
+		return "", err
+	}
+
+	addr, ok := peers[int32(c.brokerID)]
+	if !ok {
+		return "", fmt.Errorf("broker %d has no peer address", c.brokerID)
+	}
+
+	return addr, nil
+}
+
 func parseConfig() *config {
 	grpcPort := flag.Int("grpc-port", 8081, "gRPC port for serving")
 	httpPort := flag.Int("http-port", 8080, "HTTP port for serving")
+	topics := flag.String("topics", "topic1,topic2,topic3", "Comma-separated list of topics to create")
+	storage := flag.String("storage", "memory", "Storage of the messages: memory or file")
+	dataDir := flag.String("data-dir", "data", "Directory of the file storage")
+	fsync := flag.String("fsync", "os", "Flushing of the file storage: os, always, messages or interval")
+	fsyncMessages := flag.Int("fsync-messages", 1000, "Number of messages between the flushes in messages mode")
+	fsyncInterval := flag.Duration("fsync-interval", time.Second, "Time between the flushes in interval mode")
+	cleanupInterval := flag.Duration("cleanup-interval", 30*time.Second, "Time between the retention checks of the topics")
+	brokerID := flag.Int("broker-id", 0, "Id of the broker in the cluster")
+	brokers := flag.String("brokers", "", "Comma-separated list of the cluster brokers: id=host:port")
+	peers := flag.String("peers", "", "Comma-separated list of the cluster listeners of the brokers: id=host:port")
+	replicationFactor := flag.Int("replication-factor", 0, "Number of the brokers keeping every partition, all by default")
+	minInsyncReplicas := flag.Int("min-insync-replicas", 1, "Number of the in-sync replicas required by the publishes with all acks")
+	replicaLagMax := flag.Duration("replica-lag-max", 10*time.Second, "Time, after which the lagging follower is out of sync")
+	ackTimeout := flag.Duration("ack-timeout", 30*time.Second, "Time limit of the waiting for the in-sync replicas")
+	sessionTimeout := flag.Duration("session-timeout", 6*time.Second, "Time without the response to the controller, after which the broker is lost")
+	clientQuota := flag.String("client-quota", "", "Limits per second of every client: produce_bytes=n,consume_bytes=n,requests=n")
+	topicQuota := flag.String("topic-quota", "", "Limits per second of every topic: produce_bytes=n,consume_bytes=n,requests=n")
+	trustClientID := flag.Bool("trust-client-id", false, "Limit the clients by the x-client-id header, only when the clients are trusted to set it")
 
 	flag.Parse()
 	return &config{
 		grpcPort: *grpcPort,
 		httpPort: *httpPort,
+		topics:   parseTopics(*topics),
+		storage:  *storage,
+		dataDir:  *dataDir,
+		sync: repo.SyncPolicy{
+			Mode:     repo.SyncMode(*fsync),
+			Messages: *fsyncMessages,
+			Interval: *fsyncInterval,
+		},
+		cleanupInterval:   *cleanupInterval,
+		brokerID:          *brokerID,
+		brokers:           *brokers,
+		peers:             *peers,
+		replicationFactor: *replicationFactor,
+		minInsyncReplicas: *minInsyncReplicas,
+		replicaLagMax:     *replicaLagMax,
+		ackTimeout:        *ackTimeout,
+		sessionTimeout:    *sessionTimeout,
+		clientQuota:       *clientQuota,
+		topicQuota:        *topicQuota,
+		trustClientID:     *trustClientID,
+	}
+}
+
+// parseBrokers parses the cluster brokers, like 0=localhost:8081,1=localhost:8083.
+// parseTopics splits the comma-separated topics, skipping the empty ones,
+// so an empty flag or a trailing comma doesn't create a topic without a name.
+func parseTopics(topics string) []string {
+	names := make([]string, 0)
+	for _, topic := range strings.Split(topics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			names = append(names, topic)
+		}
 	}
+
+	return names
+}
+
+func parseBrokers(brokers string) (map[int32]string, error) {
+	addrs := make(map[int32]string)
+	for _, broker := range strings.Split(brokers, ",") {
+		id, addr, ok := strings.Cut(broker, "=")
+		if !ok || addr == "" {
+			return nil, fmt.Errorf("invalid broker %q, expected id=host:port", broker)
+		}
+
+		n, err := strconv.ParseInt(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid broker id %q: %w", id, err)
+		}
+
+		addrs[int32(n)] = addr
+	}
+
+	return addrs, nil
 }
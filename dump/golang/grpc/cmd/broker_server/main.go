@@ -7,8 +7,13 @@ import (
 	"github.com/fadyat/grpc-broker/internal/logger"
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/reflection"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -18,15 +23,61 @@ func main() {
 		logging.WithLogOnEvents(logging.StartCall, logging.FinishCall),
 	}
 
+	quotas, err := initQuotas(cfg)
+	if err != nil {
+		log.Fatalf("failed to create quotas: %v", err)
+	}
+
 	s := grpc.NewServer(
 		grpc.ChainUnaryInterceptor(
 			logging.UnaryServerInterceptor(logger.ToInterceptorLogger(log), logOpts...),
+			quotas.UnaryServerInterceptor(),
 		),
 		grpc.ChainStreamInterceptor(
 			logging.StreamServerInterceptor(logger.ToInterceptorLogger(log), logOpts...),
+			quotas.StreamServerInterceptor(),
 		),
+		// Pinging the idle connections, so the consumers, which disappeared without
+		// closing the stream, leave their groups and don't hold the partitions.
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    30 * time.Second,
+			Timeout: 10 * time.Second,
+		}),
 	)
-	pb.RegisterBrokerServer(s, broker.NewGrpcServer())
+	storage, err := initStorage(cfg)
+	if err != nil {
+		log.Fatalf("failed to open storage: %v", err)
+	}
+
+	b, peer, err := initBroker(cfg, storage)
+	if err != nil {
+		log.Fatalf("failed to create broker: %v", err)
+	}
+
+	pb.RegisterBrokerServer(s, broker.NewGrpcServer(b))
+
+	// The calls of the other brokers are served on the separate listener, which isn't exposed to the clients.
+	cluster := grpc.NewServer()
+	if peer != nil {
+		pb.RegisterClusterServer(cluster, broker.NewClusterServer(peer))
+
+		addr, e := cfg.PeerAddr()
+		if e != nil {
+			log.Fatalf("failed to find peer address: %v", e)
+		}
+
+		peerListener, e := net.Listen("tcp", addr)
+		if e != nil {
+			log.Fatalf("failed to listen: %v", e)
+		}
+
+		go func() {
+			log.Printf("starting cluster server on %s", addr)
+			if e := cluster.Serve(peerListener); e != nil {
+				log.Fatalf("failed to serve: %v", e)
+			}
+		}()
+	}
 
 	// Register reflection service on gRPC server.
 	// This is helpful for debugging, like grpcurl.
@@ -50,8 +101,27 @@ func main() {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
+	// Closing the broker and the storage on shutdown, so the queued messages are saved and the files are released properly.
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+		<-stop
+		log.Printf("shutting down")
+		cluster.Stop()
+		s.Stop()
+	}()
+
 	log.Printf("starting grpc server on %s", cfg.GrpcPort())
 	if e := s.Serve(listener); e != nil {
 		log.Fatalf("failed to serve: %v", e)
 	}
+
+	if e := b.Close(); e != nil {
+		log.Fatalf("failed to close broker: %v", e)
+	}
+
+	if e := storage.Close(); e != nil {
+		log.Fatalf("failed to close storage: %v", e)
+	}
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fadyat/grpc-broker/internal/quota"
+	"strconv"
+	"strings"
+)
+
+// initQuotas creates the quotas of the clients and the topics, the calls are unlimited without them.
+func initQuotas(cfg *config) (*quota.Quotas, error) {
+	client, err := parseLimits(cfg.clientQuota)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client quota: %w", err)
+	}
+
+	topic, err := parseLimits(cfg.topicQuota)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic quota: %w", err)
+	}
+
+	return quota.New(client, topic, cfg.trustClientID), nil
+}
+
+// parseLimits parses the limits per second, like produce_bytes=1048576,consume_bytes=2097152,requests=100.
+func parseLimits(limits string) (quota.Limits, error) {
+	var l quota.Limits
+	if limits == "" {
+		return l, nil
+	}
+
+	for _, limit := range strings.Split(limits, ",") {
+		name, value, ok := strings.Cut(limit, "=")
+		if !ok {
+			return l, fmt.Errorf("invalid limit %q, expected name=value", limit)
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return l, fmt.Errorf("invalid value of the limit %q", limit)
+		}
+
+		switch name {
+		case "produce_bytes":
+			l.ProduceBytes = n
+		case "consume_bytes":
+			l.ConsumeBytes = n
+		case "requests":
+			l.Requests = n
+		default:
+			return l, fmt.Errorf("unknown limit %q", name)
+		}
+	}
+
+	return l, nil
+}
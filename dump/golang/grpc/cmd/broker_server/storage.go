@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fadyat/grpc-broker/internal/repo"
+)
+
+func initStorage(cfg *config) (*repo.BrokerStorage, error) {
+	var (
+		storage *repo.BrokerStorage
+		err     error
+	)
+
+	// The topics of the cluster are created by its controller on all brokers.
+	topics := cfg.topics
+	if cfg.brokers != "" {
+		topics = nil
+	}
+
+	switch cfg.storage {
+	case "memory":
+		storage = repo.NewBrokerStorage(topics...)
+	case "file":
+		storage, err = repo.NewFileStorage(cfg.dataDir, repo.FileOptions{Sync: cfg.sync}, topics...)
+	default:
+		err = fmt.Errorf("unknown storage %q", cfg.storage)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	storage.StartCleaner(cfg.cleanupInterval)
+	return storage, nil
+}
@@ -0,0 +1,44 @@
+package broker
+
+import (
+	"context"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/service"
+)
+
+// ClusterServer serves the calls of the other brokers of the cluster on the separate listener,
+// so they aren't reachable by the clients.
+type ClusterServer struct {
+	pb.UnimplementedClusterServer
+
+	peer service.Peer
+}
+
+func NewClusterServer(peer service.Peer) *ClusterServer {
+	return &ClusterServer{peer: peer}
+}
+
+func (s *ClusterServer) RequestVote(ctx context.Context, in *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+	out, err := s.peer.RequestVote(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *ClusterServer) AppendEntries(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+	out, err := s.peer.AppendEntries(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *ClusterServer) Fetch(ctx context.Context, in *pb.FetchRequest) (*pb.FetchResponse, error) {
+	out, err := s.peer.Fetch(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *ClusterServer) AlterIsr(ctx context.Context, in *pb.AlterIsrRequest) (*pb.AlterIsrResponse, error) {
+	out, err := s.peer.AlterIsr(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *ClusterServer) Schedule(ctx context.Context, in *pb.ScheduleRequest) (*pb.ScheduleResponse, error) {
+	out, err := s.peer.Schedule(ctx, in)
+	return out, toStatus(err)
+}
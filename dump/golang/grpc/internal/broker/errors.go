@@ -0,0 +1,91 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/internal/service"
+	"github.com/fadyat/grpc-broker/pkg"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorCode maps the broker error to the gRPC code.
+type errorCode struct {
+	err  error
+	code codes.Code
+}
+
+// errorCodes are checked in order, the broker errors go before the context ones, which they may wrap,
+// so the wrapped error gets the same code every time.
+var errorCodes = []errorCode{
+	{pkg.ErrorTopicNotFound, codes.NotFound},
+	{pkg.ErrorTopicAlreadyExists, codes.AlreadyExists},
+	{pkg.ErrorInvalidTopic, codes.InvalidArgument},
+	{pkg.ErrorInvalidPartitions, codes.InvalidArgument},
+	{pkg.ErrorPartitionNotFound, codes.NotFound},
+	{pkg.ErrorPartitionRequired, codes.InvalidArgument},
+	{pkg.ErrorInvalidConfig, codes.InvalidArgument},
+	{pkg.ErrorNoMessages, codes.NotFound},
+	{pkg.ErrorOffsetOutOfRange, codes.OutOfRange},
+	{pkg.ErrorSessionTimeout, codes.Aborted},
+	{pkg.ErrorGroupRequired, codes.InvalidArgument},
+	{pkg.ErrorInvalidGroup, codes.InvalidArgument},
+	{pkg.ErrorInternalTopic, codes.PermissionDenied},
+	{pkg.ErrorTimestampRequired, codes.InvalidArgument},
+	{pkg.ErrorEmptyBatch, codes.InvalidArgument},
+	{pkg.ErrorConsumeNotStarted, codes.InvalidArgument},
+	{pkg.ErrorInvalidDeadLetter, codes.InvalidArgument},
+	{pkg.ErrorInvalidDelay, codes.InvalidArgument},
+	{pkg.ErrorInvalidTTL, codes.InvalidArgument},
+	{pkg.ErrorUnknownProducer, codes.NotFound},
+	{pkg.ErrorProducerFenced, codes.FailedPrecondition},
+	{pkg.ErrorDuplicateSequence, codes.AlreadyExists},
+	{pkg.ErrorOutOfOrderSequence, codes.FailedPrecondition},
+
+	{pkg.ErrorInvalidTransactionState, codes.FailedPrecondition},
+
+	{pkg.ErrorNotLeader, codes.FailedPrecondition},
+	{pkg.ErrorNotEnoughReplicas, codes.Unavailable},
+	{pkg.ErrorReplicationTimeout, codes.DeadlineExceeded},
+	{pkg.ErrorStaleIsr, codes.Aborted},
+	{pkg.ErrorInvalidIsr, codes.InvalidArgument},
+
+	{pkg.ErrorNotController, codes.FailedPrecondition},
+	{pkg.ErrorNoController, codes.Unavailable},
+
+	{pkg.ErrorConsumerTooSlow, codes.ResourceExhausted},
+
+	{pkg.ErrorBrokerClosed, codes.Unavailable},
+
+	{context.Canceled, codes.Canceled},
+	{context.DeadlineExceeded, codes.DeadlineExceeded},
+}
+
+// toStatus converts the broker errors to the gRPC status errors,
+// so the clients can rely on the codes instead of the messages.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	st, ok := status.FromError(err)
+	if !ok {
+		st = status.New(codes.Internal, err.Error())
+		for _, c := range errorCodes {
+			if errors.Is(err, c.err) {
+				st = status.New(c.code, err.Error())
+				break
+			}
+		}
+	}
+
+	// The client of the failed stream retries only the messages, which aren't acknowledged.
+	var partial *service.PublishStreamError
+	if errors.As(err, &partial) {
+		if detailed, e := st.WithDetails(partial.Failure); e == nil {
+			st = detailed
+		}
+	}
+
+	return st.Err()
+}
@@ -3,29 +3,106 @@ package broker
 import (
 	"context"
 	"github.com/fadyat/grpc-broker/api/pb"
-	"github.com/fadyat/grpc-broker/pkg"
-)
-
-var (
-	topics = []string{"topic1", "topic2", "topic3"}
+	"github.com/fadyat/grpc-broker/internal/service"
 )
 
 type GrpcServer struct {
 	pb.UnimplementedBrokerServer
+
+	broker service.Broker
 }
 
-func NewGrpcServer() *GrpcServer {
-	return &GrpcServer{}
+func NewGrpcServer(broker service.Broker) *GrpcServer {
+	return &GrpcServer{broker: broker}
 }
 
 func (s *GrpcServer) Publish(ctx context.Context, in *pb.PublishRequest) (*pb.PublishResponse, error) {
-	return &pb.PublishResponse{Id: 1}, nil
+	out, err := s.broker.Publish(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *GrpcServer) PublishBatch(ctx context.Context, in *pb.PublishBatchRequest) (*pb.PublishBatchResponse, error) {
+	out, err := s.broker.PublishBatch(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *GrpcServer) PublishStream(stream pb.Broker_PublishStreamServer) error {
+	return toStatus(s.broker.PublishStream(stream))
 }
 
 func (s *GrpcServer) Subscribe(in *pb.SubscribeRequest, stream pb.Broker_SubscribeServer) error {
-	if pkg.In(topics, in.Topic) {
-		return stream.Send(&pb.MessageResponse{Body: []byte("hello")})
-	}
+	return toStatus(s.broker.Subscribe(in, stream))
+}
+
+func (s *GrpcServer) Consume(stream pb.Broker_ConsumeServer) error {
+	return toStatus(s.broker.Consume(stream))
+}
+
+func (s *GrpcServer) InitProducer(ctx context.Context, in *pb.InitProducerRequest) (*pb.InitProducerResponse, error) {
+	out, err := s.broker.InitProducer(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *GrpcServer) BeginTransaction(ctx context.Context, in *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	out, err := s.broker.BeginTransaction(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *GrpcServer) Commit(ctx context.Context, in *pb.CommitTransactionRequest) (*pb.CommitTransactionResponse, error) {
+	out, err := s.broker.Commit(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *GrpcServer) Abort(ctx context.Context, in *pb.AbortTransactionRequest) (*pb.AbortTransactionResponse, error) {
+	out, err := s.broker.Abort(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *GrpcServer) Redrive(ctx context.Context, in *pb.RedriveRequest) (*pb.RedriveResponse, error) {
+	out, err := s.broker.Redrive(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *GrpcServer) CreateTopic(ctx context.Context, in *pb.CreateTopicRequest) (*pb.TopicDescription, error) {
+	out, err := s.broker.CreateTopic(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *GrpcServer) DeleteTopic(ctx context.Context, in *pb.DeleteTopicRequest) (*pb.DeleteTopicResponse, error) {
+	out, err := s.broker.DeleteTopic(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *GrpcServer) ListTopics(ctx context.Context, in *pb.ListTopicsRequest) (*pb.ListTopicsResponse, error) {
+	out, err := s.broker.ListTopics(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *GrpcServer) DescribeTopic(ctx context.Context, in *pb.DescribeTopicRequest) (*pb.TopicDescription, error) {
+	out, err := s.broker.DescribeTopic(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *GrpcServer) CommitOffset(ctx context.Context, in *pb.CommitOffsetRequest) (*pb.CommitOffsetResponse, error) {
+	out, err := s.broker.CommitOffset(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *GrpcServer) FetchCommittedOffset(
+	ctx context.Context, in *pb.FetchCommittedOffsetRequest,
+) (*pb.FetchCommittedOffsetResponse, error) {
+	out, err := s.broker.FetchCommittedOffset(ctx, in)
+	return out, toStatus(err)
+}
+
+func (s *GrpcServer) OffsetsForTimes(
+	ctx context.Context, in *pb.OffsetsForTimesRequest,
+) (*pb.OffsetsForTimesResponse, error) {
+	out, err := s.broker.OffsetsForTimes(ctx, in)
+	return out, toStatus(err)
+}
 
-	return pkg.ErrorTopicNotFound
+func (s *GrpcServer) Metadata(ctx context.Context, in *pb.MetadataRequest) (*pb.MetadataResponse, error) {
+	out, err := s.broker.Metadata(ctx, in)
+	return out, toStatus(err)
 }
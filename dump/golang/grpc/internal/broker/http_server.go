@@ -2,6 +2,7 @@ package broker
 
 import (
 	"context"
+	"expvar"
 	"github.com/fadyat/grpc-broker/api/pb"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"google.golang.org/grpc"
@@ -18,12 +19,17 @@ func RunHTTPServer(ctx context.Context, grpcPort, httpPort string) error {
 		return err
 	}
 
-	return runHTTPServer(httpPort, mux)
+	// The metrics of the broker, like the number of the expired messages, are served next to the API.
+	handler := http.NewServeMux()
+	handler.Handle("/debug/vars", expvar.Handler())
+	handler.Handle("/", mux)
+
+	return runHTTPServer(httpPort, handler)
 }
 
-func runHTTPServer(httpPort string, mux *runtime.ServeMux) error {
+func runHTTPServer(httpPort string, handler http.Handler) error {
 	server := &http.Server{
-		Handler:      mux,
+		Handler:      handler,
 		Addr:         httpPort,
 		ReadTimeout:  3 * time.Second,
 		WriteTimeout: 3 * time.Second,
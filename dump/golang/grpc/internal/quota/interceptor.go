@@ -0,0 +1,227 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ClientIDHeader is the metadata naming the client, it's used only, when the clients are trusted to set it,
+// otherwise any client could take the quota of another one.
+const ClientIDHeader = "x-client-id"
+
+// retryAfterHeader is the number of the seconds, after which the throttled call is allowed,
+// the same time is in the RetryInfo details of the error.
+const retryAfterHeader = "retry-after"
+
+// UnaryServerInterceptor rejects the calls of the clients and to the topics over the quotas.
+func (q *Quotas) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := q.admit(ctx, q.clientID(ctx), req); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor rejects the streams, which are opened over the quotas. The messages of the open
+// streams wait for the quotas instead, so the stream isn't broken in the middle.
+func (q *Quotas) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &stream{ServerStream: ss, quotas: q, client: q.clientID(ss.Context())})
+	}
+}
+
+type stream struct {
+	grpc.ServerStream
+
+	quotas *Quotas
+	client string
+
+	// topic is set by the first message, before the messages are sent.
+	topic   string
+	started bool
+}
+
+// RecvMsg admits the stream with its first message, which names the topic.
+func (s *stream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	if !s.started {
+		s.started, s.topic = true, topicOf(m)
+		return s.quotas.admit(s.Context(), s.client, m)
+	}
+
+	return s.quotas.pace(s.Context(), s.client, topicOf(m), produceBytes, produced(m))
+}
+
+func (s *stream) SendMsg(m any) error {
+	if r, ok := m.(*pb.MessageResponse); ok {
+		if err := s.quotas.pace(s.Context(), s.client, s.topic, consumeBytes, proto.Size(r)); err != nil {
+			return err
+		}
+	}
+
+	return s.ServerStream.SendMsg(m)
+}
+
+// admit takes the request and the published bytes from the quotas of the client and the topic.
+// The consuming calls take a byte, so they are rejected, while the client is over the consume quota.
+func (q *Quotas) admit(ctx context.Context, client string, req any) error {
+	now, topic := time.Now(), topicOf(req)
+
+	var r reservation
+	r.take(q.limiter(client, topic, requests, now), now, 1)
+	r.take(q.limiter(client, topic, produceBytes, now), now, produced(req))
+	if consumes(req) {
+		r.take(q.limiter(client, topic, consumeBytes, now), now, 1)
+	}
+
+	if r.delay == 0 {
+		return nil
+	}
+
+	r.cancel()
+	throttledCalls.Add(client, 1)
+	_ = grpc.SetHeader(ctx, metadata.Pairs(retryAfterHeader, strconv.Itoa(int(math.Ceil(r.delay.Seconds())))))
+	return throttled(r.delay)
+}
+
+// reservation is the tokens taken by the call, it waits for the longest of them.
+type reservation struct {
+	delay   time.Duration
+	cancels []func()
+}
+
+func (r *reservation) take(l Limiter, now time.Time, n int) {
+	if n == 0 {
+		return
+	}
+
+	delay, cancel := l.Reserve(now, n)
+	if delay > r.delay {
+		r.delay = delay
+	}
+
+	r.cancels = append(r.cancels, cancel)
+}
+
+func (r *reservation) cancel() {
+	for _, cancel := range r.cancels {
+		cancel()
+	}
+}
+
+// pace waits for the tokens of the open stream.
+func (q *Quotas) pace(ctx context.Context, client, topic string, k kind, n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	delay, cancel := q.limiter(client, topic, k, now).Reserve(now, n)
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		cancel()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttled is the error of the call over the quotas with the time, after which it's allowed.
+func throttled(delay time.Duration) error {
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf("quota exceeded, retry after %s", delay.Round(time.Millisecond)))
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)}); err == nil {
+		st = detailed
+	}
+
+	return st.Err()
+}
+
+// clientID identifies the client by the subject of its verified TLS certificate or by the host of the peer,
+// the header is preferred, when it's trusted.
+func (q *Quotas) clientID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok && q.trustClientID {
+		if ids := md.Get(ClientIDHeader); len(ids) != 0 && ids[0] != "" {
+			return ids[0]
+		}
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) != 0 {
+		cert := info.State.VerifiedChains[0][0]
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName
+		}
+
+		return cert.Subject.String()
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
+
+// topicOf returns the topic of the request, the stream of the consumer names it with the start.
+func topicOf(req any) string {
+	switch r := req.(type) {
+	case *pb.ConsumeRequest:
+		return r.GetStart().GetTopic()
+	case interface{ GetTopic() string }:
+		return r.GetTopic()
+	}
+
+	return ""
+}
+
+// produced returns the size of the published messages, the other requests don't produce anything.
+func produced(req any) int {
+	switch r := req.(type) {
+	case *pb.PublishRequest:
+		return proto.Size(r)
+	case *pb.PublishBatchRequest:
+		return proto.Size(r)
+	}
+
+	return 0
+}
+
+func consumes(req any) bool {
+	switch req.(type) {
+	case *pb.SubscribeRequest, *pb.ConsumeRequest:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,84 @@
+package quota
+
+import (
+	"golang.org/x/time/rate"
+	"sort"
+	"time"
+)
+
+// Limiter is the token bucket of the requests or the bytes.
+type Limiter interface {
+
+	// Reserve takes n tokens and returns the time, after which they are available.
+	// The cancel returns the tokens, when the call isn't made.
+	Reserve(now time.Time, n int) (time.Duration, func())
+
+	// Limit returns the number of the tokens added per second.
+	Limit() rate.Limit
+}
+
+type tokenLimiter struct {
+	*rate.Limiter
+}
+
+// newLimiter allows the tokens per second, the unused ones are kept for a second.
+func newLimiter(perSecond int) *tokenLimiter {
+	return &tokenLimiter{Limiter: rate.NewLimiter(rate.Limit(perSecond), perSecond)}
+}
+
+func (l *tokenLimiter) Reserve(now time.Time, n int) (time.Duration, func()) {
+	// The call larger than the bucket takes all of it, otherwise it's never allowed.
+	if n > l.Burst() {
+		n = l.Burst()
+	}
+
+	r := l.ReserveN(now, n)
+	return r.DelayFrom(now), func() { r.CancelAt(now) }
+}
+
+// idle reports, whether the bucket is full, so dropping it changes nothing.
+func (l *tokenLimiter) idle(now time.Time) bool {
+	return l.TokensAt(now) >= float64(l.Burst())
+}
+
+// multiLimiter takes the tokens from all limiters, so the call waits for the most restrictive of them.
+type multiLimiter struct {
+	limiters []Limiter
+}
+
+func newMultiLimiter(limiters ...Limiter) *multiLimiter {
+	byLimit := func(i, j int) bool {
+		return limiters[i].Limit() < limiters[j].Limit()
+	}
+
+	sort.Slice(limiters, byLimit)
+	return &multiLimiter{limiters: limiters}
+}
+
+func (m *multiLimiter) Reserve(now time.Time, n int) (time.Duration, func()) {
+	var delay time.Duration
+	cancels := make([]func(), 0, len(m.limiters))
+	for _, l := range m.limiters {
+		d, cancel := l.Reserve(now, n)
+		if d > delay {
+			delay = d
+		}
+
+		cancels = append(cancels, cancel)
+	}
+
+	return delay, func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+}
+
+// Limit returns the most restrictive limit, the multiLimiter without the limiters is unlimited.
+func (m *multiLimiter) Limit() rate.Limit {
+	if len(m.limiters) == 0 {
+		return rate.Inf
+	}
+
+	return m.limiters[0].Limit()
+}
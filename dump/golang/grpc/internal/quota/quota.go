@@ -0,0 +1,121 @@
+package quota
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Limits are the quotas per second, zero is unlimited.
+type Limits struct {
+	ProduceBytes int
+	ConsumeBytes int
+	Requests     int
+}
+
+type kind int
+
+const (
+	produceBytes kind = iota
+	consumeBytes
+	requests
+)
+
+func (l Limits) of(k kind) int {
+	switch k {
+	case produceBytes:
+		return l.ProduceBytes
+	case consumeBytes:
+		return l.ConsumeBytes
+	default:
+		return l.Requests
+	}
+}
+
+// sweepSize is the number of the buckets, after which the idle ones are dropped, when the next one is added,
+// so the buckets of the clients gone long ago aren't kept forever.
+const sweepSize = 1024
+
+// throttledCalls counts the rejected calls per client, it's published with the rest of the expvar metrics.
+var throttledCalls = expvar.NewMap("broker.throttled_calls")
+
+type bucketKey struct {
+	name string
+	kind kind
+}
+
+// buckets are the limiters of the clients or the topics, they are created on the first call.
+type buckets struct {
+	limits Limits
+
+	mu    sync.Mutex
+	byKey map[bucketKey]*tokenLimiter
+}
+
+func newBuckets(limits Limits) *buckets {
+	return &buckets{limits: limits, byKey: make(map[bucketKey]*tokenLimiter)}
+}
+
+// get returns the limiter of the name, it's false, when the kind is unlimited.
+func (b *buckets) get(name string, k kind, now time.Time) (*tokenLimiter, bool) {
+	perSecond := b.limits.of(k)
+	if perSecond == 0 || name == "" {
+		return nil, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := bucketKey{name: name, kind: k}
+	l, ok := b.byKey[key]
+	if !ok {
+		if len(b.byKey) >= sweepSize {
+			b.sweep(now)
+		}
+
+		l = newLimiter(perSecond)
+		b.byKey[key] = l
+	}
+
+	return l, true
+}
+
+// sweep drops the full buckets, they are created again the same way, guarded by the mu.
+func (b *buckets) sweep(now time.Time) {
+	for key, l := range b.byKey {
+		if l.idle(now) {
+			delete(b.byKey, key)
+		}
+	}
+}
+
+// Quotas limit the calls of every client and to every topic, the call is made,
+// when both the quotas of its client and its topic allow it.
+type Quotas struct {
+	clients *buckets
+	topics  *buckets
+
+	// trustClientID takes the client from the ClientIDHeader, when the clients set it.
+	trustClientID bool
+}
+
+// New creates the quotas, the header naming the client is trusted, only when the clients
+// are trusted to set it, like behind the proxy, which sets it itself.
+func New(client, topic Limits, trustClientID bool) *Quotas {
+	return &Quotas{clients: newBuckets(client), topics: newBuckets(topic), trustClientID: trustClientID}
+}
+
+// limiter returns the limiter shared by the client and the topic, the calls without the topic
+// are limited by the client only.
+func (q *Quotas) limiter(client, topic string, k kind, now time.Time) Limiter {
+	var limiters []Limiter
+	if l, ok := q.clients.get(client, k, now); ok {
+		limiters = append(limiters, l)
+	}
+
+	if l, ok := q.topics.get(topic, k, now); ok {
+		limiters = append(limiters, l)
+	}
+
+	return newMultiLimiter(limiters...)
+}
@@ -0,0 +1,229 @@
+package quota
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMultiLimiter(t *testing.T) {
+	now := time.Now()
+	slow, fast := newLimiter(2), newLimiter(5)
+	m := newMultiLimiter(fast, slow)
+
+	if m.Limit() != slow.Limit() {
+		t.Errorf("expected %v, got %v", slow.Limit(), m.Limit())
+	}
+
+	// The burst of the slower limiter is over first, the call waits for its token.
+	for i := 0; i < 2; i++ {
+		if delay, _ := m.Reserve(now, 1); delay != 0 {
+			t.Fatalf("expected no delay, got %v", delay)
+		}
+	}
+
+	delay, cancel := m.Reserve(now, 1)
+	if delay != 500*time.Millisecond {
+		t.Fatalf("expected %v, got %v", 500*time.Millisecond, delay)
+	}
+
+	// The cancelled call returns the tokens to both limiters.
+	cancel()
+	if tokens := fast.TokensAt(now); tokens != 3 {
+		t.Errorf("expected %d tokens, got %v", 3, tokens)
+	}
+
+	if limit := newMultiLimiter().Limit(); limit != rate.Inf {
+		t.Errorf("expected %v, got %v", rate.Inf, limit)
+	}
+}
+
+func TestQuotas_UnaryServerInterceptor(t *testing.T) {
+	type call struct {
+		client string
+		req    any
+	}
+
+	publish := func(topic string, size int) *pb.PublishRequest {
+		return &pb.PublishRequest{Topic: topic, Body: make([]byte, size)}
+	}
+
+	testCases := []struct {
+		name      string
+		client    Limits
+		topic     Limits
+		calls     []call
+		throttled []bool
+	}{
+		{
+			name:   "success, requests of every client are limited separately",
+			client: Limits{Requests: 1},
+			calls: []call{
+				{"client1", &pb.ListTopicsRequest{}},
+				{"client2", &pb.ListTopicsRequest{}},
+				{"client1", &pb.ListTopicsRequest{}},
+			},
+			throttled: []bool{false, false, true},
+		},
+		{
+			name:  "success, requests to the topic are shared by the clients",
+			topic: Limits{Requests: 1},
+			calls: []call{
+				{"client1", publish("topic1", 1)},
+				{"client2", publish("topic2", 1)},
+				{"client2", publish("topic1", 1)},
+				{"client2", &pb.ListTopicsRequest{}},
+			},
+			throttled: []bool{false, false, true, false},
+		},
+		{
+			name:   "success, published bytes are limited",
+			client: Limits{ProduceBytes: 100},
+			calls: []call{
+				{"client1", publish("topic1", 50)},
+				{"client1", publish("topic1", 100)},
+				{"client1", &pb.DescribeTopicRequest{Name: "topic1"}},
+			},
+			throttled: []bool{false, true, false},
+		},
+		{
+			name:   "success, throttled call doesn't take the tokens",
+			client: Limits{Requests: 1},
+			topic:  Limits{Requests: 2},
+			calls: []call{
+				{"client1", publish("topic1", 1)},
+				{"client1", publish("topic1", 1)},
+				{"client2", publish("topic1", 1)},
+			},
+			throttled: []bool{false, true, false},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			intercept := New(tc.client, tc.topic, true).UnaryServerInterceptor()
+			handler := func(context.Context, any) (any, error) { return "ok", nil }
+
+			for i, c := range tc.calls {
+				ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(ClientIDHeader, c.client))
+				_, err := intercept(ctx, c.req, &grpc.UnaryServerInfo{}, handler)
+
+				if !tc.throttled[i] {
+					if err != nil {
+						t.Fatalf("expected nil for the call %d, got %v", i, err)
+					}
+
+					continue
+				}
+
+				st := status.Convert(err)
+				if st.Code() != codes.ResourceExhausted {
+					t.Fatalf("expected %v for the call %d, got %v", codes.ResourceExhausted, i, err)
+				}
+
+				if len(st.Details()) != 1 {
+					t.Fatalf("expected the retry info, got %v", st.Details())
+				}
+
+				if info, ok := st.Details()[0].(*errdetails.RetryInfo); !ok || info.RetryDelay.AsDuration() <= 0 {
+					t.Errorf("expected the positive retry delay, got %v", st.Details()[0])
+				}
+			}
+		})
+	}
+}
+
+func TestQuotas_ClientID(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	verified := credentials.TLSInfo{State: tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "client1"}}}},
+	}}
+
+	testCases := []struct {
+		name     string
+		trusted  bool
+		header   string
+		peer     *peer.Peer
+		expected string
+	}{
+		{
+			name:     "success, header isn't trusted, peer address",
+			header:   "client2",
+			peer:     &peer.Peer{Addr: addr},
+			expected: "10.0.0.1",
+		},
+		{
+			name:     "success, header isn't trusted, verified certificate",
+			header:   "client2",
+			peer:     &peer.Peer{Addr: addr, AuthInfo: verified},
+			expected: "client1",
+		},
+		{
+			name:     "success, unverified certificate, peer address",
+			peer:     &peer.Peer{Addr: addr, AuthInfo: credentials.TLSInfo{}},
+			expected: "10.0.0.1",
+		},
+		{
+			name:     "success, trusted header",
+			trusted:  true,
+			header:   "client2",
+			peer:     &peer.Peer{Addr: addr, AuthInfo: verified},
+			expected: "client2",
+		},
+		{
+			name:     "success, trusted header is missing, peer address",
+			trusted:  true,
+			peer:     &peer.Peer{Addr: addr},
+			expected: "10.0.0.1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := peer.NewContext(context.Background(), tc.peer)
+			if tc.header != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(ClientIDHeader, tc.header))
+			}
+
+			if client := New(Limits{}, Limits{}, tc.trusted).clientID(ctx); client != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, client)
+			}
+		})
+	}
+}
+
+func TestBuckets_Sweep(t *testing.T) {
+	b := newBuckets(Limits{Requests: 1})
+	now := time.Now()
+
+	busy, _ := b.get("busy", requests, now)
+	busy.Reserve(now, 1)
+
+	for i := 0; len(b.byKey) < sweepSize; i++ {
+		b.get(fmt.Sprintf("client%d", i), requests, now)
+	}
+
+	// Only the buckets with the taken tokens are kept, the full ones are the same as the new ones.
+	b.get("next", requests, now)
+	if len(b.byKey) != 2 {
+		t.Errorf("expected %d buckets, got %d", 2, len(b.byKey))
+	}
+
+	if _, ok := b.byKey[bucketKey{name: "busy", kind: requests}]; !ok {
+		t.Errorf("expected the busy bucket to be kept")
+	}
+}
@@ -0,0 +1,570 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"github.com/fadyat/grpc-broker/pkg"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+
+	// noLeader is the leader and the vote of the node, which doesn't know them.
+	noLeader int32 = -1
+
+	// maxAppendEntries limits the number of the entries sent to a follower at once.
+	maxAppendEntries = 128
+)
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// Options describes the node of the quorum.
+type Options struct {
+
+	// ID is the id of the node, it's unique in the quorum.
+	ID int32
+
+	// Peers are the ids of the other nodes of the quorum.
+	Peers []int32
+
+	// Transport delivers the requests to the other nodes.
+	Transport Transport
+
+	// Apply is called with the committed commands in the order of the log, one at a time.
+	Apply func(command []byte)
+
+	// Dir is the directory, where the term, the vote and the log are kept,
+	// they are kept in memory only, when it's empty.
+	Dir string
+
+	// HeartbeatInterval is the time between the appends of the leader, 50ms by default.
+	HeartbeatInterval time.Duration
+
+	// ElectionTimeout is the time without the leader, after which the node starts the election,
+	// it's randomized up to the double value, 500ms by default.
+	ElectionTimeout time.Duration
+}
+
+// Node is the member of the quorum, which replicates the log of the commands by the Raft algorithm.
+// The commands proposed to the leader are applied by all nodes in the same order,
+// when they are kept by the majority of the quorum.
+//
+// The log is never compacted, it's meant for the rare metadata changes.
+type Node struct {
+	opts Options
+
+	// ctx is done, when the node is stopped.
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+
+	mu   sync.Mutex
+	role role
+
+	// term, vote and log are the persistent state of the node, the first entry of the log
+	// is the sentinel, so the indexes of the entries match their positions.
+	term uint64
+	vote int32
+	log  []Entry
+
+	leader   int32
+	commit   uint64
+	applied  uint64
+	deadline time.Time
+
+	// next and match are the replication progress of the followers, they are kept by the leader.
+	next  map[int32]uint64
+	match map[int32]uint64
+
+	// contacts are the times of the last responses of the followers to the leader.
+	contacts map[int32]time.Time
+
+	// sending marks the followers, which have the append in flight.
+	sending map[int32]bool
+
+	// committed wakes up the apply loop, when the commit index moves.
+	committed chan struct{}
+
+	// progressed is closed and replaced, every time the entries are applied.
+	progressed chan struct{}
+}
+
+// NewNode creates the node, the persisted state is restored from the Dir.
+func NewNode(opts Options) (*Node, error) {
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = 50 * time.Millisecond
+	}
+
+	if opts.ElectionTimeout <= 0 {
+		opts.ElectionTimeout = 500 * time.Millisecond
+	}
+
+	n := &Node{
+		opts:       opts,
+		vote:       noLeader,
+		log:        []Entry{{}},
+		leader:     noLeader,
+		contacts:   make(map[int32]time.Time),
+		sending:    make(map[int32]bool),
+		committed:  make(chan struct{}, 1),
+		progressed: make(chan struct{}),
+	}
+
+	if err := n.load(); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// Start starts the elections and the replication of the node.
+func (n *Node) Start() {
+	n.ctx, n.stop = context.WithCancel(context.Background())
+
+	n.mu.Lock()
+	n.resetDeadline()
+	n.mu.Unlock()
+
+	n.wg.Add(2)
+	go n.run()
+	go n.applyCommitted()
+}
+
+// Stop stops the node, the requests in flight are cancelled.
+func (n *Node) Stop() {
+	n.stop()
+	n.wg.Wait()
+}
+
+// Leader returns the id of the leader known by the node.
+func (n *Node) Leader() (int32, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.leader, n.leader != noLeader
+}
+
+// IsLeader reports, whether the node is the leader of the quorum.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.role == leader
+}
+
+// Contacts returns the times of the last responses of the other nodes to the leader,
+// they are counted from the start of its term.
+func (n *Node) Contacts() map[int32]time.Time {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	contacts := make(map[int32]time.Time, len(n.contacts))
+	for id, t := range n.contacts {
+		contacts[id] = t
+	}
+
+	return contacts
+}
+
+// Propose appends the command to the log of the leader and waits, until it's committed and applied
+// by this node. The command, which is lost with the leadership, fails with pkg.ErrorNotController.
+func (n *Node) Propose(ctx context.Context, command []byte) error {
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		return pkg.ErrorNotController
+	}
+
+	term, index := n.term, n.lastIndex()+1
+	n.log = append(n.log, Entry{Term: term, Command: command})
+	if err := n.save(); err != nil {
+		n.log = n.log[:index]
+		n.mu.Unlock()
+		return err
+	}
+
+	n.broadcast()
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	for {
+		n.mu.Lock()
+		if n.applied >= index {
+			kept := n.log[index].Term == term
+			n.mu.Unlock()
+
+			if !kept {
+				return pkg.ErrorNotController
+			}
+
+			return nil
+		}
+
+		progressed := n.progressed
+		n.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.ctx.Done():
+			return n.ctx.Err()
+		case <-progressed:
+		}
+	}
+}
+
+func (n *Node) run() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.opts.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		switch {
+		case n.role == leader:
+			n.broadcast()
+		case time.Now().After(n.deadline):
+			n.campaign()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// quorum is the number of the nodes, which make the majority.
+func (n *Node) quorum() int {
+	return (len(n.opts.Peers)+1)/2 + 1
+}
+
+func (n *Node) lastIndex() uint64 {
+	return uint64(len(n.log) - 1)
+}
+
+func (n *Node) resetDeadline() {
+	timeout := n.opts.ElectionTimeout + time.Duration(rand.Int63n(int64(n.opts.ElectionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+// becomeFollower moves the node to the newer term, its vote is forgotten.
+func (n *Node) becomeFollower(term uint64) error {
+	n.role = follower
+	if term == n.term {
+		return nil
+	}
+
+	n.term, n.vote, n.leader = term, noLeader, noLeader
+	return n.save()
+}
+
+// campaign starts the election of this node in the next term.
+func (n *Node) campaign() {
+	n.role = candidate
+	n.term++
+	n.vote = n.opts.ID
+	n.leader = noLeader
+	n.resetDeadline()
+	if err := n.save(); err != nil {
+		return
+	}
+
+	in := &VoteRequest{
+		Term:         n.term,
+		CandidateID:  n.opts.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.log[n.lastIndex()].Term,
+	}
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+
+	for _, peer := range n.opts.Peers {
+		go func(peer int32) {
+			ctx, cancel := context.WithTimeout(n.ctx, n.opts.ElectionTimeout)
+			defer cancel()
+
+			out, err := n.opts.Transport.RequestVote(ctx, peer, in)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+
+			if out.Term > n.term {
+				_ = n.becomeFollower(out.Term)
+				return
+			}
+
+			if n.role != candidate || n.term != in.Term || !out.Granted {
+				return
+			}
+
+			votes++
+			if votes == n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leader = n.opts.ID
+	n.next = make(map[int32]uint64, len(n.opts.Peers))
+	n.match = make(map[int32]uint64, len(n.opts.Peers))
+
+	now := time.Now()
+	for _, peer := range n.opts.Peers {
+		n.next[peer] = n.lastIndex() + 1
+		n.contacts[peer] = now
+	}
+
+	// The empty entry of the new term commits the entries of the previous leaders.
+	n.log = append(n.log, Entry{Term: n.term})
+	if err := n.save(); err != nil {
+		n.log = n.log[:len(n.log)-1]
+		_ = n.becomeFollower(n.term)
+		return
+	}
+
+	n.broadcast()
+	n.advanceCommit()
+}
+
+// broadcast sends the missing entries or the heartbeat to the followers, which have no append in flight.
+func (n *Node) broadcast() {
+	for _, peer := range n.opts.Peers {
+		if !n.sending[peer] {
+			n.sending[peer] = true
+			go n.replicate(peer)
+		}
+	}
+}
+
+func (n *Node) replicate(peer int32) {
+	n.mu.Lock()
+	if n.role != leader {
+		n.sending[peer] = false
+		n.mu.Unlock()
+		return
+	}
+
+	prev := n.next[peer] - 1
+	end := n.lastIndex() + 1
+	if end-prev-1 > maxAppendEntries {
+		end = prev + 1 + maxAppendEntries
+	}
+
+	in := &AppendRequest{
+		Term:         n.term,
+		LeaderID:     n.opts.ID,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.log[prev].Term,
+		Entries:      append([]Entry(nil), n.log[prev+1:end]...),
+		LeaderCommit: n.commit,
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(n.ctx, n.opts.ElectionTimeout)
+	out, err := n.opts.Transport.AppendEntries(ctx, peer, in)
+	cancel()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.sending[peer] = false
+	if err != nil {
+		return
+	}
+
+	if out.Term > n.term {
+		_ = n.becomeFollower(out.Term)
+		return
+	}
+
+	if n.role != leader || n.term != in.Term {
+		return
+	}
+
+	n.contacts[peer] = time.Now()
+	if !out.Success {
+		// Going back to the end of the follower log at once, instead of one entry at a time.
+		n.next[peer] = prev
+		if out.LastLogIndex+1 < prev {
+			n.next[peer] = out.LastLogIndex + 1
+		}
+
+		if n.next[peer] < 1 {
+			n.next[peer] = 1
+		}
+	} else {
+		n.match[peer] = prev + uint64(len(in.Entries))
+		n.next[peer] = n.match[peer] + 1
+		n.advanceCommit()
+	}
+
+	if n.next[peer] <= n.lastIndex() && n.ctx.Err() == nil {
+		n.sending[peer] = true
+		go n.replicate(peer)
+	}
+}
+
+// advanceCommit commits the entries of the current term kept by the majority.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commit && n.log[index].Term == n.term; index-- {
+		replicas := 1
+		for _, match := range n.match {
+			if match >= index {
+				replicas++
+			}
+		}
+
+		if replicas >= n.quorum() {
+			n.setCommit(index)
+			return
+		}
+	}
+}
+
+func (n *Node) setCommit(index uint64) {
+	n.commit = index
+	select {
+	case n.committed <- struct{}{}:
+	default:
+	}
+}
+
+// applyCommitted applies the committed entries in order, the lock is not held by Apply.
+func (n *Node) applyCommitted() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-n.committed:
+		}
+
+		n.mu.Lock()
+		first, entries := n.applied+1, append([]Entry(nil), n.log[n.applied+1:n.commit+1]...)
+		n.mu.Unlock()
+
+		for i, e := range entries {
+			if len(e.Command) != 0 {
+				n.opts.Apply(e.Command)
+			}
+
+			n.mu.Lock()
+			n.applied = first + uint64(i)
+			close(n.progressed)
+			n.progressed = make(chan struct{})
+			n.mu.Unlock()
+		}
+	}
+}
+
+// HandleVote grants the vote to the candidate, which log is not behind the log of this node.
+func (n *Node) HandleVote(in *VoteRequest) (*VoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if in.Term > n.term {
+		if err := n.becomeFollower(in.Term); err != nil {
+			return nil, err
+		}
+	}
+
+	lastTerm := n.log[n.lastIndex()].Term
+	upToDate := in.LastLogTerm > lastTerm || in.LastLogTerm == lastTerm && in.LastLogIndex >= n.lastIndex()
+	if in.Term < n.term || n.vote != noLeader && n.vote != in.CandidateID || !upToDate {
+		return &VoteResponse{Term: n.term}, nil
+	}
+
+	n.vote = in.CandidateID
+	if err := n.save(); err != nil {
+		n.vote = noLeader
+		return nil, err
+	}
+
+	n.resetDeadline()
+	return &VoteResponse{Term: n.term, Granted: true}, nil
+}
+
+// HandleAppend appends the entries of the leader to the log, the conflicting entries are replaced.
+func (n *Node) HandleAppend(in *AppendRequest) (*AppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if in.Term < n.term {
+		return &AppendResponse{Term: n.term, LastLogIndex: n.lastIndex()}, nil
+	}
+
+	if err := n.becomeFollower(in.Term); err != nil {
+		return nil, err
+	}
+
+	n.leader = in.LeaderID
+	n.resetDeadline()
+
+	if in.PrevLogIndex > n.lastIndex() || n.log[in.PrevLogIndex].Term != in.PrevLogTerm {
+		last := n.lastIndex()
+		if in.PrevLogIndex <= last {
+			last = in.PrevLogIndex - 1
+		}
+
+		return &AppendResponse{Term: n.term, LastLogIndex: last}, nil
+	}
+
+	changed := false
+	for i, e := range in.Entries {
+		index := in.PrevLogIndex + 1 + uint64(i)
+		if index <= n.lastIndex() && n.log[index].Term == e.Term {
+			continue
+		}
+
+		if index <= n.commit {
+			return nil, fmt.Errorf("entry %d conflicts with the committed one", index)
+		}
+
+		n.log = append(n.log[:index], in.Entries[i:]...)
+		changed = true
+		break
+	}
+
+	if changed {
+		if err := n.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	last := in.PrevLogIndex + uint64(len(in.Entries))
+	if in.LeaderCommit > n.commit {
+		commit := in.LeaderCommit
+		if last < commit {
+			commit = last
+		}
+
+		if commit > n.commit {
+			n.setCommit(commit)
+		}
+	}
+
+	return &AppendResponse{Term: n.term, Success: true, LastLogIndex: n.lastIndex()}, nil
+}
@@ -0,0 +1,268 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// localTransport connects the nodes of the test quorum in memory, the disconnected nodes
+// neither send nor receive the requests.
+type localTransport struct {
+	mu           sync.Mutex
+	nodes        map[int32]*Node
+	disconnected map[int32]bool
+}
+
+var errDisconnected = errors.New("node is disconnected")
+
+func (t *localTransport) peer(from, to int32) (*Node, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.disconnected[from] || t.disconnected[to] {
+		return nil, errDisconnected
+	}
+
+	return t.nodes[to], nil
+}
+
+func (t *localTransport) setConnected(id int32, connected bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.disconnected[id] = !connected
+}
+
+// sender is the transport of one node, it knows the sender of the requests.
+type sender struct {
+	*localTransport
+	id int32
+}
+
+func (s sender) RequestVote(_ context.Context, peer int32, in *VoteRequest) (*VoteResponse, error) {
+	n, err := s.peer(s.id, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.HandleVote(in)
+}
+
+func (s sender) AppendEntries(_ context.Context, peer int32, in *AppendRequest) (*AppendResponse, error) {
+	n, err := s.peer(s.id, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.HandleAppend(in)
+}
+
+// appliedLog collects the commands applied by a node.
+type appliedLog struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (l *appliedLog) apply(command []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.commands = append(l.commands, string(command))
+}
+
+func (l *appliedLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.commands...)
+}
+
+type testQuorum struct {
+	transport *localTransport
+	nodes     map[int32]*Node
+	applied   map[int32]*appliedLog
+}
+
+func newTestQuorum(t *testing.T, size int, dir func(id int32) string) *testQuorum {
+	q := &testQuorum{
+		transport: &localTransport{nodes: make(map[int32]*Node), disconnected: make(map[int32]bool)},
+		nodes:     make(map[int32]*Node),
+		applied:   make(map[int32]*appliedLog),
+	}
+
+	for id := int32(0); id < int32(size); id++ {
+		var peers []int32
+		for peer := int32(0); peer < int32(size); peer++ {
+			if peer != id {
+				peers = append(peers, peer)
+			}
+		}
+
+		q.applied[id] = &appliedLog{}
+		n, err := NewNode(Options{
+			ID:                id,
+			Peers:             peers,
+			Transport:         sender{localTransport: q.transport, id: id},
+			Apply:             q.applied[id].apply,
+			Dir:               dir(id),
+			HeartbeatInterval: 10 * time.Millisecond,
+			ElectionTimeout:   100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+
+		q.nodes[id] = n
+		q.transport.nodes[id] = n
+	}
+
+	for _, n := range q.nodes {
+		n.Start()
+	}
+
+	t.Cleanup(func() {
+		for _, n := range q.nodes {
+			n.Stop()
+		}
+	})
+
+	return q
+}
+
+// leader waits for the leader among the connected nodes.
+func (q *testQuorum) leader(t *testing.T) int32 {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for id, n := range q.nodes {
+			if _, err := q.transport.peer(id, id); err == nil && n.IsLeader() {
+				return id
+			}
+		}
+	}
+
+	t.Fatalf("expected the leader to be elected")
+	return noLeader
+}
+
+func (q *testQuorum) propose(t *testing.T, commands ...string) {
+	for _, command := range commands {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := q.nodes[q.leader(t)].Propose(ctx, []byte(command))
+		cancel()
+
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+}
+
+// awaitApplied waits, until the node applies the commands.
+func (q *testQuorum) awaitApplied(t *testing.T, id int32, expected []string) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if reflect.DeepEqual(q.applied[id].get(), expected) {
+			return
+		}
+	}
+
+	t.Fatalf("expected %v on node %d, got %v", expected, id, q.applied[id].get())
+}
+
+func TestNode_Replication(t *testing.T) {
+	testCases := []struct {
+		name string
+		size int
+	}{
+		{
+			name: "single node",
+			size: 1,
+		},
+		{
+			name: "three nodes",
+			size: 3,
+		},
+		{
+			name: "five nodes",
+			size: 5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := newTestQuorum(t, tc.size, func(int32) string { return "" })
+			q.propose(t, "a", "b", "c")
+
+			for id := range q.nodes {
+				q.awaitApplied(t, id, []string{"a", "b", "c"})
+			}
+		})
+	}
+}
+
+func TestNode_Failover(t *testing.T) {
+	q := newTestQuorum(t, 3, func(int32) string { return "" })
+	q.propose(t, "a")
+
+	// The rest of the quorum elects the new leader, the old one catches up, when it's back.
+	old := q.leader(t)
+	q.transport.setConnected(old, false)
+	q.propose(t, "b")
+
+	if leader := q.leader(t); leader == old {
+		t.Fatalf("expected the new leader, got %d", leader)
+	}
+
+	q.transport.setConnected(old, true)
+	for id := range q.nodes {
+		q.awaitApplied(t, id, []string{"a", "b"})
+	}
+}
+
+func TestNode_ProposeNotLeader(t *testing.T) {
+	q := newTestQuorum(t, 3, func(int32) string { return "" })
+	leader := q.leader(t)
+
+	for id, n := range q.nodes {
+		if id == leader {
+			continue
+		}
+
+		if err := n.Propose(context.Background(), []byte("a")); err == nil {
+			t.Errorf("expected the follower %d to reject the command", id)
+		}
+	}
+}
+
+func TestNode_Restart(t *testing.T) {
+	dir := t.TempDir()
+	n, err := NewNode(Options{ID: 0, Apply: func([]byte) {}, Dir: dir, ElectionTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	n.Start()
+	for !n.IsLeader() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err = n.Propose(context.Background(), []byte("a")); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	n.Stop()
+
+	// The restarted node applies the saved log again, when it's committed.
+	applied := &appliedLog{}
+	restarted, err := NewNode(Options{ID: 0, Apply: applied.apply, Dir: dir, ElectionTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	restarted.Start()
+	defer restarted.Stop()
+
+	q := &testQuorum{applied: map[int32]*appliedLog{0: applied}}
+	q.awaitApplied(t, 0, []string{"a"})
+}
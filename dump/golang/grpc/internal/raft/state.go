@@ -0,0 +1,67 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// stateFile keeps the persistent state of the node in its directory.
+const stateFile = "raft.json"
+
+type state struct {
+	Term uint64  `json:"term"`
+	Vote int32   `json:"vote"`
+	Log  []Entry `json:"log"`
+}
+
+// load restores the state saved before the restart, the new node starts from the empty log.
+func (n *Node) load() error {
+	if n.opts.Dir == "" {
+		return nil
+	}
+
+	raw, err := os.ReadFile(filepath.Join(n.opts.Dir, stateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var s state
+	if err = json.Unmarshal(raw, &s); err != nil {
+		return err
+	}
+
+	n.term, n.vote = s.Term, s.Vote
+	n.log = append([]Entry{{}}, s.Log...)
+	return nil
+}
+
+// save persists the state, before the node answers the other nodes,
+// it's replaced at once, so the crash doesn't leave it half written.
+func (n *Node) save() error {
+	if n.opts.Dir == "" {
+		return nil
+	}
+
+	raw, err := json.Marshal(state{Term: n.term, Vote: n.vote, Log: n.log[1:]})
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(n.opts.Dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(n.opts.Dir, stateFile+".tmp")
+	if err = os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(n.opts.Dir, stateFile))
+}
@@ -0,0 +1,45 @@
+package raft
+
+import "context"
+
+// Entry is the command of the log with the term of the leader, which appended it.
+type Entry struct {
+	Term    uint64 `json:"term"`
+	Command []byte `json:"command,omitempty"`
+}
+
+type VoteRequest struct {
+	Term         uint64
+	CandidateID  int32
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type VoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type AppendRequest struct {
+	Term         uint64
+	LeaderID     int32
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// AppendResponse is the result of the append, the rejected leader
+// continues from the end of the follower log.
+type AppendResponse struct {
+	Term         uint64
+	Success      bool
+	LastLogIndex uint64
+}
+
+// Transport delivers the requests of the node to the other nodes of the quorum,
+// they are handled by Node.HandleVote and Node.HandleAppend there.
+type Transport interface {
+	RequestVote(ctx context.Context, peer int32, in *VoteRequest) (*VoteResponse, error)
+	AppendEntries(ctx context.Context, peer int32, in *AppendRequest) (*AppendResponse, error)
+}
@@ -0,0 +1,47 @@
+package repo
+
+// backend is the place, where the topics and the messages of their partitions are kept.
+type backend interface {
+
+	// loadTopics returns the topics saved before the restart, with their partition logs opened.
+	loadTopics() ([]*Topic, error)
+
+	// createTopic saves the topic and opens the logs of its partitions.
+	createTopic(t *Topic) error
+
+	// deleteTopic removes the topic with all its messages, the logs are closed beforehand.
+	deleteTopic(name string) error
+
+	// loadProducers returns the producers registered before the restart.
+	loadProducers() ([]*Producer, error)
+
+	// saveProducers replaces the registered producers, there are few of them, so they are saved together.
+	saveProducers(producers []*Producer) error
+}
+
+// memoryBackend keeps everything in memory, nothing survives the restart.
+type memoryBackend struct{}
+
+func (memoryBackend) loadTopics() ([]*Topic, error) {
+	return nil, nil
+}
+
+func (memoryBackend) createTopic(t *Topic) error {
+	for _, p := range t.partitions {
+		p.log = newMemoryLog()
+	}
+
+	return nil
+}
+
+func (memoryBackend) deleteTopic(string) error {
+	return nil
+}
+
+func (memoryBackend) loadProducers() ([]*Producer, error) {
+	return nil, nil
+}
+
+func (memoryBackend) saveProducers([]*Producer) error {
+	return nil
+}
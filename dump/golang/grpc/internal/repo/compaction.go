@@ -0,0 +1,380 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fadyat/grpc-broker/pkg"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cleanupPolicyConfig is the topic setting, which defines how the old messages are removed:
+	// delete by the retention, compact by the keys or both, separated by a comma.
+	cleanupPolicyConfig = "cleanup.policy"
+
+	// deleteRetentionMsConfig is the topic setting, for which time the tombstones survive the compaction.
+	deleteRetentionMsConfig = "delete.retention.ms"
+
+	cleanupDelete  = "delete"
+	cleanupCompact = "compact"
+
+	defaultDeleteRetention = 24 * time.Hour
+)
+
+// cleanupPolicy defines how the old messages of a topic are removed.
+type cleanupPolicy struct {
+
+	// delete removes the messages exceeding the retention.
+	delete bool
+
+	// compact keeps only the newest message for every key.
+	compact bool
+
+	// tombstones is the time, for which the latest messages with the empty content are kept,
+	// so the consumers, which are behind, see the deletion of the key.
+	tombstones time.Duration
+}
+
+func parseCleanupPolicy(config map[string]string) (cleanupPolicy, error) {
+	p := cleanupPolicy{delete: true, tombstones: defaultDeleteRetention}
+	if raw, ok := config[cleanupPolicyConfig]; ok {
+		p.delete = false
+		for _, v := range strings.Split(raw, ",") {
+			switch strings.TrimSpace(v) {
+			case cleanupDelete:
+				p.delete = true
+			case cleanupCompact:
+				p.compact = true
+			default:
+				return p, fmt.Errorf("%w: %s must be %s, %s or both, got %q",
+					pkg.ErrorInvalidConfig, cleanupPolicyConfig, cleanupDelete, cleanupCompact, raw)
+			}
+		}
+	}
+
+	if raw, ok := config[deleteRetentionMsConfig]; ok {
+		ms, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || ms < 0 {
+			return p, fmt.Errorf("%w: %s must be non-negative, got %q", pkg.ErrorInvalidConfig, deleteRetentionMsConfig, raw)
+		}
+
+		p.tombstones = time.Duration(ms) * time.Millisecond
+	}
+
+	return p, nil
+}
+
+// isTombstone reports, whether the message deletes the previous ones with the same key.
+func (m *Message) isTombstone() bool {
+	return len(m.key) != 0 && len(m.content) == 0
+}
+
+// compaction decides, which messages survive, after seeing all messages of the log.
+type compaction struct {
+
+	// latest is the offset of the newest message for every key.
+	latest map[string]int64
+
+	// tombstonesBefore is the time, before which the latest tombstones are removed too.
+	tombstonesBefore time.Time
+}
+
+func newCompaction(tombstonesBefore time.Time) *compaction {
+	return &compaction{latest: make(map[string]int64), tombstonesBefore: tombstonesBefore}
+}
+
+func (c *compaction) add(m *Message) {
+	if len(m.key) != 0 {
+		c.latest[string(m.key)] = m.offset
+	}
+}
+
+// keep reports, whether the message survives. The messages without keys are never removed.
+func (c *compaction) keep(m *Message) bool {
+	if len(m.key) == 0 {
+		return true
+	}
+
+	if c.latest[string(m.key)] != m.offset {
+		return false
+	}
+
+	return !m.isTombstone() || !m.timestamp.Before(c.tombstonesBefore)
+}
+
+// compacted remembers the state of the log after the last compaction,
+// so it's not repeated, when nothing changed.
+type compacted struct {
+
+	// end is the offset, before which the log was compacted.
+	end int64
+
+	// tombstones is set, when some tombstones were kept, they are removed later.
+	tombstones bool
+}
+
+func (c compacted) dirty(end int64) bool {
+	return end != c.end || c.tombstones
+}
+
+// compact removes the overwritten messages of the partition.
+func (p *Partition) compact(tombstonesBefore time.Time) error {
+	return p.log.compact(&p.mu, tombstonesBefore)
+}
+
+func (l *memoryLog) compact(mu sync.Locker, tombstonesBefore time.Time) error {
+	mu.Lock()
+	end := l.next
+	if !l.compacted.dirty(end) {
+		mu.Unlock()
+		return nil
+	}
+
+	// The messages aren't changed after they are appended, so they are read without the lock.
+	snapshot := make([]*Message, l.messages.Len())
+	for i := range snapshot {
+		snapshot[i] = l.messages.Get(i)
+	}
+	mu.Unlock()
+
+	c := newCompaction(tombstonesBefore)
+	for _, m := range snapshot {
+		c.add(m)
+	}
+
+	var (
+		removed    = make(map[*Message]struct{})
+		tombstones bool
+	)
+
+	for _, m := range snapshot {
+		if !c.keep(m) {
+			removed[m] = struct{}{}
+		} else if m.isTombstone() {
+			tombstones = true
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	l.compacted = compacted{end: end, tombstones: tombstones}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	// The messages could be truncated or appended in the meantime, only the removed ones are dropped.
+	// They are matched by themselves, not by the offsets, which are assigned again after the tail is truncated.
+	messages := &queue[Message]{}
+	for m := l.messages.Pop(); m != nil; m = l.messages.Pop() {
+		if _, ok := removed[m]; ok {
+			l.bytes -= m.Size()
+			continue
+		}
+
+		messages.Push(m)
+	}
+
+	l.messages = messages
+	return nil
+}
+
+// compact rewrites the sealed segments without the removed records. The records are read
+// and written without the lock, the segments are swapped under it, so the writers
+// of the active segment are blocked only for the renames.
+func (l *fileLog) compact(mu sync.Locker, tombstonesBefore time.Time) error {
+	mu.Lock()
+	active, activeSize, truncations := l.active(), l.active().size, l.truncations
+	sealed := append([]*segment(nil), l.segments[:len(l.segments)-1]...)
+	if l.closed || len(sealed) == 0 || !l.compacted.dirty(active.base) {
+		mu.Unlock()
+		return nil
+	}
+	mu.Unlock()
+
+	c := newCompaction(tombstonesBefore)
+	for _, s := range sealed {
+		if err := s.forEach(s.size, c.add); err != nil {
+			return err
+		}
+	}
+
+	if err := active.forEach(activeSize, c.add); err != nil {
+		return err
+	}
+
+	cleaned, tombstones, err := l.rewrite(sealed, c)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if l.closed || l.truncations != truncations {
+		return discard(cleaned)
+	}
+
+	l.compacted = compacted{end: active.base, tombstones: tombstones}
+	return l.replace(sealed, cleaned)
+}
+
+// rewrite writes the kept records of the segments into the new files next to them.
+// The segments without the removed records are not rewritten, their cleaned ones are nil.
+func (l *fileLog) rewrite(sealed []*segment, c *compaction) ([]*segment, bool, error) {
+	var (
+		cleaned    = make([]*segment, len(sealed))
+		tombstones bool
+	)
+
+	for i, s := range sealed {
+		removed := 0
+		err := s.forEach(s.size, func(m *Message) {
+			if !c.keep(m) {
+				removed++
+			} else if m.isTombstone() {
+				tombstones = true
+			}
+		})
+
+		if err == nil && removed != 0 {
+			cleaned[i], err = l.rewriteSegment(s, c)
+		}
+
+		if err != nil {
+			return nil, false, errors.Join(err, discard(cleaned))
+		}
+	}
+
+	return cleaned, tombstones, nil
+}
+
+func (l *fileLog) rewriteSegment(s *segment, c *compaction) (*segment, error) {
+	logPath, idxPath := segmentPath(l.dir, s.base)+cleanedSuffix, indexPath(l.dir, s.base)+cleanedSuffix
+	for _, path := range []string{logPath, idxPath} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	cleaned, err := openSegmentFiles(logPath, idxPath, s.base)
+	if err != nil {
+		return nil, err
+	}
+
+	var writeErr error
+	err = s.forEach(s.size, func(m *Message) {
+		if writeErr == nil && c.keep(m) {
+			writeErr = cleaned.write(m, encodeRecord(m))
+		}
+	})
+
+	err = errors.Join(err, writeErr)
+
+	// The cleaned segment replaces the flushed one, so it's flushed before.
+	if err == nil {
+		err = cleaned.file.Sync()
+	}
+
+	if err != nil {
+		return nil, errors.Join(err, cleaned.remove())
+	}
+
+	return cleaned, nil
+}
+
+// replace swaps the segments with their cleaned copies. The segments removed
+// in the meantime are skipped, the emptied ones are removed.
+func (l *fileLog) replace(sealed, cleaned []*segment) error {
+	var errs []error
+	for i, c := range cleaned {
+		if c == nil {
+			continue
+		}
+
+		j := l.segmentIndex(sealed[i])
+		if j < 0 {
+			errs = append(errs, c.remove())
+			continue
+		}
+
+		if l.cursor.segment == l.segments[j] {
+			l.cursor.segment = nil
+		}
+
+		s, err := l.swap(l.segments[j], c)
+		if err != nil {
+			return errors.Join(append(errs, err, discard(cleaned[i+1:]))...)
+		}
+
+		if s == nil {
+			l.segments = append(l.segments[:j], l.segments[j+1:]...)
+			continue
+		}
+
+		l.segments[j] = s
+	}
+
+	return errors.Join(append(errs, syncDir(l.dir))...)
+}
+
+func (l *fileLog) segmentIndex(s *segment) int {
+	for i := range l.segments {
+		if l.segments[i] == s {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// swap moves the cleaned segment in place of the old one. The old index is removed first,
+// so the segment is reindexed on load, when the broker crashes in between.
+func (l *fileLog) swap(old, cleaned *segment) (*segment, error) {
+	if err := old.index.remove(); err != nil {
+		return nil, errors.Join(err, cleaned.remove())
+	}
+
+	if err := old.file.Close(); err != nil {
+		return nil, errors.Join(err, cleaned.remove())
+	}
+
+	if cleaned.size == 0 {
+		return nil, errors.Join(cleaned.remove(), os.Remove(segmentPath(l.dir, old.base)))
+	}
+
+	if err := cleaned.close(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(cleaned.file.Name(), segmentPath(l.dir, old.base)); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(cleaned.index.file.Name(), indexPath(l.dir, old.base)); err != nil {
+		return nil, err
+	}
+
+	s, err := openSegment(l.dir, old.base)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, s.loadIndex()
+}
+
+// discard removes the cleaned segments, which are not needed anymore.
+func discard(cleaned []*segment) error {
+	var errs []error
+	for _, c := range cleaned {
+		if c != nil {
+			errs = append(errs, c.remove())
+		}
+	}
+
+	return errors.Join(errs...)
+}
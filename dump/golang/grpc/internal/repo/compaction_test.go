@@ -0,0 +1,140 @@
+package repo
+
+import (
+	"errors"
+	"github.com/fadyat/grpc-broker/pkg"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBrokerStorage_Compact(t *testing.T) {
+	// The timestamps are in the future, so the wall clock doesn't overtake them.
+	base := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	at := func(seconds int) time.Time { return base.Add(time.Duration(seconds) * time.Second) }
+
+	messages := []struct {
+		key, content string
+	}{
+		{key: "k1", content: "v1"},
+		{key: "k2", content: "v1"},
+		{key: "k1", content: "v2"},
+		{content: "keyless"},
+		{key: "k2"},
+		{key: "k3", content: "v1"},
+		{key: "k1", content: "v3"},
+		{key: "k4", content: "v1"},
+		{key: "k4", content: "v2"},
+		{key: "k4", content: "v3"},
+	}
+
+	testCases := []struct {
+		name     string
+		now      time.Time
+		expected []int64
+	}{
+		{
+			name:     "tombstone is kept within the grace period",
+			now:      at(10),
+			expected: []int64{3, 4, 5, 6, 9},
+		},
+		{
+			name:     "tombstone is removed after the grace period",
+			now:      at(100),
+			expected: []int64{3, 5, 6, 9},
+		},
+	}
+
+	config := map[string]string{cleanupPolicyConfig: cleanupCompact, deleteRetentionMsConfig: "60000"}
+	storages := map[string]func(t *testing.T, dir string) *BrokerStorage{
+		"memory": func(t *testing.T, _ string) *BrokerStorage {
+			return NewBrokerStorage()
+		},
+		"file": func(t *testing.T, dir string) *BrokerStorage {
+			// Every message is in its own segment, only the last one is not compacted.
+			s, err := NewFileStorage(dir, FileOptions{SegmentBytes: 1})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			return s
+		},
+	}
+
+	for kind, newStorage := range storages {
+		for _, tc := range testCases {
+			t.Run(kind+", "+tc.name, func(t *testing.T) {
+				dir := t.TempDir()
+				s := newStorage(t, dir)
+				if err := s.CreateTopic("topic1", 1, config); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				p := s.topics["topic1"].partitions[0]
+				for i, m := range messages {
+					var key []byte
+					if m.key != "" {
+						key = []byte(m.key)
+					}
+
+					p.lastTimestamp = at(i).UnixMilli()
+					if _, err := s.Save("topic1", 0, NewMessage(key, []byte(m.content))); err != nil {
+						t.Fatalf("expected nil, got %v", err)
+					}
+				}
+
+				if err := s.cleanUp(tc.now); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				checkOffsets(t, s, tc.expected)
+				if offset, err := s.Save("topic1", 0, NewMessage(nil, []byte("next"))); err != nil || offset != 10 {
+					t.Errorf("expected offset %d, got %d and %v", 10, offset, err)
+				}
+
+				if err := s.Close(); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				if kind == "file" {
+					if cleaned, _ := filepath.Glob(filepath.Join(dir, "topic1", "0", "*"+cleanedSuffix)); len(cleaned) != 0 {
+						t.Errorf("expected cleaned segments to be swapped, got %v", cleaned)
+					}
+
+					reopened := newStorage(t, dir)
+					defer reopened.Close()
+
+					checkOffsets(t, reopened, append(tc.expected, 10))
+				}
+			})
+		}
+	}
+}
+
+// checkOffsets reads the partition from the beginning, following the gaps left by the compaction.
+func checkOffsets(t *testing.T, s *BrokerStorage, expected []int64) {
+	start, end, err := s.Offsets("topic1", 0)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	offsets := make([]int64, 0, len(expected))
+	for offset := start; offset < end; {
+		m, e := s.Explore("topic1", 0, offset)
+		if errors.Is(e, pkg.ErrorOffsetOutOfRange) {
+			break
+		}
+
+		if e != nil {
+			t.Fatalf("expected nil, got %v", e)
+		}
+
+		offsets = append(offsets, m.Offset())
+		offset = m.Offset() + 1
+	}
+
+	if !reflect.DeepEqual(offsets, expected) {
+		t.Errorf("expected %v, got %v", expected, offsets)
+	}
+}
@@ -0,0 +1,899 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/fadyat/grpc-broker/pkg"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	segmentSuffix = ".log"
+
+	// cleanedSuffix marks the files of the compacted segment, until it replaces the original one.
+	cleanedSuffix = ".cleaned"
+
+	// startOffsetFile keeps the start offset of the log, when it points
+	// into the middle of the oldest segment.
+	startOffsetFile = "start-offset"
+
+	// endOffsetFile keeps the end offset of the log, when it's moved past the last record,
+	// so the skipped offsets aren't assigned again after a restart.
+	endOffsetFile = "end-offset"
+
+	// defaultSegmentBytes is the size, after which the active segment is rolled.
+	defaultSegmentBytes = 16 << 20
+
+	// neverExpires is the expiration of the segment with the endless records.
+	neverExpires = math.MaxInt64
+)
+
+// segment is the file with the records of the consecutive offsets,
+// named after the offset of the first one.
+type segment struct {
+	file  *os.File
+	index *offsetIndex
+
+	// base is the offset of the first record in the segment.
+	base int64
+
+	// size is the number of bytes written to the segment.
+	size int64
+
+	// sinceIndex is the number of bytes written after the last index entry.
+	sinceIndex int64
+
+	// newest is the append time of the last record in milliseconds,
+	// it's zero, until the record is written or looked up.
+	newest int64
+
+	// expires is the time in milliseconds, when the last of the records expires,
+	// neverExpires, when some of them don't. It's zero, until it's looked up.
+	expires int64
+}
+
+func segmentPath(dir string, base int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", base, segmentSuffix))
+}
+
+func openSegment(dir string, base int64) (*segment, error) {
+	return openSegmentFiles(segmentPath(dir, base), indexPath(dir, base), base)
+}
+
+func openSegmentFiles(logPath, idxPath string, base int64) (*segment, error) {
+	f, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	index, err := openIndex(idxPath, base)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &segment{file: f, index: index, base: base, size: info.Size()}, nil
+}
+
+// scan validates the records from the beginning of the segment and indexes them from the scratch.
+// It returns the position and the offset after the last valid record.
+func (s *segment) scan() (int64, int64, error) {
+	if err := s.index.truncate(0); err != nil {
+		return 0, 0, err
+	}
+
+	next := s.base
+	s.sinceIndex = 0
+	s.expires = 0
+	pos, err := s.readRecords(s.size, func(m *Message, pos, size int64) error {
+		if err := s.track(indexEntry{offset: m.offset, pos: pos, timestamp: millis(m.timestamp)}, size); err != nil {
+			return err
+		}
+
+		s.newest = millis(m.timestamp)
+		s.expires = laterExpiry(s.expires, m)
+		next = m.offset + 1
+		return nil
+	})
+
+	return pos, next, err
+}
+
+// readRecords passes the records from the first size bytes of the segment to the function
+// one by one. It stops at the first invalid record and returns its position.
+func (s *segment) readRecords(size int64, fn func(m *Message, pos, size int64) error) (int64, error) {
+	var (
+		r      = bufio.NewReader(io.NewSectionReader(s.file, 0, size))
+		header = make([]byte, recordHeaderSize)
+		pos    int64
+	)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return pos, nil
+		}
+
+		h, err := decodeRecordHeader(header)
+		if err != nil {
+			return pos, nil
+		}
+
+		body := make([]byte, 8+h.length)
+		copy(body, header[8:])
+		if _, err = io.ReadFull(r, body[8:]); err != nil {
+			return pos, nil
+		}
+
+		m, err := decodeRecord(h, body)
+		if err != nil {
+			return pos, nil
+		}
+
+		if err = fn(m, pos, h.size()); err != nil {
+			return pos, err
+		}
+
+		pos += h.size()
+	}
+}
+
+// forEach passes the records from the first size bytes of the segment to the function,
+// unlike the recovery it fails on the invalid record.
+func (s *segment) forEach(size int64, fn func(m *Message)) error {
+	pos, err := s.readRecords(size, func(m *Message, _, _ int64) error {
+		fn(m)
+		return nil
+	})
+
+	if err == nil && pos != size {
+		err = fmt.Errorf("%w: segment %d at position %d", errCorruptedRecord, s.base, pos)
+	}
+
+	return err
+}
+
+// recover validates the records of the segment and cuts off the torn tail,
+// left by the write interrupted by a crash. It returns the offset after the last valid record.
+func (s *segment) recover() (int64, error) {
+	pos, next, err := s.scan()
+	if err != nil {
+		return 0, err
+	}
+
+	if pos != s.size {
+		if err = s.file.Truncate(pos); err != nil {
+			return 0, err
+		}
+
+		s.size = pos
+	}
+
+	return next, nil
+}
+
+// cut removes the records at and after the offset and reindexes the rest of them.
+func (s *segment) cut(offset int64) error {
+	pos := s.index.lookup(offset)
+	for pos < s.size {
+		h, err := s.readHeader(pos)
+		if err != nil {
+			return err
+		}
+
+		if h.offset >= offset {
+			break
+		}
+
+		pos += h.size()
+	}
+
+	if err := s.file.Truncate(pos); err != nil {
+		return err
+	}
+
+	s.size, s.newest = pos, 0
+	_, _, err := s.scan()
+	return err
+}
+
+// loadIndex reads the index of the sealed segment, it's rebuilt, when it's missing
+// or doesn't match the segment.
+func (s *segment) loadIndex() error {
+	if err := s.index.load(); err == nil && s.indexValid() {
+		s.sinceIndex = s.size
+		if last, ok := s.index.last(); ok {
+			s.sinceIndex = s.size - last.pos
+		}
+
+		return nil
+	}
+
+	_, _, err := s.scan()
+	return err
+}
+
+// indexValid checks, that the last index entry points to the record with its offset,
+// the entries before it are trusted to be written earlier.
+func (s *segment) indexValid() bool {
+	last, ok := s.index.last()
+	if !ok {
+		return s.size <= indexIntervalBytes
+	}
+
+	if last.pos+recordHeaderSize > s.size {
+		return false
+	}
+
+	h, err := s.readHeader(last.pos)
+	return err == nil && h.offset == last.offset && last.pos+h.size() <= s.size
+}
+
+// track adds the index entry for the record of the size,
+// when enough bytes were written after the previous one.
+func (s *segment) track(e indexEntry, size int64) error {
+	if s.sinceIndex >= indexIntervalBytes {
+		if err := s.index.add(e); err != nil {
+			return err
+		}
+
+		s.sinceIndex = 0
+	}
+
+	s.sinceIndex += size
+	return nil
+}
+
+func (s *segment) readHeader(pos int64) (recordHeader, error) {
+	b := make([]byte, recordHeaderSize)
+	if _, err := s.file.ReadAt(b, pos); err != nil {
+		return recordHeader{}, err
+	}
+
+	return decodeRecordHeader(b)
+}
+
+func (s *segment) readRecord(h recordHeader, pos int64) (*Message, error) {
+	body := make([]byte, 8+h.length)
+	if _, err := s.file.ReadAt(body, pos+8); err != nil {
+		return nil, err
+	}
+
+	return decodeRecord(h, body)
+}
+
+func (s *segment) write(m *Message, record []byte) error {
+	return s.writeBatch([]*Message{m}, [][]byte{record})
+}
+
+// writeBatch writes the records of the messages at once. The partially written batch
+// is cut off, so the records of the failed one aren't recovered after a restart.
+func (s *segment) writeBatch(ms []*Message, records [][]byte) error {
+	if _, err := s.file.WriteAt(bytes.Join(records, nil), s.size); err != nil {
+		return errors.Join(err, s.file.Truncate(s.size))
+	}
+
+	// The expiration is tracked from the empty segment or after it's looked up.
+	tracked := s.size == 0 || s.expires != 0
+	for i, m := range ms {
+		e := indexEntry{offset: m.offset, pos: s.size, timestamp: millis(m.timestamp)}
+		s.newest = e.timestamp
+		if tracked {
+			s.expires = laterExpiry(s.expires, m)
+		}
+
+		s.size += int64(len(records[i]))
+		if err := s.track(e, int64(len(records[i]))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newestTimestamp returns the append time of the last record,
+// the segment is scanned from its last index entry, when it's not known yet.
+func (s *segment) newestTimestamp() (int64, error) {
+	if s.newest != 0 {
+		return s.newest, nil
+	}
+
+	var pos int64
+	if last, ok := s.index.last(); ok {
+		pos = last.pos
+	}
+
+	for pos < s.size {
+		h, err := s.readHeader(pos)
+		if err != nil {
+			return 0, err
+		}
+
+		m, err := s.readRecord(h, pos)
+		if err != nil {
+			return 0, err
+		}
+
+		s.newest = millis(m.timestamp)
+		pos += h.size()
+	}
+
+	return s.newest, nil
+}
+
+// expiration returns the time in milliseconds, when the last of the records expires,
+// the segment is scanned, when it's not known yet.
+func (s *segment) expiration() (int64, error) {
+	if s.expires != 0 {
+		return s.expires, nil
+	}
+
+	var expires int64
+	if err := s.forEach(s.size, func(m *Message) { expires = laterExpiry(expires, m) }); err != nil {
+		return 0, err
+	}
+
+	s.expires = expires
+	return expires, nil
+}
+
+// laterExpiry returns the later of the expiration and the one of the message in milliseconds.
+func laterExpiry(expires int64, m *Message) int64 {
+	at := int64(neverExpires)
+	if e := m.ExpiresAt(); !e.IsZero() {
+		at = e.UnixMilli()
+	}
+
+	if at > expires {
+		return at
+	}
+
+	return expires
+}
+
+// first returns the first record of the segment or nil, when it's empty.
+func (s *segment) first() (*Message, error) {
+	if s.size == 0 {
+		return nil, nil
+	}
+
+	h, err := s.readHeader(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.readRecord(h, 0)
+}
+
+// seek scans the segment from the closest index entry for the first record
+// appended at or after the time, it returns false, when there is no such record.
+func (s *segment) seek(ts int64) (int64, bool, error) {
+	for pos := s.index.lookupTime(ts); pos < s.size; {
+		h, err := s.readHeader(pos)
+		if err != nil {
+			return 0, false, err
+		}
+
+		m, err := s.readRecord(h, pos)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if millis(m.timestamp) >= ts {
+			return m.offset, true, nil
+		}
+
+		pos += h.size()
+	}
+
+	return 0, false, nil
+}
+
+func (s *segment) close() error {
+	return errors.Join(s.file.Close(), s.index.close())
+}
+
+// remove deletes the index first, the segment left without it by a crash is reindexed.
+func (s *segment) remove() error {
+	if err := s.index.remove(); err != nil {
+		return err
+	}
+
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(s.file.Name())
+}
+
+// fileLog is the partition log, split into the segment files in the directory.
+// Only the last segment is written, the older ones are read and deleted as a whole.
+type fileLog struct {
+	dir string
+
+	// segments is the list of the segments sorted by their base offsets.
+	segments []*segment
+
+	opts FileOptions
+
+	// syncer flushes the written records to the disk following the sync policy.
+	syncer *syncer
+
+	// compacted is the state of the last compaction, see compact.
+	compacted compacted
+
+	// closed is set on close, so the compaction doesn't swap the segments after it.
+	closed bool
+
+	// truncations counts the truncations of the tail, the compaction running across
+	// one of them is discarded, its copies may keep the removed records.
+	truncations int
+
+	start int64
+	next  int64
+
+	// cursor is the position of the record following the last read one,
+	// so the sequential reads don't scan the segment from its beginning.
+	cursor struct {
+		segment *segment
+		offset  int64
+		pos     int64
+	}
+}
+
+func openFileLog(dir string, opts FileOptions) (*fileLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	l := &fileLog{dir: dir, opts: opts.withDefaults()}
+	if err := l.load(); err != nil {
+		_ = l.close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *fileLog) load() error {
+	start, err := readOffset(l.dir, startOffsetFile)
+	if err != nil {
+		return err
+	}
+
+	end, err := readOffset(l.dir, endOffsetFile)
+	if err != nil {
+		return err
+	}
+
+	// The compaction was interrupted before the cleaned segments replaced the original ones.
+	cleaned, err := filepath.Glob(filepath.Join(l.dir, "*"+cleanedSuffix))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range cleaned {
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	bases, err := listSegments(l.dir)
+	if err != nil {
+		return err
+	}
+
+	if len(bases) == 0 {
+		bases = []int64{start}
+	}
+
+	for _, base := range bases {
+		s, e := openSegment(l.dir, base)
+		if e != nil {
+			return e
+		}
+
+		l.segments = append(l.segments, s)
+	}
+
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if err = s.loadIndex(); err != nil {
+			return err
+		}
+	}
+
+	// The active segment is scanned anyway to cut off the torn tail, its index is rebuilt.
+	if l.next, err = l.active().recover(); err != nil {
+		return err
+	}
+
+	if end > l.next {
+		l.next = end
+	}
+
+	l.start = start
+	if first := l.segments[0].base; first > l.start {
+		l.start = first
+	}
+
+	l.syncer = newSyncer(l.opts.Sync, l.dir, l.active().file, l.next)
+	return nil
+}
+
+func listSegments(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	bases := make([]int64, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected segment %s: %w", name, err)
+		}
+
+		bases = append(bases, base)
+	}
+
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	return bases, nil
+}
+
+// readOffset reads the offset kept in the file of the log, it's zero, when the file doesn't exist.
+func readOffset(dir, name string) (int64, error) {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// writeOffset replaces the offset file atomically, so it's never seen half-written
+// and the offset isn't moved back after a crash.
+func writeOffset(dir, name string, offset int64) error {
+	return replaceFile(filepath.Join(dir, name), []byte(strconv.FormatInt(offset, 10)))
+}
+
+func (l *fileLog) active() *segment {
+	return l.segments[len(l.segments)-1]
+}
+
+func (l *fileLog) startOffset() int64 {
+	return l.start
+}
+
+func (l *fileLog) endOffset() int64 {
+	return l.next
+}
+
+func (l *fileLog) append(m *Message) error {
+	return l.appendBatch([]*Message{m})
+}
+
+// appendBatch writes the batch into a single segment, so it can exceed the segment size.
+func (l *fileLog) appendBatch(ms []*Message) error {
+	var (
+		records = make([][]byte, len(ms))
+		size    int64
+	)
+
+	for i, m := range ms {
+		m.offset = l.next + int64(i)
+		records[i] = encodeRecord(m)
+		size += int64(len(records[i]))
+	}
+
+	if active := l.active(); active.size > 0 && active.size+size > l.opts.SegmentBytes {
+		if err := l.roll(l.next); err != nil {
+			return err
+		}
+	}
+
+	if err := l.active().writeBatch(ms, records); err != nil {
+		return err
+	}
+
+	l.next += int64(len(ms))
+	l.syncer.appended(l.active().file, l.next, len(ms))
+	return nil
+}
+
+// roll starts a new active segment with the base offset.
+func (l *fileLog) roll(base int64) error {
+	s, err := openSegment(l.dir, base)
+	if err != nil {
+		return err
+	}
+
+	previous := l.active()
+	l.segments = append(l.segments, s)
+	return l.syncer.rolled(previous.file, s.file, l.next)
+}
+
+func (l *fileLog) read(offset int64) (*Message, error) {
+	if offset < l.start || offset >= l.next {
+		return nil, pkg.ErrorOffsetOutOfRange
+	}
+
+	// Starting from the last segment with the base offset not greater than the requested one.
+	// The offset may be removed by the compaction, then the next record is in the same
+	// segment or in one of the following ones.
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].base > offset }) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	for ; i < len(l.segments); i++ {
+		s := l.segments[i]
+
+		pos := s.index.lookup(offset)
+		if l.cursor.segment == s && l.cursor.offset <= offset && l.cursor.pos > pos {
+			pos = l.cursor.pos
+		}
+
+		for pos < s.size {
+			h, err := s.readHeader(pos)
+			if err != nil {
+				return nil, err
+			}
+
+			if h.offset < offset {
+				pos += h.size()
+				continue
+			}
+
+			m, err := s.readRecord(h, pos)
+			if err != nil {
+				return nil, err
+			}
+
+			l.cursor.segment, l.cursor.offset, l.cursor.pos = s, m.offset+1, pos+h.size()
+			return m, nil
+		}
+	}
+
+	return nil, pkg.ErrorOffsetOutOfRange
+}
+
+func (l *fileLog) seek(ts time.Time) (int64, error) {
+	target := millis(ts)
+
+	// The first segment, which starts at or after the time. The older records
+	// before the time are in the segments before it.
+	var err error
+	i := sort.Search(len(l.segments), func(i int) bool {
+		m, e := l.segments[i].first()
+		if e != nil {
+			err = e
+		}
+
+		return m == nil || millis(m.timestamp) >= target
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	offset := l.next
+	if i < len(l.segments) {
+		first, e := l.segments[i].first()
+		if e != nil {
+			return 0, e
+		}
+
+		if first != nil {
+			offset = first.offset
+		}
+	}
+
+	if i > 0 {
+		found, ok, e := l.segments[i-1].seek(target)
+		if e != nil {
+			return 0, e
+		}
+
+		if ok {
+			offset = found
+		}
+	}
+
+	// The first matching message may be already removed, the next ones are newer.
+	if offset < l.start {
+		offset = l.start
+	}
+
+	return offset, nil
+}
+
+// expired removes the whole segments only, when their newest records are too old,
+// all of their records expired or the rest of the log is big enough. The active segment
+// is expired by time only, the empty one is rolled instead of it on truncation.
+func (l *fileLog) expired(before time.Time, bytes int64, now time.Time) (int64, error) {
+	var size int64
+	for _, s := range l.segments {
+		size += s.size
+	}
+
+	offset := l.start
+	for i, s := range l.segments {
+		if s.size == 0 {
+			break
+		}
+
+		newest, err := s.newestTimestamp()
+		if err != nil {
+			return 0, err
+		}
+
+		expires, err := s.expiration()
+		if err != nil {
+			return 0, err
+		}
+
+		active := i == len(l.segments)-1
+		byTime := !before.IsZero() && newest < millis(before)
+		byTTL := expires <= millis(now)
+		bySize := !active && bytes > 0 && size-s.size >= bytes
+		if !byTime && !byTTL && !bySize {
+			break
+		}
+
+		size -= s.size
+		offset = l.next
+		if !active {
+			offset = l.segments[i+1].base
+		}
+	}
+
+	return offset, nil
+}
+
+func (l *fileLog) flush(offset int64) error {
+	return l.syncer.wait(offset)
+}
+
+func (l *fileLog) truncate(offset int64) error {
+	if offset <= l.start {
+		return nil
+	}
+
+	if offset >= l.next {
+		// Nothing is left, starting from the scratch with the empty segment.
+		if active := l.active(); active.size != 0 || active.base != offset {
+			if err := l.roll(offset); err != nil {
+				return err
+			}
+		}
+
+		l.next = offset
+	}
+
+	// Removing the segments, which are entirely before the offset.
+	for len(l.segments) > 1 && l.segments[1].base <= offset {
+		if l.cursor.segment == l.segments[0] {
+			l.cursor.segment = nil
+		}
+
+		if err := l.segments[0].remove(); err != nil {
+			return err
+		}
+
+		l.segments = l.segments[1:]
+	}
+
+	l.start = offset
+	return writeOffset(l.dir, startOffsetFile, offset)
+}
+
+// truncateTail cuts the segment with the offset at its record and removes the segments after it.
+// The kept end offset is moved back too, so the removed offsets are assigned again after a restart.
+func (l *fileLog) truncateTail(offset int64) error {
+	if offset >= l.next {
+		return nil
+	}
+
+	l.truncations++
+	l.cursor.segment = nil
+	for len(l.segments) > 1 && l.active().base >= offset {
+		if err := l.active().remove(); err != nil {
+			return err
+		}
+
+		l.segments = l.segments[:len(l.segments)-1]
+	}
+
+	if active := l.active(); active.base > offset {
+		// The records of the only segment are after the offset, it's replaced with the empty one.
+		s, err := openSegment(l.dir, offset)
+		if err != nil {
+			return err
+		}
+
+		if err = active.remove(); err != nil {
+			return errors.Join(err, s.close())
+		}
+
+		l.segments[0] = s
+	} else if err := active.cut(offset); err != nil {
+		return err
+	}
+
+	if offset < l.start {
+		l.start = offset
+		if err := writeOffset(l.dir, startOffsetFile, offset); err != nil {
+			return err
+		}
+	}
+
+	l.next = offset
+	if err := l.syncer.truncated(l.active().file, offset); err != nil {
+		return err
+	}
+
+	return writeOffset(l.dir, endOffsetFile, offset)
+}
+
+func (l *fileLog) skip(offset int64, appending bool) error {
+	if offset <= l.next {
+		return nil
+	}
+
+	l.next = offset
+	if appending {
+		return nil
+	}
+
+	return writeOffset(l.dir, endOffsetFile, offset)
+}
+
+func (l *fileLog) close() error {
+	l.closed = true
+
+	var errs []error
+	if l.syncer != nil {
+		errs = append(errs, l.syncer.close())
+	}
+
+	for _, s := range l.segments {
+		if err := s.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// millis returns the time in milliseconds since the epoch, the zero time, kept by
+// the records written before the timestamps, is the oldest one.
+func millis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixMilli()
+}
@@ -0,0 +1,401 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fadyat/grpc-broker/pkg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func appendMessages(t *testing.T, l partitionLog, count int) {
+	for i := 0; i < count; i++ {
+		if err := l.append(NewMessage(nil, []byte(fmt.Sprintf("message-%d", i)))); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+}
+
+func checkMessages(t *testing.T, l partitionLog, from, to int64) {
+	for offset := from; offset < to; offset++ {
+		m, err := l.read(offset)
+		if err != nil {
+			t.Fatalf("expected nil at %d, got %v", offset, err)
+		}
+
+		compareMessages(t, &Message{offset: offset, content: []byte(fmt.Sprintf("message-%d", offset))}, m)
+	}
+}
+
+func TestFileLog_AppendAndRead(t *testing.T) {
+	testCases := []struct {
+		name         string
+		segmentBytes int64
+		count        int
+		segments     int
+	}{
+		{
+			name:         "success, single segment",
+			segmentBytes: defaultSegmentBytes,
+			count:        10,
+			segments:     1,
+		},
+		{
+			name:         "success, rolled segments",
+			segmentBytes: 100,
+			count:        10,
+			segments:     4,
+		},
+		{
+			name:         "success, empty log",
+			segmentBytes: defaultSegmentBytes,
+			segments:     1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := openFileLog(dir, FileOptions{SegmentBytes: tc.segmentBytes})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			appendMessages(t, l, tc.count)
+			checkMessages(t, l, 0, int64(tc.count))
+			if len(l.segments) != tc.segments {
+				t.Errorf("expected %d segments, got %d", tc.segments, len(l.segments))
+			}
+
+			if err = l.close(); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			reopened, err := openFileLog(dir, FileOptions{SegmentBytes: tc.segmentBytes})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+			defer reopened.close()
+
+			if reopened.endOffset() != int64(tc.count) {
+				t.Errorf("expected %d, got %d", tc.count, reopened.endOffset())
+			}
+
+			checkMessages(t, reopened, 0, int64(tc.count))
+			if _, err = reopened.read(int64(tc.count)); !errors.Is(err, pkg.ErrorOffsetOutOfRange) {
+				t.Errorf("expected %v, got %v", pkg.ErrorOffsetOutOfRange, err)
+			}
+		})
+	}
+}
+
+func TestFileLog_RecoverTornTail(t *testing.T) {
+	testCases := []struct {
+		name    string
+		corrupt func(t *testing.T, path string)
+	}{
+		{
+			name: "partial header",
+			corrupt: func(t *testing.T, path string) {
+				writeTail(t, path, []byte{0, 0})
+			},
+		},
+		{
+			name: "partial payload",
+			corrupt: func(t *testing.T, path string) {
+				record := encodeRecord(&Message{offset: 3, content: []byte("torn")})
+				writeTail(t, path, record[:len(record)-2])
+			},
+		},
+		{
+			name: "checksum mismatch",
+			corrupt: func(t *testing.T, path string) {
+				record := encodeRecord(&Message{offset: 3, content: []byte("torn")})
+				record[len(record)-1] ^= 0xff
+				writeTail(t, path, record)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := openFileLog(dir, FileOptions{SegmentBytes: defaultSegmentBytes})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			appendMessages(t, l, 3)
+			size := l.active().size
+			if err = l.close(); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			tc.corrupt(t, segmentPath(dir, 0))
+
+			recovered, err := openFileLog(dir, FileOptions{SegmentBytes: defaultSegmentBytes})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+			defer recovered.close()
+
+			if recovered.endOffset() != 3 || recovered.active().size != size {
+				t.Errorf("expected end %d and size %d, got %d and %d",
+					3, size, recovered.endOffset(), recovered.active().size)
+			}
+
+			appendMessages(t, recovered, 1)
+			checkMessages(t, recovered, 0, 3)
+		})
+	}
+}
+
+func writeTail(t *testing.T, path string, b []byte) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer f.Close()
+
+	if _, err = f.Write(b); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+}
+
+func TestFileLog_Truncate(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openFileLog(dir, FileOptions{SegmentBytes: 100})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	appendMessages(t, l, 10)
+	if err = l.truncate(5); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if _, err = l.read(4); !errors.Is(err, pkg.ErrorOffsetOutOfRange) {
+		t.Errorf("expected %v, got %v", pkg.ErrorOffsetOutOfRange, err)
+	}
+
+	if l.segments[0].base > 5 {
+		t.Errorf("expected the segment with offset %d to be kept, got base %d", 5, l.segments[0].base)
+	}
+
+	if _, err = os.Stat(segmentPath(dir, 0)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the first segment to be removed, got %v", err)
+	}
+
+	if err = l.close(); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	reopened, err := openFileLog(dir, FileOptions{SegmentBytes: 100})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer reopened.close()
+
+	if reopened.startOffset() != 5 {
+		t.Errorf("expected %d, got %d", 5, reopened.startOffset())
+	}
+
+	checkMessages(t, reopened, 5, 10)
+	if err = reopened.truncate(10); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if reopened.startOffset() != 10 || reopened.endOffset() != 10 || len(reopened.segments) != 1 {
+		t.Errorf("expected empty log at %d, got [%d, %d) in %d segments",
+			10, reopened.startOffset(), reopened.endOffset(), len(reopened.segments))
+	}
+}
+
+func TestFileLog_SkipRestart(t *testing.T) {
+	testCases := []struct {
+		name      string
+		appending bool
+		expected  int64
+	}{
+		{
+			name:     "success, trailing gap is kept",
+			expected: 10,
+		},
+		{
+			name:      "success, gap is kept by the appended message",
+			appending: true,
+			expected:  11,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := openFileLog(dir, FileOptions{})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			appendMessages(t, l, 3)
+			if err = l.skip(10, tc.appending); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if tc.appending {
+				appendMessages(t, l, 1)
+			}
+
+			if err = l.close(); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			reopened, err := openFileLog(dir, FileOptions{})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+			defer reopened.close()
+
+			if reopened.endOffset() != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, reopened.endOffset())
+			}
+		})
+	}
+}
+
+func TestFileLog_TruncateTail(t *testing.T) {
+	testCases := []struct {
+		name   string
+		opts   FileOptions
+		skip   int64
+		offset int64
+	}{
+		{
+			name:   "success, segment is cut",
+			offset: 2,
+		},
+		{
+			name:   "success, segments after the offset are removed",
+			opts:   FileOptions{SegmentBytes: 1},
+			offset: 1,
+		},
+		{
+			name:   "success, only segment is replaced",
+			opts:   FileOptions{SegmentBytes: 1},
+			offset: 0,
+		},
+		{
+			name:   "success, trailing gap is dropped",
+			skip:   10,
+			offset: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := openFileLog(dir, tc.opts)
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			appendMessages(t, l, 4)
+			if err = l.skip(tc.skip, false); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if err = l.truncateTail(tc.offset); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if l.endOffset() != tc.offset {
+				t.Errorf("expected %d, got %d", tc.offset, l.endOffset())
+			}
+
+			checkMessages(t, l, 0, tc.offset)
+			appendMessages(t, l, 1)
+			if err = l.close(); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			// The removed offsets are assigned again, the appended message keeps the new end.
+			reopened, err := openFileLog(dir, tc.opts)
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+			defer reopened.close()
+
+			if reopened.endOffset() != tc.offset+1 {
+				t.Errorf("expected %d, got %d", tc.offset+1, reopened.endOffset())
+			}
+
+			checkMessages(t, reopened, 0, tc.offset)
+			m, err := reopened.read(tc.offset)
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			compareMessages(t, &Message{offset: tc.offset, content: []byte("message-0")}, m)
+		})
+	}
+}
+
+func TestFileStorage_Restart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStorage(dir, FileOptions{}, "topic1")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if err = s.CreateTopic("topic2", 2, map[string]string{"k": "v"}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	for _, topic := range []string{"topic1", "topic2"} {
+		if _, err = s.Save(topic, 0, NewMessage([]byte("key"), []byte("a"))); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// A directory left by the interrupted topic creation is cleaned up.
+	if err = os.Mkdir(filepath.Join(dir, "topic3"), 0o755); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	restarted, err := NewFileStorage(dir, FileOptions{}, "topic1")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer restarted.Close()
+
+	if topics := restarted.Topics(); len(topics) != 2 {
+		t.Errorf("expected %v, got %v", []string{"topic1", "topic2"}, topics)
+	}
+
+	d, err := restarted.DescribeTopic("topic2")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if len(d.Partitions) != 2 || d.Config["k"] != "v" || d.Partitions[0].EndOffset != 1 {
+		t.Errorf("expected topic to be recovered, got %+v", d)
+	}
+
+	m, err := restarted.Explore("topic2", 0, 0)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	compareMessages(t, &Message{offset: 0, key: []byte("key"), content: []byte("a")}, m)
+	if err = restarted.DeleteTopic("topic2"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "topic2")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected topic directory to be removed, got %v", err)
+	}
+}
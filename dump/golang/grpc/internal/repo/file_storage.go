@@ -0,0 +1,218 @@
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// topicFile keeps the topic settings next to its partitions directories.
+	topicFile = "topic.json"
+
+	// producersFile keeps the registered producers next to the topics directories.
+	producersFile = "producers.json"
+)
+
+type topicMetadata struct {
+	Partitions int               `json:"partitions"`
+	Config     map[string]string `json:"config,omitempty"`
+}
+
+type producerMetadata struct {
+	ID          int64                `json:"id"`
+	Epoch       int32                `json:"epoch"`
+	Transaction *transactionMetadata `json:"transaction,omitempty"`
+}
+
+type transactionMetadata struct {
+	State      transactionState `json:"state"`
+	Partitions []topicPartition `json:"partitions,omitempty"`
+}
+
+// FileOptions are the settings of the partition logs in the file storage.
+type FileOptions struct {
+
+	// SegmentBytes is the size, after which the active segment is rolled.
+	SegmentBytes int64
+
+	// Sync is the durability level of the written messages, SyncOS by default.
+	Sync SyncPolicy
+}
+
+func (o FileOptions) withDefaults() FileOptions {
+	if o.SegmentBytes <= 0 {
+		o.SegmentBytes = defaultSegmentBytes
+	}
+
+	if o.Sync.Mode == "" {
+		o.Sync.Mode = SyncOS
+	}
+
+	return o
+}
+
+// fileBackend keeps every topic in its own directory:
+//
+//	<dir>/producers.json
+//	<dir>/<topic>/topic.json
+//	<dir>/<topic>/<partition>/<base offset>.log
+type fileBackend struct {
+	dir  string
+	opts FileOptions
+}
+
+// NewFileStorage creates a storage, which keeps the messages in the segment files
+// under the directory. Topics, which already exist in the directory, are recovered,
+// the given ones are created with a single partition, when they are missing.
+func NewFileStorage(dir string, opts FileOptions, topics ...string) (*BrokerStorage, error) {
+	opts = opts.withDefaults()
+	if err := opts.Sync.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return newBrokerStorage(&fileBackend{dir: dir, opts: opts}, topics...)
+}
+
+func (b *fileBackend) loadTopics() ([]*Topic, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	topics := make([]*Topic, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		t, err := b.loadTopic(e.Name())
+		if errors.Is(err, os.ErrNotExist) {
+			// The broker stopped in the middle of the topic creation.
+			if err = os.RemoveAll(filepath.Join(b.dir, e.Name())); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to load topic %s: %w", e.Name(), err)
+		}
+
+		topics = append(topics, t)
+	}
+
+	return topics, nil
+}
+
+func (b *fileBackend) loadTopic(name string) (*Topic, error) {
+	raw, err := os.ReadFile(filepath.Join(b.dir, name, topicFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var meta topicMetadata
+	if err = json.Unmarshal(raw, &meta); err != nil {
+		return nil, err
+	}
+
+	t := newTopic(name, meta.Partitions, meta.Config)
+	return t, b.openLogs(t)
+}
+
+func (b *fileBackend) createTopic(t *Topic) error {
+	dir := filepath.Join(b.dir, t.name)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(topicMetadata{Partitions: len(t.partitions), Config: t.config})
+	if err != nil {
+		return err
+	}
+
+	// The metadata is written last, the directory without it is not a topic yet.
+	if err = b.openLogs(t); err != nil {
+		return err
+	}
+
+	if err = replaceFile(filepath.Join(dir, topicFile), raw); err != nil {
+		return err
+	}
+
+	// The topic directory itself is flushed with its parent.
+	return syncDir(b.dir)
+}
+
+func (b *fileBackend) openLogs(t *Topic) error {
+	for _, p := range t.partitions {
+		l, err := openFileLog(filepath.Join(b.dir, t.name, strconv.Itoa(int(p.id))), b.opts)
+		if err != nil {
+			return errors.Join(err, t.close())
+		}
+
+		p.log = l
+	}
+
+	return nil
+}
+
+func (b *fileBackend) deleteTopic(name string) error {
+	return os.RemoveAll(filepath.Join(b.dir, name))
+}
+
+func (b *fileBackend) loadProducers() ([]*Producer, error) {
+	raw, err := os.ReadFile(filepath.Join(b.dir, producersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var meta []producerMetadata
+	if err = json.Unmarshal(raw, &meta); err != nil {
+		return nil, fmt.Errorf("failed to load producers: %w", err)
+	}
+
+	producers := make([]*Producer, 0, len(meta))
+	for _, p := range meta {
+		producer := &Producer{id: p.ID, epoch: p.Epoch}
+		if t := p.Transaction; t != nil {
+			producer.transaction = &transaction{state: t.State, partitions: t.Partitions}
+		}
+
+		producers = append(producers, producer)
+	}
+
+	return producers, nil
+}
+
+func (b *fileBackend) saveProducers(producers []*Producer) error {
+	meta := make([]producerMetadata, 0, len(producers))
+	for _, p := range producers {
+		m := producerMetadata{ID: p.id, Epoch: p.epoch}
+		if t := p.transaction; t != nil {
+			m.Transaction = &transactionMetadata{State: t.state, Partitions: t.partitions}
+		}
+
+		meta = append(meta, m)
+	}
+
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	// The file is replaced at once, so the crash in the middle leaves the previous producers.
+	return replaceFile(filepath.Join(b.dir, producersFile), raw)
+}
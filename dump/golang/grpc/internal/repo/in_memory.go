@@ -1,11 +1,31 @@
 package repo
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fadyat/grpc-broker/pkg"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// topicNamePattern keeps the topic names safe to be used as the directory names.
+var topicNamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
 // BrokerStorage is the storage layer of the broker.
 //
 // By the PoC, it is an in-memory storage; however, it can be replaced with a persistent storage,
-// such as a file system.
+// such as a file system, see NewFileStorage.
 type BrokerStorage struct {
 
+	// mu guards the topics map, partitions have their own locks.
+	mu sync.RWMutex
+
+	// backend keeps the topics and creates the logs of their partitions.
+	backend backend
+
 	// topics is the map of topics in the broker.
 	topics map[string]*Topic
 
@@ -14,4 +34,430 @@ type BrokerStorage struct {
 
 	// consumers is the map of consumers in the broker.
 	consumers map[int64]*Consumer
+
+	// expired handles the expired messages before the cleaner removes them, see HandleExpired.
+	expired ExpiredHandler
+
+	// stopCleaner stops the background removal of the old messages, see StartCleaner.
+	stopCleaner context.CancelFunc
+	cleanerDone chan struct{}
+}
+
+// NewBrokerStorage creates an in-memory storage with the given single-partition topics.
+func NewBrokerStorage(topics ...string) *BrokerStorage {
+	// The memory backend can't fail.
+	s, _ := newBrokerStorage(memoryBackend{}, topics...)
+	return s
+}
+
+func newBrokerStorage(b backend, topics ...string) (*BrokerStorage, error) {
+	s := &BrokerStorage{
+		backend:   b,
+		topics:    make(map[string]*Topic, len(topics)),
+		producers: make(map[int64]*Producer),
+		consumers: make(map[int64]*Consumer),
+	}
+
+	producers, err := b.loadProducers()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range producers {
+		s.producers[p.id] = p
+	}
+
+	loaded, err := b.loadTopics()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range loaded {
+		for _, p := range t.partitions {
+			p.offset = p.log.startOffset()
+			if m, e := p.log.read(p.nextOffset() - 1); e == nil && !m.timestamp.IsZero() {
+				p.lastTimestamp = m.timestamp.UnixMilli()
+			}
+
+			if err = p.loadProducers(); err != nil {
+				return nil, errors.Join(fmt.Errorf("failed to load producers of %s/%d: %w", t.name, p.id, err), t.close())
+			}
+		}
+
+		s.topics[t.name] = t
+	}
+
+	if err = s.completeTransactions(); err != nil {
+		return nil, errors.Join(err, s.Close())
+	}
+
+	for _, name := range topics {
+		err = s.CreateTopic(name, 1, nil)
+		if err != nil && !errors.Is(err, pkg.ErrorTopicAlreadyExists) {
+			return nil, errors.Join(err, s.Close())
+		}
+	}
+
+	return s, nil
+}
+
+func newTopic(name string, partitions int, config map[string]string) *Topic {
+	t := &Topic{
+		name:       name,
+		partitions: make([]*Partition, partitions),
+		config:     make(map[string]string, len(config)),
+	}
+
+	for k, v := range config {
+		t.config[k] = v
+	}
+
+	// The config is validated, when the topic is created.
+	ttl, _ := parseTTL(config)
+	for i := range t.partitions {
+		t.partitions[i] = &Partition{
+			id:       int32(i),
+			topic:    name,
+			appended: make(chan struct{}),
+			ttl:      ttl,
+		}
+	}
+
+	return t
+}
+
+func (s *BrokerStorage) topic(name string) (*Topic, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.topics[name]
+	if !ok {
+		return nil, pkg.ErrorTopicNotFound
+	}
+
+	return t, nil
+}
+
+func (s *BrokerStorage) partition(topic string, partition int32) (*Partition, error) {
+	t, err := s.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	if partition < 0 || int(partition) >= len(t.partitions) {
+		return nil, pkg.ErrorPartitionNotFound
+	}
+
+	return t.partitions[partition], nil
+}
+
+// ValidateTopic checks the name, the partitions and the config of the topic, before it's created.
+func ValidateTopic(name string, partitions int, config map[string]string) error {
+	if !topicNamePattern.MatchString(name) || name == "." || name == ".." {
+		return pkg.ErrorInvalidTopic
+	}
+
+	if partitions <= 0 {
+		return pkg.ErrorInvalidPartitions
+	}
+
+	if _, err := parseRetention(config); err != nil {
+		return err
+	}
+
+	if _, err := parseCleanupPolicy(config); err != nil {
+		return err
+	}
+
+	_, err := parseTTL(config)
+	return err
+}
+
+func (s *BrokerStorage) CreateTopic(name string, partitions int, config map[string]string) error {
+	if err := ValidateTopic(name, partitions, config); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.topics[name]; ok {
+		return pkg.ErrorTopicAlreadyExists
+	}
+
+	t := newTopic(name, partitions, config)
+	if err := s.backend.createTopic(t); err != nil {
+		return err
+	}
+
+	s.topics[name] = t
+	return nil
+}
+
+func (s *BrokerStorage) DeleteTopic(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.topics[name]
+	if !ok {
+		return pkg.ErrorTopicNotFound
+	}
+
+	delete(s.topics, name)
+	if err := t.close(); err != nil {
+		return err
+	}
+
+	// Waking up the subscribers, so they notice that the topic is gone.
+	for _, p := range t.partitions {
+		p.mu.Lock()
+		p.notifyAppended()
+		p.mu.Unlock()
+	}
+
+	return s.backend.deleteTopic(name)
+}
+
+// Close closes the logs of all topics, the storage can't be used afterwards.
+func (s *BrokerStorage) Close() error {
+	if s.stopCleaner != nil {
+		s.stopCleaner()
+		<-s.cleanerDone
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	errs := make([]error, 0, len(s.topics))
+	for _, t := range s.topics {
+		errs = append(errs, t.close())
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *BrokerStorage) Topics() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.topics))
+	for name := range s.topics {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func (s *BrokerStorage) DescribeTopic(name string) (*TopicDescription, error) {
+	t, err := s.topic(name)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &TopicDescription{
+		Name:       t.name,
+		Partitions: make([]PartitionDescription, 0, len(t.partitions)),
+		Config:     make(map[string]string, len(t.config)),
+	}
+
+	for k, v := range t.config {
+		d.Config[k] = v
+	}
+
+	for _, p := range t.partitions {
+		p.mu.Lock()
+		d.Partitions = append(d.Partitions, PartitionDescription{
+			ID:          p.id,
+			StartOffset: p.offset,
+			EndOffset:   p.nextOffset(),
+		})
+		p.mu.Unlock()
+	}
+
+	return d, nil
+}
+
+func (s *BrokerStorage) Save(topic string, partition int32, message *Message) (int64, error) {
+	return s.SaveBatch(topic, partition, []*Message{message})
+}
+
+func (s *BrokerStorage) SaveBatch(topic string, partition int32, messages []*Message) (int64, error) {
+	if len(messages) == 0 {
+		return 0, pkg.ErrorEmptyBatch
+	}
+
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		epoch         int32
+		transactional bool
+		release       = func() {}
+	)
+
+	if messages[0].producerID != 0 {
+		if epoch, transactional, release, err = s.producerAppend(messages[0], topic, partition); err != nil {
+			return 0, err
+		}
+	}
+
+	// The messages are copied, so the offsets and the timestamps aren't assigned to the caller ones.
+	batch := make([]*Message, len(messages))
+	for i, message := range messages {
+		m := *message
+		m.transactional, m.control = transactional, controlNone
+		batch[i] = &m
+	}
+
+	// The producer is released after the batch is appended, so its transaction isn't ended in between.
+	defer func() { release() }()
+
+	p.mu.Lock()
+
+	// The topic is deleted after the partition is looked up.
+	if p.closed {
+		p.mu.Unlock()
+		return 0, pkg.ErrorTopicNotFound
+	}
+
+	if batch[0].producerID != 0 {
+		offset, duplicate, e := p.checkSequences(batch, epoch)
+		if e != nil || duplicate {
+			p.mu.Unlock()
+			if e != nil {
+				return 0, e
+			}
+
+			// The retry is acknowledged, when the original batch is as durable as the new one would be.
+			return offset, p.log.flush(offset + int64(len(batch)) - 1)
+		}
+	}
+
+	ts := p.nextTimestamp()
+	for _, m := range batch {
+		m.timestamp, m.leaderEpoch = ts, p.leaderEpoch
+		if m.ttl == 0 {
+			m.ttl = p.ttl
+		}
+	}
+
+	if err = p.log.appendBatch(batch); err != nil {
+		p.mu.Unlock()
+		return 0, err
+	}
+
+	p.producerAppended(batch)
+	p.transactionAppended(batch)
+	p.notifyAppended()
+	p.mu.Unlock()
+	release()
+	release = func() {}
+
+	// Waiting for the durability without the lock, so the concurrent
+	// writers get into the same flush.
+	last := batch[len(batch)-1]
+	if err = p.log.flush(last.offset); err != nil {
+		return 0, err
+	}
+
+	return batch[0].offset, nil
+}
+
+func (s *BrokerStorage) Get(topic string, partition int32) (*Message, error) {
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, err := p.read(p.offset, time.Now())
+	if errors.Is(err, pkg.ErrorOffsetOutOfRange) {
+		return nil, pkg.ErrorNoMessages
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m, p.truncate(m.offset + 1)
+}
+
+func (s *BrokerStorage) Explore(topic string, partition int32, offset int64) (*Message, error) {
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if offset == -1 {
+		offset = p.nextOffset() - 1
+	}
+
+	if offset < p.offset || offset >= p.nextOffset() {
+		return nil, pkg.ErrorOffsetOutOfRange
+	}
+
+	return p.read(offset, time.Now())
+}
+
+func (s *BrokerStorage) Offsets(topic string, partition int32) (int64, int64, error) {
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.offset, p.nextOffset(), nil
+}
+
+func (s *BrokerStorage) OffsetForTime(topic string, partition int32, ts time.Time) (int64, error) {
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.log.seek(ts)
+}
+
+func (s *BrokerStorage) Notify(topic string, partition int32) (<-chan struct{}, error) {
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.appended, nil
+}
+
+func (s *BrokerStorage) ResetOffset(topic string) error {
+	t, err := s.topic(topic)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range t.partitions {
+		p.mu.Lock()
+		err = p.truncate(p.nextOffset())
+		p.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,466 @@
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"github.com/fadyat/grpc-broker/pkg"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBrokerStorage_Save(t *testing.T) {
+	testCases := []struct {
+		name            string
+		topic           string
+		partition       int32
+		messages        [][]byte
+		expectedOffsets []int64
+		expectedErr     error
+	}{
+		{
+			name:            "success, offsets are increasing",
+			topic:           "topic1",
+			messages:        [][]byte{[]byte("a"), []byte("b"), []byte("c")},
+			expectedOffsets: []int64{0, 1, 2},
+		},
+		{
+			name:            "success, empty message",
+			topic:           "topic1",
+			messages:        [][]byte{nil},
+			expectedOffsets: []int64{0},
+		},
+		{
+			name:        "failure, topic not found",
+			topic:       "unknown",
+			messages:    [][]byte{[]byte("a")},
+			expectedErr: pkg.ErrorTopicNotFound,
+		},
+		{
+			name:        "failure, partition not found",
+			topic:       "topic1",
+			partition:   1,
+			messages:    [][]byte{[]byte("a")},
+			expectedErr: pkg.ErrorPartitionNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewBrokerStorage("topic1")
+			for i, m := range tc.messages {
+				offset, err := s.Save(tc.topic, tc.partition, NewMessage(nil, m))
+				if !errors.Is(err, tc.expectedErr) {
+					t.Fatalf("expected %v, got %v", tc.expectedErr, err)
+				}
+
+				if tc.expectedErr == nil && offset != tc.expectedOffsets[i] {
+					t.Errorf("expected %d, got %d", tc.expectedOffsets[i], offset)
+				}
+			}
+		})
+	}
+}
+
+func TestBrokerStorage_SaveBatch(t *testing.T) {
+	testCases := []struct {
+		name          string
+		batches       [][]string
+		expectedFirst []int64
+		expectedErr   error
+	}{
+		{
+			name:          "success, batches follow each other",
+			batches:       [][]string{{"a", "b", "c"}, {"d"}, {"e", "f"}},
+			expectedFirst: []int64{0, 3, 4},
+		},
+		{
+			name:        "failure, empty batch",
+			batches:     [][]string{{}},
+			expectedErr: pkg.ErrorEmptyBatch,
+		},
+	}
+
+	storages := map[string]func(t *testing.T, dir string) *BrokerStorage{
+		"memory": func(t *testing.T, _ string) *BrokerStorage {
+			return NewBrokerStorage("topic1")
+		},
+		"file": func(t *testing.T, dir string) *BrokerStorage {
+			// The batch is bigger than the segment, but it's not split.
+			s, err := NewFileStorage(dir, FileOptions{SegmentBytes: 1}, "topic1")
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			return s
+		},
+	}
+
+	for kind, newStorage := range storages {
+		for _, tc := range testCases {
+			t.Run(kind+", "+tc.name, func(t *testing.T) {
+				dir := t.TempDir()
+				s := newStorage(t, dir)
+
+				var expected []string
+				for i, batch := range tc.batches {
+					messages := make([]*Message, len(batch))
+					for j, content := range batch {
+						messages[j] = NewMessage(nil, []byte(content))
+					}
+
+					first, err := s.SaveBatch("topic1", 0, messages)
+					if !errors.Is(err, tc.expectedErr) {
+						t.Fatalf("expected %v, got %v", tc.expectedErr, err)
+					}
+
+					if tc.expectedErr == nil && first != tc.expectedFirst[i] {
+						t.Errorf("expected %d, got %d", tc.expectedFirst[i], first)
+					}
+
+					if len(messages) != 0 && messages[0].Offset() != 0 {
+						t.Errorf("expected the passed messages to be unchanged, got offset %d", messages[0].Offset())
+					}
+
+					if tc.expectedErr == nil {
+						expected = append(expected, batch...)
+					}
+				}
+
+				if kind == "file" {
+					if segments, _ := listSegments(filepath.Join(dir, "topic1", "0")); len(segments) != len(tc.batches) {
+						t.Errorf("expected a segment per batch, got %d", len(segments))
+					}
+
+					if err := s.Close(); err != nil {
+						t.Fatalf("expected nil, got %v", err)
+					}
+
+					s = newStorage(t, dir)
+				}
+				defer s.Close()
+
+				for offset, content := range expected {
+					m, err := s.Explore("topic1", 0, int64(offset))
+					if err != nil {
+						t.Fatalf("expected nil, got %v", err)
+					}
+
+					if string(m.Content()) != content {
+						t.Errorf("expected %s at %d, got %s", content, offset, m.Content())
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestBrokerStorage_SaveConcurrently(t *testing.T) {
+	const publishers, perPublisher = 8, 100
+	s := NewBrokerStorage("topic1")
+
+	var (
+		mu      sync.Mutex
+		offsets = make([]int64, 0, publishers*perPublisher)
+		wg      sync.WaitGroup
+	)
+
+	wg.Add(publishers)
+	for i := 0; i < publishers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < perPublisher; j++ {
+				offset, err := s.Save("topic1", 0, NewMessage(nil, []byte("a")))
+				if err != nil {
+					t.Errorf("expected nil, got %v", err)
+					return
+				}
+
+				mu.Lock()
+				offsets = append(offsets, offset)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for i, offset := range offsets {
+		if offset != int64(i) {
+			t.Fatalf("expected %d, got %d", i, offset)
+		}
+	}
+}
+
+func TestBrokerStorage_Explore(t *testing.T) {
+	testCases := []struct {
+		name        string
+		topic       string
+		messages    [][]byte
+		popCount    int
+		offset      int64
+		expected    []byte
+		expectedErr error
+	}{
+		{
+			name:     "success, read by offset",
+			topic:    "topic1",
+			messages: [][]byte{[]byte("a"), []byte("b"), []byte("c")},
+			offset:   1,
+			expected: []byte("b"),
+		},
+		{
+			name:     "success, read latest",
+			topic:    "topic1",
+			messages: [][]byte{[]byte("a"), []byte("b"), []byte("c")},
+			offset:   -1,
+			expected: []byte("c"),
+		},
+		{
+			name:     "success, read after pop",
+			topic:    "topic1",
+			messages: [][]byte{[]byte("a"), []byte("b"), []byte("c")},
+			popCount: 1,
+			offset:   1,
+			expected: []byte("b"),
+		},
+		{
+			name:        "failure, offset was popped",
+			topic:       "topic1",
+			messages:    [][]byte{[]byte("a"), []byte("b")},
+			popCount:    1,
+			offset:      0,
+			expectedErr: pkg.ErrorOffsetOutOfRange,
+		},
+		{
+			name:        "failure, offset is not written yet",
+			topic:       "topic1",
+			messages:    [][]byte{[]byte("a")},
+			offset:      1,
+			expectedErr: pkg.ErrorOffsetOutOfRange,
+		},
+		{
+			name:        "failure, latest from empty topic",
+			topic:       "topic1",
+			offset:      -1,
+			expectedErr: pkg.ErrorOffsetOutOfRange,
+		},
+		{
+			name:        "failure, topic not found",
+			topic:       "unknown",
+			expectedErr: pkg.ErrorTopicNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewBrokerStorage("topic1")
+			for _, m := range tc.messages {
+				if _, err := s.Save("topic1", 0, NewMessage(nil, m)); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+			}
+
+			for i := 0; i < tc.popCount; i++ {
+				if _, err := s.Get("topic1", 0); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+			}
+
+			actual, err := s.Explore(tc.topic, 0, tc.offset)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected %v, got %v", tc.expectedErr, err)
+			}
+
+			if tc.expectedErr == nil && !bytes.Equal(tc.expected, actual.Content()) {
+				t.Errorf("expected %v, got %v", string(tc.expected), string(actual.Content()))
+			}
+		})
+	}
+}
+
+func TestBrokerStorage_ResetOffset(t *testing.T) {
+	s := NewBrokerStorage("topic1")
+	for _, m := range [][]byte{[]byte("a"), []byte("b")} {
+		if _, err := s.Save("topic1", 0, NewMessage(nil, m)); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+
+	if err := s.ResetOffset("topic1"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if _, err := s.Get("topic1", 0); !errors.Is(err, pkg.ErrorNoMessages) {
+		t.Errorf("expected %v, got %v", pkg.ErrorNoMessages, err)
+	}
+
+	offset, err := s.Save("topic1", 0, NewMessage(nil, []byte("c")))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if offset != 2 {
+		t.Errorf("expected %d, got %d", 2, offset)
+	}
+}
+
+func TestBrokerStorage_CreateTopic(t *testing.T) {
+	testCases := []struct {
+		name        string
+		topic       string
+		partitions  int
+		expectedErr error
+	}{
+		{
+			name:       "success, several partitions",
+			topic:      "topic2",
+			partitions: 3,
+		},
+		{
+			name:        "failure, topic already exists",
+			topic:       "topic1",
+			partitions:  1,
+			expectedErr: pkg.ErrorTopicAlreadyExists,
+		},
+		{
+			name:        "failure, no partitions",
+			topic:       "topic2",
+			expectedErr: pkg.ErrorInvalidPartitions,
+		},
+		{
+			name:        "failure, empty name",
+			partitions:  1,
+			expectedErr: pkg.ErrorInvalidTopic,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewBrokerStorage("topic1")
+			err := s.CreateTopic(tc.topic, tc.partitions, map[string]string{"k": "v"})
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected %v, got %v", tc.expectedErr, err)
+			}
+
+			if tc.expectedErr != nil {
+				return
+			}
+
+			d, err := s.DescribeTopic(tc.topic)
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if len(d.Partitions) != tc.partitions {
+				t.Errorf("expected %d, got %d", tc.partitions, len(d.Partitions))
+			}
+
+			if d.Config["k"] != "v" {
+				t.Errorf("expected %v, got %v", "v", d.Config["k"])
+			}
+		})
+	}
+}
+
+func TestBrokerStorage_DeleteTopic(t *testing.T) {
+	s := NewBrokerStorage("topic1", "topic2")
+	appended, err := s.Notify("topic1", 0)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if err = s.DeleteTopic("topic1"); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	select {
+	case <-appended:
+	default:
+		t.Errorf("expected subscribers to be notified")
+	}
+
+	if topics := s.Topics(); len(topics) != 1 || topics[0] != "topic2" {
+		t.Errorf("expected %v, got %v", []string{"topic2"}, topics)
+	}
+
+	if err = s.DeleteTopic("topic1"); !errors.Is(err, pkg.ErrorTopicNotFound) {
+		t.Errorf("expected %v, got %v", pkg.ErrorTopicNotFound, err)
+	}
+}
+
+func TestBrokerStorage_SaveAfterClose(t *testing.T) {
+	s := NewBrokerStorage("topic1")
+	if err := s.Close(); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if _, err := s.SaveBatch("topic1", 0, []*Message{NewMessage(nil, []byte("message"))}); !errors.Is(err, pkg.ErrorTopicNotFound) {
+		t.Errorf("expected %v, got %v", pkg.ErrorTopicNotFound, err)
+	}
+}
+
+func TestBrokerStorage_OffsetForTime(t *testing.T) {
+	const count = 50
+
+	// The timestamps are in the future, so the wall clock doesn't overtake them.
+	base := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	at := func(ms int) time.Time { return base.Add(time.Duration(ms) * time.Millisecond) }
+
+	testCases := []struct {
+		name     string
+		ts       time.Time
+		expected int64
+	}{
+		{name: "before all messages", ts: at(-1000), expected: 0},
+		{name: "exact timestamp", ts: at(50), expected: 5},
+		{name: "between messages", ts: at(55), expected: 6},
+		{name: "last message", ts: at((count - 1) * 10), expected: count - 1},
+		{name: "after all messages", ts: at(count * 10), expected: count},
+	}
+
+	storages := map[string]func(t *testing.T) *BrokerStorage{
+		"memory": func(t *testing.T) *BrokerStorage {
+			return NewBrokerStorage("topic1")
+		},
+		"file": func(t *testing.T) *BrokerStorage {
+			s, err := NewFileStorage(t.TempDir(), FileOptions{SegmentBytes: 256}, "topic1")
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			return s
+		},
+	}
+
+	for kind, newStorage := range storages {
+		s := newStorage(t)
+		p := s.topics["topic1"].partitions[0]
+		for i := 0; i < count; i++ {
+			p.lastTimestamp = at(i * 10).UnixMilli()
+			if _, err := s.Save("topic1", 0, NewMessage(nil, []byte("message"))); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+		}
+
+		for _, tc := range testCases {
+			t.Run(kind+", "+tc.name, func(t *testing.T) {
+				offset, err := s.OffsetForTime("topic1", 0, tc.ts)
+				if err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				if offset != tc.expected {
+					t.Errorf("expected %d, got %d", tc.expected, offset)
+				}
+			})
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+}
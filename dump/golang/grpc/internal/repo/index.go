@@ -0,0 +1,159 @@
+package repo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Index entries map the offsets and the append times of some records to their positions in the segment:
+//
+//	+----------------------+----------------+-----------------------+
+//	| relative offset (4B) | position (4B)  | timestamp, ms (8B)    |
+//	+----------------------+----------------+-----------------------+
+//
+// An entry is added every indexIntervalBytes of the segment, so the read
+// finds the closest entry with the binary search and scans a few records after it.
+// The append times never decrease in the partition, so the same entries index the time.
+const (
+	indexSuffix    = ".index"
+	indexEntrySize = 16
+
+	// indexIntervalBytes is the number of the segment bytes between the index entries.
+	indexIntervalBytes = 4 << 10
+)
+
+var errCorruptedIndex = errors.New("corrupted index")
+
+type indexEntry struct {
+	offset    int64
+	pos       int64
+	timestamp int64
+}
+
+// offsetIndex is the sparse index of a segment, kept in the file next to it.
+// It's not flushed with the segment, the broken index is rebuilt from the segment on load.
+type offsetIndex struct {
+	file *os.File
+	base int64
+
+	// entries are sorted by both offsets and positions.
+	entries []indexEntry
+}
+
+func indexPath(dir string, base int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", base, indexSuffix))
+}
+
+func openIndex(path string, base int64) (*offsetIndex, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &offsetIndex{file: f, base: base}, nil
+}
+
+// load reads the entries from the file, they are checked against the segment by the caller.
+func (x *offsetIndex) load() error {
+	info, err := x.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size()%indexEntrySize != 0 {
+		return fmt.Errorf("%w: size %d", errCorruptedIndex, info.Size())
+	}
+
+	raw := make([]byte, info.Size())
+	if _, err = x.file.ReadAt(raw, 0); err != nil {
+		return err
+	}
+
+	x.entries = make([]indexEntry, 0, len(raw)/indexEntrySize)
+	for b := raw; len(b) > 0; b = b[indexEntrySize:] {
+		e := indexEntry{
+			offset:    x.base + int64(binary.BigEndian.Uint32(b[0:4])),
+			pos:       int64(binary.BigEndian.Uint32(b[4:8])),
+			timestamp: int64(binary.BigEndian.Uint64(b[8:16])),
+		}
+
+		if last, ok := x.last(); ok && (e.offset <= last.offset || e.pos <= last.pos || e.timestamp < last.timestamp) {
+			return fmt.Errorf("%w: unordered entry at offset %d", errCorruptedIndex, e.offset)
+		}
+
+		x.entries = append(x.entries, e)
+	}
+
+	return nil
+}
+
+func (x *offsetIndex) add(e indexEntry) error {
+	b := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint32(b[0:4], uint32(e.offset-x.base))
+	binary.BigEndian.PutUint32(b[4:8], uint32(e.pos))
+	binary.BigEndian.PutUint64(b[8:16], uint64(e.timestamp))
+	if _, err := x.file.WriteAt(b, int64(len(x.entries))*indexEntrySize); err != nil {
+		return err
+	}
+
+	x.entries = append(x.entries, e)
+	return nil
+}
+
+// last returns the last entry or false, when the index is empty.
+func (x *offsetIndex) last() (indexEntry, bool) {
+	if len(x.entries) == 0 {
+		return indexEntry{}, false
+	}
+
+	return x.entries[len(x.entries)-1], true
+}
+
+// lookup returns the position of the closest record before the offset,
+// from which the segment is scanned.
+func (x *offsetIndex) lookup(offset int64) int64 {
+	i := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].offset > offset }) - 1
+	if i < 0 {
+		return 0
+	}
+
+	return x.entries[i].pos
+}
+
+// lookupTime returns the position of the closest record appended before the time,
+// from which the segment is scanned.
+func (x *offsetIndex) lookupTime(ts int64) int64 {
+	i := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].timestamp >= ts }) - 1
+	if i < 0 {
+		return 0
+	}
+
+	return x.entries[i].pos
+}
+
+// truncate drops the entries pointing at or after the position.
+func (x *offsetIndex) truncate(pos int64) error {
+	i := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].pos >= pos })
+	if err := x.file.Truncate(int64(i) * indexEntrySize); err != nil {
+		return err
+	}
+
+	x.entries = x.entries[:i]
+	return nil
+}
+
+func (x *offsetIndex) close() error {
+	return x.file.Close()
+}
+
+func (x *offsetIndex) remove() error {
+	if err := x.file.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(x.file.Name())
+}
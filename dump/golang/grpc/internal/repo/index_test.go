@@ -0,0 +1,105 @@
+package repo
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestFileLog_Index(t *testing.T) {
+	testCases := []struct {
+		name    string
+		corrupt func(t *testing.T, dir string)
+	}{
+		{
+			name:    "success, intact index",
+			corrupt: func(t *testing.T, dir string) {},
+		},
+		{
+			name: "missing index",
+			corrupt: func(t *testing.T, dir string) {
+				if err := os.Remove(indexPath(dir, 0)); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+			},
+		},
+		{
+			name: "torn entry",
+			corrupt: func(t *testing.T, dir string) {
+				writeTail(t, indexPath(dir, 0), []byte{0, 0, 1})
+			},
+		},
+		{
+			name: "entry with wrong offset",
+			corrupt: func(t *testing.T, dir string) {
+				writeTail(t, indexPath(dir, 0), []byte{0, 0, 0xff, 0xff, 0, 0, 0xff, 0xf0, 0, 0, 0, 0, 0, 0, 0, 0})
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := openFileLog(dir, FileOptions{SegmentBytes: 64 << 10})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			appendMessages(t, l, 5000)
+			if len(l.segments) < 2 {
+				t.Fatalf("expected rolled segments, got %d", len(l.segments))
+			}
+
+			entries := len(l.segments[0].index.entries)
+			if entries == 0 {
+				t.Fatalf("expected index entries, got none")
+			}
+
+			if err = l.close(); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			tc.corrupt(t, dir)
+
+			reopened, err := openFileLog(dir, FileOptions{SegmentBytes: 64 << 10})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+			defer reopened.close()
+
+			if got := len(reopened.segments[0].index.entries); got != entries {
+				t.Errorf("expected %d entries, got %d", entries, got)
+			}
+
+			for _, offset := range rand.Perm(5000)[:100] {
+				checkMessages(t, reopened, int64(offset), int64(offset)+1)
+			}
+
+			appendMessages(t, reopened, 1)
+		})
+	}
+}
+
+func BenchmarkFileLog_Read(b *testing.B) {
+	const count = 200000
+
+	l, err := openFileLog(b.TempDir(), FileOptions{})
+	if err != nil {
+		b.Fatalf("expected nil, got %v", err)
+	}
+	defer l.close()
+
+	content := make([]byte, 128)
+	for i := 0; i < count; i++ {
+		if err = l.append(NewMessage(nil, content)); err != nil {
+			b.Fatalf("expected nil, got %v", err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = l.read(rand.Int63n(count)); err != nil {
+			b.Fatalf("expected nil, got %v", err)
+		}
+	}
+}
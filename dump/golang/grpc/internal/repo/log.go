@@ -0,0 +1,208 @@
+package repo
+
+import (
+	"github.com/fadyat/grpc-broker/pkg"
+	"sort"
+	"sync"
+	"time"
+)
+
+// partitionLog is the append-only sequence of the partition messages ordered by their offsets.
+//
+// Logs are not safe for the concurrent use, partitions serialize the access to them.
+// The exceptions are flush and compact, which are called without the partition lock.
+type partitionLog interface {
+
+	// startOffset returns the offset of the oldest message in the log.
+	startOffset() int64
+
+	// endOffset returns the offset, which will be assigned to the next message.
+	endOffset() int64
+
+	// append writes the message to the end of the log, assigning the end offset to it.
+	append(m *Message) error
+
+	// appendBatch writes the messages to the end of the log with the consecutive offsets,
+	// either all of them are appended or none.
+	appendBatch(ms []*Message) error
+
+	// read returns the message with the offset or pkg.ErrorOffsetOutOfRange,
+	// when the offset is not in the log. When the message was removed by the compaction,
+	// the next one is returned.
+	read(offset int64) (*Message, error)
+
+	// seek returns the offset of the first message appended at or after the time,
+	// or the end offset, when there is no such message.
+	seek(ts time.Time) (int64, error)
+
+	// expired returns the offset, before which the messages are appended before the time,
+	// exceed the size in bytes or their time to live passed by now, so they can be removed.
+	// The zero limits are not applied. Logs may keep more messages to remove them in whole chunks.
+	expired(before time.Time, bytes int64, now time.Time) (int64, error)
+
+	// compact removes the messages followed by the newer ones with the same key and the latest
+	// tombstones appended before the time, the offsets of the rest don't change. The log takes
+	// the lock only to snapshot and to replace its data, so the writers aren't blocked for long.
+	compact(mu sync.Locker, tombstonesBefore time.Time) error
+
+	// flush returns, when the appended message with the offset is as durable
+	// as the log promises, it may be flushed together with the messages around.
+	flush(offset int64) error
+
+	// truncate removes the messages before the offset.
+	truncate(offset int64) error
+
+	// truncateTail removes the messages at and after the offset and moves the end of the log back to it.
+	truncateTail(offset int64) error
+
+	// skip moves the end of the log forward to the offset, the skipped offsets
+	// are the gap like the one left by the compaction. The persistent logs keep
+	// the new end, unless the message is appended right after the gap and keeps it itself.
+	skip(offset int64, appending bool) error
+
+	// close releases the resources of the log, the data is kept.
+	close() error
+}
+
+// memoryLog keeps the messages in the queue, all of them are lost on restart.
+type memoryLog struct {
+
+	// messages is the FIFO queue of messages in the partition.
+	// structured from the oldest to the newest.
+	messages Queue[Message]
+
+	// start is the first available offset, the message at it may be removed by the compaction.
+	start int64
+
+	// next is the offset, which will be assigned to the next message.
+	next int64
+
+	// bytes is the size of the keys, the contents and the headers of the messages.
+	bytes int64
+
+	// compacted is the state of the last compaction, see compact.
+	compacted compacted
+}
+
+func newMemoryLog() *memoryLog {
+	return &memoryLog{messages: &queue[Message]{}}
+}
+
+func (l *memoryLog) startOffset() int64 {
+	return l.start
+}
+
+func (l *memoryLog) endOffset() int64 {
+	return l.next
+}
+
+func (l *memoryLog) append(m *Message) error {
+	m.offset = l.next
+	l.messages.Push(m)
+	l.bytes += m.Size()
+	l.next++
+	return nil
+}
+
+func (l *memoryLog) appendBatch(ms []*Message) error {
+	for _, m := range ms {
+		if err := l.append(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *memoryLog) read(offset int64) (*Message, error) {
+	// Offsets have gaps after the compaction, so the position isn't derived from the offset.
+	i := sort.Search(l.messages.Len(), func(i int) bool { return l.messages.Get(i).offset >= offset })
+	m := l.messages.Get(i)
+	if m == nil || offset < l.start {
+		return nil, pkg.ErrorOffsetOutOfRange
+	}
+
+	return m, nil
+}
+
+func (l *memoryLog) seek(ts time.Time) (int64, error) {
+	i := sort.Search(l.messages.Len(), func(i int) bool {
+		return !l.messages.Get(i).timestamp.Before(ts)
+	})
+
+	if m := l.messages.Get(i); m != nil {
+		return m.offset, nil
+	}
+
+	return l.next, nil
+}
+
+func (l *memoryLog) expired(before time.Time, bytes int64, now time.Time) (int64, error) {
+	offset, size := l.startOffset(), l.bytes
+	for i := 0; i < l.messages.Len(); i++ {
+		m := l.messages.Get(i)
+		if !m.timestamp.Before(before) && (bytes == 0 || size <= bytes) && !m.expired(now) {
+			break
+		}
+
+		size -= m.Size()
+		offset = m.offset + 1
+	}
+
+	return offset, nil
+}
+
+func (l *memoryLog) flush(int64) error {
+	return nil
+}
+
+func (l *memoryLog) truncate(offset int64) error {
+	for first := l.messages.Peek(); first != nil && first.offset < offset; first = l.messages.Peek() {
+		l.bytes -= l.messages.Pop().Size()
+	}
+
+	if offset > l.start {
+		l.start = offset
+	}
+
+	if offset > l.next {
+		l.next = offset
+	}
+
+	return nil
+}
+
+func (l *memoryLog) truncateTail(offset int64) error {
+	messages := &queue[Message]{}
+	for m := l.messages.Pop(); m != nil; m = l.messages.Pop() {
+		if m.offset >= offset {
+			l.bytes -= m.Size()
+			continue
+		}
+
+		messages.Push(m)
+	}
+
+	l.messages = messages
+	if offset < l.start {
+		l.start = offset
+	}
+
+	if offset < l.next {
+		l.next = offset
+	}
+
+	return nil
+}
+
+func (l *memoryLog) skip(offset int64, _ bool) error {
+	if offset > l.next {
+		l.next = offset
+	}
+
+	return nil
+}
+
+func (l *memoryLog) close() error {
+	return nil
+}
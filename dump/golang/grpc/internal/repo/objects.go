@@ -1,19 +1,161 @@
 package repo
 
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
 type Message struct {
 
 	// offset is the current index of the message in the partition.
 	offset int64
 
+	// key is the optional identifier of the entity, which the message is related to.
+	key []byte
+
 	// content is the raw bytes of the message.
 	content []byte
+
+	// timestamp is the time, when the message was appended to the partition.
+	// It's assigned by the storage and never decreases within the partition.
+	timestamp time.Time
+
+	// producerTimestamp is the optional time, set by the producer.
+	producerTimestamp time.Time
+
+	// headers are the user-defined metadata of the message.
+	headers map[string][]byte
+
+	// ttl is the time, for which the message lives after it's appended, zero for the endless one.
+	ttl time.Duration
+
+	// producerID is the idempotent producer of the message, zero for the others.
+	producerID int64
+
+	// producerEpoch is the epoch of the producer instance, which appended the message.
+	producerEpoch int32
+
+	// sequence is the number of the message among the ones of the producer in the partition.
+	sequence int32
+
+	// transactional is set for the messages appended within the transaction of the producer,
+	// they are not read committed until the transaction is committed.
+	transactional bool
+
+	// control is the marker, which ends the transaction of the producer in the partition,
+	// such messages are never returned to the readers.
+	control controlType
+
+	// leaderEpoch is the epoch of the partition leader, which appended the message,
+	// the replicas compare them to find, where their logs diverged.
+	leaderEpoch int32
+}
+
+// NewMessage creates a message, the offset is assigned by the storage on save.
+func NewMessage(key, content []byte) *Message {
+	return &Message{key: key, content: content}
+}
+
+func (m *Message) Offset() int64 {
+	return m.offset
+}
+
+func (m *Message) Key() []byte {
+	return m.key
+}
+
+func (m *Message) Content() []byte {
+	return m.content
+}
+
+func (m *Message) Timestamp() time.Time {
+	return m.timestamp
+}
+
+func (m *Message) ProducerTimestamp() time.Time {
+	return m.producerTimestamp
+}
+
+func (m *Message) Headers() map[string][]byte {
+	return m.headers
+}
+
+// WithHeaders sets the metadata of the message, the map is copied.
+func (m *Message) WithHeaders(headers map[string][]byte) *Message {
+	if len(headers) == 0 {
+		m.headers = nil
+		return m
+	}
+
+	m.headers = make(map[string][]byte, len(headers))
+	for k, v := range headers {
+		m.headers[k] = v
+	}
+
+	return m
+}
+
+func (m *Message) TTL() time.Duration {
+	return m.ttl
+}
+
+// Size is the size of the key, the content and the headers of the message,
+// it's counted by the log retention and the consumer byte credits.
+func (m *Message) Size() int64 {
+	size := len(m.key) + len(m.content)
+	for k, v := range m.headers {
+		size += len(k) + len(v)
+	}
+
+	return int64(size)
+}
+
+// ExpiresAt returns the time, after which the message is not delivered, or zero, when it doesn't expire.
+func (m *Message) ExpiresAt() time.Time {
+	if m.ttl <= 0 || m.timestamp.IsZero() {
+		return time.Time{}
+	}
+
+	return m.timestamp.Add(m.ttl)
+}
+
+// WithTTL sets the time to live of the message, it's kept with millisecond precision.
+// The zero one is replaced by the default of the topic on save.
+func (m *Message) WithTTL(ttl time.Duration) *Message {
+	m.ttl = ttl.Truncate(time.Millisecond)
+	return m
+}
+
+// expired reports, whether the time to live of the message passed by the time.
+func (m *Message) expired(now time.Time) bool {
+	expiresAt := m.ExpiresAt()
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// WithProducer marks the message as appended by the idempotent producer, the storage rejects
+// the sequences, which are already appended or skip the previous ones.
+func (m *Message) WithProducer(id int64, epoch, sequence int32) *Message {
+	m.producerID, m.producerEpoch, m.sequence = id, epoch, sequence
+	return m
+}
+
+// WithProducerTimestamp sets the time of the message creation on the producer side,
+// it's kept with millisecond precision.
+func (m *Message) WithProducerTimestamp(t time.Time) *Message {
+	m.producerTimestamp = time.UnixMilli(t.UnixMilli())
+	return m
 }
 
 type Partition struct {
 
-	// key is the unique identifier of the partition.
+	// mu serializes the writers and readers of the partition,
+	// so offsets are assigned strictly one after another.
+	mu sync.Mutex
+
+	// id is the index of the partition in the topic.
 	// Used for messages distribution across partitions.
-	key string
+	id int32
 
 	// topic is the name of the topic that the partition belongs to.
 	topic string
@@ -21,9 +163,81 @@ type Partition struct {
 	// offset is the first available index in the partition.
 	offset int64
 
-	// messages is the FIFO queue of messages in the partition.
-	// structured from the oldest to the newest.
-	messages Queue[Message]
+	// log keeps the messages of the partition from the oldest to the newest.
+	log partitionLog
+
+	// appended is closed and replaced every time a message is saved to the partition.
+	appended chan struct{}
+
+	// lastTimestamp is the append time of the last message in milliseconds.
+	lastTimestamp int64
+
+	// closed is set, when the log is closed with the topic.
+	closed bool
+
+	// ttl is the default time to live of the saved messages, set by the topic config.
+	ttl time.Duration
+
+	// producers is the progress of the idempotent producers in the partition.
+	producers map[int64]*producerState
+
+	// transactions are the offsets of the first messages of the open transactions by their producers.
+	transactions map[int64]int64
+
+	// aborted are the ranges of the aborted transactions, which are filtered from the committed reads.
+	aborted []abortedTransaction
+
+	// leaderEpoch is the latest leader epoch of the partition, which is either started by this broker
+	// or kept by the replicated messages. The appended messages are stamped with it.
+	leaderEpoch int32
+}
+
+// nextOffset returns the offset, which will be assigned to the next message.
+func (p *Partition) nextOffset() int64 {
+	return p.log.endOffset()
+}
+
+// nextTimestamp returns the append time of the next message. It doesn't go back
+// with the wall clock, so the messages are ordered by time the same way as by offsets.
+func (p *Partition) nextTimestamp() time.Time {
+	if now := time.Now().UnixMilli(); now > p.lastTimestamp {
+		p.lastTimestamp = now
+	}
+
+	return time.UnixMilli(p.lastTimestamp)
+}
+
+// truncate removes the messages before the offset and makes it the first available one.
+func (p *Partition) truncate(offset int64) error {
+	if err := p.log.truncate(offset); err != nil {
+		return err
+	}
+
+	p.offset = p.log.startOffset()
+	p.pruneAborted()
+	return nil
+}
+
+// truncateTail removes the messages at and after the offset, the progress of the producers
+// and the leader epoch are restored from the rest of the log.
+func (p *Partition) truncateTail(offset int64) error {
+	if offset >= p.nextOffset() {
+		return nil
+	}
+
+	if err := p.log.truncateTail(offset); err != nil {
+		return err
+	}
+
+	p.offset = p.log.startOffset()
+	p.producers, p.transactions, p.aborted, p.leaderEpoch = nil, nil, nil, 0
+	return p.loadProducers()
+}
+
+// notifyAppended wakes up all consumers waiting for the new messages.
+func (p *Partition) notifyAppended() {
+	close(p.appended)
+	p.appended = make(chan struct{})
 }
 
 type Topic struct {
@@ -36,13 +250,62 @@ type Topic struct {
 	// messages are distributed across partitions using a partition key or a round-robin algorithm.
 	//
 	// by default topic has exactly one partition, can be increased by the user.
-	partitions map[string]*Partition
+	partitions []*Partition
+
+	// config is the user-defined settings of the topic.
+	config map[string]string
+}
+
+// close closes the logs of all partitions.
+func (t *Topic) close() error {
+	var errs []error
+	for _, p := range t.partitions {
+		if p.log == nil {
+			continue
+		}
+
+		p.mu.Lock()
+		errs = append(errs, p.log.close())
+		p.closed = true
+		p.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// TopicDescription is the snapshot of the topic state, returned to the clients.
+type TopicDescription struct {
+	Name       string
+	Partitions []PartitionDescription
+	Config     map[string]string
+}
+
+// PartitionDescription is the snapshot of the partition state, returned to the clients.
+type PartitionDescription struct {
+	ID int32
+
+	// StartOffset is the offset of the oldest available message.
+	StartOffset int64
+
+	// EndOffset is the offset, which will be assigned to the next message.
+	EndOffset int64
 }
 
 type Producer struct {
 
+	// mu serializes the appends of the producer with the changes of its transaction,
+	// so a message is never appended after the transaction is ended.
+	mu sync.Mutex
+
 	// id is the unique identifier of the producer.
 	id int64
+
+	// epoch is bumped, when the producer is initialized once again, so its previous instance is fenced.
+	epoch int32
+
+	// transaction is the open transaction of the producer, it's replaced on every change,
+	// so the saved one is restored, when the change isn't saved.
+	transaction *transaction
 }
 
 type Consumer struct {
@@ -0,0 +1,281 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fadyat/grpc-broker/pkg"
+)
+
+// producerRecentBatches is the number of the last batches of a producer in a partition,
+// which retries are acknowledged with their original offsets instead of being rejected.
+const producerRecentBatches = 5
+
+// producerBatch is the range of the sequences appended at once, the first one at the offset.
+type producerBatch struct {
+	first  int32
+	last   int32
+	offset int64
+}
+
+// producerState is the progress of an idempotent producer in a partition.
+type producerState struct {
+	epoch int32
+
+	// last is the sequence of the last appended message.
+	last int32
+
+	// recent are the last appended batches from the oldest to the newest.
+	recent []producerBatch
+}
+
+// duplicate returns the offset of the recent batch, which has the sequences.
+func (s *producerState) duplicate(first, last int32) (int64, bool) {
+	for _, b := range s.recent {
+		if b.first <= first && last <= b.last {
+			return b.offset + int64(first-b.first), true
+		}
+	}
+
+	return 0, false
+}
+
+// appended moves the producer to the batch, the batch continuing the previous one
+// at the next offset is merged with it.
+func (s *producerState) appended(epoch, first, last int32, offset int64) {
+	if epoch != s.epoch {
+		s.epoch, s.recent = epoch, nil
+	}
+
+	s.last = last
+	if n := len(s.recent); n != 0 {
+		prev := &s.recent[n-1]
+		if prev.last+1 == first && prev.offset+int64(prev.last-prev.first)+1 == offset {
+			prev.last = last
+			return
+		}
+	}
+
+	s.recent = append(s.recent, producerBatch{first: first, last: last, offset: offset})
+	if len(s.recent) > producerRecentBatches {
+		s.recent = s.recent[1:]
+	}
+}
+
+// InitProducer registers a new producer, when the id is zero, or bumps the epoch of the existing one,
+// so the messages of its previous instance are rejected and its open transaction is aborted.
+// It returns the id and the epoch of the producer.
+func (s *BrokerStorage) InitProducer(id int64) (int64, int32, error) {
+	if id == 0 {
+		return s.registerProducer()
+	}
+
+	p, err := s.producer(id)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s.mu.Lock()
+	previous := p.transaction
+	if previous != nil && previous.state == transactionOngoing {
+		p.transaction = previous.withState(transactionAborting)
+	}
+
+	p.epoch++
+	if err = s.saveProducers(); err != nil {
+		p.epoch, p.transaction = p.epoch-1, previous
+		s.mu.Unlock()
+		return 0, 0, err
+	}
+
+	t, epoch := p.transaction, p.epoch
+	s.mu.Unlock()
+
+	// The transaction, which was being ended, is ended the way it was decided.
+	if t != nil {
+		if err = s.completeTransaction(p, t); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return id, epoch, nil
+}
+
+// registerProducer gives out the next id, the producer is registered, only when it's saved,
+// so its id is never given out twice.
+func (s *BrokerStorage) registerProducer() (int64, int32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := &Producer{id: 1}
+	for existing := range s.producers {
+		if existing >= p.id {
+			p.id = existing + 1
+		}
+	}
+
+	s.producers[p.id] = p
+	if err := s.saveProducers(); err != nil {
+		delete(s.producers, p.id)
+		return 0, 0, err
+	}
+
+	return p.id, p.epoch, nil
+}
+
+// saveProducers saves all registered producers, the caller holds the lock.
+func (s *BrokerStorage) saveProducers() error {
+	producers := make([]*Producer, 0, len(s.producers))
+	for _, p := range s.producers {
+		producers = append(producers, p)
+	}
+
+	return s.backend.saveProducers(producers)
+}
+
+func (s *BrokerStorage) producer(id int64) (*Producer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.producers[id]
+	if !ok {
+		return nil, pkg.ErrorUnknownProducer
+	}
+
+	return p, nil
+}
+
+// producerAppend locks the producer of the message until the returned release is called,
+// the message of the open transaction adds the partition to it beforehand. It returns
+// the current epoch of the producer and whether the message belongs to the transaction.
+func (s *BrokerStorage) producerAppend(m *Message, topic string, partition int32) (int32, bool, func(), error) {
+	p, err := s.producer(m.producerID)
+	if err != nil {
+		return 0, false, nil, err
+	}
+
+	p.mu.Lock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The messages of the other epochs are rejected by their sequences.
+	t := p.transaction
+	if t == nil || m.producerEpoch != p.epoch {
+		return p.epoch, false, p.mu.Unlock, nil
+	}
+
+	if t.state != transactionOngoing {
+		p.mu.Unlock()
+		return 0, false, nil, fmt.Errorf("%w: the transaction is %s", pkg.ErrorInvalidTransactionState, t.state)
+	}
+
+	// The partition is saved before the message is appended, so the transaction is ended in it after a restart.
+	if tp := (topicPartition{Topic: topic, Partition: partition}); !t.has(tp) {
+		p.transaction = t.withPartition(tp)
+		if err = s.saveProducers(); err != nil {
+			p.transaction = t
+			p.mu.Unlock()
+			return 0, false, nil, err
+		}
+	}
+
+	return p.epoch, true, p.mu.Unlock, nil
+}
+
+// checkSequences validates the sequences of the producer batch against its progress in the partition.
+// It returns true with the offset of the batch, when the batch is a retry of a recently appended one.
+//
+// The first batch of the producer in the partition is accepted with any sequence, because its older
+// messages could be removed by the retention before the restart, the batches of a new epoch start from zero.
+func (p *Partition) checkSequences(batch []*Message, epoch int32) (int64, bool, error) {
+	first := batch[0]
+	for i, m := range batch {
+		if m.producerID != first.producerID || m.producerEpoch != first.producerEpoch || m.sequence != first.sequence+int32(i) {
+			return 0, false, fmt.Errorf("%w: the batch sequences must be consecutive", pkg.ErrorOutOfOrderSequence)
+		}
+	}
+
+	switch {
+	case first.producerEpoch < epoch:
+		return 0, false, pkg.ErrorProducerFenced
+	case first.producerEpoch > epoch:
+		return 0, false, fmt.Errorf("%w: epoch %d is not initialized", pkg.ErrorUnknownProducer, first.producerEpoch)
+	}
+
+	state, ok := p.producers[first.producerID]
+	if !ok {
+		return 0, false, nil
+	}
+
+	if state.epoch != first.producerEpoch {
+		if first.sequence != 0 {
+			return 0, false, fmt.Errorf("%w: the new epoch starts from zero, got %d", pkg.ErrorOutOfOrderSequence, first.sequence)
+		}
+
+		return 0, false, nil
+	}
+
+	last := first.sequence + int32(len(batch)) - 1
+	if first.sequence == state.last+1 {
+		return 0, false, nil
+	}
+
+	if offset, ok := state.duplicate(first.sequence, last); ok {
+		return offset, true, nil
+	}
+
+	if first.sequence <= state.last {
+		return 0, false, fmt.Errorf("%w: %d is already appended", pkg.ErrorDuplicateSequence, first.sequence)
+	}
+
+	return 0, false, fmt.Errorf("%w: expected %d, got %d", pkg.ErrorOutOfOrderSequence, state.last+1, first.sequence)
+}
+
+// producerAppended moves the producer of the appended batch.
+func (p *Partition) producerAppended(batch []*Message) {
+	first, last := batch[0], batch[len(batch)-1]
+	if first.producerID == 0 || first.control != controlNone {
+		return
+	}
+
+	if p.producers == nil {
+		p.producers = make(map[int64]*producerState)
+	}
+
+	state, ok := p.producers[first.producerID]
+	if !ok {
+		state = &producerState{epoch: first.producerEpoch}
+		p.producers[first.producerID] = state
+	}
+
+	state.appended(first.producerEpoch, first.sequence, last.sequence, first.offset)
+}
+
+// loadProducers restores the progress of the producers and their transactions from the messages of the log,
+// the leader epoch of the partition is restored with them. The whole log is read, so it's done once on start
+// and after the tail of the log is truncated.
+func (p *Partition) loadProducers() error {
+	for offset := p.offset; offset < p.nextOffset(); {
+		m, err := p.log.read(offset)
+		if errors.Is(err, pkg.ErrorOffsetOutOfRange) {
+			// The last messages were removed by the compaction.
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		p.producerAppended([]*Message{m})
+		p.transactionAppended([]*Message{m})
+		if m.leaderEpoch > p.leaderEpoch {
+			p.leaderEpoch = m.leaderEpoch
+		}
+
+		offset = m.offset + 1
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package repo
+
+import (
+	"errors"
+	"github.com/fadyat/grpc-broker/pkg"
+	"testing"
+)
+
+func saveSequences(s *BrokerStorage, id int64, epoch int32, sequences ...int32) (int64, error) {
+	batch := make([]*Message, len(sequences))
+	for i, sequence := range sequences {
+		batch[i] = NewMessage(nil, []byte("message")).WithProducer(id, epoch, sequence)
+	}
+
+	return s.SaveBatch("topic1", 0, batch)
+}
+
+func TestBrokerStorage_SaveIdempotent(t *testing.T) {
+	testCases := []struct {
+		name           string
+		sequences      []int32
+		expectedOffset int64
+		expectedEnd    int64
+		expectedErr    error
+	}{
+		{
+			name:           "success, next sequence",
+			sequences:      []int32{3},
+			expectedOffset: 3,
+			expectedEnd:    4,
+		},
+		{
+			name:           "success, retry of the last batch",
+			sequences:      []int32{1, 2},
+			expectedOffset: 1,
+			expectedEnd:    3,
+		},
+		{
+			name:           "success, retry of the part of the batch",
+			sequences:      []int32{2},
+			expectedOffset: 2,
+			expectedEnd:    3,
+		},
+		{
+			name:        "failure, retry overlapping the next sequence",
+			sequences:   []int32{2, 3},
+			expectedEnd: 3,
+			expectedErr: pkg.ErrorDuplicateSequence,
+		},
+		{
+			name:        "failure, skipped sequence",
+			sequences:   []int32{4},
+			expectedEnd: 3,
+			expectedErr: pkg.ErrorOutOfOrderSequence,
+		},
+		{
+			name:        "failure, gap in the batch",
+			sequences:   []int32{3, 5},
+			expectedEnd: 3,
+			expectedErr: pkg.ErrorOutOfOrderSequence,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewBrokerStorage("topic1")
+			id, epoch, err := s.InitProducer(0)
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if _, err = saveSequences(s, id, epoch, 0); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if _, err = saveSequences(s, id, epoch, 1, 2); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			offset, err := saveSequences(s, id, epoch, tc.sequences...)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected %v, got %v", tc.expectedErr, err)
+			}
+
+			if tc.expectedErr == nil && offset != tc.expectedOffset {
+				t.Errorf("expected offset %d, got %d", tc.expectedOffset, offset)
+			}
+
+			// The retries and the rejected batches are not appended.
+			if _, end, _ := s.Offsets("topic1", 0); end != tc.expectedEnd {
+				t.Errorf("expected end %d, got %d", tc.expectedEnd, end)
+			}
+		})
+	}
+}
+
+func TestBrokerStorage_InitProducer(t *testing.T) {
+	s := NewBrokerStorage("topic1")
+	id, epoch, err := s.InitProducer(0)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if _, err = saveSequences(s, id, epoch, 0, 1); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if other, _, _ := s.InitProducer(0); other == id {
+		t.Errorf("expected a new id, got %d", other)
+	}
+
+	_, fenced, err := s.InitProducer(id)
+	if err != nil || fenced != epoch+1 {
+		t.Fatalf("expected epoch %d, got %d and %v", epoch+1, fenced, err)
+	}
+
+	if _, err = saveSequences(s, id, epoch, 2); !errors.Is(err, pkg.ErrorProducerFenced) {
+		t.Errorf("expected %v, got %v", pkg.ErrorProducerFenced, err)
+	}
+
+	if _, err = saveSequences(s, id, fenced, 2); !errors.Is(err, pkg.ErrorOutOfOrderSequence) {
+		t.Errorf("expected %v, got %v", pkg.ErrorOutOfOrderSequence, err)
+	}
+
+	if _, err = saveSequences(s, id, fenced, 0); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+
+	if _, _, err = s.InitProducer(id + 10); !errors.Is(err, pkg.ErrorUnknownProducer) {
+		t.Errorf("expected %v, got %v", pkg.ErrorUnknownProducer, err)
+	}
+
+	if _, err = saveSequences(s, id+10, 0, 0); !errors.Is(err, pkg.ErrorUnknownProducer) {
+		t.Errorf("expected %v, got %v", pkg.ErrorUnknownProducer, err)
+	}
+}
+
+func TestFileStorage_RestartProducers(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStorage(dir, FileOptions{}, "topic1")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	id, epoch, err := s.InitProducer(0)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if _, err = saveSequences(s, id, epoch, 0, 1); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	restarted, err := NewFileStorage(dir, FileOptions{}, "topic1")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer restarted.Close()
+
+	// The retry after the restart is still acknowledged with the original offset.
+	offset, err := saveSequences(restarted, id, epoch, 1)
+	if err != nil || offset != 1 {
+		t.Errorf("expected 1, got %d and %v", offset, err)
+	}
+
+	if _, err = saveSequences(restarted, id, epoch, 3); !errors.Is(err, pkg.ErrorOutOfOrderSequence) {
+		t.Errorf("expected %v, got %v", pkg.ErrorOutOfOrderSequence, err)
+	}
+
+	if _, fenced, e := restarted.InitProducer(id); e != nil || fenced != epoch+1 {
+		t.Errorf("expected epoch %d, got %d and %v", epoch+1, fenced, e)
+	}
+}
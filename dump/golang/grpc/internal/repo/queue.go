@@ -11,6 +11,10 @@ type Queue[T any] interface {
 	// Peek returns the first element in the queue without removing it.
 	Peek() *T
 
+	// Get returns the element at the given index without removing it.
+	// If the index is out of range, it returns nil.
+	Get(idx int) *T
+
 	// IsEmpty returns true if the queue is empty.
 	IsEmpty() bool
 
@@ -18,46 +22,127 @@ type Queue[T any] interface {
 	Len() int
 }
 
-type node struct {
-	value *Message
-	next  *node
+const (
+
+	// chunkSize is the number of the elements in one chunk of the queue.
+	chunkSize = 256
+
+	// minChunks is the smallest ring of the chunks, the ring isn't shrunk below it.
+	minChunks = 4
+)
+
+type chunk[T any] [chunkSize]*T
+
+// queue is the ring of the fixed size chunks, the popped elements are cleared and the emptied
+// chunks are released, so the queue holds only the memory of the elements in it.
+type queue[T any] struct {
+
+	// chunks is the ring, the chunks in use go one after another starting from the first.
+	chunks []*chunk[T]
+	first  int
+	used   int
+
+	// head is the index of the first element in the first chunk.
+	head int
+	size int
+
+	// spare is the last released chunk, it's reused by the next push, so the queue,
+	// which stays around the chunk boundary, doesn't allocate all the time.
+	spare *chunk[T]
 }
 
-type queue struct {
-	elements []*node
+func (q *queue[T]) Push(element *T) {
+	pos := q.head + q.size
+	if pos/chunkSize == q.used {
+		q.addChunk()
+	}
+
+	q.chunk(pos / chunkSize)[pos%chunkSize] = element
+	q.size++
+}
+
+func (q *queue[T]) addChunk() {
+	if q.used == len(q.chunks) {
+		q.resize(2 * len(q.chunks))
+	}
+
+	c := q.spare
+	if c == nil {
+		c = new(chunk[T])
+	}
+
+	q.spare = nil
+	q.chunks[(q.first+q.used)%len(q.chunks)] = c
+	q.used++
 }
 
-func (q *queue) Push(element *Message) {
-	newNode := &node{value: element}
-	if !q.IsEmpty() {
-		q.elements[len(q.elements)-1].next = newNode
+// resize moves the chunks in use to the new ring of the capacity.
+func (q *queue[T]) resize(capacity int) {
+	if capacity < minChunks {
+		capacity = minChunks
+	}
+
+	chunks := make([]*chunk[T], capacity)
+	for i := 0; i < q.used; i++ {
+		chunks[i] = q.chunk(i)
 	}
 
-	q.elements = append(q.elements, newNode)
+	q.chunks, q.first = chunks, 0
+}
+
+// chunk returns the chunk in use by its index starting from the first one.
+func (q *queue[T]) chunk(idx int) *chunk[T] {
+	return q.chunks[(q.first+idx)%len(q.chunks)]
 }
 
-func (q *queue) Pop() *Message {
+func (q *queue[T]) Pop() *T {
 	if q.IsEmpty() {
 		return nil
 	}
 
-	first := q.elements[0]
-	q.elements = q.elements[1:]
-	return first.value
+	c := q.chunks[q.first]
+	element := c[q.head]
+	c[q.head] = nil
+
+	q.head++
+	q.size--
+	if q.head == chunkSize || q.size == 0 {
+		q.releaseFirst()
+	}
+
+	return element
 }
 
-func (q *queue) Peek() *Message {
-	if q.IsEmpty() {
+// releaseFirst releases the emptied first chunk, the ring is shrunk, when it's mostly unused.
+func (q *queue[T]) releaseFirst() {
+	q.spare = q.chunks[q.first]
+	q.chunks[q.first] = nil
+	q.first = (q.first + 1) % len(q.chunks)
+	q.used--
+	q.head = 0
+
+	if len(q.chunks) > minChunks && q.used <= len(q.chunks)/4 {
+		q.resize(len(q.chunks) / 2)
+	}
+}
+
+func (q *queue[T]) Peek() *T {
+	return q.Get(0)
+}
+
+func (q *queue[T]) Get(idx int) *T {
+	if idx < 0 || idx >= q.size {
 		return nil
 	}
 
-	return q.elements[0].value
+	pos := q.head + idx
+	return q.chunk(pos / chunkSize)[pos%chunkSize]
 }
 
-func (q *queue) IsEmpty() bool {
-	return len(q.elements) == 0
+func (q *queue[T]) IsEmpty() bool {
+	return q.size == 0
 }
 
-func (q *queue) Len() int {
-	return len(q.elements)
+func (q *queue[T]) Len() int {
+	return q.size
 }
@@ -66,17 +66,6 @@ func TestQueue_PushAndPop(t *testing.T) {
 		}
 	}
 
-	checkForNextMessage := func(t *testing.T, idx int, q *queue) {
-		if idx < q.Len()-1 {
-			compareMessages(t, q.elements[idx+1].value, q.elements[idx].next.value)
-			return
-		}
-
-		if q.elements[idx].next != nil {
-			t.Errorf("expected %v, got %v", nil, q.elements[idx].next)
-		}
-	}
-
 	max := func(a, b int) int {
 		if a > b {
 			return a
@@ -87,15 +76,14 @@ func TestQueue_PushAndPop(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			q := &queue{}
+			q := &queue[Message]{}
 			for _, m := range tc.messages {
 				q.Push(m)
 			}
 
 			checkLength(t, len(tc.messages), q.Len())
 			for i, m := range tc.messages {
-				compareMessages(t, m, q.elements[i].value)
-				checkForNextMessage(t, i, q)
+				compareMessages(t, m, q.Get(i))
 			}
 
 			for i := 0; i < tc.popCount; i++ {
@@ -104,15 +92,14 @@ func TestQueue_PushAndPop(t *testing.T) {
 
 			checkLength(t, max(len(tc.messages)-tc.popCount, 0), q.Len())
 			for i := 0; i < q.Len(); i++ {
-				compareMessages(t, tc.messages[i+tc.popCount], q.elements[i].value)
-				checkForNextMessage(t, i, q)
+				compareMessages(t, tc.messages[i+tc.popCount], q.Get(i))
 			}
 		})
 	}
 }
 
 func TestQueue_Peek(t *testing.T) {
-	q := &queue{}
+	q := &queue[Message]{}
 	top := q.Peek()
 	compareMessages(t, nil, top)
 
@@ -121,3 +108,125 @@ func TestQueue_Peek(t *testing.T) {
 	top = q.Peek()
 	compareMessages(t, msg, top)
 }
+
+func TestQueue_Chunks(t *testing.T) {
+	testCases := []struct {
+		name     string
+		pushes   int
+		pops     int
+		expected int
+	}{
+		{
+			name:     "within one chunk",
+			pushes:   chunkSize,
+			pops:     chunkSize - 1,
+			expected: 1,
+		},
+		{
+			name:     "popped chunks are released",
+			pushes:   10 * chunkSize,
+			pops:     9*chunkSize + 1,
+			expected: 1,
+		},
+		{
+			name:     "all popped",
+			pushes:   3*chunkSize + 1,
+			pops:     3*chunkSize + 1,
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := &queue[int]{}
+			for i := 0; i < tc.pushes; i++ {
+				v := i
+				q.Push(&v)
+			}
+
+			for i := 0; i < tc.pops; i++ {
+				if v := q.Pop(); *v != i {
+					t.Fatalf("expected %d, got %d", i, *v)
+				}
+			}
+
+			if q.used != tc.expected {
+				t.Errorf("expected %d chunks, got %d", tc.expected, q.used)
+			}
+
+			if len(q.chunks) > minChunks && q.used <= len(q.chunks)/4 {
+				t.Errorf("expected the ring to shrink, got %d chunks for %d", len(q.chunks), q.used)
+			}
+		})
+	}
+}
+
+// FuzzQueue checks the queue against the slice, every byte of the input pushes or pops
+// the elements and the whole queue is compared after every operation.
+func FuzzQueue(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 255, 128})
+	f.Add(bytes.Repeat([]byte{1, 1, 1, 200}, 300))
+
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		q, expected, next := &queue[int]{}, []int(nil), 0
+		for _, op := range ops {
+			// The lower values push more elements, so the queue crosses the chunks.
+			if op < 192 {
+				for i := 0; i <= int(op)%8; i++ {
+					v := next
+					q.Push(&v)
+					expected = append(expected, next)
+					next++
+				}
+			} else {
+				v := q.Pop()
+				switch {
+				case len(expected) == 0 && v != nil:
+					t.Fatalf("expected nil, got %d", *v)
+				case len(expected) != 0 && (v == nil || *v != expected[0]):
+					t.Fatalf("expected %d, got %v", expected[0], v)
+				case len(expected) != 0:
+					expected = expected[1:]
+				}
+			}
+
+			if q.Len() != len(expected) || q.IsEmpty() != (len(expected) == 0) {
+				t.Fatalf("expected length %d, got %d", len(expected), q.Len())
+			}
+
+			for i, e := range expected {
+				if v := q.Get(i); v == nil || *v != e {
+					t.Fatalf("expected %d at %d, got %v", e, i, v)
+				}
+			}
+
+			if q.Get(-1) != nil || q.Get(len(expected)) != nil {
+				t.Fatalf("expected nil out of range")
+			}
+		}
+	})
+}
+
+func BenchmarkQueue_PushPop(b *testing.B) {
+	q, m := &queue[Message]{}, &Message{}
+	for i := 0; i < b.N; i++ {
+		q.Push(m)
+		if q.Len() > 1000 {
+			q.Pop()
+		}
+	}
+}
+
+func BenchmarkQueue_Get(b *testing.B) {
+	q := &queue[Message]{}
+	for i := 0; i < 100_000; i++ {
+		q.Push(&Message{offset: int64(i)})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if m := q.Get(i % q.Len()); m.offset != int64(i%q.Len()) {
+			b.Fatalf("expected %d, got %d", i%q.Len(), m.offset)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package repo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"hash/crc32"
+	"sort"
+	"time"
+)
+
+// Records are the messages, written to the files:
+//
+//	+-------------+-------------+-------------+-------------------+
+//	| length (4B) | crc32c (4B) | offset (8B) | payload (length)  |
+//	+-------------+-------------+-------------+-------------------+
+//
+// The checksum covers the offset and the payload. The payload is encoded
+// with the protobuf wire format, so the new message fields can be added
+// without breaking the records written before.
+const (
+	recordHeaderSize = 16
+
+	// maxRecordSize protects from allocating the garbage length of a torn record.
+	maxRecordSize = 64 << 20
+
+	fieldKey               protowire.Number = 1
+	fieldContent           protowire.Number = 2
+	fieldTimestamp         protowire.Number = 3
+	fieldProducerTimestamp protowire.Number = 4
+	fieldHeader            protowire.Number = 5
+	fieldTTL               protowire.Number = 6
+	fieldProducerID        protowire.Number = 7
+	fieldProducerEpoch     protowire.Number = 8
+	fieldSequence          protowire.Number = 9
+	fieldTransactional     protowire.Number = 10
+	fieldControl           protowire.Number = 11
+	fieldLeaderEpoch       protowire.Number = 12
+
+	// Headers are encoded as the map entries of the protobuf.
+	fieldHeaderKey   protowire.Number = 1
+	fieldHeaderValue protowire.Number = 2
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptedRecord = errors.New("corrupted record")
+)
+
+type recordHeader struct {
+	length uint32
+	crc    uint32
+	offset int64
+}
+
+func decodeRecordHeader(b []byte) (recordHeader, error) {
+	h := recordHeader{
+		length: binary.BigEndian.Uint32(b[0:4]),
+		crc:    binary.BigEndian.Uint32(b[4:8]),
+		offset: int64(binary.BigEndian.Uint64(b[8:16])),
+	}
+
+	if h.length > maxRecordSize {
+		return h, fmt.Errorf("%w: length %d exceeds the limit", errCorruptedRecord, h.length)
+	}
+
+	return h, nil
+}
+
+// size returns the size of the whole record on disk.
+func (h recordHeader) size() int64 {
+	return recordHeaderSize + int64(h.length)
+}
+
+func encodeRecord(m *Message) []byte {
+	payload := make([]byte, 0, len(m.key)+len(m.content)+16)
+	if len(m.key) != 0 {
+		payload = protowire.AppendTag(payload, fieldKey, protowire.BytesType)
+		payload = protowire.AppendBytes(payload, m.key)
+	}
+
+	payload = protowire.AppendTag(payload, fieldContent, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, m.content)
+	payload = appendTimestamp(payload, fieldTimestamp, m.timestamp)
+	payload = appendTimestamp(payload, fieldProducerTimestamp, m.producerTimestamp)
+	payload = appendHeaders(payload, m.headers)
+	if m.ttl > 0 {
+		payload = protowire.AppendTag(payload, fieldTTL, protowire.VarintType)
+		payload = protowire.AppendVarint(payload, uint64(m.ttl.Milliseconds()))
+	}
+
+	if m.producerID != 0 {
+		payload = protowire.AppendTag(payload, fieldProducerID, protowire.VarintType)
+		payload = protowire.AppendVarint(payload, uint64(m.producerID))
+		payload = protowire.AppendTag(payload, fieldProducerEpoch, protowire.VarintType)
+		payload = protowire.AppendVarint(payload, uint64(m.producerEpoch))
+		payload = protowire.AppendTag(payload, fieldSequence, protowire.VarintType)
+		payload = protowire.AppendVarint(payload, uint64(m.sequence))
+	}
+
+	if m.transactional {
+		payload = protowire.AppendTag(payload, fieldTransactional, protowire.VarintType)
+		payload = protowire.AppendVarint(payload, 1)
+	}
+
+	if m.control != controlNone {
+		payload = protowire.AppendTag(payload, fieldControl, protowire.VarintType)
+		payload = protowire.AppendVarint(payload, uint64(m.control))
+	}
+
+	if m.leaderEpoch != 0 {
+		payload = protowire.AppendTag(payload, fieldLeaderEpoch, protowire.VarintType)
+		payload = protowire.AppendVarint(payload, uint64(m.leaderEpoch))
+	}
+
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(record[8:16], uint64(m.offset))
+	record = append(record, payload...)
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(record[8:], crcTable))
+	return record
+}
+
+// EncodeMessage encodes the message with its offset the same way it's written to the files,
+// so the replicas get it exactly as it's kept by the leader.
+func EncodeMessage(m *Message) []byte {
+	return encodeRecord(m)
+}
+
+// DecodeMessage decodes the message encoded by EncodeMessage.
+func DecodeMessage(b []byte) (*Message, error) {
+	if len(b) < recordHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes is less than the header", errCorruptedRecord, len(b))
+	}
+
+	h, err := decodeRecordHeader(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.size() != int64(len(b)) {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d", errCorruptedRecord, h.size(), len(b))
+	}
+
+	return decodeRecord(h, b[8:])
+}
+
+// decodeRecord decodes the record body, which is the offset and the payload following the checksum.
+func decodeRecord(h recordHeader, body []byte) (*Message, error) {
+	if crc32.Checksum(body, crcTable) != h.crc {
+		return nil, fmt.Errorf("%w: checksum mismatch at offset %d", errCorruptedRecord, h.offset)
+	}
+
+	m := &Message{offset: h.offset}
+	payload := body[8:]
+	for len(payload) > 0 {
+		num, typ, n := protowire.ConsumeTag(payload)
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %v", errCorruptedRecord, protowire.ParseError(n))
+		}
+
+		payload = payload[n:]
+		switch {
+		case num == fieldKey && typ == protowire.BytesType:
+			m.key, n = protowire.ConsumeBytes(payload)
+		case num == fieldContent && typ == protowire.BytesType:
+			m.content, n = protowire.ConsumeBytes(payload)
+		case num == fieldTimestamp && typ == protowire.VarintType:
+			m.timestamp, n = consumeTimestamp(payload)
+		case num == fieldProducerTimestamp && typ == protowire.VarintType:
+			m.producerTimestamp, n = consumeTimestamp(payload)
+		case num == fieldTTL && typ == protowire.VarintType:
+			var ms uint64
+			ms, n = protowire.ConsumeVarint(payload)
+			m.ttl = time.Duration(ms) * time.Millisecond
+		case num == fieldProducerID && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(payload)
+			m.producerID = int64(v)
+		case num == fieldProducerEpoch && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(payload)
+			m.producerEpoch = int32(v)
+		case num == fieldSequence && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(payload)
+			m.sequence = int32(v)
+		case num == fieldTransactional && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(payload)
+			m.transactional = v != 0
+		case num == fieldControl && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(payload)
+			m.control = controlType(v)
+		case num == fieldLeaderEpoch && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(payload)
+			m.leaderEpoch = int32(v)
+		case num == fieldHeader && typ == protowire.BytesType:
+			var err error
+			if n, err = consumeHeader(payload, m); err != nil {
+				return nil, err
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, payload)
+		}
+
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %v", errCorruptedRecord, protowire.ParseError(n))
+		}
+
+		payload = payload[n:]
+	}
+
+	return m, nil
+}
+
+// appendTimestamp encodes the time as milliseconds since the epoch, the zero time is omitted.
+func appendTimestamp(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeZigZag(t.UnixMilli()))
+}
+
+func consumeTimestamp(b []byte) (time.Time, int) {
+	v, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return time.Time{}, n
+	}
+
+	return time.UnixMilli(protowire.DecodeZigZag(v)), n
+}
+
+// appendHeaders encodes the headers sorted by their keys, so the same message is always encoded the same way.
+func appendHeaders(b []byte, headers map[string][]byte) []byte {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = protowire.AppendTag(entry, fieldHeaderKey, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, fieldHeaderValue, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, headers[k])
+
+		b = protowire.AppendTag(b, fieldHeader, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	return b
+}
+
+// consumeHeader decodes the header entry into the message and returns the number of the consumed bytes.
+func consumeHeader(b []byte, m *Message) (int, error) {
+	entry, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+
+	var (
+		key   string
+		value []byte
+	)
+
+	for len(entry) > 0 {
+		num, typ, tn := protowire.ConsumeTag(entry)
+		if tn < 0 {
+			return 0, fmt.Errorf("%w: %v", errCorruptedRecord, protowire.ParseError(tn))
+		}
+
+		entry = entry[tn:]
+		var vn int
+		switch {
+		case num == fieldHeaderKey && typ == protowire.BytesType:
+			key, vn = protowire.ConsumeString(entry)
+		case num == fieldHeaderValue && typ == protowire.BytesType:
+			value, vn = protowire.ConsumeBytes(entry)
+		default:
+			vn = protowire.ConsumeFieldValue(num, typ, entry)
+		}
+
+		if vn < 0 {
+			return 0, fmt.Errorf("%w: %v", errCorruptedRecord, protowire.ParseError(vn))
+		}
+
+		entry = entry[vn:]
+	}
+
+	if m.headers == nil {
+		m.headers = make(map[string][]byte)
+	}
+
+	m.headers[key] = value
+	return n, nil
+}
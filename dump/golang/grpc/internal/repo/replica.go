@@ -0,0 +1,193 @@
+package repo
+
+import (
+	"errors"
+	"github.com/fadyat/grpc-broker/pkg"
+	"sort"
+)
+
+// Fetch reads the log without skipping anything, see Storage.Fetch.
+func (s *BrokerStorage) Fetch(topic string, partition int32, offset int64, max int) ([]*Message, int64, int64, error) {
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if offset < p.offset {
+		return nil, p.offset, p.offset, pkg.ErrorOffsetOutOfRange
+	}
+
+	var messages []*Message
+	for len(messages) < max && offset < p.nextOffset() {
+		m, e := p.log.read(offset)
+		if errors.Is(e, pkg.ErrorOffsetOutOfRange) {
+			break
+		}
+
+		if e != nil {
+			return nil, 0, 0, e
+		}
+
+		messages = append(messages, m)
+		offset = m.offset + 1
+	}
+
+	// The messages, which don't reach the end, are followed by the ones left for the next fetch.
+	end := p.nextOffset()
+	if len(messages) == max {
+		end = offset
+	}
+
+	return messages, p.offset, end, nil
+}
+
+// Replicate appends the messages one by one, so the gaps between them are kept.
+func (s *BrokerStorage) Replicate(topic string, partition int32, start int64, messages []*Message, end int64) error {
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	if start > p.offset {
+		if err = p.truncate(start); err != nil {
+			p.mu.Unlock()
+			return err
+		}
+	}
+
+	last := int64(-1)
+	for _, message := range messages {
+		if message.offset < p.nextOffset() {
+			continue
+		}
+
+		// The gaps of the leader are kept, so the offsets are the same on all replicas.
+		m := *message
+		if err = p.log.skip(m.offset, true); err != nil {
+			break
+		}
+
+		if err = p.log.appendBatch([]*Message{&m}); err != nil {
+			break
+		}
+
+		if ts := m.timestamp.UnixMilli(); ts > p.lastTimestamp {
+			p.lastTimestamp = ts
+		}
+
+		if m.leaderEpoch > p.leaderEpoch {
+			p.leaderEpoch = m.leaderEpoch
+		}
+
+		p.producerAppended([]*Message{&m})
+		p.transactionAppended([]*Message{&m})
+		last = m.offset
+	}
+
+	// The gap at the end of the leader log is kept without the message following it.
+	if err == nil {
+		err = p.log.skip(end, false)
+	}
+
+	if last != -1 {
+		p.notifyAppended()
+	}
+
+	p.mu.Unlock()
+
+	if err != nil || last == -1 {
+		return err
+	}
+
+	return p.log.flush(last)
+}
+
+// StartLeaderEpoch stamps the messages appended after it with the epoch, see Storage.StartLeaderEpoch.
+func (s *BrokerStorage) StartLeaderEpoch(topic string, partition int32, epoch int32) error {
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if epoch > p.leaderEpoch {
+		p.leaderEpoch = epoch
+	}
+
+	return nil
+}
+
+func (s *BrokerStorage) LastEpoch(topic string, partition int32) (int32, int64, error) {
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.leaderEpoch, p.nextOffset(), nil
+}
+
+// EpochEnd searches for the first message of the later epoch, the epochs of the messages
+// don't decrease with their offsets.
+func (s *BrokerStorage) EpochEnd(topic string, partition int32, epoch int32) (int64, error) {
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	size := int(p.nextOffset() - p.offset)
+	i := sort.Search(size, func(i int) bool {
+		m, e := p.log.read(p.offset + int64(i))
+		if e != nil {
+			if !errors.Is(e, pkg.ErrorOffsetOutOfRange) {
+				err = e
+			}
+
+			return true
+		}
+
+		return m.leaderEpoch > epoch
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if i == size {
+		return p.nextOffset(), nil
+	}
+
+	m, err := p.log.read(p.offset + int64(i))
+	if errors.Is(err, pkg.ErrorOffsetOutOfRange) {
+		return p.nextOffset(), nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return m.offset, nil
+}
+
+func (s *BrokerStorage) TruncateTail(topic string, partition int32, offset int64) error {
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.truncateTail(offset)
+}
@@ -0,0 +1,129 @@
+package repo
+
+import (
+	"errors"
+	"github.com/fadyat/grpc-broker/pkg"
+	"testing"
+)
+
+func TestBrokerStorage_Replicate(t *testing.T) {
+	for kind, newStorage := range ttlStorages {
+		t.Run(kind, func(t *testing.T) {
+			leader, follower := newStorage(t), newStorage(t)
+			defer leader.Close()
+			defer follower.Close()
+
+			for _, s := range []*BrokerStorage{leader, follower} {
+				if err := s.CreateTopic("topic1", 1, nil); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+			}
+
+			for _, content := range []string{"a", "b", "c", "d"} {
+				if _, err := leader.Save("topic1", 0, NewMessage(nil, []byte(content))); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+			}
+
+			// The first segment is removed from the leader, the follower starts after it.
+			p, err := leader.partition("topic1", 0)
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			p.mu.Lock()
+			err = p.truncate(2)
+			p.mu.Unlock()
+
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if _, _, _, err := leader.Fetch("topic1", 0, 0, 10); !errors.Is(err, pkg.ErrorOffsetOutOfRange) {
+				t.Errorf("expected %v, got %v", pkg.ErrorOffsetOutOfRange, err)
+			}
+
+			messages, start, end, err := leader.Fetch("topic1", 0, 2, 1)
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			// The fetched message doesn't reach the end of the leader log.
+			if end != 3 {
+				t.Errorf("expected 3, got %d", end)
+			}
+
+			// The fetch is applied twice, the copies are skipped.
+			for i := 0; i < 2; i++ {
+				if err = follower.Replicate("topic1", 0, start, messages, end); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+			}
+
+			first, end, err := follower.Offsets("topic1", 0)
+			if err != nil || first != 2 || end != 3 {
+				t.Errorf("expected offsets 2 and 3, got %d, %d and %v", first, end, err)
+			}
+
+			m, err := follower.Explore("topic1", 0, 2)
+			if err != nil || string(m.Content()) != "c" {
+				t.Errorf("expected c, got %v and %v", m, err)
+			}
+		})
+	}
+}
+
+func TestBrokerStorage_TruncateTail(t *testing.T) {
+	for kind, newStorage := range ttlStorages {
+		t.Run(kind, func(t *testing.T) {
+			s := newStorage(t)
+			defer s.Close()
+
+			if err := s.CreateTopic("topic1", 1, nil); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			// The first two messages are appended before the leader epoch is started.
+			for i, content := range []string{"a", "b", "c", "d", "e"} {
+				if i == 2 {
+					if err := s.StartLeaderEpoch("topic1", 0, 2); err != nil {
+						t.Fatalf("expected nil, got %v", err)
+					}
+				}
+
+				if _, err := s.Save("topic1", 0, NewMessage(nil, []byte(content))); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+			}
+
+			for epoch, expected := range map[int32]int64{0: 2, 1: 2, 2: 5, 3: 5} {
+				if end, err := s.EpochEnd("topic1", 0, epoch); err != nil || end != expected {
+					t.Errorf("expected end %d of epoch %d, got %d and %v", expected, epoch, end, err)
+				}
+			}
+
+			if epoch, end, err := s.LastEpoch("topic1", 0); err != nil || epoch != 2 || end != 5 {
+				t.Errorf("expected epoch 2 and end 5, got %d, %d and %v", epoch, end, err)
+			}
+
+			if err := s.TruncateTail("topic1", 0, 1); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			// The epoch is restored from the messages left.
+			if epoch, end, err := s.LastEpoch("topic1", 0); err != nil || epoch != 0 || end != 1 {
+				t.Errorf("expected epoch 0 and end 1, got %d, %d and %v", epoch, end, err)
+			}
+
+			offset, err := s.Save("topic1", 0, NewMessage(nil, []byte("f")))
+			if err != nil || offset != 1 {
+				t.Fatalf("expected offset 1, got %d and %v", offset, err)
+			}
+
+			m, err := s.Explore("topic1", 0, 1)
+			if err != nil || string(m.Content()) != "f" {
+				t.Errorf("expected f, got %v and %v", m, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fadyat/grpc-broker/pkg"
+	"strconv"
+	"time"
+)
+
+const (
+	// retentionMsConfig is the topic setting, after which time the messages are deleted.
+	retentionMsConfig = "retention.ms"
+
+	// retentionBytesConfig is the topic setting, which limits the size of every partition.
+	retentionBytesConfig = "retention.bytes"
+)
+
+// retention is the limits of the partition logs of a topic, the zero ones are unlimited.
+type retention struct {
+	age   time.Duration
+	bytes int64
+}
+
+// parseRetention reads the retention settings from the topic config,
+// they are positive numbers or -1 for the unlimited retention, which is the default.
+func parseRetention(config map[string]string) (retention, error) {
+	var r retention
+
+	age, err := parseLimit(config, retentionMsConfig)
+	if err != nil {
+		return r, err
+	}
+
+	r.age = time.Duration(age) * time.Millisecond
+	if r.bytes, err = parseLimit(config, retentionBytesConfig); err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+func parseLimit(config map[string]string, key string) (int64, error) {
+	raw, ok := config[key]
+	if !ok {
+		return 0, nil
+	}
+
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || v == 0 || v < -1 {
+		return 0, fmt.Errorf("%w: %s must be positive or -1, got %q", pkg.ErrorInvalidConfig, key, raw)
+	}
+
+	if v == -1 {
+		return 0, nil
+	}
+
+	return v, nil
+}
+
+// StartCleaner removes the messages exceeding the retention and compacts the topics
+// every interval, until the storage is closed.
+func (s *BrokerStorage) StartCleaner(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopCleaner, s.cleanerDone = cancel, make(chan struct{})
+
+	go func() {
+		defer close(s.cleanerDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				// The failed partitions are retried with the next tick.
+				_ = s.cleanUp(now)
+			}
+		}
+	}()
+}
+
+// cleanUp applies the retention and the compaction of every topic once.
+func (s *BrokerStorage) cleanUp(now time.Time) error {
+	s.mu.RLock()
+	topics := make([]*Topic, 0, len(s.topics))
+	for _, t := range s.topics {
+		topics = append(topics, t)
+	}
+
+	expire := s.expired
+	s.mu.RUnlock()
+
+	var errs []error
+	for _, t := range topics {
+		if err := t.cleanUp(now, expire); err != nil {
+			errs = append(errs, fmt.Errorf("topic %s: %w", t.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// cleanUp removes the messages exceeding the retention and compacts the partitions following the policy.
+// The expired messages are removed regardless of the policy, when they are at the beginning of the log.
+func (t *Topic) cleanUp(now time.Time, expire ExpiredHandler) error {
+	policy, err := parseCleanupPolicy(t.config)
+	if err != nil {
+		return err
+	}
+
+	r, err := parseRetention(t.config)
+	if err != nil {
+		return err
+	}
+
+	if !policy.delete {
+		r = retention{}
+	}
+
+	var before time.Time
+	if r.age > 0 {
+		before = now.Add(-r.age)
+	}
+
+	var errs []error
+	for _, p := range t.partitions {
+		if err = p.retain(before, r.bytes, now, expire); err != nil {
+			errs = append(errs, fmt.Errorf("partition %d: %w", p.id, err))
+		}
+
+		if policy.compact {
+			if err = p.compact(now.Add(-policy.tombstones)); err != nil {
+				errs = append(errs, fmt.Errorf("partition %d: %w", p.id, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// retain removes the messages appended before the time, exceeding the size or expired by now.
+// The expired ones are passed to the handler before, they are kept, when it fails.
+func (p *Partition) retain(before time.Time, bytes int64, now time.Time, expire ExpiredHandler) error {
+	p.mu.Lock()
+
+	// The topic is deleted in the meantime.
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+
+	start := p.offset
+	offset, err := p.log.expired(before, bytes, now)
+	p.mu.Unlock()
+
+	if err != nil || offset <= start {
+		return err
+	}
+
+	expired, err := p.expiredBefore(offset, now)
+	if err != nil {
+		return err
+	}
+
+	if len(expired) != 0 && expire != nil {
+		if err = expire(p.topic, p.id, expired); err != nil {
+			return fmt.Errorf("handle expired: %w", err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+
+	if err = p.truncate(offset); err != nil {
+		return err
+	}
+
+	expiredMessages.Add(p.topic, int64(len(expired)))
+	return nil
+}
@@ -0,0 +1,142 @@
+package repo
+
+import (
+	"errors"
+	"github.com/fadyat/grpc-broker/pkg"
+	"testing"
+	"time"
+)
+
+func TestBrokerStorage_CleanUp(t *testing.T) {
+	const count = 10
+
+	// The timestamps are in the future, so the wall clock doesn't overtake them.
+	base := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	at := func(seconds int) time.Time { return base.Add(time.Duration(seconds) * time.Second) }
+
+	testCases := []struct {
+		name          string
+		config        map[string]string
+		now           time.Time
+		expectedStart map[string]int64
+	}{
+		{
+			name:          "unlimited retention",
+			config:        map[string]string{retentionMsConfig: "-1"},
+			now:           at(100),
+			expectedStart: map[string]int64{"memory": 0, "file": 0},
+		},
+		{
+			name:          "by time",
+			config:        map[string]string{retentionMsConfig: "5000"},
+			now:           at(10),
+			expectedStart: map[string]int64{"memory": 5, "file": 4},
+		},
+		{
+			name:          "all messages expired",
+			config:        map[string]string{retentionMsConfig: "1000"},
+			now:           at(100),
+			expectedStart: map[string]int64{"memory": count, "file": count},
+		},
+		{
+			name:          "by size",
+			config:        map[string]string{retentionBytesConfig: "30"},
+			now:           at(10),
+			expectedStart: map[string]int64{"memory": 7, "file": 8},
+		},
+	}
+
+	storages := map[string]func(t *testing.T) *BrokerStorage{
+		"memory": func(t *testing.T) *BrokerStorage {
+			return NewBrokerStorage()
+		},
+		"file": func(t *testing.T) *BrokerStorage {
+			// Every segment keeps two messages.
+			s, err := NewFileStorage(t.TempDir(), FileOptions{SegmentBytes: 80})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			return s
+		},
+	}
+
+	for kind, newStorage := range storages {
+		for _, tc := range testCases {
+			t.Run(kind+", "+tc.name, func(t *testing.T) {
+				s := newStorage(t)
+				defer s.Close()
+
+				if err := s.CreateTopic("topic1", 1, tc.config); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				p := s.topics["topic1"].partitions[0]
+				for i := 0; i < count; i++ {
+					p.lastTimestamp = at(i).UnixMilli()
+					if _, err := s.Save("topic1", 0, NewMessage(nil, []byte("message-10"))); err != nil {
+						t.Fatalf("expected nil, got %v", err)
+					}
+				}
+
+				if err := s.cleanUp(tc.now); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				start, end, err := s.Offsets("topic1", 0)
+				if err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				expected := tc.expectedStart[kind]
+				if start != expected || end != count {
+					t.Errorf("expected [%d, %d), got [%d, %d)", expected, count, start, end)
+				}
+
+				if _, err = s.Explore("topic1", 0, expected-1); expected > 0 && !errors.Is(err, pkg.ErrorOffsetOutOfRange) {
+					t.Errorf("expected %v, got %v", pkg.ErrorOffsetOutOfRange, err)
+				}
+
+				if offset, e := s.Save("topic1", 0, NewMessage(nil, []byte("message-11"))); e != nil || offset != count {
+					t.Errorf("expected offset %d, got %d and %v", count, offset, e)
+				}
+			})
+		}
+	}
+}
+
+func TestBrokerStorage_CreateTopicRetention(t *testing.T) {
+	testCases := []struct {
+		name        string
+		config      map[string]string
+		expectedErr error
+	}{
+		{
+			name:   "success, limits",
+			config: map[string]string{retentionMsConfig: "60000", retentionBytesConfig: "1024"},
+		},
+		{
+			name:   "success, unlimited",
+			config: map[string]string{retentionMsConfig: "-1", retentionBytesConfig: "-1"},
+		},
+		{
+			name:        "failure, not a number",
+			config:      map[string]string{retentionMsConfig: "week"},
+			expectedErr: pkg.ErrorInvalidConfig,
+		},
+		{
+			name:        "failure, zero",
+			config:      map[string]string{retentionBytesConfig: "0"},
+			expectedErr: pkg.ErrorInvalidConfig,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewBrokerStorage()
+			if err := s.CreateTopic("topic1", 1, tc.config); !errors.Is(err, tc.expectedErr) {
+				t.Errorf("expected %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
@@ -1,19 +1,101 @@
 package repo
 
+import "time"
+
 // Storage is abstracted from partitions, all logic is handled by the broker.
 type Storage interface {
 
-	// Save saves a message to a topic and returns the offset of the message.
-	Save(topic string, message []byte) (int64, error)
+	// CreateTopic creates a topic with the given number of partitions.
+	CreateTopic(name string, partitions int, config map[string]string) error
+
+	// DeleteTopic deletes a topic with all its messages.
+	DeleteTopic(name string) error
+
+	// Topics returns the sorted names of all topics.
+	Topics() []string
+
+	// DescribeTopic returns the partitions and the config of a topic.
+	DescribeTopic(name string) (*TopicDescription, error)
+
+	// Save saves a message to a partition of a topic and returns the offset of the message.
+	// It returns, when the message is as durable as the storage promises.
+	Save(topic string, partition int32, message *Message) (int64, error)
+
+	// SaveBatch saves the messages to a partition of a topic atomically, under a single lock,
+	// and returns the offset of the first one, the rest of them follow it without the gaps.
+	SaveBatch(topic string, partition int32, messages []*Message) (int64, error)
 
-	// Get gets a message from a topic by reading from the latest offset.
-	Get(topic string) ([]byte, error)
+	// Get gets a message from a partition of a topic by reading from the latest offset.
+	// The expired messages are skipped.
+	Get(topic string, partition int32) (*Message, error)
 
-	// Explore gets a message from a topic by reading from a specific offset.
-	// If the offset is -1, it will read from the latest offset.
-	Explore(topic string, offset int64) ([]byte, error)
+	// Explore gets a message from a partition of a topic by reading from a specific offset.
+	// If the offset is -1, it will read from the latest offset. When the message was removed
+	// by the compaction or is expired, the next one is returned, so the offsets of the results may have gaps.
+	Explore(topic string, partition int32, offset int64) (*Message, error)
 
-	// ResetOffset resets the offset of a topic to the latest offset.
+	// Offsets returns the first available offset of a partition and the offset,
+	// which will be assigned to the next saved message.
+	Offsets(topic string, partition int32) (int64, int64, error)
+
+	// OffsetForTime returns the offset of the first message of a partition appended at or after the time.
+	// When there is no such message, it returns the offset, which will be assigned to the next one.
+	OffsetForTime(topic string, partition int32, ts time.Time) (int64, error)
+
+	// Notify returns a channel, which is closed when the next message is saved to a partition.
+	// Consumers subscribe before reading, so they don't miss a message saved in between.
+	Notify(topic string, partition int32) (<-chan struct{}, error)
+
+	// ResetOffset resets the offsets of all topic partitions to the latest offset.
 	// This is useful when a consumer wants to miss some incorrect messages.
 	ResetOffset(topic string) error
+
+	// InitProducer registers the idempotent producer, when the id is zero, or fences its previous instance
+	// by bumping the epoch. It returns the id and the epoch, which the producer sends with its messages.
+	InitProducer(id int64) (int64, int32, error)
+
+	// BeginTransaction opens the transaction of the producer, its next messages to any partition
+	// are not read committed, until the transaction is committed.
+	BeginTransaction(id int64, epoch int32) error
+
+	// EndTransaction commits or aborts the open transaction of the producer.
+	EndTransaction(id int64, epoch int32, commit bool) error
+
+	// ExploreCommitted is the Explore for the read committed consumers, it skips the messages of the aborted
+	// transactions and returns pkg.ErrorOffsetOutOfRange at the first message of the open one.
+	ExploreCommitted(topic string, partition int32, offset int64) (*Message, error)
+
+	// LastStableOffset returns the offset of the first message of the open transactions in a partition,
+	// or the offset, which will be assigned to the next message, when there are none.
+	LastStableOffset(topic string, partition int32) (int64, error)
+
+	// Fetch returns up to max messages of a partition starting from the offset exactly as they are kept,
+	// the expired messages and the transaction markers included, the first available offset and the offset,
+	// before which the log is covered by the messages, it's the end of the log, when they reach it.
+	// It's the reading of the followers, which copy the partition of the leader.
+	Fetch(topic string, partition int32, offset int64, max int) ([]*Message, int64, int64, error)
+
+	// Replicate appends the messages fetched from the leader with their offsets and timestamps and moves
+	// the end of the log to the end of the fetched ones. The messages before the start offset of the leader
+	// are removed, the ones already appended are skipped.
+	Replicate(topic string, partition int32, start int64, messages []*Message, end int64) error
+
+	// StartLeaderEpoch stamps the messages appended to a partition after it with the leader epoch,
+	// the replicated messages keep the epoch of their leader. The epoch never goes back.
+	StartLeaderEpoch(topic string, partition int32, epoch int32) error
+
+	// LastEpoch returns the latest leader epoch of a partition and the offset,
+	// which will be assigned to the next message.
+	LastEpoch(topic string, partition int32) (int32, int64, error)
+
+	// EpochEnd returns the offset of the first message of a partition appended by the leader of the later epoch,
+	// or the offset, which will be assigned to the next message, when there is no such message.
+	EpochEnd(topic string, partition int32, epoch int32) (int64, error)
+
+	// TruncateTail removes the messages of a partition at and after the offset, it's the tail of the follower,
+	// which diverged from the log of the leader.
+	TruncateTail(topic string, partition int32, offset int64) error
+
+	// HandleExpired sets the function, which receives the expired messages before they are removed.
+	HandleExpired(handle ExpiredHandler)
 }
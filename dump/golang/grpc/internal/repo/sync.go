@@ -0,0 +1,297 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SyncMode defines when the written messages are flushed to the disk.
+type SyncMode string
+
+const (
+	// SyncOS leaves the flushing to the operating system, the messages survive
+	// the broker crash, but not the machine one.
+	SyncOS SyncMode = "os"
+
+	// SyncAlways flushes every message before it's acknowledged.
+	// The concurrent writers wait for the same fsync, so it's done once per batch.
+	SyncAlways SyncMode = "always"
+
+	// SyncMessages flushes every N messages, the writer of the Nth message waits for it.
+	SyncMessages SyncMode = "messages"
+
+	// SyncInterval flushes in the background every T, the writers don't wait.
+	SyncInterval SyncMode = "interval"
+)
+
+// SyncPolicy is the durability level of the file storage.
+type SyncPolicy struct {
+	Mode SyncMode
+
+	// Messages is the number of messages between the flushes for SyncMessages.
+	Messages int
+
+	// Interval is the time between the flushes for SyncInterval.
+	Interval time.Duration
+}
+
+func (p SyncPolicy) validate() error {
+	switch p.Mode {
+	case SyncOS, SyncAlways:
+		return nil
+	case SyncMessages:
+		if p.Messages <= 0 {
+			return fmt.Errorf("%s sync requires positive number of messages", p.Mode)
+		}
+	case SyncInterval:
+		if p.Interval <= 0 {
+			return fmt.Errorf("%s sync requires positive interval", p.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown sync mode %q", p.Mode)
+	}
+
+	return nil
+}
+
+// syncer flushes the active segment of a log following the policy.
+//
+// Writers append under the partition lock and wait for the flush without it,
+// the first waiter does the fsync for everyone appended before it started (group commit).
+type syncer struct {
+	policy SyncPolicy
+
+	// dir is the directory of the log, it's flushed with the new segments.
+	dir string
+
+	// flushMu serializes the fsyncs, the waiters queue on it.
+	flushMu sync.Mutex
+
+	// synced is the offset, before which everything is on the disk, guarded by flushMu.
+	synced int64
+
+	// mu guards the state of the written, but not yet flushed messages.
+	mu sync.Mutex
+
+	file     *os.File
+	written  int64
+	unsynced int
+
+	// failed is the error of the background flush, it's returned to the next waiter.
+	failed error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSyncer(policy SyncPolicy, dir string, file *os.File, end int64) *syncer {
+	s := &syncer{policy: policy, dir: dir, synced: end, file: file, written: end}
+	if policy.Mode == SyncInterval {
+		s.stop, s.done = make(chan struct{}), make(chan struct{})
+		go s.flushPeriodically()
+	}
+
+	return s
+}
+
+// appended records, that the count of messages before the end offset are written to the file.
+func (s *syncer) appended(file *os.File, end int64, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.file, s.written = file, end
+	s.unsynced += count
+}
+
+// rolled is called, when the active file is replaced. The previous one and the directory
+// with the new file are flushed right away, so the next flushes cover everything written before.
+func (s *syncer) rolled(previous, file *os.File, end int64) error {
+	if s.policy.Mode != SyncOS {
+		if err := previous.Sync(); err != nil {
+			return err
+		}
+
+		if err := syncDir(s.dir); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.file, s.written = file, end
+	return nil
+}
+
+// truncated is called, when the end of the file is cut off. The truncation is flushed right away,
+// so the offsets synced before it aren't considered synced, when they are written again.
+func (s *syncer) truncated(file *os.File, end int64) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	if s.policy.Mode != SyncOS {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+
+		if err := syncDir(s.dir); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.file, s.written = file, end
+	if s.synced > end {
+		s.synced = end
+	}
+
+	return nil
+}
+
+// wait returns, when the message with the offset is as durable as the policy requires.
+func (s *syncer) wait(offset int64) error {
+	if err := s.failure(); err != nil {
+		return err
+	}
+
+	switch s.policy.Mode {
+	case SyncAlways:
+		return s.flush(offset)
+	case SyncMessages:
+		s.mu.Lock()
+		due := s.unsynced >= s.policy.Messages
+		s.mu.Unlock()
+
+		if due {
+			return s.flush(offset)
+		}
+	}
+
+	return nil
+}
+
+// flush syncs the file, unless the offset was already synced by another writer.
+// The failed background flush is reported first.
+func (s *syncer) flush(offset int64) error {
+	if err := s.failure(); err != nil {
+		return err
+	}
+
+	return s.sync(offset)
+}
+
+// sync does the fsync of the flushes, the background one included.
+func (s *syncer) sync(offset int64) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	if offset < s.synced {
+		return nil
+	}
+
+	s.mu.Lock()
+	file, written := s.file, s.written
+	s.unsynced = 0
+	s.mu.Unlock()
+
+	// The file can be closed by the truncation, its messages aren't needed anymore.
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+
+	s.synced = written
+	return nil
+}
+
+func (s *syncer) flushPeriodically() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			offset := s.written - 1
+			s.mu.Unlock()
+
+			// Nobody waits for the background flush, the error is kept
+			// for the next wait, flush or close.
+			if err := s.sync(offset); err != nil {
+				s.mu.Lock()
+				s.failed = err
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// failure returns the error of the background flush once.
+func (s *syncer) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.failed
+	s.failed = nil
+	return err
+}
+
+// close stops the background flushes and flushes the rest of the messages.
+func (s *syncer) close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+	}
+
+	if s.policy.Mode == SyncOS {
+		return nil
+	}
+
+	s.mu.Lock()
+	offset := s.written - 1
+	s.mu.Unlock()
+
+	return s.flush(offset)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(d.Sync(), d.Close())
+}
+
+// replaceFile writes the file atomically and durably: the temporary file is flushed
+// before it replaces the previous one, then the directory is flushed with the rename.
+func replaceFile(path string, raw []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(raw); err == nil {
+		err = f.Sync()
+	}
+
+	if err = errors.Join(err, f.Close()); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
@@ -0,0 +1,143 @@
+package repo
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileStorage_Sync(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy SyncPolicy
+		count  int
+		synced int64
+		err    bool
+	}{
+		{
+			name:   "success, os",
+			policy: SyncPolicy{Mode: SyncOS},
+			count:  3,
+			synced: 0,
+		},
+		{
+			name:   "success, always",
+			policy: SyncPolicy{Mode: SyncAlways},
+			count:  3,
+			synced: 3,
+		},
+		{
+			name:   "success, every 2 messages",
+			policy: SyncPolicy{Mode: SyncMessages, Messages: 2},
+			count:  3,
+			synced: 2,
+		},
+		{
+			name:   "success, interval",
+			policy: SyncPolicy{Mode: SyncInterval, Interval: time.Hour},
+			count:  3,
+			synced: 0,
+		},
+		{
+			name:   "messages without count",
+			policy: SyncPolicy{Mode: SyncMessages},
+			err:    true,
+		},
+		{
+			name:   "unknown mode",
+			policy: SyncPolicy{Mode: "sometimes"},
+			err:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := NewFileStorage(t.TempDir(), FileOptions{Sync: tc.policy}, "topic1")
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+			defer s.Close()
+
+			for i := 0; i < tc.count; i++ {
+				if _, err = s.Save("topic1", 0, NewMessage(nil, []byte("a"))); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+			}
+
+			sy := s.topics["topic1"].partitions[0].log.(*fileLog).syncer
+			if sy.synced != tc.synced {
+				t.Errorf("expected messages before %d to be synced, got %d", tc.synced, sy.synced)
+			}
+		})
+	}
+}
+
+func TestSyncer_IntervalFailure(t *testing.T) {
+	// The pipe can't be synced, so every background flush fails.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	s := newSyncer(SyncPolicy{Mode: SyncInterval, Interval: time.Millisecond}, t.TempDir(), w, 0)
+	s.appended(w, 1, 1)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if err = s.wait(0); err != nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the background flush error, got nil")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if err = s.close(); err == nil {
+		t.Errorf("expected the close to flush and fail, got nil")
+	}
+}
+
+func BenchmarkFileStorage_Save(b *testing.B) {
+	policies := []SyncPolicy{
+		{Mode: SyncOS},
+		{Mode: SyncAlways},
+		{Mode: SyncMessages, Messages: 100},
+		{Mode: SyncInterval, Interval: 10 * time.Millisecond},
+	}
+
+	content := make([]byte, 128)
+	for _, policy := range policies {
+		b.Run(string(policy.Mode), func(b *testing.B) {
+			s, err := NewFileStorage(b.TempDir(), FileOptions{Sync: policy}, "topic1")
+			if err != nil {
+				b.Fatalf("expected nil, got %v", err)
+			}
+			defer s.Close()
+
+			// Parallel writers show the group commit, they share the flushes of SyncAlways.
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := s.Save("topic1", 0, NewMessage(nil, content)); err != nil {
+						b.Errorf("expected nil, got %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fadyat/grpc-broker/pkg"
+	"time"
+)
+
+// controlType is the kind of the transaction marker.
+type controlType int8
+
+const (
+	controlNone controlType = iota
+	controlCommit
+	controlAbort
+)
+
+// transactionState is the stage of the producer transaction, the ending ones are saved
+// before the markers are appended, so the transaction is ended the same way after a restart.
+type transactionState string
+
+const (
+	transactionOngoing    transactionState = "ongoing"
+	transactionCommitting transactionState = "committing"
+	transactionAborting   transactionState = "aborting"
+)
+
+// topicPartition is the partition, which the transaction appended to.
+type topicPartition struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+}
+
+// transaction is the open transaction of the producer, it's never changed after it's created.
+type transaction struct {
+	state      transactionState
+	partitions []topicPartition
+}
+
+func (t *transaction) has(tp topicPartition) bool {
+	for _, existing := range t.partitions {
+		if existing == tp {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *transaction) withState(state transactionState) *transaction {
+	return &transaction{state: state, partitions: t.partitions}
+}
+
+func (t *transaction) withPartition(tp topicPartition) *transaction {
+	partitions := make([]topicPartition, len(t.partitions), len(t.partitions)+1)
+	copy(partitions, t.partitions)
+	return &transaction{state: t.state, partitions: append(partitions, tp)}
+}
+
+// abortedTransaction is the range of the offsets, where the messages of the producer are aborted.
+type abortedTransaction struct {
+	producerID int64
+	first      int64
+	last       int64
+}
+
+// BeginTransaction opens the transaction of the producer, its messages are not read committed,
+// until the transaction is committed.
+func (s *BrokerStorage) BeginTransaction(id int64, epoch int32) error {
+	p, err := s.producer(id)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = checkEpoch(p, epoch); err != nil {
+		return err
+	}
+
+	if p.transaction != nil {
+		return fmt.Errorf("%w: the transaction is %s", pkg.ErrorInvalidTransactionState, p.transaction.state)
+	}
+
+	p.transaction = &transaction{state: transactionOngoing}
+	if err = s.saveProducers(); err != nil {
+		p.transaction = nil
+		return err
+	}
+
+	return nil
+}
+
+// EndTransaction commits or aborts the open transaction of the producer. When the markers are not appended
+// to all partitions, the transaction can be ended once again the same way, the rest of them are appended then.
+func (s *BrokerStorage) EndTransaction(id int64, epoch int32, commit bool) error {
+	p, err := s.producer(id)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := transactionAborting
+	if commit {
+		state = transactionCommitting
+	}
+
+	s.mu.Lock()
+	if err = checkEpoch(p, epoch); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	previous := p.transaction
+	switch {
+	case previous == nil:
+		s.mu.Unlock()
+		return fmt.Errorf("%w: no transaction is open", pkg.ErrorInvalidTransactionState)
+	case previous.state != transactionOngoing && previous.state != state:
+		s.mu.Unlock()
+		return fmt.Errorf("%w: the transaction is %s", pkg.ErrorInvalidTransactionState, previous.state)
+	}
+
+	p.transaction = previous.withState(state)
+	if err = s.saveProducers(); err != nil {
+		p.transaction = previous
+		s.mu.Unlock()
+		return err
+	}
+
+	t := p.transaction
+	s.mu.Unlock()
+
+	return s.completeTransaction(p, t)
+}
+
+// checkEpoch rejects the transaction changes of the fenced and the unknown producer instances.
+func checkEpoch(p *Producer, epoch int32) error {
+	switch {
+	case epoch < p.epoch:
+		return pkg.ErrorProducerFenced
+	case epoch > p.epoch:
+		return fmt.Errorf("%w: epoch %d is not initialized", pkg.ErrorUnknownProducer, epoch)
+	}
+
+	return nil
+}
+
+// completeTransaction appends the markers of the ending transaction to its partitions and forgets it.
+// The caller holds the lock of the producer.
+func (s *BrokerStorage) completeTransaction(p *Producer, t *transaction) error {
+	control := controlAbort
+	if t.state == transactionCommitting {
+		control = controlCommit
+	}
+
+	for _, tp := range t.partitions {
+		part, err := s.partition(tp.Topic, tp.Partition)
+		if errors.Is(err, pkg.ErrorTopicNotFound) || errors.Is(err, pkg.ErrorPartitionNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err = part.appendControl(p.id, p.epoch, control); err != nil {
+			return fmt.Errorf("failed to end the transaction in %s/%d: %w", tp.Topic, tp.Partition, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p.transaction = nil
+	if err := s.saveProducers(); err != nil {
+		p.transaction = t
+		return err
+	}
+
+	return nil
+}
+
+// completeTransactions ends the transactions, which were being ended before the restart.
+func (s *BrokerStorage) completeTransactions() error {
+	for _, p := range s.producers {
+		if p.transaction == nil || p.transaction.state == transactionOngoing {
+			continue
+		}
+
+		p.mu.Lock()
+		err := s.completeTransaction(p, p.transaction)
+		p.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// appendControl appends the marker, which ends the transaction of the producer in the partition.
+// Nothing is appended, when the transaction has no messages in the partition or it's already ended there.
+func (p *Partition) appendControl(producerID int64, epoch int32, control controlType) error {
+	p.mu.Lock()
+	if _, ok := p.transactions[producerID]; !ok {
+		p.mu.Unlock()
+		return nil
+	}
+
+	m := &Message{
+		producerID:    producerID,
+		producerEpoch: epoch,
+		control:       control,
+		timestamp:     p.nextTimestamp(),
+		ttl:           p.ttl,
+		leaderEpoch:   p.leaderEpoch,
+	}
+
+	if err := p.log.appendBatch([]*Message{m}); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+
+	p.transactionAppended([]*Message{m})
+	p.notifyAppended()
+	p.mu.Unlock()
+
+	return p.log.flush(m.offset)
+}
+
+// transactionAppended opens the transactions of the appended messages and ends them by the markers.
+func (p *Partition) transactionAppended(batch []*Message) {
+	for _, m := range batch {
+		switch {
+		case m.transactional:
+			if p.transactions == nil {
+				p.transactions = make(map[int64]int64)
+			}
+
+			if _, ok := p.transactions[m.producerID]; !ok {
+				p.transactions[m.producerID] = m.offset
+			}
+		case m.control != controlNone:
+			first, ok := p.transactions[m.producerID]
+			delete(p.transactions, m.producerID)
+			if ok && m.control == controlAbort {
+				p.aborted = append(p.aborted, abortedTransaction{producerID: m.producerID, first: first, last: m.offset})
+			}
+		}
+	}
+}
+
+// lastStable returns the offset, before which all transactions are ended,
+// the committed reads don't go further.
+func (p *Partition) lastStable() int64 {
+	stable := p.nextOffset()
+	for _, first := range p.transactions {
+		if first < stable {
+			stable = first
+		}
+	}
+
+	return stable
+}
+
+// isAborted reports, whether the message belongs to the aborted transaction.
+func (p *Partition) isAborted(m *Message) bool {
+	if !m.transactional {
+		return false
+	}
+
+	for _, a := range p.aborted {
+		if a.producerID == m.producerID && a.first <= m.offset && m.offset <= a.last {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pruneAborted forgets the aborted transactions, which messages are removed.
+func (p *Partition) pruneAborted() {
+	i := 0
+	for _, a := range p.aborted {
+		if a.last >= p.offset {
+			p.aborted[i] = a
+			i++
+		}
+	}
+
+	p.aborted = p.aborted[:i]
+}
+
+// readCommitted returns the first message at or after the offset, which is before the last stable offset
+// and doesn't belong to the aborted transaction.
+func (p *Partition) readCommitted(offset int64, now time.Time) (*Message, error) {
+	stable := p.lastStable()
+	for offset < stable {
+		m, err := p.read(offset, now)
+		if err != nil {
+			return nil, err
+		}
+
+		if m.offset >= stable {
+			break
+		}
+
+		if !p.isAborted(m) {
+			return m, nil
+		}
+
+		offset = m.offset + 1
+	}
+
+	return nil, pkg.ErrorOffsetOutOfRange
+}
+
+func (s *BrokerStorage) ExploreCommitted(topic string, partition int32, offset int64) (*Message, error) {
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if offset < p.offset {
+		return nil, pkg.ErrorOffsetOutOfRange
+	}
+
+	return p.readCommitted(offset, time.Now())
+}
+
+func (s *BrokerStorage) LastStableOffset(topic string, partition int32) (int64, error) {
+	p, err := s.partition(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.lastStable(), nil
+}
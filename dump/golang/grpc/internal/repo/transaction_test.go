@@ -0,0 +1,217 @@
+package repo
+
+import (
+	"errors"
+	"github.com/fadyat/grpc-broker/pkg"
+	"reflect"
+	"testing"
+)
+
+// committed returns the contents of the read committed messages of the partition.
+func committed(t *testing.T, s *BrokerStorage, topic string) []string {
+	var contents []string
+	for offset := int64(0); ; {
+		m, err := s.ExploreCommitted(topic, 0, offset)
+		if errors.Is(err, pkg.ErrorOffsetOutOfRange) {
+			return contents
+		}
+
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+
+		contents = append(contents, string(m.Content()))
+		offset = m.offset + 1
+	}
+}
+
+func saveProduced(t *testing.T, s *BrokerStorage, topic string, id int64, epoch, sequence int32, content string) {
+	m := NewMessage(nil, []byte(content)).WithProducer(id, epoch, sequence)
+	if _, err := s.Save(topic, 0, m); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+}
+
+func TestBrokerStorage_Transaction(t *testing.T) {
+	testCases := []struct {
+		name     string
+		commit   bool
+		expected []string
+	}{
+		{
+			name:     "commit",
+			commit:   true,
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			name:     "abort",
+			expected: []string{"a", "c"},
+		},
+	}
+
+	for kind, newStorage := range ttlStorages {
+		for _, tc := range testCases {
+			t.Run(kind+", "+tc.name, func(t *testing.T) {
+				s := newStorage(t)
+				defer s.Close()
+
+				for _, topic := range []string{"topic1", "topic2"} {
+					if err := s.CreateTopic(topic, 1, nil); err != nil {
+						t.Fatalf("expected nil, got %v", err)
+					}
+				}
+
+				id, epoch, err := s.InitProducer(0)
+				if err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				if _, err = s.Save("topic1", 0, NewMessage(nil, []byte("a"))); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				if err = s.BeginTransaction(id, epoch); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				saveProduced(t, s, "topic1", id, epoch, 0, "b")
+				saveProduced(t, s, "topic2", id, epoch, 0, "b")
+				if _, err = s.Save("topic1", 0, NewMessage(nil, []byte("c"))); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				// The message after the open transaction waits for it.
+				if got := committed(t, s, "topic1"); !reflect.DeepEqual(got, []string{"a"}) {
+					t.Errorf("expected [a], got %v", got)
+				}
+
+				if stable, _ := s.LastStableOffset("topic1", 0); stable != 1 {
+					t.Errorf("expected stable offset 1, got %d", stable)
+				}
+
+				if err = s.EndTransaction(id, epoch, tc.commit); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				if got := committed(t, s, "topic1"); !reflect.DeepEqual(got, tc.expected) {
+					t.Errorf("expected %v, got %v", tc.expected, got)
+				}
+
+				// The markers are not read, the uncommitted reads see the aborted messages.
+				m, err := s.Explore("topic1", 0, 3)
+				if !errors.Is(err, pkg.ErrorOffsetOutOfRange) {
+					t.Errorf("expected %v, got %v and %v", pkg.ErrorOffsetOutOfRange, m, err)
+				}
+
+				if m, err = s.Explore("topic2", 0, 0); err != nil || string(m.Content()) != "b" {
+					t.Errorf("expected b, got %v and %v", m, err)
+				}
+			})
+		}
+	}
+}
+
+func TestBrokerStorage_TransactionState(t *testing.T) {
+	s := NewBrokerStorage("topic1")
+	id, epoch, err := s.InitProducer(0)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if err = s.EndTransaction(id, epoch, true); !errors.Is(err, pkg.ErrorInvalidTransactionState) {
+		t.Errorf("expected %v, got %v", pkg.ErrorInvalidTransactionState, err)
+	}
+
+	if err = s.BeginTransaction(id, epoch); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if err = s.BeginTransaction(id, epoch); !errors.Is(err, pkg.ErrorInvalidTransactionState) {
+		t.Errorf("expected %v, got %v", pkg.ErrorInvalidTransactionState, err)
+	}
+
+	saveProduced(t, s, "topic1", id, epoch, 0, "a")
+
+	// The new instance of the producer aborts the transaction of the previous one.
+	_, fenced, err := s.InitProducer(id)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if err = s.EndTransaction(id, epoch, true); !errors.Is(err, pkg.ErrorProducerFenced) {
+		t.Errorf("expected %v, got %v", pkg.ErrorProducerFenced, err)
+	}
+
+	if got := committed(t, s, "topic1"); len(got) != 0 {
+		t.Errorf("expected no messages, got %v", got)
+	}
+
+	if err = s.BeginTransaction(id, fenced); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
+
+func TestFileStorage_RestartTransactions(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStorage(dir, FileOptions{}, "topic1", "topic2")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	committing, epoch, err := s.InitProducer(0)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	ongoing, _, err := s.InitProducer(0)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	for _, id := range []int64{committing, ongoing} {
+		if err = s.BeginTransaction(id, epoch); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+
+	saveProduced(t, s, "topic1", committing, epoch, 0, "a")
+	saveProduced(t, s, "topic2", ongoing, epoch, 0, "b")
+
+	// The broker stops after the commit is decided, but before the markers are appended.
+	s.mu.Lock()
+	p := s.producers[committing]
+	p.transaction = p.transaction.withState(transactionCommitting)
+	err = s.saveProducers()
+	s.mu.Unlock()
+
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	restarted, err := NewFileStorage(dir, FileOptions{}, "topic1", "topic2")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer restarted.Close()
+
+	if got := committed(t, restarted, "topic1"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("expected [a], got %v", got)
+	}
+
+	if got := committed(t, restarted, "topic2"); len(got) != 0 {
+		t.Errorf("expected no messages, got %v", got)
+	}
+
+	// The open transaction survives the restart and is committed by its producer.
+	if err = restarted.EndTransaction(ongoing, epoch, true); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if got := committed(t, restarted, "topic2"); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("expected [b], got %v", got)
+	}
+}
@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"errors"
+	"expvar"
+	"github.com/fadyat/grpc-broker/pkg"
+	"time"
+)
+
+// messageTTLMsConfig is the topic setting, for which time the messages without their own time to live
+// are delivered after they are appended.
+const messageTTLMsConfig = "message.ttl.ms"
+
+// expiredMessages counts the expired messages removed by the cleaner per topic,
+// it's published with the rest of the expvar metrics.
+var expiredMessages = expvar.NewMap("broker.expired_messages")
+
+// ExpiredHandler is called by the cleaner with the expired messages of a partition, which are about
+// to be removed. The messages are kept until the next cleanup, when it fails.
+type ExpiredHandler func(topic string, partition int32, messages []*Message) error
+
+// parseTTL reads the default time to live of the topic messages, it's a positive number
+// of milliseconds or -1 for the endless messages, which is the default.
+func parseTTL(config map[string]string) (time.Duration, error) {
+	ms, err := parseLimit(config, messageTTLMsConfig)
+	return time.Duration(ms) * time.Millisecond, err
+}
+
+// HandleExpired sets the handler of the expired messages, without it they are just dropped.
+func (s *BrokerStorage) HandleExpired(handle ExpiredHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expired = handle
+}
+
+// read returns the first message at or after the offset, which is not expired by the time.
+// The expired messages are skipped, until the cleaner removes them, the transaction markers are always skipped.
+func (p *Partition) read(offset int64, now time.Time) (*Message, error) {
+	for offset < p.nextOffset() {
+		m, err := p.log.read(offset)
+		if err != nil || (!m.expired(now) && m.control == controlNone) {
+			return m, err
+		}
+
+		offset = m.offset + 1
+	}
+
+	return nil, pkg.ErrorOffsetOutOfRange
+}
+
+// expiredBefore returns the expired messages of the partition before the offset.
+// The partition is locked for every message only, so the writers aren't blocked for the whole scan.
+func (p *Partition) expiredBefore(offset int64, now time.Time) ([]*Message, error) {
+	var expired []*Message
+	for next := int64(-1); ; {
+		p.mu.Lock()
+		if next < p.offset {
+			next = p.offset
+		}
+
+		if p.closed || next >= offset {
+			p.mu.Unlock()
+			return expired, nil
+		}
+
+		m, err := p.log.read(next)
+		p.mu.Unlock()
+
+		if errors.Is(err, pkg.ErrorOffsetOutOfRange) {
+			return expired, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if m.offset < offset && m.expired(now) && m.control == controlNone {
+			expired = append(expired, m)
+		}
+
+		next = m.offset + 1
+	}
+}
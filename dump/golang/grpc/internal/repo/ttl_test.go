@@ -0,0 +1,193 @@
+package repo
+
+import (
+	"errors"
+	"expvar"
+	"github.com/fadyat/grpc-broker/pkg"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// ttlStorages are the storages of the expiration tests, every file segment keeps two messages.
+var ttlStorages = map[string]func(t *testing.T) *BrokerStorage{
+	"memory": func(t *testing.T) *BrokerStorage {
+		return NewBrokerStorage()
+	},
+	"file": func(t *testing.T) *BrokerStorage {
+		s, err := NewFileStorage(t.TempDir(), FileOptions{SegmentBytes: 80})
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+
+		return s
+	},
+}
+
+func saveWithTTL(t *testing.T, s *BrokerStorage, ttls []time.Duration) {
+	for _, ttl := range ttls {
+		if _, err := s.Save("topic1", 0, NewMessage(nil, []byte("message")).WithTTL(ttl)); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+}
+
+func TestBrokerStorage_ExploreExpired(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   map[string]string
+		ttls     []time.Duration
+		expected []int64
+	}{
+		{
+			name:     "message ttl",
+			ttls:     []time.Duration{time.Millisecond, 0, time.Millisecond, time.Millisecond, time.Hour},
+			expected: []int64{1, 4},
+		},
+		{
+			name:     "topic ttl",
+			config:   map[string]string{messageTTLMsConfig: "1"},
+			ttls:     []time.Duration{0, time.Hour, 0},
+			expected: []int64{1},
+		},
+		{
+			name:     "all messages expired",
+			ttls:     []time.Duration{time.Millisecond, time.Millisecond},
+			expected: nil,
+		},
+	}
+
+	for kind, newStorage := range ttlStorages {
+		for _, tc := range testCases {
+			t.Run(kind+", "+tc.name, func(t *testing.T) {
+				s := newStorage(t)
+				defer s.Close()
+
+				if err := s.CreateTopic("topic1", 1, tc.config); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				saveWithTTL(t, s, tc.ttls)
+				time.Sleep(5 * time.Millisecond)
+
+				var offsets []int64
+				for offset := int64(0); ; {
+					m, err := s.Explore("topic1", 0, offset)
+					if errors.Is(err, pkg.ErrorOffsetOutOfRange) {
+						break
+					}
+
+					if err != nil {
+						t.Fatalf("expected nil, got %v", err)
+					}
+
+					offsets = append(offsets, m.Offset())
+					offset = m.Offset() + 1
+				}
+
+				if !reflect.DeepEqual(offsets, tc.expected) {
+					t.Errorf("expected %v, got %v", tc.expected, offsets)
+				}
+
+				m, err := s.Get("topic1", 0)
+				if len(tc.expected) != 0 && (err != nil || m.Offset() != tc.expected[0]) {
+					t.Errorf("expected the offset %d, got %v and %v", tc.expected[0], m, err)
+				}
+			})
+		}
+	}
+}
+
+func TestBrokerStorage_CleanUpExpired(t *testing.T) {
+	errHandler := errors.New("handler failed")
+
+	testCases := []struct {
+		name          string
+		config        map[string]string
+		ttls          []time.Duration
+		handlerErr    error
+		expectedStart int64
+		expired       []int64
+	}{
+		{
+			name:          "expired prefix",
+			ttls:          []time.Duration{time.Second, time.Second, 0, time.Second},
+			expectedStart: 2,
+			expired:       []int64{0, 1},
+		},
+		{
+			name:          "compacted topic",
+			config:        map[string]string{cleanupPolicyConfig: cleanupCompact},
+			ttls:          []time.Duration{time.Second, time.Second, time.Hour * 2, time.Second},
+			expectedStart: 2,
+			expired:       []int64{0, 1},
+		},
+		{
+			name:          "retention before the expiration",
+			config:        map[string]string{retentionMsConfig: "1000"},
+			ttls:          []time.Duration{0, time.Second, time.Hour * 2, time.Hour * 2},
+			expectedStart: 4,
+			expired:       []int64{1},
+		},
+		{
+			name:          "handler failed",
+			ttls:          []time.Duration{time.Second, time.Second, 0},
+			handlerErr:    errHandler,
+			expectedStart: 0,
+			expired:       []int64{0, 1},
+		},
+	}
+
+	for kind, newStorage := range ttlStorages {
+		for _, tc := range testCases {
+			t.Run(kind+", "+tc.name, func(t *testing.T) {
+				s := newStorage(t)
+				defer s.Close()
+
+				if err := s.CreateTopic("topic1", 1, tc.config); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				var expired []int64
+				s.HandleExpired(func(topic string, partition int32, messages []*Message) error {
+					for _, m := range messages {
+						expired = append(expired, m.Offset())
+					}
+
+					return tc.handlerErr
+				})
+
+				saveWithTTL(t, s, tc.ttls)
+				counted := expiredCount("topic1")
+				if err := s.cleanUp(time.Now().Add(time.Hour)); !errors.Is(err, tc.handlerErr) {
+					t.Fatalf("expected %v, got %v", tc.handlerErr, err)
+				}
+
+				if !reflect.DeepEqual(expired, tc.expired) {
+					t.Errorf("expected the expired %v, got %v", tc.expired, expired)
+				}
+
+				if start, _, _ := s.Offsets("topic1", 0); start != tc.expectedStart {
+					t.Errorf("expected the start %d, got %d", tc.expectedStart, start)
+				}
+
+				expectedCount := int64(len(tc.expired))
+				if tc.handlerErr != nil {
+					expectedCount = 0
+				}
+
+				if c := expiredCount("topic1") - counted; c != expectedCount {
+					t.Errorf("expected %d counted, got %d", expectedCount, c)
+				}
+			})
+		}
+	}
+}
+
+func expiredCount(topic string) int64 {
+	if v, ok := expiredMessages.Get(topic).(*expvar.Int); ok {
+		return v.Value()
+	}
+
+	return 0
+}
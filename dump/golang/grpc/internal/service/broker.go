@@ -2,8 +2,13 @@ package service
 
 import (
 	"context"
+	"errors"
 	"github.com/fadyat/grpc-broker/api/pb"
 	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Broker interface {
@@ -11,22 +16,387 @@ type Broker interface {
 	// Publish publishes a message to a topic.
 	Publish(ctx context.Context, in *pb.PublishRequest) (*pb.PublishResponse, error)
 
-	// Subscribe subscribes to a topic.
-	Subscribe(ctx context.Context, stream pb.Broker_SubscribeServer) error
+	// PublishBatch publishes the messages atomically to one partition of a topic.
+	PublishBatch(ctx context.Context, in *pb.PublishBatchRequest) (*pb.PublishBatchResponse, error)
+
+	// PublishStream publishes the streamed messages and acknowledges them in order, when the client is done.
+	PublishStream(stream pb.Broker_PublishStreamServer) error
+
+	// Subscribe subscribes to a topic and streams the messages until the client goes away.
+	Subscribe(in *pb.SubscribeRequest, stream pb.Broker_SubscribeServer) error
+
+	// Consume delivers the messages to the consumers of a group, until they are acked,
+	// the nacked and the expired messages are delivered again.
+	Consume(stream pb.Broker_ConsumeServer) error
+
+	// InitProducer registers the idempotent producer or fences the previous instance of the existing one.
+	InitProducer(ctx context.Context, in *pb.InitProducerRequest) (*pb.InitProducerResponse, error)
+
+	// BeginTransaction opens the transaction of the producer, its messages to any topic are committed together.
+	BeginTransaction(ctx context.Context, in *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error)
+
+	// Commit makes the messages of the producer transaction visible to the read committed subscribers.
+	Commit(ctx context.Context, in *pb.CommitTransactionRequest) (*pb.CommitTransactionResponse, error)
+
+	// Abort drops the messages of the producer transaction for the read committed subscribers.
+	Abort(ctx context.Context, in *pb.AbortTransactionRequest) (*pb.AbortTransactionResponse, error)
+
+	// Redrive moves the dead-lettered messages back to their source topics.
+	Redrive(ctx context.Context, in *pb.RedriveRequest) (*pb.RedriveResponse, error)
+
+	// CreateTopic creates a topic and returns its description.
+	CreateTopic(ctx context.Context, in *pb.CreateTopicRequest) (*pb.TopicDescription, error)
+
+	// DeleteTopic deletes a topic with all its messages.
+	DeleteTopic(ctx context.Context, in *pb.DeleteTopicRequest) (*pb.DeleteTopicResponse, error)
+
+	// ListTopics returns the names of all topics.
+	ListTopics(ctx context.Context, in *pb.ListTopicsRequest) (*pb.ListTopicsResponse, error)
+
+	// DescribeTopic returns the partitions and the config of a topic.
+	DescribeTopic(ctx context.Context, in *pb.DescribeTopicRequest) (*pb.TopicDescription, error)
+
+	// CommitOffset records the progress of a consumer group in a partition.
+	CommitOffset(ctx context.Context, in *pb.CommitOffsetRequest) (*pb.CommitOffsetResponse, error)
+
+	// FetchCommittedOffset returns the last committed offset of a consumer group in a partition.
+	FetchCommittedOffset(ctx context.Context, in *pb.FetchCommittedOffsetRequest) (*pb.FetchCommittedOffsetResponse, error)
+
+	// OffsetsForTimes returns the offsets of the first messages appended at or after the timestamp.
+	OffsetsForTimes(ctx context.Context, in *pb.OffsetsForTimesRequest) (*pb.OffsetsForTimesResponse, error)
+
+	// Metadata returns the brokers of the cluster and the leaders of the partitions.
+	Metadata(ctx context.Context, in *pb.MetadataRequest) (*pb.MetadataResponse, error)
+
+	// Close stops the background work of the broker, the queued publishes and commits are saved first.
+	// The storage is left open, it's closed by its owner after the broker.
+	Close() error
+}
+
+// Peer is the part of the broker, which is called by the other brokers of the cluster only.
+type Peer interface {
+
+	// RequestVote asks the broker to vote for the candidate of the metadata quorum.
+	RequestVote(ctx context.Context, in *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error)
+
+	// AppendEntries appends the metadata changes of the controller to the log of the broker.
+	AppendEntries(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error)
+
+	// Fetch returns the messages of the partition led by the broker to its follower.
+	Fetch(ctx context.Context, in *pb.FetchRequest) (*pb.FetchResponse, error)
+
+	// AlterIsr changes the in-sync replicas of the partition proposed by its leader, it's called on the controller.
+	AlterIsr(ctx context.Context, in *pb.AlterIsrRequest) (*pb.AlterIsrResponse, error)
+
+	// Schedule saves the delayed message received by the leader of its partition, it's called on the broker,
+	// which delivers the delayed messages.
+	Schedule(ctx context.Context, in *pb.ScheduleRequest) (*pb.ScheduleResponse, error)
+}
+
+// ClusterBroker is the broker of the cluster, it's called by the clients and by the other brokers.
+type ClusterBroker interface {
+	Broker
+	Peer
 }
 
 type broker struct {
 	storage repo.Storage
+
+	// mu guards the topics cache.
+	mu sync.Mutex
+
+	// topics caches the routing settings of the topics, so publishing
+	// doesn't have to describe the topic every time.
+	topics map[string]*topicRouting
+
+	// groups coordinates the consumer groups of the subscribers.
+	groups *coordinator
+
+	// offsets keeps the committed offsets of the consumer groups.
+	offsets *offsetStore
+
+	// subscriptions shares the acknowledged deliveries between the consumers of the groups.
+	subscriptions *subscriptions
+
+	// redriveMu serializes the redrives, so a dead-lettered message is not moved twice.
+	redriveMu sync.Mutex
+
+	// delayed holds the delayed messages until their delivery.
+	delayed *scheduler
+
+	// unacked are the publishes without acks, which are saved in the background one by one,
+	// saved is closed, when all of them are saved after the close.
+	unacked chan func() error
+	saved   chan struct{}
+
+	// closeMu orders the queued publishes with the close, so none of them is sent to the closed queue.
+	closeMu sync.RWMutex
+	closed  bool
+
+	// cluster replicates the partitions between the brokers, it's nil for the single broker.
+	cluster *cluster
+}
+
+func (b *broker) Close() error {
+	b.closeMu.Lock()
+	if b.closed {
+		b.closeMu.Unlock()
+		return nil
+	}
+
+	b.closed = true
+	close(b.unacked)
+	b.closeMu.Unlock()
+
+	var errs []error
+	if b.cluster != nil {
+		errs = append(errs, b.cluster.close())
+	}
+
+	<-b.saved
+	b.offsets.close()
+	b.delayed.close()
+	return errors.Join(errs...)
+}
+
+// topicRouting is the information needed to choose a partition for a message.
+type topicRouting struct {
+	partitions  int
+	partitioner Partitioner
+}
+
+func NewBroker(storage repo.Storage) (Broker, error) {
+	b, err := newBroker(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	b.delayed.start()
+	return b, nil
+}
+
+// NewClusterBroker creates the broker, which replicates the partitions with the other brokers of the cluster.
+func NewClusterBroker(storage repo.Storage, opts ClusterOptions) (ClusterBroker, error) {
+	b, err := newBroker(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.cluster, err = newCluster(opts, b.applyMetadata, b.startLeaderEpoch); err != nil {
+		return nil, err
+	}
+
+	// The delayed messages are delivered and the commits are stored, once they know about the cluster.
+	b.offsets.cluster, b.delayed.cluster = b.cluster, b.cluster
+	b.delayed.start()
+	b.cluster.start()
+	for _, topic := range replicatedInternalTopics {
+		b.replicateTopic(topic)
+	}
+
+	go b.registerTopics(opts.Topics)
+	return b, nil
 }
 
-func _() Broker {
-	return &broker{}
+func newBroker(storage repo.Storage) (*broker, error) {
+	offsets, err := newOffsetStore(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &broker{
+		storage: storage,
+		topics:  make(map[string]*topicRouting),
+		groups:  newCoordinator(),
+		offsets: offsets,
+
+		subscriptions: newSubscriptions(),
+		unacked:       make(chan func() error, unackedQueue),
+		saved:         make(chan struct{}),
+	}
+
+	if b.delayed, err = newScheduler(storage, b.deliverDelayed); err != nil {
+		return nil, err
+	}
+
+	storage.HandleExpired(b.deadLetterExpired)
+	go b.saveUnacked()
+	return b, nil
+}
+
+func (b *broker) routing(topic string) (*topicRouting, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r, ok := b.topics[topic]; ok {
+		return r, nil
+	}
+
+	d, err := b.storage.DescribeTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	partitioner, err := NewPartitioner(d.Config[partitionerConfig])
+	if err != nil {
+		return nil, err
+	}
+
+	r := &topicRouting{partitions: len(d.Partitions), partitioner: partitioner}
+	b.topics[topic] = r
+	return r, nil
+}
+
+// forget drops the cached routing of a topic, when it's no longer valid.
+func (b *broker) forget(topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.topics, topic)
 }
 
 func (b *broker) Publish(ctx context.Context, in *pb.PublishRequest) (*pb.PublishResponse, error) {
-	panic("implement me")
+	if isInternalTopic(in.Topic) {
+		return nil, pkg.ErrorInternalTopic
+	}
+
+	at, err := deliveryTime(in, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, err := messageTTL(in.Ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	partition, err := b.choosePartition(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = b.checkLeader(in.Topic, partition, in.Acks); err != nil {
+		return nil, err
+	}
+
+	if !at.IsZero() {
+		return b.publishDelayed(ctx, in, partition, at)
+	}
+
+	m := withProducer(newMessage(in.Key, in.Body, in.Headers, in.Timestamp).WithTTL(ttl), in.ProducerId, in.ProducerEpoch, in.Sequence)
+	offset, err := b.save(ctx, in.Topic, partition, []*repo.Message{m}, in.Acks)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.PublishResponse{Id: uint64(offset), Partition: uint32(partition)}, nil
 }
 
-func (b *broker) Subscribe(ctx context.Context, stream pb.Broker_SubscribeServer) error {
-	panic("implement me")
+// choosePartition returns the partition requested by the publisher, or asks the topic partitioner.
+func (b *broker) choosePartition(in *pb.PublishRequest) (int32, error) {
+	r, err := b.routing(in.Topic)
+	if err != nil {
+		return 0, err
+	}
+
+	if in.Partition != nil {
+		return explicitPartition(in, r.partitions)
+	}
+
+	return r.partitioner.Partition(in, r.partitions)
+}
+
+func (b *broker) CommitOffset(ctx context.Context, in *pb.CommitOffsetRequest) (*pb.CommitOffsetResponse, error) {
+	key, err := b.offsetKey(in.GroupId, in.Topic, in.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.Async {
+		b.offsets.commitAsync(key, int64(in.Offset))
+		return &pb.CommitOffsetResponse{}, nil
+	}
+
+	if err = b.offsets.commit(ctx, key, int64(in.Offset)); err != nil {
+		return nil, err
+	}
+
+	return &pb.CommitOffsetResponse{}, nil
+}
+
+func (b *broker) FetchCommittedOffset(
+	ctx context.Context, in *pb.FetchCommittedOffsetRequest,
+) (*pb.FetchCommittedOffsetResponse, error) {
+	key, err := b.offsetKey(in.GroupId, in.Topic, in.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	// The commits are read from the coordinator, the replicas of the other brokers may lag behind it.
+	if id, ok := b.offsets.coordinator(); !ok {
+		client, forwarded, e := b.cluster.forward(ctx, id)
+		if e != nil {
+			return nil, e
+		}
+
+		return client.FetchCommittedOffset(forwarded, in)
+	}
+
+	offset, ok := b.offsets.fetch(key)
+	return &pb.FetchCommittedOffsetResponse{Offset: uint64(offset), Committed: ok}, nil
+}
+
+func (b *broker) OffsetsForTimes(_ context.Context, in *pb.OffsetsForTimesRequest) (*pb.OffsetsForTimesResponse, error) {
+	if in.Timestamp == nil {
+		return nil, pkg.ErrorTimestampRequired
+	}
+
+	partitions, err := b.partitions(in.Topic, in.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &pb.OffsetsForTimesResponse{Offsets: make([]*pb.PartitionOffset, 0, len(partitions))}
+	for _, partition := range partitions {
+		offset, e := b.storage.OffsetForTime(in.Topic, partition, in.Timestamp.AsTime())
+		if e != nil {
+			return nil, e
+		}
+
+		out.Offsets = append(out.Offsets, &pb.PartitionOffset{Partition: uint32(partition), Offset: uint64(offset)})
+	}
+
+	return out, nil
+}
+
+// offsetKey validates, that the group is set and the partition exists.
+func (b *broker) offsetKey(group, topic string, partition uint32) (offsetKey, error) {
+	if err := validateGroup(group); err != nil {
+		return offsetKey{}, err
+	}
+
+	r, err := b.routing(topic)
+	if err != nil {
+		return offsetKey{}, err
+	}
+
+	if int(partition) >= r.partitions {
+		return offsetKey{}, pkg.ErrorPartitionNotFound
+	}
+
+	return offsetKey{group: group, topic: topic, partition: int32(partition)}, nil
+}
+
+// validateGroup checks, that the group is set and can be stored in the offset key,
+// where NUL separates the group from the topic.
+func validateGroup(group string) error {
+	if group == "" {
+		return pkg.ErrorGroupRequired
+	}
+
+	if strings.Contains(group, "\x00") {
+		return pkg.ErrorInvalidGroup
+	}
+
+	return nil
 }
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+	"time"
+)
+
+// subscribeStream collects the sent messages and cancels the subscription,
+// when the expected number of them is received.
+type subscribeStream struct {
+	grpc.ServerStream
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	expected int
+	received []*pb.MessageResponse
+}
+
+func newSubscribeStream(expected int) *subscribeStream {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	return &subscribeStream{ctx: ctx, cancel: cancel, expected: expected}
+}
+
+func (s *subscribeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *subscribeStream) Send(m *pb.MessageResponse) error {
+	s.received = append(s.received, m)
+	if len(s.received) == s.expected {
+		s.cancel()
+	}
+
+	return nil
+}
+
+// waitingStorage signals, when a subscriber starts waiting for the new messages
+// of a partition, meaning that its start offset is already resolved.
+type waitingStorage struct {
+	repo.Storage
+
+	waiting chan struct{}
+}
+
+func newWaitingStorage(storage repo.Storage) *waitingStorage {
+	return &waitingStorage{Storage: storage, waiting: make(chan struct{}, 1)}
+}
+
+func (s *waitingStorage) Notify(topic string, partition int32) (<-chan struct{}, error) {
+	select {
+	case s.waiting <- struct{}{}:
+	default:
+	}
+
+	return s.Storage.Notify(topic, partition)
+}
+
+func newTestBroker(t *testing.T, storage repo.Storage) Broker {
+	b, err := NewBroker(storage)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	t.Cleanup(func() { _ = b.Close() })
+	return b
+}
+
+func publish(t *testing.T, b Broker, bodies ...string) {
+	for _, body := range bodies {
+		if _, err := b.Publish(context.Background(), &pb.PublishRequest{Topic: "topic1", Body: []byte(body)}); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+}
+
+func TestBroker_Subscribe(t *testing.T) {
+	testCases := []struct {
+		name            string
+		request         *pb.SubscribeRequest
+		before, after   []string
+		expected        []string
+		expectedOffsets []uint64
+		expectedErr     error
+	}{
+		{
+			name:            "success, earliest reads stored and new messages",
+			request:         &pb.SubscribeRequest{Topic: "topic1", Policy: pb.OffsetPolicy_EARLIEST},
+			before:          []string{"a", "b"},
+			after:           []string{"c"},
+			expected:        []string{"a", "b", "c"},
+			expectedOffsets: []uint64{0, 1, 2},
+		},
+		{
+			name:            "success, latest reads only new messages",
+			request:         &pb.SubscribeRequest{Topic: "topic1", Policy: pb.OffsetPolicy_LATEST},
+			before:          []string{"a", "b"},
+			after:           []string{"c", "d"},
+			expected:        []string{"c", "d"},
+			expectedOffsets: []uint64{2, 3},
+		},
+		{
+			name:            "success, explicit offset",
+			request:         &pb.SubscribeRequest{Topic: "topic1", Policy: pb.OffsetPolicy_EXPLICIT, Offset: 1},
+			before:          []string{"a", "b"},
+			after:           []string{"c"},
+			expected:        []string{"b", "c"},
+			expectedOffsets: []uint64{1, 2},
+		},
+		{
+			name: "success, timestamp before the stored messages",
+			request: &pb.SubscribeRequest{
+				Topic: "topic1", Policy: pb.OffsetPolicy_TIMESTAMP, Timestamp: timestamppb.New(time.Unix(0, 0)),
+			},
+			before:          []string{"a", "b"},
+			after:           []string{"c"},
+			expected:        []string{"a", "b", "c"},
+			expectedOffsets: []uint64{0, 1, 2},
+		},
+		{
+			name: "success, timestamp after the stored messages",
+			request: &pb.SubscribeRequest{
+				Topic: "topic1", Policy: pb.OffsetPolicy_TIMESTAMP, Timestamp: timestamppb.New(time.Now().Add(time.Hour)),
+			},
+			before:          []string{"a", "b"},
+			after:           []string{"c"},
+			expected:        []string{"c"},
+			expectedOffsets: []uint64{2},
+		},
+		{
+			name:        "failure, topic not found",
+			request:     &pb.SubscribeRequest{Topic: "unknown"},
+			expectedErr: pkg.ErrorTopicNotFound,
+		},
+		{
+			name:        "failure, timestamp required",
+			request:     &pb.SubscribeRequest{Topic: "topic1", Policy: pb.OffsetPolicy_TIMESTAMP},
+			expectedErr: pkg.ErrorTimestampRequired,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			storage := newWaitingStorage(repo.NewBrokerStorage("topic1"))
+			b := newTestBroker(t, storage)
+			publish(t, b, tc.before...)
+
+			stream := newSubscribeStream(len(tc.expected))
+			defer stream.cancel()
+
+			done := make(chan error)
+			go func() { done <- b.Subscribe(tc.request, stream) }()
+
+			// Subscribe resolves the latest offset at the start, publishing the messages,
+			// which it has to wait for, only when it's waiting for them.
+			if tc.expectedErr == nil {
+				select {
+				case <-storage.waiting:
+				case <-stream.ctx.Done():
+				}
+			}
+
+			publish(t, b, tc.after...)
+
+			if err := <-done; !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected %v, got %v", tc.expectedErr, err)
+			}
+
+			if errors.Is(stream.ctx.Err(), context.DeadlineExceeded) {
+				t.Fatalf("expected %d messages, got %d", len(tc.expected), len(stream.received))
+			}
+
+			for i, m := range stream.received {
+				if string(m.Body) != tc.expected[i] || m.Offset != tc.expectedOffsets[i] {
+					t.Errorf("expected %s at %d, got %s at %d", tc.expected[i], tc.expectedOffsets[i], m.Body, m.Offset)
+				}
+			}
+		})
+	}
+}
+
+func TestBroker_PublishMetadata(t *testing.T) {
+	producedAt := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	testCases := []struct {
+		name    string
+		request *pb.PublishRequest
+	}{
+		{
+			name: "success, key, headers and timestamp",
+			request: &pb.PublishRequest{
+				Topic:     "topic1",
+				Body:      []byte("a"),
+				Key:       []byte("k1"),
+				Headers:   map[string][]byte{"content-type": []byte("text/plain"), "trace-id": []byte("42"), "empty": {}},
+				Timestamp: timestamppb.New(producedAt),
+			},
+		},
+		{
+			name:    "success, no metadata",
+			request: &pb.PublishRequest{Topic: "topic1", Body: []byte("a")},
+		},
+	}
+
+	storages := map[string]func(t *testing.T) repo.Storage{
+		"memory": func(t *testing.T) repo.Storage {
+			return repo.NewBrokerStorage("topic1")
+		},
+		"file": func(t *testing.T) repo.Storage {
+			s, err := repo.NewFileStorage(t.TempDir(), repo.FileOptions{}, "topic1")
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			t.Cleanup(func() { _ = s.Close() })
+			return s
+		},
+	}
+
+	for kind, newStorage := range storages {
+		for _, tc := range testCases {
+			t.Run(kind+", "+tc.name, func(t *testing.T) {
+				b := newTestBroker(t, newStorage(t))
+				before := time.Now().Truncate(time.Millisecond)
+				if _, err := b.Publish(context.Background(), tc.request); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				stream := newSubscribeStream(1)
+				defer stream.cancel()
+
+				if err := b.Subscribe(&pb.SubscribeRequest{Topic: "topic1", Policy: pb.OffsetPolicy_EARLIEST}, stream); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				if len(stream.received) != 1 {
+					t.Fatalf("expected 1 message, got %d", len(stream.received))
+				}
+
+				m := stream.received[0]
+				if string(m.Key) != string(tc.request.Key) {
+					t.Errorf("expected key %q, got %q", tc.request.Key, m.Key)
+				}
+
+				if len(m.Headers) != len(tc.request.Headers) {
+					t.Errorf("expected %v, got %v", tc.request.Headers, m.Headers)
+				}
+
+				for k, v := range tc.request.Headers {
+					if actual, ok := m.Headers[k]; !ok || string(actual) != string(v) {
+						t.Errorf("expected header %s=%q, got %q", k, v, actual)
+					}
+				}
+
+				if m.Timestamp == nil || m.Timestamp.AsTime().Before(before) {
+					t.Errorf("expected the broker timestamp after %v, got %v", before, m.Timestamp)
+				}
+
+				if !m.ProducerTimestamp.AsTime().Equal(tc.request.Timestamp.AsTime()) {
+					t.Errorf("expected %v, got %v", tc.request.Timestamp, m.ProducerTimestamp)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,746 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/raft"
+	"github.com/fadyat/grpc-broker/pkg"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+
+	// isrCheckInterval is the time between the checks of the in-sync replicas by the leader and by the publishes
+	// waiting for them, so the followers, which fell out of sync in the meantime, are removed and stop holding them.
+	isrCheckInterval = 100 * time.Millisecond
+
+	// forwardedHeader marks the calls forwarded to the controller or to the leader, so they aren't forwarded once again.
+	forwardedHeader = "x-broker-forwarded"
+)
+
+// replicatedInternalTopics are the internal topics replicated between the brokers. Every broker assigns them
+// on the start, before the controller is elected, the assignment depends only on the brokers, so it's the same.
+var replicatedInternalTopics = []string{offsetsTopic, delayedTopic}
+
+// ClusterOptions describes the brokers, which replicate the partitions of the topics between each other.
+// The replicas of a partition are chosen, when its topic is created, the leader appends the published
+// messages, the rest of them fetch the messages from it.
+//
+// The topics, the leaders and the in-sync replicas of the partitions are kept by the raft quorum of all brokers,
+// its leader is the controller, which creates and deletes the topics and moves the leadership from the lost
+// brokers to the alive in-sync replicas. The leader proposes the in-sync replicas to the controller, when
+// the followers fall out of sync or catch up, and acknowledges the publishes with all acks, once all of them
+// have the messages, so the publishes are not lost, while one of the in-sync replicas is alive. The partition
+// without the alive in-sync replicas keeps its leader, until one of them is back.
+//
+// The messages of the lost leader, which the new one didn't fetch, are truncated, when it's back and follows
+// the new leader, the leader epochs of the messages tell, where their logs diverged.
+//
+// The internal topics are replicated like the other ones, so they are the same on every broker and survive
+// the loss of the leader. The leader of the committed offsets stores the commits of all groups, the leader
+// of the delayed messages delivers all of them, the other brokers forward the commits and the delayed messages.
+type ClusterOptions struct {
+
+	// BrokerID is the id of this broker in the Brokers.
+	BrokerID int32
+
+	// Brokers are the gRPC addresses of all brokers of the cluster by their ids, this one included,
+	// the clients are redirected to them.
+	Brokers map[int32]string
+
+	// Peers are the addresses of the cluster listeners of all brokers by their ids, this one included.
+	// The brokers call each other there, the listeners aren't exposed to the clients.
+	Peers map[int32]string
+
+	// ReplicationFactor is the number of the brokers keeping every partition, all brokers by default.
+	ReplicationFactor int
+
+	// MinInsyncReplicas is the number of the in-sync replicas, the leader included,
+	// without which the publishes with all acks are rejected, one by default.
+	MinInsyncReplicas int
+
+	// ReplicaLagMax is the time, after which the follower, which didn't catch up with the leader,
+	// is removed from the in-sync replicas, 10s by default.
+	ReplicaLagMax time.Duration
+
+	// AckTimeout limits the waiting for the in-sync replicas, 30s by default.
+	AckTimeout time.Duration
+
+	// SessionTimeout is the time without the response to the controller, after which the broker
+	// is lost and its partitions are led by the other replicas, 6s by default.
+	SessionTimeout time.Duration
+
+	// MetadataDir is the directory of the metadata log, it's kept in memory, when it's empty.
+	MetadataDir string
+
+	// Topics are created in the cluster on the start, unless they exist.
+	Topics []string
+}
+
+// partitionKey identifies the replicated partition.
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+// replicaProgress is the position of the follower known by the leader.
+type replicaProgress struct {
+
+	// offset is the end of the follower log, all messages before it are replicated.
+	offset int64
+
+	// caughtUp is the last time, when the follower fetched from the end of the leader log.
+	caughtUp time.Time
+}
+
+type cluster struct {
+	opts ClusterOptions
+
+	// ids are the sorted ids of the brokers, the replicas are chosen from them.
+	ids []int32
+
+	// ctx is done, when the cluster is closed, it stops the replication.
+	ctx  context.Context
+	stop context.CancelFunc
+
+	// conns are the connections to the other brokers by their addresses.
+	connsMu sync.Mutex
+	conns   map[string]*grpc.ClientConn
+
+	// node is the member of the metadata quorum, meta is the state applied by it.
+	node *raft.Node
+	meta *metadataState
+
+	// proposeMu serializes the topic changes of the controller, so the same topic isn't created twice.
+	proposeMu sync.Mutex
+
+	// mu guards the progress of the followers, the running fetchers and the proposed in-sync replicas.
+	// The metadata isn't read under it, the metadata changes take it.
+	mu sync.Mutex
+
+	// progress is the position of the followers of the partitions, which this broker leads.
+	progress map[partitionKey]map[int32]*replicaProgress
+
+	// progressed is closed and replaced, every time a follower moves.
+	progressed chan struct{}
+
+	// fetchers are the partitions, which this broker follows.
+	fetchers map[partitionKey]struct{}
+
+	// proposed are the in-sync replicas of the partitions proposed by this broker, which may be committed
+	// without it knowing yet, so their members are waited for too.
+	proposed map[partitionKey]isrProposal
+}
+
+// isrProposal is the in-sync replicas proposed instead of the ones with the version.
+type isrProposal struct {
+	version int32
+	isr     []int32
+}
+
+// newCluster creates the cluster, the committed metadata changes are passed to the apply,
+// after they are applied to the metadata. The lead is called with the partitions, which
+// this broker starts to lead, before the change is applied.
+func newCluster(opts ClusterOptions, apply func(cmd metadataCommand), lead func(key partitionKey, epoch int32)) (*cluster, error) {
+	if _, ok := opts.Brokers[opts.BrokerID]; !ok {
+		return nil, fmt.Errorf("broker %d is not in the cluster", opts.BrokerID)
+	}
+
+	ids := make([]int32, 0, len(opts.Brokers))
+	for id := range opts.Brokers {
+		if _, ok := opts.Peers[id]; !ok {
+			return nil, fmt.Errorf("broker %d has no peer address", id)
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if opts.ReplicationFactor <= 0 || opts.ReplicationFactor > len(ids) {
+		opts.ReplicationFactor = len(ids)
+	}
+
+	if opts.MinInsyncReplicas <= 0 {
+		opts.MinInsyncReplicas = 1
+	}
+
+	if opts.ReplicaLagMax <= 0 {
+		opts.ReplicaLagMax = 10 * time.Second
+	}
+
+	if opts.AckTimeout <= 0 {
+		opts.AckTimeout = 30 * time.Second
+	}
+
+	if opts.SessionTimeout <= 0 {
+		opts.SessionTimeout = 6 * time.Second
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	c := &cluster{
+		opts:  opts,
+		ids:   ids,
+		ctx:   ctx,
+		stop:  stop,
+		conns: make(map[string]*grpc.ClientConn),
+
+		progress:   make(map[partitionKey]map[int32]*replicaProgress),
+		progressed: make(chan struct{}),
+		fetchers:   make(map[partitionKey]struct{}),
+		proposed:   make(map[partitionKey]isrProposal),
+	}
+
+	c.meta = newMetadataState(ids, func(key partitionKey, leader, epoch int32, isr []int32) {
+		if leader == opts.BrokerID {
+			c.resetProgress(key, isr)
+			lead(key, epoch)
+		}
+	})
+
+	for _, topic := range replicatedInternalTopics {
+		c.meta.apply(metadataCommand{
+			Type:     commandCreateTopic,
+			Topic:    topic,
+			Config:   map[string]string{"cleanup.policy": "compact"},
+			Replicas: c.assignReplicas(topic, 1),
+		})
+	}
+
+	node, err := raft.NewNode(raft.Options{
+		ID:        opts.BrokerID,
+		Peers:     c.peers(),
+		Transport: c,
+		Dir:       opts.MetadataDir,
+		Apply: func(raw []byte) {
+			cmd, e := decodeCommand(raw)
+			if e != nil {
+				return
+			}
+
+			c.meta.apply(cmd)
+			apply(cmd)
+		},
+	})
+	if err != nil {
+		stop()
+		return nil, err
+	}
+
+	c.node = node
+	return c, nil
+}
+
+// start joins the metadata quorum.
+func (c *cluster) start() {
+	c.node.Start()
+	go c.watchBrokers()
+	go c.watchReplicas()
+}
+
+// close stops the replication and closes the connections to the other brokers.
+func (c *cluster) close() error {
+	c.node.Stop()
+	c.stop()
+
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+
+	var errs []error
+	for _, conn := range c.conns {
+		errs = append(errs, conn.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// assignReplicas chooses the brokers keeping the partitions of the new topic. The partitions
+// go one after another around the brokers, starting from the one chosen by the topic name.
+func (c *cluster) assignReplicas(topic string, partitions int) [][]int32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(topic))
+
+	n := len(c.ids)
+	assigned := make([][]int32, partitions)
+	for partition := range assigned {
+		first := (int(h.Sum32()%uint32(n)) + partition) % n
+
+		replicas := make([]int32, c.opts.ReplicationFactor)
+		for i := range replicas {
+			replicas[i] = c.ids[(first+i)%n]
+		}
+
+		assigned[partition] = replicas
+	}
+
+	return assigned
+}
+
+// replicas returns the brokers keeping the partition and its leader.
+func (c *cluster) replicas(key partitionKey) ([]int32, int32, error) {
+	p, ok := c.meta.partition(key)
+	if !ok {
+		return nil, 0, pkg.ErrorTopicNotFound
+	}
+
+	return p.replicas, p.leader, nil
+}
+
+// leads returns the leader of the partition and reports, whether it's this broker.
+func (c *cluster) leads(key partitionKey) (int32, bool) {
+	_, leader, err := c.replicas(key)
+	return leader, err == nil && leader == c.opts.BrokerID
+}
+
+// peers returns the ids of the other brokers.
+func (c *cluster) peers() []int32 {
+	peers := make([]int32, 0, len(c.ids)-1)
+	for _, id := range c.ids {
+		if id != c.opts.BrokerID {
+			peers = append(peers, id)
+		}
+	}
+
+	return peers
+}
+
+// client returns the client of the broker, which the client calls are forwarded to.
+func (c *cluster) client(id int32) (pb.BrokerClient, error) {
+	conn, err := c.dial(c.opts.Brokers[id])
+	if err != nil {
+		return nil, err
+	}
+
+	return pb.NewBrokerClient(conn), nil
+}
+
+// peer returns the client of the cluster listener of the broker.
+func (c *cluster) peer(id int32) (pb.ClusterClient, error) {
+	conn, err := c.dial(c.opts.Peers[id])
+	if err != nil {
+		return nil, err
+	}
+
+	return pb.NewClusterClient(conn), nil
+}
+
+func (c *cluster) dial(addr string) (*grpc.ClientConn, error) {
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+
+	if conn, ok := c.conns[addr]; ok {
+		return conn, nil
+	}
+
+	// The connection is established lazily, so the brokers can be started in any order.
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+
+	c.conns[addr] = conn
+	return conn, nil
+}
+
+// checkLeader rejects the publishes to the partitions led by the other brokers,
+// the publishes with all acks are rejected, when there are not enough in-sync replicas.
+func (c *cluster) checkLeader(key partitionKey, acks pb.Acks) error {
+	_, leader, err := c.replicas(key)
+	if err != nil {
+		return err
+	}
+
+	if leader != c.opts.BrokerID {
+		return c.notLeader(leader)
+	}
+
+	if acks != pb.Acks_ACKS_ALL {
+		return nil
+	}
+
+	if isr := c.isr(key); len(isr) < c.opts.MinInsyncReplicas {
+		return fmt.Errorf("%w: %d of %d", pkg.ErrorNotEnoughReplicas, len(isr), c.opts.MinInsyncReplicas)
+	}
+
+	return nil
+}
+
+func (c *cluster) notLeader(leader int32) error {
+	return fmt.Errorf("%w: the leader is broker %d at %s", pkg.ErrorNotLeader, leader, c.opts.Brokers[leader])
+}
+
+// isr returns the committed in-sync replicas of the partition, the leader included.
+func (c *cluster) isr(key partitionKey) []int32 {
+	p, _ := c.meta.partition(key)
+	return p.isr
+}
+
+// resetProgress starts the leadership of the partition, its in-sync followers are caught up,
+// until they fetch from the leader or lag behind it.
+func (c *cluster) resetProgress(key partitionKey, isr []int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	followers, now := make(map[int32]*replicaProgress, len(isr)), time.Now()
+	for _, id := range isr {
+		if id != c.opts.BrokerID {
+			followers[id] = &replicaProgress{caughtUp: now}
+		}
+	}
+
+	c.progress[key] = followers
+	delete(c.proposed, key)
+}
+
+// syncedLocked returns the leader of the partition and the followers, which were caught up with it
+// within the max lag, they are the in-sync replicas proposed by the leader.
+func (c *cluster) syncedLocked(key partitionKey, p partitionMetadata, now time.Time) []int32 {
+	synced := []int32{p.leader}
+	for _, id := range p.replicas {
+		if r, ok := c.progress[key][id]; ok && id != p.leader && now.Sub(r.caughtUp) <= c.opts.ReplicaLagMax {
+			synced = append(synced, id)
+		}
+	}
+
+	return synced
+}
+
+// ackingLocked returns the followers, which must have the message before it's acknowledged:
+// the committed in-sync replicas and the proposed ones, which may be committed already.
+func (c *cluster) ackingLocked(key partitionKey, p partitionMetadata) []int32 {
+	acking := make([]int32, 0, len(p.replicas))
+	for _, id := range p.isr {
+		if id != p.leader {
+			acking = append(acking, id)
+		}
+	}
+
+	if proposed, ok := c.proposed[key]; ok && proposed.version == p.isrVersion {
+		for _, id := range proposed.isr {
+			if id != p.leader && !pkg.In(acking, id) {
+				acking = append(acking, id)
+			}
+		}
+	}
+
+	return acking
+}
+
+// fetched moves the follower of the partition to the offset, the follower fetching
+// from the end of the leader log is caught up with it.
+func (c *cluster) fetched(key partitionKey, replica int32, offset, end int64) {
+	replicas, leader, err := c.replicas(key)
+	if err != nil || replica == leader || !pkg.In(replicas, replica) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	followers, ok := c.progress[key]
+	if !ok {
+		followers = make(map[int32]*replicaProgress)
+		c.progress[key] = followers
+	}
+
+	p, ok := followers[replica]
+	if !ok {
+		p = &replicaProgress{}
+		followers[replica] = p
+	}
+
+	p.offset = offset
+	if offset >= end {
+		p.caughtUp = time.Now()
+	}
+
+	close(c.progressed)
+	c.progressed = make(chan struct{})
+}
+
+// awaitReplicas waits, until all in-sync replicas of the partition have the message with the offset.
+func (c *cluster) awaitReplicas(ctx context.Context, key partitionKey, offset int64) error {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.AckTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(isrCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		p, ok := c.meta.partition(key)
+		if !ok {
+			return pkg.ErrorTopicNotFound
+		}
+
+		// The new leader may not have the message, it's not acknowledged by the previous one.
+		if p.leader != c.opts.BrokerID {
+			return c.notLeader(p.leader)
+		}
+
+		c.mu.Lock()
+		replicated := true
+		for _, id := range c.ackingLocked(key, p) {
+			r, ok := c.progress[key][id]
+			replicated = replicated && ok && r.offset > offset
+		}
+
+		progressed := c.progressed
+		c.mu.Unlock()
+
+		if len(p.isr) < c.opts.MinInsyncReplicas {
+			return fmt.Errorf("%w: %d of %d", pkg.ErrorNotEnoughReplicas, len(p.isr), c.opts.MinInsyncReplicas)
+		}
+
+		if replicated {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", pkg.ErrorReplicationTimeout, ctx.Err())
+		case <-progressed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchReplicas proposes the in-sync replicas of the partitions led by this broker, when its followers
+// fall out of sync or catch up. The publishes wait for the lagging followers, until they are removed.
+func (c *cluster) watchReplicas() {
+	ticker := time.NewTicker(isrCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, key := range c.meta.led(c.opts.BrokerID) {
+			p, ok := c.meta.partition(key)
+			if !ok || p.leader != c.opts.BrokerID {
+				continue
+			}
+
+			c.mu.Lock()
+			synced := c.syncedLocked(key, p, time.Now())
+			if len(synced) == len(p.isr) && pkg.Subset(p.isr, synced) {
+				c.mu.Unlock()
+				continue
+			}
+
+			c.proposed[key] = isrProposal{version: p.isrVersion, isr: synced}
+			c.mu.Unlock()
+
+			ctx, cancel := context.WithTimeout(c.ctx, c.opts.SessionTimeout)
+			_ = c.alterIsr(ctx, key, p, synced)
+			cancel()
+		}
+	}
+}
+
+// alterIsr sends the in-sync replicas of the partition led by this broker to the controller.
+func (c *cluster) alterIsr(ctx context.Context, key partitionKey, p partitionMetadata, isr []int32) error {
+	in := &pb.AlterIsrRequest{
+		Topic:       key.topic,
+		Partition:   uint32(key.partition),
+		LeaderId:    uint32(p.leader),
+		LeaderEpoch: uint32(p.epoch),
+		IsrVersion:  uint32(p.isrVersion),
+	}
+
+	for _, id := range isr {
+		in.Isr = append(in.Isr, uint32(id))
+	}
+
+	id, ok := c.node.Leader()
+	if !ok {
+		return pkg.ErrorNoController
+	}
+
+	if id == c.opts.BrokerID {
+		return c.proposeIsr(ctx, in)
+	}
+
+	client, err := c.peer(id)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.AlterIsr(ctx, in)
+	return err
+}
+
+// proposeIsr applies the in-sync replicas proposed by the leader of the partition, it's called by the controller.
+func (c *cluster) proposeIsr(ctx context.Context, in *pb.AlterIsrRequest) error {
+	key := partitionKey{topic: in.Topic, partition: int32(in.Partition)}
+	p, ok := c.meta.partition(key)
+	if !ok {
+		return pkg.ErrorTopicNotFound
+	}
+
+	if p.leader != int32(in.LeaderId) || p.epoch != int32(in.LeaderEpoch) {
+		return c.notLeader(p.leader)
+	}
+
+	if p.isrVersion != int32(in.IsrVersion) {
+		return pkg.ErrorStaleIsr
+	}
+
+	isr := make([]int32, 0, len(in.Isr))
+	for _, id := range in.Isr {
+		isr = append(isr, int32(id))
+	}
+
+	if !pkg.In(isr, p.leader) || !pkg.Subset(isr, p.replicas) {
+		return pkg.ErrorInvalidIsr
+	}
+
+	return c.propose(ctx, metadataCommand{
+		Type:        commandIsr,
+		Topic:       key.topic,
+		Partition:   key.partition,
+		LeaderEpoch: p.epoch,
+		IsrVersion:  p.isrVersion,
+		Isr:         isr,
+	})
+}
+
+// controller returns the client of the controller, the change, which is forwarded already, isn't forwarded again.
+func (c *cluster) controller(ctx context.Context) (pb.BrokerClient, context.Context, error) {
+	if forwarded(ctx) {
+		return nil, nil, pkg.ErrorNotController
+	}
+
+	id, ok := c.node.Leader()
+	if !ok {
+		return nil, nil, pkg.ErrorNoController
+	}
+
+	client, err := c.client(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, metadata.AppendToOutgoingContext(ctx, forwardedHeader, "true"), nil
+}
+
+// forward returns the client of the leader, which the call is forwarded to, the call,
+// which is forwarded already, isn't forwarded again, the brokers may disagree on the leader for a while.
+func (c *cluster) forward(ctx context.Context, leader int32) (pb.BrokerClient, context.Context, error) {
+	if forwarded(ctx) {
+		return nil, nil, c.notLeader(leader)
+	}
+
+	client, err := c.client(leader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, metadata.AppendToOutgoingContext(ctx, forwardedHeader, "true"), nil
+}
+
+// forwarded reports, whether the call is forwarded by the other broker.
+func forwarded(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	return ok && len(md.Get(forwardedHeader)) != 0
+}
+
+// propose applies the metadata change on all brokers, it's called by the controller.
+func (c *cluster) propose(ctx context.Context, cmd metadataCommand) error {
+	raw, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	return c.node.Propose(ctx, raw)
+}
+
+// watchBrokers marks the brokers, which the controller lost contact with, so their partitions
+// are led by the other replicas, and the returned ones, so they lead the partitions without the leaders.
+func (c *cluster) watchBrokers() {
+	ticker := time.NewTicker(c.opts.SessionTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !c.node.IsLeader() {
+			continue
+		}
+
+		now, alive := time.Now(), []int32{c.opts.BrokerID}
+		for id, contact := range c.node.Contacts() {
+			if now.Sub(contact) < c.opts.SessionTimeout {
+				alive = append(alive, id)
+			}
+		}
+
+		if c.meta.sameAlive(alive) {
+			continue
+		}
+
+		sort.Slice(alive, func(i, j int) bool { return alive[i] < alive[j] })
+		ctx, cancel := context.WithTimeout(c.ctx, c.opts.SessionTimeout)
+		_ = c.propose(ctx, metadataCommand{Type: commandBrokers, Alive: alive})
+		cancel()
+	}
+}
+
+func (c *cluster) RequestVote(ctx context.Context, peer int32, in *raft.VoteRequest) (*raft.VoteResponse, error) {
+	client, err := c.peer(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := client.RequestVote(ctx, &pb.RequestVoteRequest{
+		Term:         in.Term,
+		CandidateId:  uint32(in.CandidateID),
+		LastLogIndex: in.LastLogIndex,
+		LastLogTerm:  in.LastLogTerm,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &raft.VoteResponse{Term: out.Term, Granted: out.Granted}, nil
+}
+
+func (c *cluster) AppendEntries(ctx context.Context, peer int32, in *raft.AppendRequest) (*raft.AppendResponse, error) {
+	client, err := c.peer(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*pb.RaftEntry, len(in.Entries))
+	for i, e := range in.Entries {
+		entries[i] = &pb.RaftEntry{Term: e.Term, Command: e.Command}
+	}
+
+	out, err := client.AppendEntries(ctx, &pb.AppendEntriesRequest{
+		Term:         in.Term,
+		LeaderId:     uint32(in.LeaderID),
+		PrevLogIndex: in.PrevLogIndex,
+		PrevLogTerm:  in.PrevLogTerm,
+		Entries:      entries,
+		LeaderCommit: in.LeaderCommit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &raft.AppendResponse{Term: out.Term, Success: out.Success, LastLogIndex: out.LastLogIndex}, nil
+}
@@ -0,0 +1,655 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	defaultVisibilityTimeout = 30 * time.Second
+	defaultMaxInFlight       = 100
+
+	// readyBuffer is the number of the read messages waiting for the consumers or the dead-lettering,
+	// the partitions are not read further, while it's full.
+	readyBuffer = 1024
+
+	// deadLetterBackoff is the pause before the failed dead-lettering is retried.
+	deadLetterBackoff = time.Second
+)
+
+// subscriptions keeps the acknowledged deliveries of the consumer groups, while they have consumers.
+//
+// The progress of a group is its committed offsets, so the messages, which were not acked
+// before the last consumer left, are delivered again to the next one.
+type subscriptions struct {
+	mu sync.Mutex
+
+	active map[groupKey]*subscription
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{active: make(map[groupKey]*subscription)}
+}
+
+// subscription shares the messages of a topic between the consumers of a group,
+// every message is delivered to one consumer at a time, until it's acked.
+type subscription struct {
+	key     groupKey
+	offsets *offsetStore
+
+	// stop stops the reading of the partitions and waits until it's finished.
+	stop func()
+
+	// maxAttempts is the number of the deliveries, after which the message is dead-lettered,
+	// zero means the message is delivered, until it's acked.
+	maxAttempts uint32
+
+	// deadLetter moves the message to the dead-letter topic, it's called without the mu,
+	// because the publish is slow and can fail.
+	deadLetter func(ctx context.Context, d *delivery) error
+
+	// maxLag is the number of the not acked messages of a partition, after which
+	// the overflow policy applies, zero never applies it.
+	maxLag         int64
+	overflowPolicy pb.OverflowPolicy
+
+	// partitionOffsets returns the first offset of the partition and the offset of its next message.
+	partitionOffsets func(partition int32) (int64, int64, error)
+
+	mu sync.Mutex
+
+	// consumers is the number of the connected consumers.
+	consumers int
+
+	// ready is the queue of the messages waiting for a consumer, the redelivered ones go first.
+	ready []*delivery
+
+	// inflight is the messages delivered to the consumers and not acked yet.
+	inflight map[deliveryKey]*delivery
+
+	// dead is the queue of the messages out of the delivery attempts,
+	// they are committed, when they are moved to the dead-letter topic.
+	dead []*delivery
+
+	// positions is the offset of the next message to read from every partition.
+	positions map[int32]int64
+
+	// changed is closed and replaced, when the ready or the inflight messages change.
+	changed chan struct{}
+
+	// err is the failure of the partitions reading, the consumers are stopped with it.
+	err error
+
+	// dropped is the number of the messages skipped by the overflow policy.
+	dropped int64
+}
+
+type deliveryKey struct {
+	partition int32
+	offset    int64
+}
+
+type delivery struct {
+	partition int32
+	message   *repo.Message
+
+	// attempt is the number of the times the message was delivered.
+	attempt uint32
+
+	// lastError is the reason of the last failed delivery.
+	lastError string
+
+	// consumer is the current owner of the inflight message, it has to ack it before the deadline.
+	consumer *consumer
+	deadline time.Time
+}
+
+func (d *delivery) key() deliveryKey {
+	return deliveryKey{partition: d.partition, offset: d.message.Offset()}
+}
+
+type consumer struct {
+	sub  *subscription
+	name string
+
+	visibility  time.Duration
+	maxInFlight int
+
+	// inflight is the number of the messages owned by the consumer, guarded by the subscription.
+	inflight int
+
+	// window is the rest of the credit granted by the consumer, guarded by the subscription.
+	window window
+}
+
+func (b *broker) Consume(stream pb.Broker_ConsumeServer) error {
+	in, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	start := in.GetStart()
+	if start == nil {
+		return pkg.ErrorConsumeNotStarted
+	}
+
+	c, err := b.joinSubscription(start)
+	if err != nil {
+		return err
+	}
+	defer b.leaveSubscription(c)
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.receive(stream) }()
+
+	for {
+		// Taking the notification channel before the delivery, so a change in between is not missed.
+		changed := c.sub.changes()
+
+		d, deadline, e := c.take(time.Now())
+		if e != nil {
+			return e
+		}
+
+		if d != nil {
+			response := toMessageResponse(d.partition, d.message)
+			response.DeliveryAttempt = d.attempt
+			if e = stream.Send(response); e != nil {
+				return e
+			}
+
+			continue
+		}
+
+		if ok, e := c.wait(stream.Context(), changed, deadline, errs); !ok {
+			return e
+		}
+	}
+}
+
+// wait returns true, when the subscription is changed or the inflight messages expire,
+// and false, when the consumer is gone, which is not an error, when it just closed the stream.
+func (c *consumer) wait(ctx context.Context, changed <-chan struct{}, deadline time.Time, errs <-chan error) (bool, error) {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+
+		expired = timer.C
+	}
+
+	select {
+	case <-ctx.Done():
+		return false, nil
+	case err := <-errs:
+		return false, err
+	case <-changed:
+	case <-expired:
+	}
+
+	return true, nil
+}
+
+// receive applies the acks and the nacks of the consumer, until it closes the stream.
+func (c *consumer) receive(stream pb.Broker_ConsumeServer) error {
+	for {
+		in, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		switch r := in.Request.(type) {
+		case *pb.ConsumeRequest_Ack:
+			c.ack(deliveryKey{partition: int32(r.Ack.Partition), offset: int64(r.Ack.Offset)})
+		case *pb.ConsumeRequest_Nack:
+			c.nack(deliveryKey{partition: int32(r.Nack.Partition), offset: int64(r.Nack.Offset)}, r.Nack.Error)
+		case *pb.ConsumeRequest_Credit:
+			c.credit(r.Credit)
+		default:
+			return pkg.ErrorConsumeNotStarted
+		}
+	}
+}
+
+// joinSubscription adds the consumer to the subscription of its group, starting the subscription,
+// when it's the first consumer. The settings of the first consumer define the start of the group.
+func (b *broker) joinSubscription(start *pb.ConsumeStart) (*consumer, error) {
+	if err := validateGroup(start.GroupId); err != nil {
+		return nil, err
+	}
+
+	if err := validateDeadLetter(start); err != nil {
+		return nil, err
+	}
+
+	// The dead-letter topic is created before the lock, because in the cluster it takes
+	// a round-trip to the controller, which would block all the other groups.
+	var deadLetter func(ctx context.Context, d *delivery) error
+	if start.MaxDeliveryAttempts != 0 {
+		var err error
+		if deadLetter, err = b.deadLetterTo(start.Topic, start.DeadLetterTopic); err != nil {
+			return nil, err
+		}
+	}
+
+	b.subscriptions.mu.Lock()
+	defer b.subscriptions.mu.Unlock()
+
+	key := groupKey{id: start.GroupId, topic: start.Topic}
+	sub, ok := b.subscriptions.active[key]
+	if !ok {
+		var err error
+		if sub, err = b.startSubscription(key, start, deadLetter); err != nil {
+			return nil, err
+		}
+
+		b.subscriptions.active[key] = sub
+	}
+
+	c := &consumer{
+		sub:         sub,
+		visibility:  defaultVisibilityTimeout,
+		maxInFlight: defaultMaxInFlight,
+		window:      newWindow(start),
+	}
+
+	if start.VisibilityTimeoutMs != 0 {
+		c.visibility = time.Duration(start.VisibilityTimeoutMs) * time.Millisecond
+	}
+
+	if start.MaxInFlight != 0 {
+		c.maxInFlight = int(start.MaxInFlight)
+	}
+
+	sub.mu.Lock()
+	sub.consumers++
+	sub.mu.Unlock()
+
+	c.publishStats()
+	return c, nil
+}
+
+// startSubscription reads the partitions from the committed offsets of the group,
+// or from the offsets of the start policy, when nothing was committed.
+func (b *broker) startSubscription(
+	key groupKey, start *pb.ConsumeStart, deadLetter func(ctx context.Context, d *delivery) error,
+) (*subscription, error) {
+	partitions, err := b.partitions(key.topic, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &subscription{
+		key:       key,
+		offsets:   b.offsets,
+		inflight:  make(map[deliveryKey]*delivery),
+		positions: make(map[int32]int64, len(partitions)),
+		changed:   make(chan struct{}),
+
+		maxAttempts:    start.MaxDeliveryAttempts,
+		deadLetter:     deadLetter,
+		maxLag:         int64(start.MaxLag),
+		overflowPolicy: start.OverflowPolicy,
+		partitionOffsets: func(partition int32) (int64, int64, error) {
+			return b.storage.Offsets(key.topic, partition)
+		},
+	}
+
+	policy := &pb.SubscribeRequest{Topic: key.topic, Policy: start.Policy, Timestamp: start.Timestamp}
+	for _, partition := range partitions {
+		offset, ok := b.offsets.fetch(offsetKey{group: key.id, topic: key.topic, partition: partition})
+		if !ok {
+			if offset, err = b.startOffset(policy, partition); err != nil {
+				return nil, err
+			}
+		}
+
+		sub.positions[partition] = offset
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	if sub.deadLetter != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sub.deadLetterExhausted(ctx)
+		}()
+	}
+
+	wg.Add(len(partitions))
+	for _, partition := range partitions {
+		go func(partition int32, offset int64) {
+			defer wg.Done()
+
+			err := b.tail(ctx, key.topic, partition, offset, pb.IsolationLevel_READ_UNCOMMITTED, func(partition int32, m *repo.Message) error {
+				return sub.enqueue(ctx, partition, m)
+			})
+
+			if err != nil {
+				sub.fail(err)
+			}
+		}(partition, sub.positions[partition])
+	}
+
+	sub.stop = func() {
+		cancel()
+		wg.Wait()
+	}
+
+	return sub, nil
+}
+
+// leaveSubscription returns the messages of the consumer to the others,
+// the subscription is stopped, when the last consumer leaves.
+func (b *broker) leaveSubscription(c *consumer) {
+	consumerStats.Delete(c.name)
+
+	b.subscriptions.mu.Lock()
+
+	sub := c.sub
+	sub.mu.Lock()
+	for _, d := range sub.inflight {
+		if d.consumer == c {
+			sub.redeliver(d, "consumer left")
+		}
+	}
+
+	sub.consumers--
+	last := sub.consumers == 0
+	sub.notify()
+	sub.mu.Unlock()
+
+	// The subscription of the deleted topic may be replaced by the one of the new topic.
+	if last && b.subscriptions.active[sub.key] == sub {
+		delete(b.subscriptions.active, sub.key)
+	}
+	b.subscriptions.mu.Unlock()
+
+	// The stop waits for the pending dead-letter publish, so it's done without the lock,
+	// the next consumer of the group starts the new subscription in the meantime.
+	if last {
+		sub.stop()
+	}
+}
+
+// dropTopic stops the consumers of the deleted topic and drops their deliveries, so they aren't
+// committed after the topic is gone. The consumers of the new topic start the new subscriptions.
+func (s *subscriptions) dropTopic(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, sub := range s.active {
+		if key.topic != topic {
+			continue
+		}
+
+		sub.mu.Lock()
+		sub.err = pkg.ErrorTopicNotFound
+		sub.ready, sub.dead = nil, nil
+		sub.inflight = make(map[deliveryKey]*delivery)
+		sub.notify()
+		sub.mu.Unlock()
+
+		delete(s.active, key)
+	}
+}
+
+func (s *subscription) changes() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.changed
+}
+
+// notify wakes up the consumers and the readers waiting for the changes, guarded by the mu.
+func (s *subscription) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// enqueue adds the read message to the ready ones, waiting while there are too many of them.
+// The message is dropped, when the subscription is stopped, it's read again by the next one.
+func (s *subscription) enqueue(ctx context.Context, partition int32, m *repo.Message) error {
+	var check <-chan time.Time
+	if s.limitsLag() {
+		ticker := time.NewTicker(lagCheckInterval)
+		defer ticker.Stop()
+
+		check = ticker.C
+	}
+
+	for {
+		changed, err := s.push(partition, m)
+		if changed == nil || err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		case <-check:
+		}
+	}
+}
+
+// push adds the message to the ready ones or skips it, when it's behind the lag allowed by
+// the overflow policy. It returns the channel to wait on, when there is no space for the message.
+func (s *subscription) push(partition int32, m *repo.Message) (<-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before, err := s.overflow(partition)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case m.Offset() < before:
+		s.positions[partition] = m.Offset() + 1
+		s.drop(partition, 1)
+	case len(s.ready)+len(s.dead) >= readyBuffer:
+		return s.changed, nil
+	default:
+		s.ready = append(s.ready, &delivery{partition: partition, message: m})
+		s.positions[partition] = m.Offset() + 1
+		s.notify()
+	}
+
+	return nil, nil
+}
+
+func (s *subscription) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+	s.notify()
+}
+
+// redeliver moves the inflight message to the front of the ready ones, guarded by the mu.
+func (s *subscription) redeliver(d *delivery, reason string) {
+	delete(s.inflight, d.key())
+	d.consumer.inflight--
+	d.consumer, d.lastError = nil, reason
+	s.ready = append([]*delivery{d}, s.ready...)
+}
+
+// commit commits the offset of the oldest not acked message of the partition, guarded by the mu.
+// The offsets don't depend on the subscriptions, so they are committed without releasing the lock.
+func (s *subscription) commit(partition int32) {
+	s.offsets.commitAsync(offsetKey{group: s.key.id, topic: s.key.topic, partition: partition}, s.floor(partition))
+}
+
+// take returns the next message for the consumer or nil, when there is nothing to deliver,
+// the consumer has too many unacked messages or no credit left. In the latter case, it also returns
+// the nearest deadline of the inflight messages, when they have to be redelivered.
+func (c *consumer) take(now time.Time) (*delivery, time.Time, error) {
+	s := c.sub
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, time.Time{}, s.err
+	}
+
+	var nearest time.Time
+	for _, d := range s.inflight {
+		if !now.Before(d.deadline) {
+			s.redeliver(d, "visibility timeout expired")
+			continue
+		}
+
+		if nearest.IsZero() || d.deadline.Before(nearest) {
+			nearest = d.deadline
+		}
+	}
+
+	for c.inflight < c.maxInFlight && c.window.open() && len(s.ready) > 0 {
+		d := s.ready[0]
+		s.ready[0] = nil
+		s.ready = s.ready[1:]
+
+		// The readers may wait for the space in the ready messages.
+		s.notify()
+
+		if s.maxAttempts != 0 && d.attempt >= s.maxAttempts {
+			s.dead = append(s.dead, d)
+			continue
+		}
+
+		d.attempt++
+		d.consumer, d.deadline = c, now.Add(c.visibility)
+		s.inflight[d.key()] = d
+		c.inflight++
+		c.window.take(d.message)
+		return d, nearest, nil
+	}
+
+	return nil, nearest, nil
+}
+
+// deadLetterExhausted moves the messages out of the delivery attempts to the dead-letter topic one by one,
+// until the subscription is stopped. The failed message is retried after the backoff, the consumers
+// aren't blocked by it, the ones left at the stop are delivered again by the next subscription.
+func (s *subscription) deadLetterExhausted(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		changed := s.changed
+
+		var d *delivery
+		if len(s.dead) != 0 {
+			d = s.dead[0]
+		}
+		s.mu.Unlock()
+
+		if d == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+
+			continue
+		}
+
+		if err := s.deadLetter(ctx, d); err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(deadLetterBackoff):
+			}
+
+			continue
+		}
+
+		s.mu.Lock()
+
+		// The deliveries are dropped, when the topic is deleted.
+		if len(s.dead) != 0 && s.dead[0] == d {
+			s.dead[0] = nil
+			s.dead = s.dead[1:]
+			s.commit(d.partition)
+			s.notify()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// ack removes the message from the subscription and commits the offset, before which
+// all messages of the partition are acked. The late acks of the redelivered messages are accepted too.
+func (c *consumer) ack(key deliveryKey) {
+	s := c.sub
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d, ok := s.inflight[key]; ok {
+		delete(s.inflight, key)
+		d.consumer.inflight--
+	} else if i := s.readyIndex(key); i >= 0 {
+		s.ready = append(s.ready[:i], s.ready[i+1:]...)
+	} else {
+		return
+	}
+
+	s.commit(key.partition)
+	s.notify()
+}
+
+// nack redelivers the message right away, the nacks of the messages owned by the others are ignored.
+func (c *consumer) nack(key deliveryKey, reason string) {
+	s := c.sub
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d, ok := s.inflight[key]; ok && d.consumer == c {
+		s.redeliver(d, reason)
+		s.notify()
+	}
+}
+
+func (s *subscription) readyIndex(key deliveryKey) int {
+	for i, d := range s.ready {
+		if d.key() == key {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// floor returns the offset of the oldest not acked message of the partition, guarded by the mu.
+func (s *subscription) floor(partition int32) int64 {
+	floor := s.positions[partition]
+	for _, d := range s.inflight {
+		if d.partition == partition && d.message.Offset() < floor {
+			floor = d.message.Offset()
+		}
+	}
+
+	for _, ds := range [][]*delivery{s.ready, s.dead} {
+		for _, d := range ds {
+			if d.partition == partition && d.message.Offset() < floor {
+				floor = d.message.Offset()
+			}
+		}
+	}
+
+	return floor
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"google.golang.org/grpc"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// consumeStream is the consumer side of the Consume stream, the requests are sent
+// with the channel, which is closed to end the stream.
+type consumeStream struct {
+	grpc.ServerStream
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	requests  chan *pb.ConsumeRequest
+	responses chan *pb.MessageResponse
+	done      chan error
+	stopped   sync.Once
+}
+
+func startConsumer(t *testing.T, b Broker, start *pb.ConsumeStart) *consumeStream {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	s := &consumeStream{
+		ctx:       ctx,
+		cancel:    cancel,
+		requests:  make(chan *pb.ConsumeRequest, 16),
+		responses: make(chan *pb.MessageResponse, 16),
+		done:      make(chan error, 1),
+	}
+
+	t.Cleanup(s.stop)
+
+	s.requests <- &pb.ConsumeRequest{Request: &pb.ConsumeRequest_Start{Start: start}}
+	go func() { s.done <- b.Consume(s) }()
+	return s
+}
+
+func (s *consumeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *consumeStream) Recv() (*pb.ConsumeRequest, error) {
+	select {
+	case in, ok := <-s.requests:
+		if !ok {
+			return nil, io.EOF
+		}
+
+		return in, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func (s *consumeStream) Send(m *pb.MessageResponse) error {
+	select {
+	case s.responses <- m:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// stop closes the stream and waits until the broker is done with it.
+func (s *consumeStream) stop() {
+	s.stopped.Do(func() {
+		s.cancel()
+		<-s.done
+	})
+}
+
+func (s *consumeStream) receive(t *testing.T) *pb.MessageResponse {
+	select {
+	case m := <-s.responses:
+		return m
+	case <-s.ctx.Done():
+		t.Fatalf("expected a message, got %v", s.ctx.Err())
+		return nil
+	}
+}
+
+func (s *consumeStream) ack(m *pb.MessageResponse) {
+	s.requests <- &pb.ConsumeRequest{Request: &pb.ConsumeRequest_Ack{
+		Ack: &pb.Ack{Partition: m.Partition, Offset: m.Offset},
+	}}
+}
+
+func (s *consumeStream) nack(m *pb.MessageResponse) {
+	s.requests <- &pb.ConsumeRequest{Request: &pb.ConsumeRequest_Nack{
+		Nack: &pb.Nack{Partition: m.Partition, Offset: m.Offset, Error: "failed"},
+	}}
+}
+
+func TestBroker_Consume(t *testing.T) {
+	type delivered struct {
+		body    string
+		attempt uint32
+	}
+
+	testCases := []struct {
+		name     string
+		start    *pb.ConsumeStart
+		respond  func(s *consumeStream, m *pb.MessageResponse, i int)
+		expected []delivered
+	}{
+		{
+			name:  "success, acked messages are delivered once",
+			start: &pb.ConsumeStart{Topic: "topic1", GroupId: "group1", Policy: pb.OffsetPolicy_EARLIEST},
+			respond: func(s *consumeStream, m *pb.MessageResponse, _ int) {
+				s.ack(m)
+			},
+			expected: []delivered{{"a", 1}, {"b", 1}, {"c", 1}},
+		},
+		{
+			name:  "success, nacked message is redelivered",
+			start: &pb.ConsumeStart{Topic: "topic1", GroupId: "group1", Policy: pb.OffsetPolicy_EARLIEST, MaxInFlight: 1},
+			respond: func(s *consumeStream, m *pb.MessageResponse, i int) {
+				if i == 1 {
+					s.nack(m)
+					return
+				}
+
+				s.ack(m)
+			},
+			expected: []delivered{{"a", 1}, {"b", 1}, {"b", 2}, {"c", 1}},
+		},
+		{
+			name: "success, not acked message is redelivered after the visibility timeout",
+			start: &pb.ConsumeStart{
+				Topic: "topic1", GroupId: "group1", Policy: pb.OffsetPolicy_EARLIEST, MaxInFlight: 1, VisibilityTimeoutMs: 50,
+			},
+			respond: func(s *consumeStream, m *pb.MessageResponse, i int) {
+				if i != 0 {
+					s.ack(m)
+				}
+			},
+			expected: []delivered{{"a", 1}, {"a", 2}, {"b", 1}, {"c", 1}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBroker(t, repo.NewBrokerStorage("topic1"))
+			publish(t, b, "a", "b", "c")
+
+			s := startConsumer(t, b, tc.start)
+			for i, expected := range tc.expected {
+				m := s.receive(t)
+				if string(m.Body) != expected.body || m.DeliveryAttempt != expected.attempt {
+					t.Fatalf("expected %s with attempt %d, got %s with attempt %d", expected.body, expected.attempt, m.Body, m.DeliveryAttempt)
+				}
+
+				tc.respond(s, m, i)
+			}
+
+			// The acks are applied in the background, waiting for the commit of all of them.
+			deadline := time.Now().Add(time.Second)
+			for {
+				out, err := b.FetchCommittedOffset(context.Background(), &pb.FetchCommittedOffsetRequest{
+					GroupId: "group1", Topic: "topic1",
+				})
+				if err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+
+				if out.Offset == 3 {
+					break
+				}
+
+				if time.Now().After(deadline) {
+					t.Fatalf("expected committed offset %d, got %d", 3, out.Offset)
+				}
+
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestBroker_ConsumeRedelivery(t *testing.T) {
+	b := newTestBroker(t, repo.NewBrokerStorage("topic1"))
+	publish(t, b, "a", "b")
+
+	start := &pb.ConsumeStart{Topic: "topic1", GroupId: "group1", Policy: pb.OffsetPolicy_EARLIEST, MaxInFlight: 1}
+	first := startConsumer(t, b, start)
+	second := startConsumer(t, b, start)
+
+	// Every consumer takes one message, the messages aren't acked.
+	taken, kept := first.receive(t), second.receive(t)
+	if string(taken.Body) == string(kept.Body) {
+		t.Fatalf("expected the messages to be shared, got %s twice", taken.Body)
+	}
+
+	// The message of the crashed consumer goes to the live one, once it has the space for it.
+	first.stop()
+	second.ack(kept)
+
+	m := second.receive(t)
+	if string(m.Body) != string(taken.Body) || m.DeliveryAttempt != 2 {
+		t.Errorf("expected %s with attempt %d, got %s with attempt %d", taken.Body, 2, m.Body, m.DeliveryAttempt)
+	}
+
+	// The redelivered message isn't acked, so the next consumers of the group start from it.
+	second.stop()
+	third := startConsumer(t, b, start)
+	if m = third.receive(t); string(m.Body) != string(taken.Body) || m.DeliveryAttempt != 1 {
+		t.Errorf("expected %s with attempt %d, got %s with attempt %d", taken.Body, 1, m.Body, m.DeliveryAttempt)
+	}
+}
+
+func TestBroker_ConsumeFailure(t *testing.T) {
+	testCases := []struct {
+		name        string
+		first       *pb.ConsumeRequest
+		expectedErr error
+	}{
+		{
+			name:        "failure, ack before the start",
+			first:       &pb.ConsumeRequest{Request: &pb.ConsumeRequest_Ack{Ack: &pb.Ack{}}},
+			expectedErr: pkg.ErrorConsumeNotStarted,
+		},
+		{
+			name: "failure, group required",
+			first: &pb.ConsumeRequest{Request: &pb.ConsumeRequest_Start{
+				Start: &pb.ConsumeStart{Topic: "topic1"},
+			}},
+			expectedErr: pkg.ErrorGroupRequired,
+		},
+		{
+			name: "failure, topic not found",
+			first: &pb.ConsumeRequest{Request: &pb.ConsumeRequest_Start{
+				Start: &pb.ConsumeStart{Topic: "unknown", GroupId: "group1"},
+			}},
+			expectedErr: pkg.ErrorTopicNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBroker(t, repo.NewBrokerStorage("topic1"))
+			s := &consumeStream{ctx: context.Background(), requests: make(chan *pb.ConsumeRequest, 1)}
+			s.requests <- tc.first
+
+			if err := b.Consume(s); !errors.Is(err, tc.expectedErr) {
+				t.Errorf("expected %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
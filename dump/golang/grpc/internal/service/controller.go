@@ -0,0 +1,216 @@
+package service
+
+import (
+	"context"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/raft"
+	"github.com/fadyat/grpc-broker/pkg"
+	"time"
+)
+
+// applyMetadata brings the topics of the storage in line with the committed metadata change,
+// the failures are not reported, the topic is validated by the controller before the change.
+func (b *broker) applyMetadata(cmd metadataCommand) {
+	switch cmd.Type {
+	case commandCreateTopic:
+		_ = b.storage.CreateTopic(cmd.Topic, len(cmd.Replicas), cmd.Config)
+		b.replicateTopic(cmd.Topic)
+	case commandDeleteTopic:
+		_ = b.dropTopic(cmd.Topic)
+		_ = b.storage.DeleteTopic(cmd.Topic)
+	case commandBrokers:
+		// The brokers, which don't lead the partitions anymore, follow the new leaders.
+		for _, topic := range b.cluster.meta.topicNames() {
+			b.replicateTopic(topic)
+		}
+	}
+}
+
+// startLeaderEpoch stamps the messages appended by this broker as the new leader of the partition with its epoch.
+// The partitions of the created topic are stamped with the zero epoch, until the first election,
+// no other leader appends to them before.
+func (b *broker) startLeaderEpoch(key partitionKey, epoch int32) {
+	_ = b.storage.StartLeaderEpoch(key.topic, key.partition, epoch)
+
+	// The new leader of the delayed messages delivers the ones, which it replicated from the previous one.
+	// The wheel is rebuilt in the background, the metadata is locked until it returns.
+	if key == delayedPartition {
+		go func() { _ = b.delayed.reload() }()
+	}
+}
+
+// registerTopics creates the topics in the cluster, once the controller is elected.
+func (b *broker) registerTopics(topics []string) {
+	for _, topic := range topics {
+		for !b.cluster.meta.hasTopic(topic) {
+			ctx, cancel := context.WithTimeout(b.cluster.ctx, b.cluster.opts.SessionTimeout)
+			_, err := b.CreateTopic(ctx, &pb.CreateTopicRequest{Name: topic})
+			cancel()
+
+			if err == nil {
+				break
+			}
+
+			select {
+			case <-b.cluster.ctx.Done():
+				return
+			case <-time.After(replicationBackoff):
+			}
+		}
+	}
+}
+
+// createClusterTopic creates the validated topic on all brokers, the other brokers forward it to the controller.
+func (b *broker) createClusterTopic(ctx context.Context, in *pb.CreateTopicRequest, partitions int) (*pb.TopicDescription, error) {
+	if !b.cluster.node.IsLeader() {
+		client, forwarded, err := b.cluster.controller(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return client.CreateTopic(forwarded, in)
+	}
+
+	b.cluster.proposeMu.Lock()
+	defer b.cluster.proposeMu.Unlock()
+
+	if b.cluster.meta.hasTopic(in.Name) {
+		return nil, pkg.ErrorTopicAlreadyExists
+	}
+
+	err := b.cluster.propose(ctx, metadataCommand{
+		Type:     commandCreateTopic,
+		Topic:    in.Name,
+		Config:   in.Config,
+		Replicas: b.cluster.assignReplicas(in.Name, partitions),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.DescribeTopic(ctx, &pb.DescribeTopicRequest{Name: in.Name})
+}
+
+// deleteClusterTopic deletes the topic on all brokers, the other brokers forward it to the controller.
+func (b *broker) deleteClusterTopic(ctx context.Context, in *pb.DeleteTopicRequest) (*pb.DeleteTopicResponse, error) {
+	if !b.cluster.node.IsLeader() {
+		client, forwarded, err := b.cluster.controller(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return client.DeleteTopic(forwarded, in)
+	}
+
+	b.cluster.proposeMu.Lock()
+	defer b.cluster.proposeMu.Unlock()
+
+	if !b.cluster.meta.hasTopic(in.Name) {
+		return nil, pkg.ErrorTopicNotFound
+	}
+
+	if err := b.cluster.propose(ctx, metadataCommand{Type: commandDeleteTopic, Topic: in.Name}); err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteTopicResponse{}, nil
+}
+
+func (b *broker) Metadata(_ context.Context, in *pb.MetadataRequest) (*pb.MetadataResponse, error) {
+	if b.cluster != nil {
+		out := b.cluster.meta.describe(b.cluster.opts.Brokers, in.Topics)
+		if id, ok := b.cluster.node.Leader(); ok {
+			controller := uint32(id)
+			out.ControllerId = &controller
+		}
+
+		return out, nil
+	}
+
+	// The single broker leads all partitions, it's the broker 0 without the known address.
+	controller := uint32(0)
+	out := &pb.MetadataResponse{
+		Brokers:      []*pb.BrokerMetadata{{Id: controller, Alive: true}},
+		ControllerId: &controller,
+	}
+
+	topics := in.Topics
+	if len(topics) == 0 {
+		topics = b.storage.Topics()
+	}
+
+	for _, name := range topics {
+		d, err := b.storage.DescribeTopic(name)
+		if err != nil || isInternalTopic(name) {
+			continue
+		}
+
+		topic := &pb.TopicMetadata{Name: name}
+		for _, p := range d.Partitions {
+			topic.Partitions = append(topic.Partitions, &pb.PartitionMetadata{Id: uint32(p.ID), Replicas: []uint32{0}, Isr: []uint32{0}})
+		}
+
+		out.Topics = append(out.Topics, topic)
+	}
+
+	return out, nil
+}
+
+func (b *broker) AlterIsr(ctx context.Context, in *pb.AlterIsrRequest) (*pb.AlterIsrResponse, error) {
+	if b.cluster == nil {
+		return nil, pkg.ErrorNoController
+	}
+
+	if !b.cluster.node.IsLeader() {
+		return nil, pkg.ErrorNotController
+	}
+
+	if err := b.cluster.proposeIsr(ctx, in); err != nil {
+		return nil, err
+	}
+
+	return &pb.AlterIsrResponse{}, nil
+}
+
+func (b *broker) RequestVote(_ context.Context, in *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+	if b.cluster == nil {
+		return nil, pkg.ErrorNoController
+	}
+
+	out, err := b.cluster.node.HandleVote(&raft.VoteRequest{
+		Term:         in.Term,
+		CandidateID:  int32(in.CandidateId),
+		LastLogIndex: in.LastLogIndex,
+		LastLogTerm:  in.LastLogTerm,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RequestVoteResponse{Term: out.Term, Granted: out.Granted}, nil
+}
+
+func (b *broker) AppendEntries(_ context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+	if b.cluster == nil {
+		return nil, pkg.ErrorNoController
+	}
+
+	entries := make([]raft.Entry, len(in.Entries))
+	for i, e := range in.Entries {
+		entries[i] = raft.Entry{Term: e.Term, Command: e.Command}
+	}
+
+	out, err := b.cluster.node.HandleAppend(&raft.AppendRequest{
+		Term:         in.Term,
+		LeaderID:     int32(in.LeaderId),
+		PrevLogIndex: in.PrevLogIndex,
+		PrevLogTerm:  in.PrevLogTerm,
+		Entries:      entries,
+		LeaderCommit: in.LeaderCommit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.AppendEntriesResponse{Term: out.Term, Success: out.Success, LastLogIndex: out.LastLogIndex}, nil
+}
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"strconv"
+)
+
+const (
+
+	// The headers of the dead-lettered messages, they tell where the message came from and why.
+	deadLetterTopicHeader     = "dlq.topic"
+	deadLetterPartitionHeader = "dlq.partition"
+	deadLetterOffsetHeader    = "dlq.offset"
+	deadLetterErrorHeader     = "dlq.error"
+	deadLetterAttemptsHeader  = "dlq.attempts"
+
+	// redriveGroup is the internal consumer group, which commits the redriven offsets of the dead-letter topics.
+	redriveGroup = "__redrive"
+
+	// expiredDeadLetterConfig is the topic setting, which moves the expired messages to the dead-letter topic
+	// instead of dropping them.
+	expiredDeadLetterConfig = "message.ttl.dead.letter.topic"
+
+	// expiredError is the dead-letter error of the expired messages.
+	expiredError = "message expired"
+)
+
+var deadLetterHeaders = []string{
+	deadLetterTopicHeader,
+	deadLetterPartitionHeader,
+	deadLetterOffsetHeader,
+	deadLetterErrorHeader,
+	deadLetterAttemptsHeader,
+}
+
+func validateDeadLetter(start *pb.ConsumeStart) error {
+	if start.MaxDeliveryAttempts == 0 {
+		return nil
+	}
+
+	switch {
+	case start.DeadLetterTopic == "":
+		return fmt.Errorf("%w: it's required by the max delivery attempts", pkg.ErrorInvalidDeadLetter)
+	case start.DeadLetterTopic == start.Topic:
+		return fmt.Errorf("%w: it's the consumed topic", pkg.ErrorInvalidDeadLetter)
+	case isInternalTopic(start.DeadLetterTopic):
+		return pkg.ErrorInternalTopic
+	}
+
+	return nil
+}
+
+// deadLetterTo creates the dead-letter topic, when it doesn't exist,
+// and returns the function moving the messages of the source topic to it.
+func (b *broker) deadLetterTo(source, topic string) (func(ctx context.Context, d *delivery) error, error) {
+	// The topic is created like by the clients, so in the cluster it goes through the controller.
+	_, err := b.storage.DescribeTopic(topic)
+	if errors.Is(err, pkg.ErrorTopicNotFound) {
+		_, err = b.CreateTopic(context.Background(), &pb.CreateTopicRequest{Name: topic, Partitions: 1})
+	}
+
+	if err != nil && !errors.Is(err, pkg.ErrorTopicAlreadyExists) {
+		return nil, err
+	}
+
+	return func(ctx context.Context, d *delivery) error {
+		headers := make(map[string][]byte, len(d.message.Headers())+len(deadLetterHeaders))
+		for k, v := range d.message.Headers() {
+			headers[k] = v
+		}
+
+		headers[deadLetterTopicHeader] = []byte(source)
+		headers[deadLetterPartitionHeader] = []byte(strconv.Itoa(int(d.partition)))
+		headers[deadLetterOffsetHeader] = []byte(strconv.FormatInt(d.message.Offset(), 10))
+		headers[deadLetterErrorHeader] = []byte(d.lastError)
+		if d.attempt != 0 {
+			headers[deadLetterAttemptsHeader] = []byte(strconv.Itoa(int(d.attempt)))
+		}
+
+		_, e := b.Publish(ctx, &pb.PublishRequest{
+			Topic:     topic,
+			Body:      d.message.Content(),
+			Key:       d.message.Key(),
+			Headers:   headers,
+			Timestamp: toTimestamp(d.message.ProducerTimestamp()),
+		})
+
+		return e
+	}, nil
+}
+
+// validateExpiredDeadLetter checks the dead-letter topic of the expired messages in the topic config.
+func validateExpiredDeadLetter(topic string, config map[string]string) error {
+	switch deadLetter := config[expiredDeadLetterConfig]; {
+	case deadLetter == "":
+		return nil
+	case deadLetter == topic:
+		return fmt.Errorf("%w: it's the topic itself", pkg.ErrorInvalidDeadLetter)
+	case isInternalTopic(deadLetter):
+		return pkg.ErrorInternalTopic
+	}
+
+	return nil
+}
+
+// deadLetterExpired moves the expired messages, which are removed by the storage, to the dead-letter topic
+// of their topic, when it's configured. After a failure the moved messages are moved once again.
+func (b *broker) deadLetterExpired(topic string, partition int32, messages []*repo.Message) error {
+	d, err := b.storage.DescribeTopic(topic)
+	if errors.Is(err, pkg.ErrorTopicNotFound) {
+		return nil
+	}
+
+	if err != nil || d.Config[expiredDeadLetterConfig] == "" {
+		return err
+	}
+
+	send, err := b.deadLetterTo(topic, d.Config[expiredDeadLetterConfig])
+	if err != nil {
+		return err
+	}
+
+	for _, m := range messages {
+		if err = send(context.Background(), &delivery{partition: partition, message: m, lastError: expiredError}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *broker) Redrive(ctx context.Context, in *pb.RedriveRequest) (*pb.RedriveResponse, error) {
+	if isInternalTopic(in.DeadLetterTopic) {
+		return nil, pkg.ErrorInternalTopic
+	}
+
+	partitions, err := b.partitions(in.DeadLetterTopic, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	b.redriveMu.Lock()
+	defer b.redriveMu.Unlock()
+
+	out := &pb.RedriveResponse{}
+	for _, partition := range partitions {
+		if err = b.redrivePartition(ctx, in, partition, out); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// redrivePartition moves the messages appended before the call and commits the progress after every one of them,
+// so the failed redrive is continued by the next one.
+func (b *broker) redrivePartition(ctx context.Context, in *pb.RedriveRequest, partition int32, out *pb.RedriveResponse) error {
+	start, end, err := b.storage.Offsets(in.DeadLetterTopic, partition)
+	if err != nil {
+		return err
+	}
+
+	key := offsetKey{group: redriveGroup, topic: in.DeadLetterTopic, partition: partition}
+	offset, ok := b.offsets.fetch(key)
+	if !ok || offset < start {
+		offset = start
+	}
+
+	for offset < end && (in.Limit == 0 || out.Redriven < uint64(in.Limit)) {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		m, e := b.storage.Explore(in.DeadLetterTopic, partition, offset)
+		if errors.Is(e, pkg.ErrorOffsetOutOfRange) {
+			return nil
+		}
+
+		if e != nil {
+			return e
+		}
+
+		moved, e := b.redriveMessage(ctx, m)
+		if e != nil {
+			return e
+		}
+
+		if moved {
+			out.Redriven++
+		} else {
+			out.Skipped++
+		}
+
+		offset = m.Offset() + 1
+		b.offsets.commitAsync(key, offset)
+	}
+
+	return nil
+}
+
+// redriveMessage publishes the message to the partition it was dead-lettered from. The messages without
+// the source or with the source, which doesn't exist anymore, are skipped.
+func (b *broker) redriveMessage(ctx context.Context, m *repo.Message) (bool, error) {
+	source := string(m.Headers()[deadLetterTopicHeader])
+	partition, err := strconv.ParseUint(string(m.Headers()[deadLetterPartitionHeader]), 10, 32)
+	if source == "" || err != nil || isInternalTopic(source) {
+		return false, nil
+	}
+
+	headers := make(map[string][]byte, len(m.Headers()))
+	for k, v := range m.Headers() {
+		if !pkg.In(deadLetterHeaders, k) {
+			headers[k] = v
+		}
+	}
+
+	p := uint32(partition)
+	_, err = b.Publish(ctx, &pb.PublishRequest{
+		Topic:     source,
+		Body:      m.Content(),
+		Key:       m.Key(),
+		Partition: &p,
+		Headers:   headers,
+		Timestamp: toTimestamp(m.ProducerTimestamp()),
+	})
+
+	if errors.Is(err, pkg.ErrorTopicNotFound) || errors.Is(err, pkg.ErrorPartitionNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
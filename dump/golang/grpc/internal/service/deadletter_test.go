@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBroker_ConsumeDeadLetter(t *testing.T) {
+	storage := repo.NewBrokerStorage("topic1")
+	b := newTestBroker(t, storage)
+	publish(t, b, "a", "b")
+
+	s := startConsumer(t, b, &pb.ConsumeStart{
+		Topic:               "topic1",
+		GroupId:             "group1",
+		Policy:              pb.OffsetPolicy_EARLIEST,
+		MaxInFlight:         1,
+		MaxDeliveryAttempts: 2,
+		DeadLetterTopic:     "topic1-dlq",
+	})
+
+	for attempt := uint32(1); attempt <= 2; attempt++ {
+		m := s.receive(t)
+		if string(m.Body) != "a" || m.DeliveryAttempt != attempt {
+			t.Fatalf("expected a with attempt %d, got %s with attempt %d", attempt, m.Body, m.DeliveryAttempt)
+		}
+
+		s.nack(m)
+	}
+
+	// The failing message doesn't block the next one.
+	m := s.receive(t)
+	if string(m.Body) != "b" || m.DeliveryAttempt != 1 {
+		t.Fatalf("expected b with attempt 1, got %s with attempt %d", m.Body, m.DeliveryAttempt)
+	}
+
+	s.ack(m)
+
+	// The message is dead-lettered in the background, so the consumers aren't blocked by the publish.
+	waitForEnd(t, storage, "topic1-dlq", 1)
+	dead, err := storage.Explore("topic1-dlq", 0, 0)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	expectedHeaders := map[string]string{
+		deadLetterTopicHeader:     "topic1",
+		deadLetterPartitionHeader: "0",
+		deadLetterOffsetHeader:    "0",
+		deadLetterErrorHeader:     "failed",
+		deadLetterAttemptsHeader:  "2",
+	}
+
+	if string(dead.Content()) != "a" || len(dead.Headers()) != len(expectedHeaders) {
+		t.Errorf("expected a with %v, got %s with %v", expectedHeaders, dead.Content(), dead.Headers())
+	}
+
+	for k, v := range expectedHeaders {
+		if string(dead.Headers()[k]) != v {
+			t.Errorf("expected header %s=%s, got %s", k, v, dead.Headers()[k])
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		expected *pb.RedriveResponse
+	}{
+		{
+			name:     "success, dead-lettered message is moved back",
+			expected: &pb.RedriveResponse{Redriven: 1},
+		},
+		{
+			name:     "success, moved message is not moved again",
+			expected: &pb.RedriveResponse{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, e := b.Redrive(context.Background(), &pb.RedriveRequest{DeadLetterTopic: "topic1-dlq"})
+			if e != nil {
+				t.Fatalf("expected nil, got %v", e)
+			}
+
+			if out.Redriven != tc.expected.Redriven || out.Skipped != tc.expected.Skipped {
+				t.Errorf("expected %v, got %v", tc.expected, out)
+			}
+		})
+	}
+
+	// The redriven message is delivered again, without the dead-letter headers.
+	m = s.receive(t)
+	if string(m.Body) != "a" || m.Offset != 2 || len(m.Headers) != 0 {
+		t.Errorf("expected a at %d without headers, got %s at %d with %v", 2, m.Body, m.Offset, m.Headers)
+	}
+}
+
+// failingStorage fails the saves to the topic, until it's repaired, every failure is signaled.
+type failingStorage struct {
+	repo.Storage
+
+	topic    string
+	repaired atomic.Bool
+	failed   chan struct{}
+}
+
+func (s *failingStorage) SaveBatch(topic string, partition int32, messages []*repo.Message) (int64, error) {
+	if topic == s.topic && !s.repaired.Load() {
+		select {
+		case s.failed <- struct{}{}:
+		default:
+		}
+
+		return 0, errors.New("disk failure")
+	}
+
+	return s.Storage.SaveBatch(topic, partition, messages)
+}
+
+func TestBroker_ConsumeDeadLetterFailure(t *testing.T) {
+	storage := &failingStorage{Storage: repo.NewBrokerStorage("topic1"), topic: "topic1-dlq", failed: make(chan struct{}, 1)}
+	b := newTestBroker(t, storage)
+	publish(t, b, "a", "b")
+
+	s := startConsumer(t, b, &pb.ConsumeStart{
+		Topic:               "topic1",
+		GroupId:             "group1",
+		Policy:              pb.OffsetPolicy_EARLIEST,
+		MaxInFlight:         1,
+		MaxDeliveryAttempts: 1,
+		DeadLetterTopic:     "topic1-dlq",
+	})
+
+	s.nack(s.receive(t))
+	select {
+	case <-storage.failed:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the dead-lettering to fail, got nothing")
+	}
+
+	// The consumers get the next message, while the failed one waits for the retry.
+	m := s.receive(t)
+	if string(m.Body) != "b" {
+		t.Fatalf("expected b, got %s", m.Body)
+	}
+
+	s.ack(m)
+	select {
+	case err := <-s.done:
+		t.Fatalf("expected the stream to continue, got %v", err)
+	default:
+	}
+
+	storage.repaired.Store(true)
+	waitForEnd(t, storage, "topic1-dlq", 1)
+}
+
+func TestBroker_ConsumeDeadLetterValidation(t *testing.T) {
+	testCases := []struct {
+		name        string
+		start       *pb.ConsumeStart
+		expectedErr error
+	}{
+		{
+			name:        "failure, dead-letter topic required",
+			start:       &pb.ConsumeStart{Topic: "topic1", GroupId: "group1", MaxDeliveryAttempts: 3},
+			expectedErr: pkg.ErrorInvalidDeadLetter,
+		},
+		{
+			name: "failure, dead-letter topic is the consumed one",
+			start: &pb.ConsumeStart{
+				Topic: "topic1", GroupId: "group1", MaxDeliveryAttempts: 3, DeadLetterTopic: "topic1",
+			},
+			expectedErr: pkg.ErrorInvalidDeadLetter,
+		},
+		{
+			name: "failure, internal dead-letter topic",
+			start: &pb.ConsumeStart{
+				Topic: "topic1", GroupId: "group1", MaxDeliveryAttempts: 3, DeadLetterTopic: offsetsTopic,
+			},
+			expectedErr: pkg.ErrorInternalTopic,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBroker(t, repo.NewBrokerStorage("topic1"))
+			s := startConsumer(t, b, tc.start)
+
+			select {
+			case err := <-s.done:
+				if !errors.Is(err, tc.expectedErr) {
+					t.Errorf("expected %v, got %v", tc.expectedErr, err)
+				}
+
+				// The stream is finished, the cleanup has nothing to wait for.
+				s.done <- err
+			case <-time.After(time.Second):
+				t.Fatalf("expected %v, got nothing", tc.expectedErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"sync"
+	"time"
+)
+
+const (
+
+	// delayedTopic is the internal topic, where the delayed messages wait for the delivery.
+	// The delivered ones are deleted with the tombstones, so the topic is compacted.
+	delayedTopic = "__delayed_messages"
+
+	// wheelTick is the precision of the delayed delivery, the messages are delivered up to it late.
+	wheelTick = 10 * time.Millisecond
+
+	// wheelSize is the number of the buckets on every level of the timing wheel.
+	wheelSize = 64
+
+	// redeliveryDelay is the time, after which the failed delivery of a delayed message is retried.
+	redeliveryDelay = time.Second
+
+	// deliveryTimeout limits the publish of the due message, so the unreachable leader
+	// of its partition doesn't hold the delivery of the other ones.
+	deliveryTimeout = 5 * time.Second
+)
+
+// delayedPartition is the only partition of the delayedTopic, in the cluster its leader delivers the messages.
+var delayedPartition = partitionKey{topic: delayedTopic}
+
+// scheduledMessage is the delayed message, the request has the partition and the delivery time resolved.
+type scheduledMessage struct {
+	id      []byte
+	at      int64
+	request *pb.PublishRequest
+}
+
+// scheduler holds the delayed messages until their time comes and appends them to the partitions.
+//
+// The messages are saved to the delayedTopic before they are acknowledged, so they are as durable
+// as the storage itself, and the wheel is rebuilt from the topic on start. The message, which was
+// delivered right before the crash, may be delivered once again.
+//
+// In the cluster the delayedTopic is replicated like the other topics, its leader delivers all messages,
+// the other brokers forward the scheduled ones to it. The new leader rebuilds the wheel from its replica.
+type scheduler struct {
+	storage repo.Storage
+
+	// cluster is set for the broker of the cluster, before the delivery is started.
+	cluster *cluster
+
+	// publish appends the due message to its partition like the publisher would,
+	// so in the cluster it's appended by the leader of the partition.
+	publish func(ctx context.Context, in *pb.PublishRequest) error
+
+	// mu guards the wheel and orders the scheduled messages with its rebuilding.
+	mu    sync.Mutex
+	wheel *timingWheel
+
+	// wake interrupts the waiting for the next tick, when a nearer message is added.
+	wake chan struct{}
+
+	// done stops the delivery, stopped is closed, when the delivering message is saved,
+	// it's closed from the start, until the delivery is started.
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+func newScheduler(storage repo.Storage, publish func(ctx context.Context, in *pb.PublishRequest) error) (*scheduler, error) {
+	err := storage.CreateTopic(delayedTopic, 1, map[string]string{"cleanup.policy": "compact"})
+	if err != nil && !errors.Is(err, pkg.ErrorTopicAlreadyExists) {
+		return nil, err
+	}
+
+	s := &scheduler{
+		storage: storage,
+		publish: publish,
+		wheel:   newTimingWheel(wheelTick.Milliseconds(), wheelSize, time.Now().UnixMilli()),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	close(s.stopped)
+	if err = s.replay(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// start starts the delivery, the broker starts it, once it's ready to publish the due messages.
+func (s *scheduler) start() {
+	s.stopped = make(chan struct{})
+	go s.run()
+}
+
+// replay restores the not yet delivered messages from the delayedTopic.
+func (s *scheduler) replay() error {
+	start, end, err := s.storage.Offsets(delayedTopic, 0)
+	if err != nil {
+		return err
+	}
+
+	pending := make(map[string]*scheduledMessage)
+	for offset := start; offset < end; {
+		m, e := s.storage.Explore(delayedTopic, 0, offset)
+		if e != nil {
+			return e
+		}
+
+		offset = m.Offset() + 1
+		if len(m.Content()) == 0 {
+			delete(pending, string(m.Key()))
+			continue
+		}
+
+		request := &pb.PublishRequest{}
+		if e = proto.Unmarshal(m.Content(), request); e != nil {
+			return fmt.Errorf("malformed delayed message %x: %w", m.Key(), e)
+		}
+
+		pending[string(m.Key())] = &scheduledMessage{id: m.Key(), at: request.DeliverAt.AsTime().UnixMilli(), request: request}
+	}
+
+	// The overdue messages are delivered by the first tick.
+	now := time.Now().UnixMilli()
+	for _, m := range pending {
+		if !s.wheel.add(m, now) {
+			m.at = now + 1
+			s.wheel.add(m, now)
+		}
+	}
+
+	return nil
+}
+
+// reload rebuilds the wheel from the delayedTopic, when this broker starts to deliver the messages.
+func (s *scheduler) reload() error {
+	s.mu.Lock()
+	s.wheel = newTimingWheel(wheelTick.Milliseconds(), wheelSize, time.Now().UnixMilli())
+	err := s.replay()
+	s.mu.Unlock()
+
+	s.wakeUp()
+	return err
+}
+
+// leader returns the broker, which delivers the delayed messages, and reports, whether it's this one.
+func (s *scheduler) leader() (int32, bool) {
+	if s.cluster == nil {
+		return 0, true
+	}
+
+	return s.cluster.leads(delayedPartition)
+}
+
+// schedule saves the message to be delivered to the partition at the time. In the cluster it's forwarded
+// to the broker delivering the messages, the publish with all acks returns, when its in-sync replicas have it.
+func (s *scheduler) schedule(ctx context.Context, in *pb.PublishRequest, partition int32, at time.Time) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	p := uint32(partition)
+	request := &pb.PublishRequest{
+		Topic:     in.Topic,
+		Body:      in.Body,
+		Key:       in.Key,
+		Partition: &p,
+		Headers:   in.Headers,
+		Timestamp: in.Timestamp,
+		DeliverAt: timestamppb.New(at),
+		Ttl:       in.Ttl,
+	}
+
+	if leader, ok := s.leader(); !ok {
+		request.Acks = in.Acks
+		return s.forward(ctx, leader, request)
+	}
+
+	content, err := proto.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	// The message is saved and added together, so the rebuilt wheel has it once.
+	key := []byte(hex.EncodeToString(id))
+	s.mu.Lock()
+	stored, err := s.storage.Save(delayedTopic, 0, repo.NewMessage(key, content))
+	if err == nil {
+		s.addLocked(&scheduledMessage{id: key, at: at.UnixMilli(), request: request})
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	s.wakeUp()
+	if in.Acks != pb.Acks_ACKS_ALL || s.cluster == nil {
+		return nil
+	}
+
+	return s.cluster.awaitReplicas(ctx, delayedPartition, stored)
+}
+
+// forward sends the message to the broker delivering the delayed messages,
+// the message forwarded already isn't forwarded again.
+func (s *scheduler) forward(ctx context.Context, leader int32, request *pb.PublishRequest) error {
+	if forwarded(ctx) {
+		return s.cluster.notLeader(leader)
+	}
+
+	client, err := s.cluster.peer(leader)
+	if err != nil {
+		return err
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, forwardedHeader, "true")
+	_, err = client.Schedule(ctx, &pb.ScheduleRequest{Request: request})
+	return err
+}
+
+// add puts the message into the wheel, the due message is put to the next tick.
+func (s *scheduler) add(m *scheduledMessage) {
+	s.mu.Lock()
+	s.addLocked(m)
+	s.mu.Unlock()
+
+	s.wakeUp()
+}
+
+func (s *scheduler) addLocked(m *scheduledMessage) {
+	now := time.Now().UnixMilli()
+	if !s.wheel.add(m, now) {
+		m.at = now + 1
+		s.wheel.add(m, now)
+	}
+}
+
+// wakeUp interrupts the waiting for the next tick, so the nearer message isn't delivered late.
+func (s *scheduler) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scheduler) run() {
+	defer close(s.stopped)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		due := s.wheel.advance(time.Now().UnixMilli())
+		next := s.wheel.next()
+		s.mu.Unlock()
+
+		for _, m := range due {
+			s.deliver(m)
+		}
+
+		wait := time.Hour
+		if next != 0 {
+			wait = time.Until(time.UnixMilli(next))
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// close stops the delivery, the messages not delivered yet stay in the delayedTopic until the restart.
+func (s *scheduler) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	<-s.stopped
+}
+
+// deliver publishes the message to its partition and deletes it from the delayedTopic. The messages
+// of the deleted topics are dropped, the other failures are retried later. The broker, which doesn't
+// deliver the messages anymore, drops them, the new one has them in its replica.
+func (s *scheduler) deliver(m *scheduledMessage) {
+	if _, ok := s.leader(); !ok {
+		return
+	}
+
+	in := proto.Clone(m.request).(*pb.PublishRequest)
+	in.DeliverAt = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	err := s.publish(ctx, in)
+	cancel()
+
+	if err != nil && !errors.Is(err, pkg.ErrorTopicNotFound) && !errors.Is(err, pkg.ErrorPartitionNotFound) {
+		m.at = time.Now().Add(redeliveryDelay).UnixMilli()
+		s.add(m)
+		return
+	}
+
+	// The tombstone isn't retried, the message is delivered once again after the restart at worst.
+	_, _ = s.storage.Save(delayedTopic, 0, repo.NewMessage(m.id, nil))
+}
+
+// deliveryTime returns the time of the delayed delivery requested by the publisher, or zero,
+// when the message is delivered right away.
+func deliveryTime(in *pb.PublishRequest, now time.Time) (time.Time, error) {
+	switch {
+	case in.ProducerId != 0 && (in.DeliverAfter != nil || in.DeliverAt != nil):
+		return time.Time{}, fmt.Errorf("%w: the idempotent messages can't be delayed", pkg.ErrorInvalidDelay)
+	case in.DeliverAfter != nil && in.DeliverAt != nil:
+		return time.Time{}, fmt.Errorf("%w: deliver_after and deliver_at can't be combined", pkg.ErrorInvalidDelay)
+	case in.DeliverAfter != nil:
+		if err := in.DeliverAfter.CheckValid(); err != nil || in.DeliverAfter.AsDuration() < 0 {
+			return time.Time{}, fmt.Errorf("%w: deliver_after must be non-negative", pkg.ErrorInvalidDelay)
+		}
+
+		if in.DeliverAfter.AsDuration() == 0 {
+			return time.Time{}, nil
+		}
+
+		return now.Add(in.DeliverAfter.AsDuration()), nil
+	case in.DeliverAt != nil:
+		if err := in.DeliverAt.CheckValid(); err != nil {
+			return time.Time{}, fmt.Errorf("%w: %v", pkg.ErrorInvalidDelay, err)
+		}
+
+		if !in.DeliverAt.AsTime().After(now) {
+			return time.Time{}, nil
+		}
+
+		return in.DeliverAt.AsTime(), nil
+	default:
+		return time.Time{}, nil
+	}
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+	"time"
+)
+
+// waitForEnd waits until the first partition of the topic has the expected end offset,
+// the topic may be created in the meantime.
+func waitForEnd(t *testing.T, storage repo.Storage, topic string, expected int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, end, err := storage.Offsets(topic, 0)
+		if err != nil && !errors.Is(err, pkg.ErrorTopicNotFound) {
+			t.Fatalf("expected nil, got %v", err)
+		}
+
+		if end == expected {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages, got %d", expected, end)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBroker_PublishDelayed(t *testing.T) {
+	testCases := []struct {
+		name        string
+		request     *pb.PublishRequest
+		deliverAt   time.Duration
+		delayed     bool
+		expectedErr error
+	}{
+		{
+			name:    "success, deliver after",
+			request: &pb.PublishRequest{Topic: "topic1", Body: []byte("a"), DeliverAfter: durationpb.New(100 * time.Millisecond)},
+			delayed: true,
+		},
+		{
+			name:      "success, deliver at",
+			request:   &pb.PublishRequest{Topic: "topic1", Body: []byte("a")},
+			deliverAt: 100 * time.Millisecond,
+			delayed:   true,
+		},
+		{
+			name:      "success, deliver at the past time",
+			request:   &pb.PublishRequest{Topic: "topic1", Body: []byte("a")},
+			deliverAt: -time.Minute,
+		},
+		{
+			name:        "failure, both delays",
+			request:     &pb.PublishRequest{Topic: "topic1", DeliverAfter: durationpb.New(time.Minute)},
+			deliverAt:   time.Minute,
+			expectedErr: pkg.ErrorInvalidDelay,
+		},
+		{
+			name:        "failure, negative delay",
+			request:     &pb.PublishRequest{Topic: "topic1", DeliverAfter: durationpb.New(-time.Minute)},
+			expectedErr: pkg.ErrorInvalidDelay,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			storage := repo.NewBrokerStorage("topic1")
+			b := newTestBroker(t, storage)
+
+			published := time.Now()
+			if tc.deliverAt != 0 {
+				tc.request.DeliverAt = timestamppb.New(published.Add(tc.deliverAt))
+			}
+
+			out, err := b.Publish(context.Background(), tc.request)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected %v, got %v", tc.expectedErr, err)
+			}
+
+			if tc.expectedErr != nil {
+				return
+			}
+
+			if tc.delayed != (out.DeliverAt != nil) {
+				t.Fatalf("expected delayed %v, got %v", tc.delayed, out.DeliverAt)
+			}
+
+			if tc.delayed {
+				// The subscribers don't see the message before its time.
+				if _, end, _ := storage.Offsets("topic1", 0); end != 0 {
+					t.Fatalf("expected no messages, got %d", end)
+				}
+			}
+
+			waitForEnd(t, storage, "topic1", 1)
+			m, err := storage.Explore("topic1", 0, 0)
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if tc.delayed && m.Timestamp().Before(out.DeliverAt.AsTime().Truncate(time.Millisecond)) {
+				t.Errorf("expected the delivery after %v, got %v", out.DeliverAt.AsTime(), m.Timestamp())
+			}
+
+			if !tc.delayed && m.Timestamp().Before(published.Truncate(time.Millisecond)) {
+				t.Errorf("expected the delivery right away, got %v", m.Timestamp())
+			}
+		})
+	}
+}
+
+func TestBroker_PublishDelayedRestart(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := repo.NewFileStorage(dir, repo.FileOptions{}, "topic1")
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	b := newTestBroker(t, storage)
+	for _, delay := range []time.Duration{200 * time.Millisecond, time.Hour} {
+		_, err = b.Publish(context.Background(), &pb.PublishRequest{
+			Topic: "topic1", Body: []byte(delay.String()), DeliverAfter: durationpb.New(delay),
+		})
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+
+	// The broker is stopped before the delivery, the next one delivers the message.
+	if err = storage.Close(); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	reopened, err := repo.NewFileStorage(dir, repo.FileOptions{})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer reopened.Close()
+
+	newTestBroker(t, reopened)
+	waitForEnd(t, reopened, "topic1", 1)
+
+	m, err := reopened.Explore("topic1", 0, 0)
+	if err != nil || string(m.Content()) != "200ms" {
+		t.Fatalf("expected 200ms, got %v and %v", m, err)
+	}
+
+	// The delivered message is deleted with the tombstone, only the hour delay is restored.
+	waitForEnd(t, reopened, delayedTopic, 3)
+	restored, err := newScheduler(reopened, nil)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer restored.close()
+
+	restored.mu.Lock()
+	defer restored.mu.Unlock()
+
+	if due := restored.wheel.advance(time.Now().Add(time.Minute).UnixMilli()); len(due) != 0 {
+		t.Errorf("expected no messages due in a minute, got %d", len(due))
+	}
+
+	if due := restored.wheel.advance(time.Now().Add(2 * time.Hour).UnixMilli()); len(due) != 1 {
+		t.Errorf("expected the hour delay to be due, got %d messages", len(due))
+	}
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"sync/atomic"
+	"time"
+)
+
+// lagCheckInterval is how often the reader waiting for the space in the ready messages checks the lag,
+// so the group falling behind is noticed, while nothing is read.
+const lagCheckInterval = 100 * time.Millisecond
+
+var (
+	// consumerStats publishes the lag and the buffer usage of the connected consumers,
+	// the consumer is removed from it, when it leaves.
+	consumerStats = expvar.NewMap("broker.consumers")
+
+	// droppedMessages counts the messages skipped by the DROP_OLDEST policy per group and topic.
+	droppedMessages = expvar.NewMap("broker.dropped_messages")
+
+	consumerIDs atomic.Int64
+)
+
+// window is the credit granted by the consumer, only the limits enabled by the start are tracked.
+// The bytes go below zero, when the sent message is larger than the rest of the grant.
+type window struct {
+	byMessages bool
+	messages   int64
+
+	byBytes bool
+	bytes   int64
+}
+
+func newWindow(start *pb.ConsumeStart) window {
+	w := window{byMessages: start.CreditMessages != nil, byBytes: start.CreditBytes != nil}
+	w.grant(start.GetCreditMessages(), start.GetCreditBytes())
+	return w
+}
+
+func (w *window) open() bool {
+	return (!w.byMessages || w.messages > 0) && (!w.byBytes || w.bytes > 0)
+}
+
+func (w *window) grant(messages uint32, bytes uint64) {
+	if w.byMessages {
+		w.messages += int64(messages)
+	}
+
+	if w.byBytes {
+		w.bytes += int64(bytes)
+	}
+}
+
+func (w *window) take(m *repo.Message) {
+	if w.byMessages {
+		w.messages--
+	}
+
+	if w.byBytes {
+		w.bytes -= m.Size()
+	}
+}
+
+// credit adds the grant of the consumer to its window and wakes it up.
+func (c *consumer) credit(in *pb.Credit) {
+	s := c.sub
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.window.grant(in.Messages, in.Bytes)
+	s.notify()
+}
+
+// limitsLag reports, whether the overflow policy of the subscription is applied by the readers.
+func (s *subscription) limitsLag() bool {
+	return s.maxLag != 0 && s.overflowPolicy != pb.OverflowPolicy_BLOCK
+}
+
+// overflow applies the overflow policy, when the partition lags more than allowed, guarded by the mu.
+// It returns the offset, before which the messages of the partition are dropped.
+func (s *subscription) overflow(partition int32) (int64, error) {
+	if !s.limitsLag() {
+		return 0, nil
+	}
+
+	_, end, err := s.partitionOffsets(partition)
+	if err != nil {
+		return 0, err
+	}
+
+	lag := end - s.floor(partition)
+	if lag <= s.maxLag {
+		return 0, nil
+	}
+
+	if s.overflowPolicy == pb.OverflowPolicy_DISCONNECT {
+		return 0, fmt.Errorf("%w: partition %d lags %d messages", pkg.ErrorConsumerTooSlow, partition, lag)
+	}
+
+	// The inflight messages are kept, they are processed by the consumers already.
+	before := end - s.maxLag
+	dropped := 0
+	for i, d := range s.ready {
+		if d.partition == partition && d.message.Offset() < before {
+			dropped++
+			continue
+		}
+
+		s.ready[i-dropped] = d
+	}
+
+	if dropped != 0 {
+		for i := len(s.ready) - dropped; i < len(s.ready); i++ {
+			s.ready[i] = nil
+		}
+
+		s.ready = s.ready[:len(s.ready)-dropped]
+		s.drop(partition, dropped)
+		s.notify()
+	}
+
+	return before, nil
+}
+
+// drop counts the skipped messages and commits past them, guarded by the mu.
+func (s *subscription) drop(partition int32, count int) {
+	s.dropped += int64(count)
+	droppedMessages.Add(s.key.id+"/"+s.key.topic, int64(count))
+	s.commit(partition)
+}
+
+// lag returns the number of the not acked messages of all partitions, guarded by the mu.
+func (s *subscription) lag() int64 {
+	var lag int64
+	for partition := range s.positions {
+		_, end, err := s.partitionOffsets(partition)
+		if err != nil {
+			continue
+		}
+
+		if behind := end - s.floor(partition); behind > 0 {
+			lag += behind
+		}
+	}
+
+	return lag
+}
+
+// consumerStat is the state of the consumer published in the broker.consumers, the lag,
+// the buffered and the dropped messages are shared by the consumers of the group.
+type consumerStat struct {
+	Group    string `json:"group"`
+	Topic    string `json:"topic"`
+	Lag      int64  `json:"lag"`
+	Buffered int    `json:"buffered"`
+	Dropped  int64  `json:"dropped"`
+
+	InFlight    int `json:"in_flight"`
+	MaxInFlight int `json:"max_in_flight"`
+
+	// The credits are omitted, when the flow control by them is disabled.
+	CreditMessages *int64 `json:"credit_messages,omitempty"`
+	CreditBytes    *int64 `json:"credit_bytes,omitempty"`
+}
+
+func (c *consumer) stats() consumerStat {
+	s := c.sub
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stat := consumerStat{
+		Group:       s.key.id,
+		Topic:       s.key.topic,
+		Lag:         s.lag(),
+		Buffered:    len(s.ready),
+		Dropped:     s.dropped,
+		InFlight:    c.inflight,
+		MaxInFlight: c.maxInFlight,
+	}
+
+	if c.window.byMessages {
+		messages := c.window.messages
+		stat.CreditMessages = &messages
+	}
+
+	if c.window.byBytes {
+		bytes := c.window.bytes
+		stat.CreditBytes = &bytes
+	}
+
+	return stat
+}
+
+// publishStats adds the consumer to the broker.consumers, until it leaves.
+func (c *consumer) publishStats() {
+	c.name = fmt.Sprintf("%s/%s/%d", c.sub.key.id, c.sub.key.topic, consumerIDs.Add(1))
+	consumerStats.Set(c.name, expvar.Func(func() any { return c.stats() }))
+}
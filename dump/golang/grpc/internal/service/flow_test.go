@@ -0,0 +1,212 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (s *consumeStream) credit(messages uint32, bytes uint64) {
+	s.requests <- &pb.ConsumeRequest{Request: &pb.ConsumeRequest_Credit{
+		Credit: &pb.Credit{Messages: messages, Bytes: bytes},
+	}}
+}
+
+// expectNothing checks, that nothing is sent to the consumer for a while.
+func (s *consumeStream) expectNothing(t *testing.T) {
+	select {
+	case m := <-s.responses:
+		t.Fatalf("expected no messages, got %s", m.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// finished waits until the broker ends the stream and returns its error, the error is kept for the stop.
+func (s *consumeStream) finished(t *testing.T) error {
+	select {
+	case err := <-s.done:
+		s.done <- err
+		return err
+	case <-s.ctx.Done():
+		t.Fatalf("expected the stream to be finished, got %v", s.ctx.Err())
+		return nil
+	}
+}
+
+func TestBroker_ConsumeCredits(t *testing.T) {
+	credit := func(v uint32) *uint32 { return &v }
+	creditBytes := func(v uint64) *uint64 { return &v }
+
+	testCases := []struct {
+		name     string
+		start    *pb.ConsumeStart
+		granted  []string
+		messages uint32
+		bytes    uint64
+		expected []string
+	}{
+		{
+			name:     "success, messages are sent within the message credit",
+			start:    &pb.ConsumeStart{CreditMessages: credit(2)},
+			granted:  []string{"a", "bb"},
+			messages: 1,
+			expected: []string{"ccc"},
+		},
+		{
+			name:     "success, message larger than the rest of the byte credit is sent",
+			start:    &pb.ConsumeStart{CreditBytes: creditBytes(2)},
+			granted:  []string{"a", "bb"},
+			bytes:    4,
+			expected: []string{"ccc"},
+		},
+		{
+			name:     "success, both credits are required",
+			start:    &pb.ConsumeStart{CreditMessages: credit(3), CreditBytes: creditBytes(1)},
+			granted:  []string{"a"},
+			bytes:    2,
+			expected: []string{"bb"},
+		},
+		{
+			name:     "success, credit without the flow control is ignored",
+			start:    &pb.ConsumeStart{},
+			granted:  []string{"a", "bb", "ccc"},
+			expected: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBroker(t, repo.NewBrokerStorage("topic1"))
+			publish(t, b, "a", "bb", "ccc")
+
+			tc.start.Topic, tc.start.GroupId, tc.start.Policy = "topic1", "group1", pb.OffsetPolicy_EARLIEST
+			s := startConsumer(t, b, tc.start)
+			for _, body := range tc.granted {
+				if m := s.receive(t); string(m.Body) != body {
+					t.Fatalf("expected %s, got %s", body, m.Body)
+				}
+			}
+
+			s.expectNothing(t)
+			s.credit(tc.messages, tc.bytes)
+			for _, body := range tc.expected {
+				if m := s.receive(t); string(m.Body) != body {
+					t.Fatalf("expected %s, got %s", body, m.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestBroker_ConsumeOverflow(t *testing.T) {
+	testCases := []struct {
+		name        string
+		policy      pb.OverflowPolicy
+		expected    []string
+		expectedErr error
+	}{
+		{
+			name:     "success, block delivers all messages",
+			policy:   pb.OverflowPolicy_BLOCK,
+			expected: []string{"a", "b", "c", "d", "e"},
+		},
+		{
+			name:     "success, drop oldest keeps the newest messages",
+			policy:   pb.OverflowPolicy_DROP_OLDEST,
+			expected: []string{"c", "d", "e"},
+		},
+		{
+			name:        "failure, disconnect closes the stream",
+			policy:      pb.OverflowPolicy_DISCONNECT,
+			expectedErr: pkg.ErrorConsumerTooSlow,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBroker(t, repo.NewBrokerStorage("topic1"))
+			publish(t, b, "a", "b", "c", "d", "e")
+
+			s := startConsumer(t, b, &pb.ConsumeStart{
+				Topic: "topic1", GroupId: "group1", Policy: pb.OffsetPolicy_EARLIEST, MaxLag: 3, OverflowPolicy: tc.policy,
+			})
+
+			if tc.expectedErr != nil {
+				if err := s.finished(t); !errors.Is(err, tc.expectedErr) {
+					t.Fatalf("expected %v, got %v", tc.expectedErr, err)
+				}
+
+				return
+			}
+
+			for _, body := range tc.expected {
+				m := s.receive(t)
+				if string(m.Body) != body {
+					t.Fatalf("expected %s, got %s", body, m.Body)
+				}
+
+				s.ack(m)
+			}
+		})
+	}
+}
+
+func TestBroker_ConsumeStats(t *testing.T) {
+	b := newTestBroker(t, repo.NewBrokerStorage("topic1"))
+	publish(t, b, "a", "b", "c")
+
+	messages := uint32(1)
+	s := startConsumer(t, b, &pb.ConsumeStart{
+		Topic: "topic1", GroupId: "stats", Policy: pb.OffsetPolicy_EARLIEST, CreditMessages: &messages,
+	})
+	s.receive(t)
+
+	stat := func() *consumerStat {
+		var found *consumerStat
+		consumerStats.Do(func(kv expvar.KeyValue) {
+			if strings.HasPrefix(kv.Key, "stats/topic1/") {
+				found = &consumerStat{}
+				if err := json.Unmarshal([]byte(kv.Value.String()), found); err != nil {
+					t.Fatalf("expected nil, got %v", err)
+				}
+			}
+		})
+
+		return found
+	}
+
+	// The rest of the messages are read by the subscription, waiting for the credit.
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := stat()
+		if got == nil {
+			t.Fatalf("expected the consumer stats to be published")
+		}
+
+		if got.Buffered == 2 {
+			if got.Lag != 3 || got.InFlight != 1 || got.CreditMessages == nil || *got.CreditMessages != 0 {
+				t.Fatalf("expected lag 3, one inflight message and no credit, got %+v", got)
+			}
+
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d buffered messages, got %+v", 2, got)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// The consumer is removed from the stats, when it leaves.
+	s.stop()
+	if got := stat(); got != nil {
+		t.Errorf("expected nil, got %+v", got)
+	}
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"fmt"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"sync"
+)
+
+// coordinator spreads the partitions of a topic across the live members of the consumer groups.
+//
+// Every group is bound to a single topic, members of the same group subscribed to
+// different topics are treated as the separate groups.
+type coordinator struct {
+	mu sync.Mutex
+
+	// groups is the map of the groups with at least one member.
+	groups map[groupKey]*group
+
+	// joined is the counter of the joined members, used to generate their ids.
+	joined uint64
+}
+
+type groupKey struct {
+	id    string
+	topic string
+}
+
+type group struct {
+	key groupKey
+
+	// generation is increased on every rebalance.
+	generation uint32
+
+	// strategy is chosen by the first member of the group.
+	strategy pb.AssignmentStrategy
+
+	// partitions is the number of partitions in the topic.
+	partitions int
+
+	// members is the list of the live members in the order they joined.
+	members []*member
+
+	// owners is the current owner of each partition.
+	owners map[int32]*member
+
+	// positions is the offset of the next message to read from each partition,
+	// so the new owner continues from where the previous one stopped.
+	positions map[int32]int64
+}
+
+type member struct {
+	id    string
+	group *group
+
+	// assignments holds the latest not yet received assignment of the member.
+	assignments chan *pb.Assignment
+}
+
+func newCoordinator() *coordinator {
+	return &coordinator{groups: make(map[groupKey]*group)}
+}
+
+// join adds a member to the group and rebalances it.
+func (c *coordinator) join(groupID, topic string, partitions int, strategy pb.AssignmentStrategy) *member {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := groupKey{id: groupID, topic: topic}
+	g, ok := c.groups[key]
+	if !ok {
+		g = &group{
+			key:        key,
+			strategy:   strategy,
+			partitions: partitions,
+			owners:     make(map[int32]*member),
+			positions:  make(map[int32]int64),
+		}
+		c.groups[key] = g
+	}
+
+	c.joined++
+	m := &member{
+		id:          fmt.Sprintf("%s-%d", groupID, c.joined),
+		group:       g,
+		assignments: make(chan *pb.Assignment, 1),
+	}
+
+	g.members = append(g.members, m)
+	c.rebalance(g)
+	return m
+}
+
+// leave removes a member from the group and rebalances the rest of it.
+// Leaving twice is a no-op, so it's safe to leave on both timeout and disconnect.
+func (c *coordinator) leave(m *member) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g := m.group
+	for i, other := range g.members {
+		if other != m {
+			continue
+		}
+
+		g.members = append(g.members[:i], g.members[i+1:]...)
+		if len(g.members) == 0 {
+			// The group of the deleted topic may be replaced by the one of the new topic.
+			if c.groups[g.key] == g {
+				delete(c.groups, g.key)
+			}
+
+			return
+		}
+
+		c.rebalance(g)
+		return
+	}
+}
+
+// dropTopic forgets the groups of the deleted topic with their positions,
+// their members are stopped by the failed reading of the topic.
+func (c *coordinator) dropTopic(topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.groups {
+		if key.topic == topic {
+			delete(c.groups, key)
+		}
+	}
+}
+
+// rebalance assigns the partitions to the members and notifies them.
+func (c *coordinator) rebalance(g *group) {
+	g.generation++
+
+	assign := rangeAssign
+	if g.strategy == pb.AssignmentStrategy_ROUND_ROBIN {
+		assign = roundRobinAssign
+	}
+
+	g.owners = make(map[int32]*member, g.partitions)
+	for i, partitions := range assign(len(g.members), g.partitions) {
+		m := g.members[i]
+		a := &pb.Assignment{MemberId: m.id, Generation: g.generation, Partitions: make([]uint32, 0, len(partitions))}
+		for _, p := range partitions {
+			g.owners[p] = m
+			a.Partitions = append(a.Partitions, uint32(p))
+		}
+
+		// Replacing the pending assignment, the member is interested in the latest one only.
+		select {
+		case <-m.assignments:
+		default:
+		}
+
+		m.assignments <- a
+	}
+}
+
+// position returns the offset, from which the member should start reading a partition.
+func (c *coordinator) position(m *member, partition int32) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offset, ok := m.group.positions[partition]
+	return offset, ok
+}
+
+// advance records, that the member has read the message with the offset from a partition.
+// Members, which already lost the partition, can't move the position anymore.
+func (c *coordinator) advance(m *member, partition int32, offset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if m.group.owners[partition] == m {
+		m.group.positions[partition] = offset + 1
+	}
+}
+
+// rangeAssign gives every member a contiguous range of partitions,
+// the first members get one partition more, when they can't be divided evenly.
+func rangeAssign(members, partitions int) [][]int32 {
+	assignment := make([][]int32, members)
+	per, extra := partitions/members, partitions%members
+
+	next := int32(0)
+	for i := range assignment {
+		count := per
+		if i < extra {
+			count++
+		}
+
+		assignment[i] = make([]int32, 0, count)
+		for j := 0; j < count; j++ {
+			assignment[i] = append(assignment[i], next)
+			next++
+		}
+	}
+
+	return assignment
+}
+
+// roundRobinAssign deals the partitions to the members one by one.
+func roundRobinAssign(members, partitions int) [][]int32 {
+	assignment := make([][]int32, members)
+	for p := 0; p < partitions; p++ {
+		assignment[p%members] = append(assignment[p%members], int32(p))
+	}
+
+	return assignment
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"google.golang.org/grpc"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAssign(t *testing.T) {
+	testCases := []struct {
+		name       string
+		assign     func(members, partitions int) [][]int32
+		members    int
+		partitions int
+		expected   [][]int32
+	}{
+		{
+			name:       "range, divided evenly",
+			assign:     rangeAssign,
+			members:    2,
+			partitions: 4,
+			expected:   [][]int32{{0, 1}, {2, 3}},
+		},
+		{
+			name:       "range, first members get more",
+			assign:     rangeAssign,
+			members:    3,
+			partitions: 5,
+			expected:   [][]int32{{0, 1}, {2, 3}, {4}},
+		},
+		{
+			name:       "range, more members than partitions",
+			assign:     rangeAssign,
+			members:    3,
+			partitions: 2,
+			expected:   [][]int32{{0}, {1}, {}},
+		},
+		{
+			name:       "round-robin, dealt one by one",
+			assign:     roundRobinAssign,
+			members:    2,
+			partitions: 5,
+			expected:   [][]int32{{0, 2, 4}, {1, 3}},
+		},
+		{
+			name:       "round-robin, more members than partitions",
+			assign:     roundRobinAssign,
+			members:    3,
+			partitions: 2,
+			expected:   [][]int32{{0}, {1}, nil},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := tc.assign(tc.members, tc.partitions); !reflect.DeepEqual(tc.expected, actual) {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func receiveAssignment(t *testing.T, m *member) *pb.Assignment {
+	select {
+	case a := <-m.assignments:
+		return a
+	default:
+		t.Fatalf("expected assignment for %s", m.id)
+		return nil
+	}
+}
+
+func TestCoordinator_Rebalance(t *testing.T) {
+	c := newCoordinator()
+
+	first := c.join("group", "topic1", 4, pb.AssignmentStrategy_RANGE)
+	if a := receiveAssignment(t, first); !reflect.DeepEqual(a.Partitions, []uint32{0, 1, 2, 3}) {
+		t.Errorf("expected all partitions, got %v", a.Partitions)
+	}
+
+	c.advance(first, 2, 10)
+	second := c.join("group", "topic1", 4, pb.AssignmentStrategy_ROUND_ROBIN)
+
+	a1, a2 := receiveAssignment(t, first), receiveAssignment(t, second)
+	if a1.Generation != 2 || a2.Generation != 2 {
+		t.Errorf("expected generation %d, got %d and %d", 2, a1.Generation, a2.Generation)
+	}
+
+	// The strategy of the first member is kept.
+	if !reflect.DeepEqual(a1.Partitions, []uint32{0, 1}) || !reflect.DeepEqual(a2.Partitions, []uint32{2, 3}) {
+		t.Errorf("expected range assignment, got %v and %v", a1.Partitions, a2.Partitions)
+	}
+
+	// The revoked partition can't be moved by the previous owner.
+	c.advance(first, 2, 20)
+	if offset, _ := c.position(second, 2); offset != 11 {
+		t.Errorf("expected %d, got %d", 11, offset)
+	}
+
+	c.leave(first)
+	c.leave(first)
+	if a := receiveAssignment(t, second); !reflect.DeepEqual(a.Partitions, []uint32{0, 1, 2, 3}) {
+		t.Errorf("expected all partitions, got %v", a.Partitions)
+	}
+
+	c.leave(second)
+	if len(c.groups) != 0 {
+		t.Errorf("expected no groups, got %d", len(c.groups))
+	}
+}
+
+// groupStream passes the sent messages to the test one by one, the send is blocked, until the test receives it.
+type groupStream struct {
+	grpc.ServerStream
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	responses chan *pb.MessageResponse
+	done      chan error
+}
+
+func startGroupSubscriber(t *testing.T, b Broker, in *pb.SubscribeRequest) *groupStream {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	s := &groupStream{ctx: ctx, cancel: cancel, responses: make(chan *pb.MessageResponse), done: make(chan error, 1)}
+	t.Cleanup(cancel)
+
+	go func() { s.done <- b.Subscribe(in, s) }()
+	return s
+}
+
+func (s *groupStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *groupStream) Send(m *pb.MessageResponse) error {
+	select {
+	case s.responses <- m:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *groupStream) receive(t *testing.T) *pb.MessageResponse {
+	select {
+	case m := <-s.responses:
+		return m
+	case <-s.ctx.Done():
+		t.Fatalf("expected a message, got %v", s.ctx.Err())
+		return nil
+	}
+}
+
+// stop closes the stream and returns the result of the subscription.
+func (s *groupStream) stop() error {
+	s.cancel()
+	return <-s.done
+}
+
+func TestBroker_SubscribeGroup(t *testing.T) {
+	b := newTestBroker(t, repo.NewBrokerStorage())
+	if _, err := b.CreateTopic(context.Background(), &pb.CreateTopicRequest{Name: "topic1", Partitions: 2}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	publishTo := func(partition uint32, body string) {
+		in := &pb.PublishRequest{Topic: "topic1", Body: []byte(body), Partition: &partition}
+		if _, err := b.Publish(context.Background(), in); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+
+	in := &pb.SubscribeRequest{Topic: "topic1", GroupId: "group1", Policy: pb.OffsetPolicy_EARLIEST, SessionTimeoutMs: 200}
+	first := startGroupSubscriber(t, b, in)
+	if a := first.receive(t).Assignment; !reflect.DeepEqual(a.GetPartitions(), []uint32{0, 1}) {
+		t.Fatalf("expected all partitions, got %v", a)
+	}
+
+	// The second member takes half of the partitions.
+	second := startGroupSubscriber(t, b, in)
+	a1, a2 := first.receive(t).Assignment, second.receive(t).Assignment
+	if !reflect.DeepEqual(a1.GetPartitions(), []uint32{0}) || !reflect.DeepEqual(a2.GetPartitions(), []uint32{1}) {
+		t.Fatalf("expected partitions 0 and 1, got %v and %v", a1, a2)
+	}
+
+	publishTo(0, "a")
+	publishTo(1, "b")
+	if m := first.receive(t); string(m.Body) != "a" || m.Partition != 0 {
+		t.Errorf("expected a from partition 0, got %v", m)
+	}
+
+	if m := second.receive(t); string(m.Body) != "b" || m.Partition != 1 {
+		t.Errorf("expected b from partition 1, got %v", m)
+	}
+
+	// The second member stops reading, its partition goes to the first one, when the send expires,
+	// the message, which wasn't sent, is delivered to the first member.
+	publishTo(1, "c")
+	if a := first.receive(t).Assignment; !reflect.DeepEqual(a.GetPartitions(), []uint32{0, 1}) {
+		t.Fatalf("expected all partitions, got %v", a)
+	}
+
+	if m := first.receive(t); string(m.Body) != "c" || m.Partition != 1 {
+		t.Errorf("expected c from partition 1, got %v", m)
+	}
+
+	if err := second.stop(); !errors.Is(err, pkg.ErrorSessionTimeout) {
+		t.Errorf("expected %v, got %v", pkg.ErrorSessionTimeout, err)
+	}
+
+	if err := first.stop(); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/pkg"
+	"sort"
+	"sync"
+)
+
+// The kinds of the metadata changes in the raft log.
+const (
+	commandCreateTopic = "create_topic"
+	commandDeleteTopic = "delete_topic"
+	commandBrokers     = "brokers"
+	commandIsr         = "isr"
+)
+
+// metadataCommand is the change of the cluster metadata, it's proposed by the controller
+// and applied by every broker in the order of the raft log.
+type metadataCommand struct {
+	Type   string            `json:"type"`
+	Topic  string            `json:"topic,omitempty"`
+	Config map[string]string `json:"config,omitempty"`
+
+	// Replicas are the brokers keeping the partitions of the created topic, the first alive one leads,
+	// all of them are in sync.
+	Replicas [][]int32 `json:"replicas,omitempty"`
+
+	// Alive are the brokers reachable by the controller, the partitions of the rest are led by the other replicas.
+	Alive []int32 `json:"alive,omitempty"`
+
+	// Partition, LeaderEpoch, IsrVersion and Isr are the in-sync replicas of the partition proposed by its leader,
+	// the change of the previous leader or the one based on the stale in-sync replicas is dropped.
+	Partition   int32   `json:"partition,omitempty"`
+	LeaderEpoch int32   `json:"leader_epoch,omitempty"`
+	IsrVersion  int32   `json:"isr_version,omitempty"`
+	Isr         []int32 `json:"isr,omitempty"`
+}
+
+// partitionMetadata is replaced as a whole, when it changes, so its copy is safe to read without the lock.
+type partitionMetadata struct {
+	replicas []int32
+	leader   int32
+	epoch    int32
+
+	// isr are the in-sync replicas, the leader included, only they lead the partition after the leader is lost,
+	// isrVersion grows, every time they change.
+	isr        []int32
+	isrVersion int32
+}
+
+// metadataState is the topic registry and the leaders of the partitions, every broker applies
+// the same changes in the same order, so they agree on them.
+type metadataState struct {
+	mu     sync.Mutex
+	topics map[string][]*partitionMetadata
+
+	// alive are the brokers reachable by the controller, all of them are alive at the start.
+	alive map[int32]bool
+
+	// elected is called with the new leader of the partition and its in-sync replicas under the lock,
+	// so the leader starts its epoch, before anyone finds out, that it leads the partition.
+	elected func(key partitionKey, leader, epoch int32, isr []int32)
+}
+
+func newMetadataState(ids []int32, elected func(key partitionKey, leader, epoch int32, isr []int32)) *metadataState {
+	m := &metadataState{
+		topics:  make(map[string][]*partitionMetadata),
+		alive:   make(map[int32]bool, len(ids)),
+		elected: elected,
+	}
+
+	for _, id := range ids {
+		m.alive[id] = true
+	}
+
+	return m
+}
+
+func decodeCommand(raw []byte) (metadataCommand, error) {
+	var cmd metadataCommand
+	err := json.Unmarshal(raw, &cmd)
+	return cmd, err
+}
+
+func (m *metadataState) apply(cmd metadataCommand) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch cmd.Type {
+	case commandCreateTopic:
+		if _, ok := m.topics[cmd.Topic]; ok {
+			return
+		}
+
+		partitions := make([]*partitionMetadata, len(cmd.Replicas))
+		m.topics[cmd.Topic] = partitions
+		for i, replicas := range cmd.Replicas {
+			key := partitionKey{topic: cmd.Topic, partition: int32(i)}
+			partitions[i] = &partitionMetadata{replicas: replicas, leader: replicas[0], isr: replicas}
+			if m.alive[replicas[0]] {
+				m.elected(key, replicas[0], 0, replicas)
+			} else {
+				m.electLeader(key, partitions[i])
+			}
+		}
+	case commandDeleteTopic:
+		delete(m.topics, cmd.Topic)
+	case commandBrokers:
+		for id := range m.alive {
+			m.alive[id] = false
+		}
+
+		for _, id := range cmd.Alive {
+			m.alive[id] = true
+		}
+
+		for topic, partitions := range m.topics {
+			for i, p := range partitions {
+				m.electLeader(partitionKey{topic: topic, partition: int32(i)}, p)
+			}
+		}
+	case commandIsr:
+		partitions, ok := m.topics[cmd.Topic]
+		if !ok || int(cmd.Partition) >= len(partitions) {
+			return
+		}
+
+		p := partitions[cmd.Partition]
+		if p.epoch != cmd.LeaderEpoch || p.isrVersion != cmd.IsrVersion {
+			return
+		}
+
+		partitions[cmd.Partition] = &partitionMetadata{
+			replicas:   p.replicas,
+			leader:     p.leader,
+			epoch:      p.epoch,
+			isr:        cmd.Isr,
+			isrVersion: p.isrVersion + 1,
+		}
+	}
+}
+
+// electLeader moves the leadership of the partition from the lost broker to the first alive in-sync replica,
+// the rest of the alive ones stay in sync. The partition without the alive in-sync replicas keeps its leader,
+// until one of them is back, the other replicas may miss the acknowledged messages.
+func (m *metadataState) electLeader(key partitionKey, p *partitionMetadata) {
+	if m.alive[p.leader] {
+		return
+	}
+
+	isr := make([]int32, 0, len(p.isr))
+	for _, id := range p.replicas {
+		if m.alive[id] && pkg.In(p.isr, id) {
+			isr = append(isr, id)
+		}
+	}
+
+	if len(isr) == 0 {
+		return
+	}
+
+	elected := &partitionMetadata{
+		replicas:   p.replicas,
+		leader:     isr[0],
+		epoch:      p.epoch + 1,
+		isr:        isr,
+		isrVersion: p.isrVersion + 1,
+	}
+
+	m.topics[key.topic][key.partition] = elected
+	m.elected(key, elected.leader, elected.epoch, elected.isr)
+}
+
+// partition returns the metadata of the partition.
+func (m *metadataState) partition(key partitionKey) (partitionMetadata, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	partitions, ok := m.topics[key.topic]
+	if !ok || int(key.partition) >= len(partitions) {
+		return partitionMetadata{}, false
+	}
+
+	return *partitions[key.partition], true
+}
+
+// led returns the partitions led by the broker.
+func (m *metadataState) led(id int32) []partitionKey {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []partitionKey
+	for topic, partitions := range m.topics {
+		for i, p := range partitions {
+			if p.leader == id {
+				keys = append(keys, partitionKey{topic: topic, partition: int32(i)})
+			}
+		}
+	}
+
+	return keys
+}
+
+func (m *metadataState) hasTopic(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.topics[name]
+	return ok
+}
+
+func (m *metadataState) topicNames() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.topics))
+	for name := range m.topics {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// sameAlive reports, whether the brokers are the alive ones already.
+func (m *metadataState) sameAlive(alive []int32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, ok := range m.alive {
+		if ok {
+			count++
+		}
+	}
+
+	for _, id := range alive {
+		if !m.alive[id] {
+			return false
+		}
+	}
+
+	return count == len(alive)
+}
+
+// describe returns the brokers and the requested topics, all topics are returned, when none are requested.
+func (m *metadataState) describe(addrs map[int32]string, topics []string) *pb.MetadataResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := &pb.MetadataResponse{}
+	for id, addr := range addrs {
+		out.Brokers = append(out.Brokers, &pb.BrokerMetadata{Id: uint32(id), Address: addr, Alive: m.alive[id]})
+	}
+
+	sort.Slice(out.Brokers, func(i, j int) bool { return out.Brokers[i].Id < out.Brokers[j].Id })
+	if len(topics) == 0 {
+		for name := range m.topics {
+			topics = append(topics, name)
+		}
+
+		sort.Strings(topics)
+	}
+
+	for _, name := range topics {
+		partitions, ok := m.topics[name]
+		if !ok || isInternalTopic(name) {
+			continue
+		}
+
+		topic := &pb.TopicMetadata{Name: name}
+		for i, p := range partitions {
+			partition := &pb.PartitionMetadata{Id: uint32(i), Leader: uint32(p.leader), LeaderEpoch: uint32(p.epoch)}
+			for _, id := range p.replicas {
+				partition.Replicas = append(partition.Replicas, uint32(id))
+			}
+
+			for _, id := range p.isr {
+				partition.Isr = append(partition.Isr, uint32(id))
+			}
+
+			topic.Partitions = append(topic.Partitions, partition)
+		}
+
+		out.Topics = append(out.Topics, topic)
+	}
+
+	return out
+}
@@ -0,0 +1,330 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+
+	// offsetsTopic is the internal topic, where the committed offsets are stored.
+	// The latest commit of every key wins, when the topic is replayed on start.
+	offsetsTopic = "__consumer_offsets"
+
+	// asyncCommitsBuffer is the number of async commits, which can wait to be stored,
+	// before the committers are blocked.
+	asyncCommitsBuffer = 1024
+)
+
+// offsetsPartition is the only partition of the offsetsTopic, in the cluster its leader stores the commits.
+var offsetsPartition = partitionKey{topic: offsetsTopic}
+
+type offsetKey struct {
+	group     string
+	topic     string
+	partition int32
+}
+
+func (k offsetKey) encode() []byte {
+	return []byte(fmt.Sprintf("%s\x00%s\x00%d", k.group, k.topic, k.partition))
+}
+
+func decodeOffsetKey(b []byte) (offsetKey, error) {
+	parts := strings.Split(string(b), "\x00")
+	if len(parts) != 3 {
+		return offsetKey{}, fmt.Errorf("malformed offset key %q", b)
+	}
+
+	partition, err := strconv.ParseInt(parts[2], 10, 32)
+	if err != nil {
+		return offsetKey{}, fmt.Errorf("malformed offset key %q: %w", b, err)
+	}
+
+	return offsetKey{group: parts[0], topic: parts[1], partition: int32(partition)}, nil
+}
+
+type offsetCommit struct {
+	key    offsetKey
+	offset int64
+}
+
+// offsetStore keeps the committed offsets of the consumer groups.
+//
+// Commits are appended to the offsetsTopic, so they are as durable as the storage itself,
+// and cached in memory for the fast lookups.
+//
+// In the cluster the offsetsTopic is replicated like the other topics, its leader is the coordinator,
+// which stores the commits of all groups, the other brokers forward the commits to it. The followers
+// cache the commits, which they replicate, so they can take over, when the coordinator is lost.
+type offsetStore struct {
+	storage repo.Storage
+
+	// cluster is set for the broker of the cluster, before the commits arrive.
+	cluster *cluster
+
+	// mu guards the offsets and orders the commits written to the storage.
+	mu sync.Mutex
+
+	// offsets is the latest committed offset of every key.
+	offsets map[offsetKey]int64
+
+	// async is the queue of the commits, which were acknowledged before being stored,
+	// stored is closed, when all of them are stored after the close.
+	async  chan offsetCommit
+	stored chan struct{}
+
+	// closeMu orders the queued commits with the close, so none of them is sent to the closed queue.
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+func newOffsetStore(storage repo.Storage) (*offsetStore, error) {
+	// Only the latest commit of every key is needed, the older ones are compacted away.
+	err := storage.CreateTopic(offsetsTopic, 1, map[string]string{"cleanup.policy": "compact"})
+	if err != nil && !errors.Is(err, pkg.ErrorTopicAlreadyExists) {
+		return nil, err
+	}
+
+	s := &offsetStore{
+		storage: storage,
+		offsets: make(map[offsetKey]int64),
+		async:   make(chan offsetCommit, asyncCommitsBuffer),
+		stored:  make(chan struct{}),
+	}
+
+	if err = s.replay(); err != nil {
+		return nil, err
+	}
+
+	go s.storeAsync()
+	return s, nil
+}
+
+// replay restores the latest commits from the offsetsTopic.
+func (s *offsetStore) replay() error {
+	start, end, err := s.storage.Offsets(offsetsTopic, 0)
+	if err != nil {
+		return err
+	}
+
+	for offset := start; offset < end; {
+		m, e := s.storage.Explore(offsetsTopic, 0, offset)
+		if e != nil {
+			return e
+		}
+
+		offset = m.Offset() + 1
+		s.apply(m)
+	}
+
+	return nil
+}
+
+// reload restores the commits once again, after the replica of the offsetsTopic is truncated.
+func (s *offsetStore) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.offsets = make(map[offsetKey]int64)
+	return s.replay()
+}
+
+// replicated caches the commits appended to the replica of the offsetsTopic, guarded by the mu.
+func (s *offsetStore) replicated(messages []*repo.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range messages {
+		s.apply(m)
+	}
+}
+
+// apply caches the commit read from the offsetsTopic, guarded by the mu.
+func (s *offsetStore) apply(m *repo.Message) {
+	// The malformed commit is skipped, so it can't stop the broker from starting,
+	// the group starts from its reset policy instead.
+	key, err := decodeOffsetKey(m.Key())
+	if err != nil {
+		log.Printf("skipping offset commit at %d: %v", m.Offset(), err)
+		return
+	}
+
+	// The tombstone is left by the deleted topic.
+	if len(m.Content()) == 0 {
+		delete(s.offsets, key)
+		return
+	}
+
+	if len(m.Content()) != 8 {
+		log.Printf("skipping offset commit at %d: malformed offset %x", m.Offset(), m.Content())
+		return
+	}
+
+	s.offsets[key] = int64(binary.BigEndian.Uint64(m.Content()))
+}
+
+// coordinator returns the broker, which stores the commits, and reports, whether it's this one.
+func (s *offsetStore) coordinator() (int32, bool) {
+	if s.cluster == nil {
+		return 0, true
+	}
+
+	return s.cluster.leads(offsetsPartition)
+}
+
+// commit stores the offset and returns, when it's saved. In the cluster it's saved by the coordinator
+// and returns, when the in-sync replicas of the offsetsTopic have it.
+func (s *offsetStore) commit(ctx context.Context, key offsetKey, offset int64) error {
+	if id, ok := s.coordinator(); !ok {
+		return s.forward(ctx, id, key, offset, false)
+	}
+
+	s.mu.Lock()
+	stored, err := s.save(key, offset)
+	s.mu.Unlock()
+
+	if err != nil || s.cluster == nil {
+		return err
+	}
+
+	return s.cluster.awaitReplicas(ctx, offsetsPartition, stored)
+}
+
+// forward sends the commit to the coordinator, the commit forwarded already isn't forwarded again.
+func (s *offsetStore) forward(ctx context.Context, id int32, key offsetKey, offset int64, async bool) error {
+	client, forwarded, err := s.cluster.forward(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CommitOffset(forwarded, &pb.CommitOffsetRequest{
+		GroupId:   key.group,
+		Topic:     key.topic,
+		Partition: uint32(key.partition),
+		Offset:    uint64(offset),
+		Async:     async,
+	})
+
+	return err
+}
+
+// commitAsync caches the offset right away and stores it in the background.
+// The commits, which arrived after a newer one, are ignored, so a delayed
+// async commit can't move the group back. The commits after the close are only cached.
+func (s *offsetStore) commitAsync(key offsetKey, offset int64) {
+	s.mu.Lock()
+	if current, ok := s.offsets[key]; ok && current > offset {
+		s.mu.Unlock()
+		return
+	}
+
+	s.offsets[key] = offset
+	s.mu.Unlock()
+
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+
+	if !s.closed {
+		s.async <- offsetCommit{key: key, offset: offset}
+	}
+}
+
+// close stores the queued commits and stops the background storing.
+func (s *offsetStore) close() {
+	s.closeMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.async)
+	}
+
+	s.closeMu.Unlock()
+	<-s.stored
+}
+
+func (s *offsetStore) storeAsync() {
+	defer close(s.stored)
+
+	for c := range s.async {
+		// The coordinator ignores the commit, when it has a newer one, so the commit is forwarded as is.
+		if id, ok := s.coordinator(); !ok {
+			ctx, cancel := context.WithTimeout(context.Background(), s.cluster.opts.AckTimeout)
+			_ = s.forward(ctx, id, c.key, c.offset, true)
+			cancel()
+
+			continue
+		}
+
+		s.mu.Lock()
+
+		// A newer commit could have been stored in between, it's the one to keep,
+		// the commit of the deleted topic is dropped. The failed commit is lost, like any
+		// other fire-and-forget commit, the next one of the consumer will cover it.
+		if current, ok := s.offsets[c.key]; ok && current == c.offset {
+			_, _ = s.save(c.key, c.offset)
+		}
+
+		s.mu.Unlock()
+	}
+}
+
+// save appends the commit to the offsetsTopic and returns its offset there.
+func (s *offsetStore) save(key offsetKey, offset int64) (int64, error) {
+	content := make([]byte, 8)
+	binary.BigEndian.PutUint64(content, uint64(offset))
+
+	stored, err := s.storage.Save(offsetsTopic, 0, repo.NewMessage(key.encode(), content))
+	if err != nil {
+		return 0, err
+	}
+
+	s.offsets[key] = offset
+	return stored, nil
+}
+
+// dropTopic removes the committed offsets of all groups in the topic, the tombstones remove them
+// from the offsetsTopic too. In the cluster the tombstones are appended by the coordinator only.
+func (s *offsetStore) dropTopic(topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, coordinator := s.coordinator()
+	for key := range s.offsets {
+		if key.topic != topic {
+			continue
+		}
+
+		if coordinator {
+			if _, err := s.storage.Save(offsetsTopic, 0, repo.NewMessage(key.encode(), nil)); err != nil {
+				return err
+			}
+		}
+
+		delete(s.offsets, key)
+	}
+
+	return nil
+}
+
+// fetch returns the committed offset and false, when nothing was committed.
+func (s *offsetStore) fetch(key offsetKey) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, ok := s.offsets[key]
+	return offset, ok
+}
+
+// isInternalTopic reports whether the topic is managed by the broker itself,
+// such topics can't be changed by the clients directly.
+func isInternalTopic(name string) bool {
+	return strings.HasPrefix(name, "__")
+}
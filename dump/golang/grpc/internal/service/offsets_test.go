@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"testing"
+	"time"
+)
+
+func TestBroker_CommitOffset(t *testing.T) {
+	testCases := []struct {
+		name        string
+		commits     []*pb.CommitOffsetRequest
+		expected    *pb.FetchCommittedOffsetResponse
+		expectedErr error
+	}{
+		{
+			name: "success, latest sync commit wins",
+			commits: []*pb.CommitOffsetRequest{
+				{GroupId: "group", Topic: "topic1", Offset: 5},
+				{GroupId: "group", Topic: "topic1", Offset: 3},
+			},
+			expected: &pb.FetchCommittedOffsetResponse{Offset: 3, Committed: true},
+		},
+		{
+			name: "success, delayed async commit is ignored",
+			commits: []*pb.CommitOffsetRequest{
+				{GroupId: "group", Topic: "topic1", Offset: 5, Async: true},
+				{GroupId: "group", Topic: "topic1", Offset: 3, Async: true},
+			},
+			expected: &pb.FetchCommittedOffsetResponse{Offset: 5, Committed: true},
+		},
+		{
+			name:     "success, nothing committed",
+			expected: &pb.FetchCommittedOffsetResponse{},
+		},
+		{
+			name:        "failure, no group",
+			commits:     []*pb.CommitOffsetRequest{{Topic: "topic1", Offset: 5}},
+			expectedErr: pkg.ErrorGroupRequired,
+		},
+		{
+			name:        "failure, NUL in group",
+			commits:     []*pb.CommitOffsetRequest{{GroupId: "gr\x00oup", Topic: "topic1", Offset: 5}},
+			expectedErr: pkg.ErrorInvalidGroup,
+		},
+		{
+			name:        "failure, partition not found",
+			commits:     []*pb.CommitOffsetRequest{{GroupId: "group", Topic: "topic1", Partition: 1}},
+			expectedErr: pkg.ErrorPartitionNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBroker(t, repo.NewBrokerStorage("topic1"))
+			for _, c := range tc.commits {
+				if _, err := b.CommitOffset(context.Background(), c); !errors.Is(err, tc.expectedErr) {
+					t.Fatalf("expected %v, got %v", tc.expectedErr, err)
+				}
+			}
+
+			if tc.expectedErr != nil {
+				return
+			}
+
+			actual, err := b.FetchCommittedOffset(context.Background(), &pb.FetchCommittedOffsetRequest{
+				GroupId: "group", Topic: "topic1",
+			})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if actual.Offset != tc.expected.Offset || actual.Committed != tc.expected.Committed {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestOffsetStore_Replay(t *testing.T) {
+	storage := repo.NewBrokerStorage("topic1")
+	s, err := newOffsetStore(storage)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	key := offsetKey{group: "group", topic: "topic1"}
+	if err = s.commit(context.Background(), key, 7); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// The queued commit is stored on the close.
+	s.commitAsync(key, 9)
+	s.close()
+
+	// Restarting the broker on top of the same storage.
+	restarted, err := newOffsetStore(storage)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer restarted.close()
+
+	if offset, ok := restarted.fetch(key); !ok || offset != 9 {
+		t.Errorf("expected %d, got %d", 9, offset)
+	}
+}
+
+func TestOffsetStore_ReplayMalformed(t *testing.T) {
+	storage := repo.NewBrokerStorage()
+	s, err := newOffsetStore(storage)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	key := offsetKey{group: "group", topic: "topic1"}
+	if err = s.commit(context.Background(), key, 7); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	s.close()
+
+	// The commits left by the older brokers, which didn't validate the groups.
+	for _, m := range []*repo.Message{
+		repo.NewMessage([]byte("gr\x00oup\x00topic1\x000"), []byte{0, 0, 0, 0, 0, 0, 0, 1}),
+		repo.NewMessage([]byte("group\x00topic1\x000"), []byte{1}),
+	} {
+		if _, err = storage.Save(offsetsTopic, 0, m); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+
+	restarted, err := newOffsetStore(storage)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer restarted.close()
+
+	if offset, ok := restarted.fetch(key); !ok || offset != 7 {
+		t.Errorf("expected %d, got %d", 7, offset)
+	}
+}
+
+func TestBroker_DeleteTopicOffsets(t *testing.T) {
+	storage := repo.NewBrokerStorage("topic1")
+	b := newTestBroker(t, storage)
+	publish(t, b, "a", "b")
+
+	commit := &pb.CommitOffsetRequest{GroupId: "group1", Topic: "topic1", Offset: 2}
+	if _, err := b.CommitOffset(context.Background(), commit); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	s := startConsumer(t, b, &pb.ConsumeStart{Topic: "topic1", GroupId: "group2", Policy: pb.OffsetPolicy_EARLIEST})
+	s.receive(t)
+
+	if _, err := b.DeleteTopic(context.Background(), &pb.DeleteTopicRequest{Name: "topic1"}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// The consumers of the deleted topic are stopped with it.
+	select {
+	case err := <-s.done:
+		if !errors.Is(err, pkg.ErrorTopicNotFound) {
+			t.Errorf("expected %v, got %v", pkg.ErrorTopicNotFound, err)
+		}
+
+		s.done <- err
+	case <-time.After(time.Second):
+		t.Fatalf("expected %v, got nothing", pkg.ErrorTopicNotFound)
+	}
+
+	if _, err := b.CreateTopic(context.Background(), &pb.CreateTopicRequest{Name: "topic1"}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// The recreated topic doesn't inherit the offsets, neither after the restart.
+	restarted := newTestBroker(t, storage)
+	for name, broker := range map[string]Broker{"running": b, "restarted": restarted} {
+		out, err := broker.FetchCommittedOffset(context.Background(), &pb.FetchCommittedOffsetRequest{
+			GroupId: "group1", Topic: "topic1",
+		})
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+
+		if out.Committed {
+			t.Errorf("%s: expected no committed offset, got %d", name, out.Offset)
+		}
+	}
+
+	publish(t, b, "c")
+	next := startConsumer(t, b, &pb.ConsumeStart{Topic: "topic1", GroupId: "group2", Policy: pb.OffsetPolicy_EARLIEST})
+	if m := next.receive(t); string(m.Body) != "c" || m.Offset != 0 {
+		t.Errorf("expected c at %d, got %s at %d", 0, m.Body, m.Offset)
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"fmt"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/pkg"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+
+	// partitionerConfig is the topic config key, which selects the partitioner.
+	partitionerConfig = "partitioner"
+
+	partitionerHash       = "hash"
+	partitionerRoundRobin = "round-robin"
+	partitionerSticky     = "sticky"
+	partitionerExplicit   = "explicit"
+
+	// stickyBatchSize is the number of keyless messages sent to the same
+	// partition before the sticky partitioner switches to the next one.
+	stickyBatchSize = 64
+)
+
+// Partitioner chooses the partition of a topic for the published message.
+type Partitioner interface {
+
+	// Partition returns the index of the partition for the message.
+	Partition(in *pb.PublishRequest, partitions int) (int32, error)
+}
+
+// NewPartitioner creates a partitioner by its name, empty name stands for the default one.
+func NewPartitioner(name string) (Partitioner, error) {
+	switch name {
+	case "", partitionerHash:
+		return &hashPartitioner{keyless: &stickyPartitioner{}}, nil
+	case partitionerRoundRobin:
+		return &roundRobinPartitioner{}, nil
+	case partitionerSticky:
+		return &stickyPartitioner{}, nil
+	case partitionerExplicit:
+		return &explicitPartitioner{}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown %s %q", pkg.ErrorInvalidConfig, partitionerConfig, name)
+	}
+}
+
+// hashPartitioner sends the messages with the same key to the same partition,
+// so they are read in the order they were published.
+type hashPartitioner struct {
+
+	// keyless is used for the messages without a key.
+	keyless Partitioner
+}
+
+func (p *hashPartitioner) Partition(in *pb.PublishRequest, partitions int) (int32, error) {
+	if len(in.Key) == 0 {
+		return p.keyless.Partition(in, partitions)
+	}
+
+	return hashKey(in.Key, partitions), nil
+}
+
+func hashKey(key []byte, partitions int) int32 {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int32(h.Sum32() % uint32(partitions))
+}
+
+// roundRobinPartitioner spreads the messages evenly, ignoring their keys.
+type roundRobinPartitioner struct {
+	next atomic.Uint32
+}
+
+func (p *roundRobinPartitioner) Partition(_ *pb.PublishRequest, partitions int) (int32, error) {
+	return int32((p.next.Add(1) - 1) % uint32(partitions)), nil
+}
+
+// stickyPartitioner sends the keyless messages in batches to the same partition,
+// which keeps the partitions balanced, while the consecutive messages stay together.
+// The messages with a key are hashed, like in the hashPartitioner.
+type stickyPartitioner struct {
+	mu      sync.Mutex
+	current int32
+	left    int
+}
+
+func (p *stickyPartitioner) Partition(in *pb.PublishRequest, partitions int) (int32, error) {
+	if len(in.Key) != 0 {
+		return hashKey(in.Key, partitions), nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.left == 0 {
+		p.current = (p.current + 1) % int32(partitions)
+		p.left = stickyBatchSize
+	}
+
+	p.left--
+	return p.current % int32(partitions), nil
+}
+
+// explicitPartitioner requires the publisher to choose the partition.
+type explicitPartitioner struct{}
+
+func (p *explicitPartitioner) Partition(in *pb.PublishRequest, partitions int) (int32, error) {
+	if in.Partition == nil {
+		return 0, pkg.ErrorPartitionRequired
+	}
+
+	return explicitPartition(in, partitions)
+}
+
+func explicitPartition(in *pb.PublishRequest, partitions int) (int32, error) {
+	if int(*in.Partition) >= partitions {
+		return 0, pkg.ErrorPartitionNotFound
+	}
+
+	return int32(*in.Partition), nil
+}
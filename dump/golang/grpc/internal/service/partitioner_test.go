@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"testing"
+)
+
+func partitionOf(partition uint32) *uint32 {
+	return &partition
+}
+
+func TestPartitioner_Partition(t *testing.T) {
+	testCases := []struct {
+		name        string
+		partitioner string
+		requests    []*pb.PublishRequest
+		expected    []int32
+		expectedErr error
+	}{
+		{
+			name:        "success, hash keeps the same key together",
+			partitioner: partitionerHash,
+			requests: []*pb.PublishRequest{
+				{Key: []byte("customer-1")},
+				{Key: []byte("customer-2")},
+				{Key: []byte("customer-1")},
+			},
+			expected: []int32{
+				hashKey([]byte("customer-1"), 4),
+				hashKey([]byte("customer-2"), 4),
+				hashKey([]byte("customer-1"), 4),
+			},
+		},
+		{
+			name:        "success, round-robin ignores the keys",
+			partitioner: partitionerRoundRobin,
+			requests: []*pb.PublishRequest{
+				{Key: []byte("a")}, {Key: []byte("a")}, {Key: []byte("a")}, {Key: []byte("a")}, {Key: []byte("a")},
+			},
+			expected: []int32{0, 1, 2, 3, 0},
+		},
+		{
+			name:        "success, sticky keeps keyless messages together",
+			partitioner: partitionerSticky,
+			requests:    []*pb.PublishRequest{{}, {}, {}},
+			expected:    []int32{1, 1, 1},
+		},
+		{
+			name:        "success, explicit",
+			partitioner: partitionerExplicit,
+			requests:    []*pb.PublishRequest{{Partition: partitionOf(3)}, {Partition: partitionOf(0)}},
+			expected:    []int32{3, 0},
+		},
+		{
+			name:        "failure, explicit without partition",
+			partitioner: partitionerExplicit,
+			requests:    []*pb.PublishRequest{{}},
+			expectedErr: pkg.ErrorPartitionRequired,
+		},
+		{
+			name:        "failure, explicit partition out of range",
+			partitioner: partitionerExplicit,
+			requests:    []*pb.PublishRequest{{Partition: partitionOf(4)}},
+			expectedErr: pkg.ErrorPartitionNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewPartitioner(tc.partitioner)
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			for i, in := range tc.requests {
+				actual, e := p.Partition(in, 4)
+				if !errors.Is(e, tc.expectedErr) {
+					t.Fatalf("expected %v, got %v", tc.expectedErr, e)
+				}
+
+				if tc.expectedErr == nil && actual != tc.expected[i] {
+					t.Errorf("expected %d, got %d", tc.expected[i], actual)
+				}
+			}
+		})
+	}
+}
+
+func TestPartitioner_Unknown(t *testing.T) {
+	if _, err := NewPartitioner("random"); !errors.Is(err, pkg.ErrorInvalidConfig) {
+		t.Errorf("expected %v, got %v", pkg.ErrorInvalidConfig, err)
+	}
+}
+
+func TestBroker_PublishByKey(t *testing.T) {
+	b := newTestBroker(t, repo.NewBrokerStorage())
+	_, err := b.CreateTopic(context.Background(), &pb.CreateTopicRequest{Name: "customers", Partitions: 4})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	offsets := make(map[uint32]uint64)
+	for i := 0; i < 10; i++ {
+		out, e := b.Publish(context.Background(), &pb.PublishRequest{
+			Topic: "customers", Key: []byte("customer-1"), Body: []byte("update"),
+		})
+		if e != nil {
+			t.Fatalf("expected nil, got %v", e)
+		}
+
+		// Every partition has its own offsets, so the messages of the same key
+		// are numbered without gaps.
+		if out.Id != offsets[out.Partition] {
+			t.Errorf("expected %d, got %d", offsets[out.Partition], out.Id)
+		}
+
+		offsets[out.Partition]++
+	}
+
+	if len(offsets) != 1 {
+		t.Errorf("expected all messages in one partition, got %d partitions", len(offsets))
+	}
+}
@@ -0,0 +1,408 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"time"
+)
+
+const (
+
+	// streamWindow is the maximum number of the streamed messages, which are saved together.
+	streamWindow = 512
+
+	// unackedQueue is the number of the publishes without acks waiting to be saved,
+	// the publishers are blocked, when it's full.
+	unackedQueue = 1024
+)
+
+// unackedFailures counts the publishes without acks, which failed, they aren't reported to the publishers.
+var unackedFailures = expvar.NewInt("broker.unacked_failures")
+
+func newMessage(key, body []byte, headers map[string][]byte, ts *timestamppb.Timestamp) *repo.Message {
+	m := repo.NewMessage(key, body).WithHeaders(headers)
+	if ts != nil {
+		m.WithProducerTimestamp(ts.AsTime())
+	}
+
+	return m
+}
+
+// withProducer marks the message of the idempotent producer, the messages without the producer are left as is.
+func withProducer(m *repo.Message, producer uint64, epoch, sequence uint32) *repo.Message {
+	if producer == 0 {
+		return m
+	}
+
+	return m.WithProducer(int64(producer), int32(epoch), int32(sequence))
+}
+
+func (b *broker) InitProducer(_ context.Context, in *pb.InitProducerRequest) (*pb.InitProducerResponse, error) {
+	id, epoch, err := b.storage.InitProducer(int64(in.ProducerId))
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.InitProducerResponse{ProducerId: uint64(id), Epoch: uint32(epoch)}, nil
+}
+
+// messageTTL validates the time to live requested by the publisher, the zero one leaves the default of the topic.
+func messageTTL(ttl *durationpb.Duration) (time.Duration, error) {
+	if ttl == nil {
+		return 0, nil
+	}
+
+	d := ttl.AsDuration()
+	if err := ttl.CheckValid(); err != nil || d < 0 || (d > 0 && d < time.Millisecond) {
+		return 0, fmt.Errorf("%w: it must be zero or at least a millisecond", pkg.ErrorInvalidTTL)
+	}
+
+	return d, nil
+}
+
+// publishDelayed saves the message to be delivered at the time, its offset is not known until then.
+func (b *broker) publishDelayed(ctx context.Context, in *pb.PublishRequest, partition int32, at time.Time) (*pb.PublishResponse, error) {
+	if err := b.delayed.schedule(ctx, in, partition, at); err != nil {
+		return nil, err
+	}
+
+	return &pb.PublishResponse{Partition: uint32(partition), DeliverAt: timestamppb.New(at)}, nil
+}
+
+func (b *broker) Schedule(ctx context.Context, in *pb.ScheduleRequest) (*pb.ScheduleResponse, error) {
+	r := in.Request
+	if r == nil || r.Partition == nil || r.DeliverAt == nil {
+		return nil, fmt.Errorf("%w: the partition and the delivery time are required", pkg.ErrorInvalidDelay)
+	}
+
+	if err := b.delayed.schedule(ctx, r, int32(*r.Partition), r.DeliverAt.AsTime()); err != nil {
+		return nil, err
+	}
+
+	return &pb.ScheduleResponse{}, nil
+}
+
+// deliverDelayed publishes the due delayed message to its partition. In the cluster the partition may be led
+// by the other broker by then, the message is forwarded to it, instead of being appended to the local replica.
+func (b *broker) deliverDelayed(ctx context.Context, in *pb.PublishRequest) error {
+	_, err := b.Publish(ctx, in)
+	if b.cluster == nil || !errors.Is(err, pkg.ErrorNotLeader) {
+		return err
+	}
+
+	_, leader, err := b.cluster.replicas(partitionKey{topic: in.Topic, partition: int32(*in.Partition)})
+	if err != nil {
+		return err
+	}
+
+	client, err := b.cluster.client(leader)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Publish(ctx, in)
+	return err
+}
+
+// checkLeader rejects the publishes to the partitions, which are led by the other brokers of the cluster.
+func (b *broker) checkLeader(topic string, partition int32, acks pb.Acks) error {
+	if b.cluster == nil {
+		return nil
+	}
+
+	return b.cluster.checkLeader(partitionKey{topic: topic, partition: partition}, acks)
+}
+
+// save appends the messages to the partition and waits for the replicas requested by the acks.
+// The messages without acks are saved in the background, the returned offset is zero for them.
+func (b *broker) save(ctx context.Context, topic string, partition int32, messages []*repo.Message, acks pb.Acks) (int64, error) {
+	if acks == pb.Acks_ACKS_NONE {
+		b.closeMu.RLock()
+		defer b.closeMu.RUnlock()
+
+		if b.closed {
+			return 0, pkg.ErrorBrokerClosed
+		}
+
+		b.unacked <- func() error {
+			_, err := b.storage.SaveBatch(topic, partition, messages)
+			return err
+		}
+
+		return 0, nil
+	}
+
+	offset, err := b.storage.SaveBatch(topic, partition, messages)
+	if err != nil || acks != pb.Acks_ACKS_ALL || b.cluster == nil {
+		return offset, err
+	}
+
+	last := offset + int64(len(messages)) - 1
+	return offset, b.cluster.awaitReplicas(ctx, partitionKey{topic: topic, partition: partition}, last)
+}
+
+// saveUnacked saves the publishes without acks in the order they are received, until the broker is closed.
+func (b *broker) saveUnacked() {
+	defer close(b.saved)
+
+	for save := range b.unacked {
+		if err := save(); err != nil {
+			unackedFailures.Add(1)
+		}
+	}
+}
+
+func (b *broker) PublishBatch(ctx context.Context, in *pb.PublishBatchRequest) (*pb.PublishBatchResponse, error) {
+	if isInternalTopic(in.Topic) {
+		return nil, pkg.ErrorInternalTopic
+	}
+
+	if len(in.Messages) == 0 {
+		return nil, pkg.ErrorEmptyBatch
+	}
+
+	first := in.Messages[0]
+	partition, err := b.choosePartition(&pb.PublishRequest{
+		Topic: in.Topic, Body: first.Body, Key: first.Key, Partition: in.Partition,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = b.checkLeader(in.Topic, partition, in.Acks); err != nil {
+		return nil, err
+	}
+
+	messages := make([]*repo.Message, len(in.Messages))
+	for i, m := range in.Messages {
+		ttl, e := messageTTL(m.Ttl)
+		if e != nil {
+			return nil, e
+		}
+
+		messages[i] = withProducer(
+			newMessage(m.Key, m.Body, m.Headers, m.Timestamp).WithTTL(ttl), in.ProducerId, in.ProducerEpoch, in.BaseSequence+uint32(i),
+		)
+	}
+
+	offset, err := b.save(ctx, in.Topic, partition, messages, in.Acks)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.Acks == pb.Acks_ACKS_NONE {
+		return &pb.PublishBatchResponse{Partition: uint32(partition)}, nil
+	}
+
+	return &pb.PublishBatchResponse{
+		Partition: uint32(partition),
+		FirstId:   uint64(offset),
+		LastId:    uint64(offset) + uint64(len(messages)) - 1,
+	}, nil
+}
+
+// PublishStream receives the messages in the background, while the received ones are saved,
+// the messages received in the meantime are saved together, one batch per partition.
+func (b *broker) PublishStream(stream pb.Broker_PublishStreamServer) error {
+	var (
+		received = make(chan *pb.PublishRequest, streamWindow)
+		recvErr  = make(chan error, 1)
+		done     = make(chan struct{})
+	)
+
+	defer close(done)
+	go func() {
+		defer close(received)
+
+		for {
+			in, err := stream.Recv()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					recvErr <- err
+				}
+
+				return
+			}
+
+			select {
+			case received <- in:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var acks []*pb.PublishResponse
+	for in := range received {
+		window := receiveWindow(in, received)
+		saved, err := b.publishWindow(stream.Context(), window)
+		acks = append(acks, saved...)
+		if err != nil {
+			return partialPublish(err, acks)
+		}
+	}
+
+	select {
+	case err := <-recvErr:
+		return partialPublish(err, acks)
+	default:
+	}
+
+	return stream.SendAndClose(&pb.PublishStreamResponse{Acks: acks})
+}
+
+// PublishStreamError is the failure of the publish stream, which saved some of its messages,
+// their acks are sent to the client with the error.
+type PublishStreamError struct {
+	Err     error
+	Failure *pb.PublishStreamFailure
+}
+
+func (e *PublishStreamError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PublishStreamError) Unwrap() error {
+	return e.Err
+}
+
+// partialPublish adds the acks of the saved messages to the error, the nil acks are the messages,
+// which weren't saved, the error is returned as it is, when none of them were.
+func partialPublish(err error, acks []*pb.PublishResponse) error {
+	failure := &pb.PublishStreamFailure{Acks: make(map[uint32]*pb.PublishResponse)}
+	for i, ack := range acks {
+		if ack != nil {
+			failure.Acks[uint32(i)] = ack
+		}
+	}
+
+	if len(failure.Acks) == 0 {
+		return err
+	}
+
+	return &PublishStreamError{Err: err, Failure: failure}
+}
+
+// receiveWindow takes the messages, which are already received, without waiting for the new ones.
+func receiveWindow(first *pb.PublishRequest, received <-chan *pb.PublishRequest) []*pb.PublishRequest {
+	window := []*pb.PublishRequest{first}
+	for len(window) < streamWindow {
+		select {
+		case in, ok := <-received:
+			if !ok {
+				return window
+			}
+
+			window = append(window, in)
+		default:
+			return window
+		}
+	}
+
+	return window
+}
+
+// partitionBatch is the part of the window going to the same partition with the same acks.
+type partitionBatch struct {
+	topic     string
+	partition int32
+	acks      pb.Acks
+	messages  []*repo.Message
+
+	// positions are the indexes of the messages in the window.
+	positions []int
+}
+
+// publishWindow saves the messages with one batch per partition and returns the acks in the order of the window.
+// On failure, the acks of the messages, which weren't saved, are nil.
+func (b *broker) publishWindow(ctx context.Context, window []*pb.PublishRequest) ([]*pb.PublishResponse, error) {
+	type target struct {
+		topic     string
+		partition int32
+		acks      pb.Acks
+	}
+
+	var (
+		batches []*partitionBatch
+		byKey   = make(map[target]*partitionBatch)
+	)
+
+	acks := make([]*pb.PublishResponse, len(window))
+	for i, in := range window {
+		if isInternalTopic(in.Topic) {
+			return acks, pkg.ErrorInternalTopic
+		}
+
+		at, err := deliveryTime(in, time.Now())
+		if err != nil {
+			return acks, err
+		}
+
+		ttl, err := messageTTL(in.Ttl)
+		if err != nil {
+			return acks, err
+		}
+
+		partition, err := b.choosePartition(in)
+		if err != nil {
+			return acks, err
+		}
+
+		if err = b.checkLeader(in.Topic, partition, in.Acks); err != nil {
+			return acks, err
+		}
+
+		// The delayed messages are not appended with the batch, they wait for their time.
+		if !at.IsZero() {
+			if acks[i], err = b.publishDelayed(ctx, in, partition, at); err != nil {
+				return acks, err
+			}
+
+			continue
+		}
+
+		// The idempotent messages are saved one by one, so the retried ones are acknowledged
+		// without failing the new messages of the same batch. The messages after them start
+		// a new batch, so the order of the partition is kept.
+		t := target{topic: in.Topic, partition: partition, acks: in.Acks}
+		batch, ok := byKey[t]
+		if !ok || in.ProducerId != 0 {
+			batch = &partitionBatch{topic: in.Topic, partition: partition, acks: in.Acks}
+			byKey[t] = batch
+			batches = append(batches, batch)
+		}
+
+		if in.ProducerId != 0 {
+			delete(byKey, t)
+		}
+
+		m := newMessage(in.Key, in.Body, in.Headers, in.Timestamp).WithTTL(ttl)
+		batch.messages = append(batch.messages, withProducer(m, in.ProducerId, in.ProducerEpoch, in.Sequence))
+		batch.positions = append(batch.positions, i)
+	}
+
+	for _, batch := range batches {
+		offset, err := b.save(ctx, batch.topic, batch.partition, batch.messages, batch.acks)
+		if err != nil {
+			return acks, err
+		}
+
+		// The messages without acks are saved in the background, their offsets aren't known.
+		for i, position := range batch.positions {
+			acks[position] = &pb.PublishResponse{Partition: uint32(batch.partition)}
+			if batch.acks != pb.Acks_ACKS_NONE {
+				acks[position].Id = uint64(offset) + uint64(i)
+			}
+		}
+	}
+
+	return acks, nil
+}
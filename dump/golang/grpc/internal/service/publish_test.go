@@ -0,0 +1,258 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"io"
+	"testing"
+	"time"
+)
+
+// publishStream sends the requests to the broker one by one and keeps the response.
+type publishStream struct {
+	grpc.ServerStream
+
+	requests []*pb.PublishRequest
+	response *pb.PublishStreamResponse
+}
+
+func (s *publishStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *publishStream) Recv() (*pb.PublishRequest, error) {
+	if len(s.requests) == 0 {
+		return nil, io.EOF
+	}
+
+	in := s.requests[0]
+	s.requests = s.requests[1:]
+	return in, nil
+}
+
+func (s *publishStream) SendAndClose(out *pb.PublishStreamResponse) error {
+	s.response = out
+	return nil
+}
+
+func TestBroker_PublishBatch(t *testing.T) {
+	first, second := uint32(0), uint32(1)
+	messages := []*pb.BatchMessage{{Body: []byte("a")}, {Body: []byte("b")}, {Body: []byte("c")}}
+
+	testCases := []struct {
+		name        string
+		request     *pb.PublishBatchRequest
+		expected    *pb.PublishBatchResponse
+		expectedErr error
+	}{
+		{
+			name:     "success, range follows the stored messages",
+			request:  &pb.PublishBatchRequest{Topic: "topic1", Partition: &first, Messages: messages},
+			expected: &pb.PublishBatchResponse{Partition: 0, FirstId: 2, LastId: 4},
+		},
+		{
+			name:     "success, empty partition",
+			request:  &pb.PublishBatchRequest{Topic: "topic1", Partition: &second, Messages: messages[:1]},
+			expected: &pb.PublishBatchResponse{Partition: 1, FirstId: 0, LastId: 0},
+		},
+		{
+			name:        "failure, batch is routed by the topic partitioner",
+			request:     &pb.PublishBatchRequest{Topic: "topic1", Messages: messages},
+			expectedErr: pkg.ErrorPartitionRequired,
+		},
+		{
+			name:        "failure, empty batch",
+			request:     &pb.PublishBatchRequest{Topic: "topic1", Partition: &first},
+			expectedErr: pkg.ErrorEmptyBatch,
+		},
+		{
+			name:        "failure, internal topic",
+			request:     &pb.PublishBatchRequest{Topic: offsetsTopic, Messages: messages},
+			expectedErr: pkg.ErrorInternalTopic,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBroker(t, repo.NewBrokerStorage())
+			_, err := b.CreateTopic(context.Background(), &pb.CreateTopicRequest{
+				Name: "topic1", Partitions: 2, Config: map[string]string{partitionerConfig: partitionerExplicit},
+			})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			stored := &pb.PublishBatchRequest{Topic: "topic1", Partition: &first, Messages: messages[:2]}
+			if _, err = b.PublishBatch(context.Background(), stored); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			out, err := b.PublishBatch(context.Background(), tc.request)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected %v, got %v", tc.expectedErr, err)
+			}
+
+			if tc.expectedErr != nil {
+				return
+			}
+
+			if out.Partition != tc.expected.Partition || out.FirstId != tc.expected.FirstId || out.LastId != tc.expected.LastId {
+				t.Errorf("expected %v, got %v", tc.expected, out)
+			}
+		})
+	}
+}
+
+func TestBroker_PublishStream(t *testing.T) {
+	const count = 2000
+
+	storage := repo.NewBrokerStorage()
+	b := newTestBroker(t, storage)
+	_, err := b.CreateTopic(context.Background(), &pb.CreateTopicRequest{Name: "customers", Partitions: 4})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	keys := []string{"customer-1", "customer-2", "customer-3"}
+	stream := &publishStream{}
+	for i := 0; i < count; i++ {
+		stream.requests = append(stream.requests, &pb.PublishRequest{
+			Topic: "customers", Key: []byte(keys[i%len(keys)]), Body: []byte{byte(i)},
+		})
+	}
+
+	requests := append([]*pb.PublishRequest(nil), stream.requests...)
+	if err = b.PublishStream(stream); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if len(stream.response.Acks) != count {
+		t.Fatalf("expected %d acks, got %d", count, len(stream.response.Acks))
+	}
+
+	// The acks are in the order of the requests, so every ack points to its own message.
+	for i, ack := range stream.response.Acks {
+		m, e := storage.Explore("customers", int32(ack.Partition), int64(ack.Id))
+		if e != nil {
+			t.Fatalf("expected nil, got %v", e)
+		}
+
+		if string(m.Key()) != string(requests[i].Key) || m.Content()[0] != requests[i].Body[0] {
+			t.Errorf("expected %s at %d, got %s", requests[i].Key, i, m.Key())
+		}
+	}
+
+	stream = &publishStream{requests: []*pb.PublishRequest{{Topic: offsetsTopic, Body: []byte("a")}}}
+	if err = b.PublishStream(stream); !errors.Is(err, pkg.ErrorInternalTopic) {
+		t.Errorf("expected %v, got %v", pkg.ErrorInternalTopic, err)
+	}
+}
+
+func TestBroker_PublishStreamFailure(t *testing.T) {
+	storage := repo.NewBrokerStorage("topic1")
+	b := newTestBroker(t, storage)
+
+	// The failed message is after the first window, so the messages before it are saved.
+	stream := &publishStream{}
+	for i := 0; i < streamWindow; i++ {
+		stream.requests = append(stream.requests, &pb.PublishRequest{Topic: "topic1", Body: []byte{byte(i)}})
+	}
+
+	stream.requests = append(stream.requests, &pb.PublishRequest{Topic: offsetsTopic, Body: []byte("a")})
+	err := b.PublishStream(stream)
+	if !errors.Is(err, pkg.ErrorInternalTopic) {
+		t.Fatalf("expected %v, got %v", pkg.ErrorInternalTopic, err)
+	}
+
+	var partial *PublishStreamError
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected the acks of the saved messages, got %v", err)
+	}
+
+	_, end, _ := storage.Offsets("topic1", 0)
+	if len(partial.Failure.Acks) != int(end) {
+		t.Errorf("expected %d acks, got %d", end, len(partial.Failure.Acks))
+	}
+
+	for position, ack := range partial.Failure.Acks {
+		if position >= streamWindow || ack.Id != uint64(position) {
+			t.Errorf("expected message %d at %d, got %d", position, position, ack.Id)
+		}
+	}
+}
+
+func TestBroker_PublishIdempotent(t *testing.T) {
+	storage := repo.NewBrokerStorage("topic1")
+	b := newTestBroker(t, storage)
+	producer, err := b.InitProducer(context.Background(), &pb.InitProducerRequest{})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	request := func(sequence uint32) *pb.PublishRequest {
+		return &pb.PublishRequest{
+			Topic: "topic1", Body: []byte{byte(sequence)},
+			ProducerId: producer.ProducerId, ProducerEpoch: producer.Epoch, Sequence: sequence,
+		}
+	}
+
+	// The retried messages of the stream are acknowledged with their original offsets, the new ones are appended.
+	stream := &publishStream{requests: []*pb.PublishRequest{request(0), request(1), {Topic: "topic1", Body: []byte("a")}}}
+	if err = b.PublishStream(stream); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	stream = &publishStream{requests: []*pb.PublishRequest{request(1), request(2)}}
+	if err = b.PublishStream(stream); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if acks := stream.response.Acks; acks[0].Id != 1 || acks[1].Id != 3 {
+		t.Errorf("expected 1 and 3, got %d and %d", acks[0].Id, acks[1].Id)
+	}
+
+	out, err := b.Publish(context.Background(), request(2))
+	if err != nil || out.Id != 3 {
+		t.Errorf("expected 3, got %v and %v", out, err)
+	}
+
+	if _, end, _ := storage.Offsets("topic1", 0); end != 4 {
+		t.Errorf("expected end 4, got %d", end)
+	}
+
+	delayed := request(3)
+	delayed.DeliverAfter = durationpb.New(time.Minute)
+	if _, err = b.Publish(context.Background(), delayed); !errors.Is(err, pkg.ErrorInvalidDelay) {
+		t.Errorf("expected %v, got %v", pkg.ErrorInvalidDelay, err)
+	}
+}
+
+func TestBroker_Close(t *testing.T) {
+	storage := repo.NewBrokerStorage("topic1")
+	b := newTestBroker(t, storage)
+
+	in := &pb.PublishRequest{Topic: "topic1", Body: []byte("a"), Acks: pb.Acks_ACKS_NONE}
+	for i := 0; i < 100; i++ {
+		if _, err := b.Publish(context.Background(), in); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+
+	// The queued publishes are saved before the close returns, the later ones are rejected.
+	if err := b.Close(); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if _, end, err := storage.Offsets("topic1", 0); err != nil || end != 100 {
+		t.Errorf("expected end 100, got %d and %v", end, err)
+	}
+
+	if _, err := b.Publish(context.Background(), in); !errors.Is(err, pkg.ErrorBrokerClosed) {
+		t.Errorf("expected %v, got %v", pkg.ErrorBrokerClosed, err)
+	}
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"time"
+)
+
+const (
+
+	// fetchMaxMessages is the default number of the messages fetched by the follower at once.
+	fetchMaxMessages = 500
+
+	// fetchMaxWait is the time, for which the leader holds the fetch of the caught up follower,
+	// it's less than the lag of the in-sync replicas, so the idle followers stay in sync.
+	fetchMaxWait = 500 * time.Millisecond
+
+	// replicationBackoff is the pause of the follower after the failed fetch.
+	replicationBackoff = time.Second
+)
+
+// Fetch returns the messages of the partition to its follower, when there are no new ones,
+// the request is held until they are appended or the max wait passes.
+func (b *broker) Fetch(ctx context.Context, in *pb.FetchRequest) (*pb.FetchResponse, error) {
+	key := partitionKey{topic: in.Topic, partition: int32(in.Partition)}
+	if b.cluster != nil {
+		if err := b.cluster.checkLeader(key, pb.Acks_ACKS_LEADER); err != nil {
+			return nil, err
+		}
+	}
+
+	max := int(in.MaxMessages)
+	if max == 0 {
+		max = fetchMaxMessages
+	}
+
+	// Taking the notification channel before reading, so the message appended in between is not missed.
+	appended, err := b.storage.Notify(key.topic, key.partition)
+	if err != nil {
+		return nil, err
+	}
+
+	_, end, err := b.storage.Offsets(key.topic, key.partition)
+	if err != nil {
+		return nil, err
+	}
+
+	// The messages of the follower after the end of its last epoch in this log were never appended here,
+	// they are left by the previous leader, so the follower truncates them and fetches again.
+	epochEnd, err := b.storage.EpochEnd(key.topic, key.partition, int32(in.LastEpoch))
+	if err != nil {
+		return nil, err
+	}
+
+	if epochEnd < int64(in.Offset) {
+		diverging := uint64(epochEnd)
+		return &pb.FetchResponse{DivergingEndOffset: &diverging}, nil
+	}
+
+	if b.cluster != nil {
+		b.cluster.fetched(key, int32(in.ReplicaId), int64(in.Offset), end)
+	}
+
+	messages, start, covered, err := b.storage.Fetch(key.topic, key.partition, int64(in.Offset), max)
+	if len(messages) == 0 && err == nil && in.MaxWaitMs != 0 {
+		timer := time.NewTimer(time.Duration(in.MaxWaitMs) * time.Millisecond)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		case <-appended:
+			messages, start, covered, err = b.storage.Fetch(key.topic, key.partition, int64(in.Offset), max)
+		}
+	}
+
+	// The follower behind the start of the leader log continues from it.
+	if err != nil && !errors.Is(err, pkg.ErrorOffsetOutOfRange) {
+		return nil, err
+	}
+
+	out := &pb.FetchResponse{StartOffset: uint64(start), EndOffset: uint64(covered)}
+	for _, m := range messages {
+		out.Records = append(out.Records, repo.EncodeMessage(m))
+	}
+
+	return out, nil
+}
+
+// replicateTopic starts following the partitions of the topic, which this broker replicates.
+func (b *broker) replicateTopic(topic string) {
+	d, err := b.storage.DescribeTopic(topic)
+	if err != nil {
+		return
+	}
+
+	for _, p := range d.Partitions {
+		key := partitionKey{topic: topic, partition: p.ID}
+		if !b.isFollower(key) {
+			continue
+		}
+
+		b.cluster.mu.Lock()
+		_, running := b.cluster.fetchers[key]
+		b.cluster.fetchers[key] = struct{}{}
+		b.cluster.mu.Unlock()
+
+		if !running {
+			go b.follow(key)
+		}
+	}
+}
+
+// isFollower reports, whether the partition is replicated by this broker from its leader.
+func (b *broker) isFollower(key partitionKey) bool {
+	replicas, leader, err := b.cluster.replicas(key)
+	return err == nil && leader != b.cluster.opts.BrokerID && pkg.In(replicas, b.cluster.opts.BrokerID)
+}
+
+// follow copies the messages of the partition from its leader, until the topic is deleted,
+// this broker leads the partition or the cluster is closed.
+func (b *broker) follow(key partitionKey) {
+	defer func() {
+		b.cluster.mu.Lock()
+		delete(b.cluster.fetchers, key)
+		b.cluster.mu.Unlock()
+	}()
+
+	for b.cluster.ctx.Err() == nil && b.isFollower(key) {
+		_, leader, _ := b.cluster.replicas(key)
+		err := b.fetchFrom(key, leader)
+		if errors.Is(err, pkg.ErrorTopicNotFound) || errors.Is(err, pkg.ErrorPartitionNotFound) {
+			return
+		}
+
+		if err == nil {
+			continue
+		}
+
+		select {
+		case <-b.cluster.ctx.Done():
+		case <-time.After(replicationBackoff):
+		}
+	}
+}
+
+// fetchFrom fetches the next messages of the partition from the end of the local log,
+// the tail, which diverged from the leader log, is truncated instead.
+func (b *broker) fetchFrom(key partitionKey, leader int32) error {
+	epoch, end, err := b.storage.LastEpoch(key.topic, key.partition)
+	if err != nil {
+		return err
+	}
+
+	client, err := b.cluster.peer(leader)
+	if err != nil {
+		return err
+	}
+
+	out, err := client.Fetch(b.cluster.ctx, &pb.FetchRequest{
+		Topic:       key.topic,
+		Partition:   uint32(key.partition),
+		Offset:      uint64(end),
+		MaxMessages: fetchMaxMessages,
+		ReplicaId:   uint32(b.cluster.opts.BrokerID),
+		MaxWaitMs:   uint32(fetchMaxWait.Milliseconds()),
+		LastEpoch:   uint32(epoch),
+	})
+	if err != nil {
+		return err
+	}
+
+	if out.DivergingEndOffset != nil {
+		if err = b.storage.TruncateTail(key.topic, key.partition, int64(*out.DivergingEndOffset)); err != nil {
+			return err
+		}
+
+		// The truncated commits are dropped from the cache too.
+		if key == offsetsPartition {
+			return b.offsets.reload()
+		}
+
+		return nil
+	}
+
+	messages := make([]*repo.Message, 0, len(out.Records))
+	for _, record := range out.Records {
+		m, e := repo.DecodeMessage(record)
+		if e != nil {
+			return e
+		}
+
+		messages = append(messages, m)
+	}
+
+	err = b.storage.Replicate(key.topic, key.partition, int64(out.StartOffset), messages, int64(out.EndOffset))
+	if err == nil && key == offsetsPartition {
+		b.offsets.replicated(messages)
+	}
+
+	return err
+}
+
+// describeReplicas adds the replicas of the partition and the in-sync ones to its description.
+func (b *broker) describeReplicas(out *pb.PartitionDescription, key partitionKey) {
+	replicas, leader, err := b.cluster.replicas(key)
+	if err != nil {
+		return
+	}
+
+	out.Leader = uint32(leader)
+	for _, id := range replicas {
+		out.Replicas = append(out.Replicas, uint32(id))
+	}
+
+	for _, id := range b.cluster.isr(key) {
+		out.Isr = append(out.Isr, uint32(id))
+	}
+}
@@ -0,0 +1,555 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replicationServer serves the calls, which the brokers of the cluster make to each other.
+type replicationServer struct {
+	pb.UnimplementedBrokerServer
+	b Broker
+}
+
+func (s *replicationServer) Publish(ctx context.Context, in *pb.PublishRequest) (*pb.PublishResponse, error) {
+	return s.b.Publish(ctx, in)
+}
+
+func (s *replicationServer) CommitOffset(ctx context.Context, in *pb.CommitOffsetRequest) (*pb.CommitOffsetResponse, error) {
+	return s.b.CommitOffset(ctx, in)
+}
+
+func (s *replicationServer) FetchCommittedOffset(
+	ctx context.Context, in *pb.FetchCommittedOffsetRequest,
+) (*pb.FetchCommittedOffsetResponse, error) {
+	return s.b.FetchCommittedOffset(ctx, in)
+}
+
+func (s *replicationServer) CreateTopic(ctx context.Context, in *pb.CreateTopicRequest) (*pb.TopicDescription, error) {
+	return s.b.CreateTopic(ctx, in)
+}
+
+func (s *replicationServer) DeleteTopic(ctx context.Context, in *pb.DeleteTopicRequest) (*pb.DeleteTopicResponse, error) {
+	return s.b.DeleteTopic(ctx, in)
+}
+
+func (s *replicationServer) ListTopics(ctx context.Context, in *pb.ListTopicsRequest) (*pb.ListTopicsResponse, error) {
+	return s.b.ListTopics(ctx, in)
+}
+
+func (s *replicationServer) DescribeTopic(ctx context.Context, in *pb.DescribeTopicRequest) (*pb.TopicDescription, error) {
+	return s.b.DescribeTopic(ctx, in)
+}
+
+// peerServer serves the calls of the cluster listener, it shares the server with the replicationServer.
+type peerServer struct {
+	pb.UnimplementedClusterServer
+	p Peer
+}
+
+func (s *peerServer) RequestVote(ctx context.Context, in *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+	return s.p.RequestVote(ctx, in)
+}
+
+func (s *peerServer) AppendEntries(ctx context.Context, in *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+	return s.p.AppendEntries(ctx, in)
+}
+
+func (s *peerServer) Fetch(ctx context.Context, in *pb.FetchRequest) (*pb.FetchResponse, error) {
+	return s.p.Fetch(ctx, in)
+}
+
+func (s *peerServer) AlterIsr(ctx context.Context, in *pb.AlterIsrRequest) (*pb.AlterIsrResponse, error) {
+	return s.p.AlterIsr(ctx, in)
+}
+
+func (s *peerServer) Schedule(ctx context.Context, in *pb.ScheduleRequest) (*pb.ScheduleResponse, error) {
+	return s.p.Schedule(ctx, in)
+}
+
+// testCluster is the brokers of the cluster running on the local ports.
+type testCluster struct {
+	brokers map[int32]Broker
+	stops   map[int32]func()
+}
+
+// newTestCluster starts the brokers of the cluster, they are stopped with the test.
+func newTestCluster(t *testing.T, n int, opts ClusterOptions) *testCluster {
+	listeners := make(map[int32]net.Listener, n)
+	opts.Brokers, opts.Peers = make(map[int32]string, n), make(map[int32]string, n)
+	for id := int32(0); id < int32(n); id++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+
+		listeners[id], opts.Brokers[id], opts.Peers[id] = l, l.Addr().String(), l.Addr().String()
+	}
+
+	c := &testCluster{brokers: make(map[int32]Broker, n), stops: make(map[int32]func(), n)}
+	for id, l := range listeners {
+		opts.BrokerID = id
+		b, err := NewClusterBroker(repo.NewBrokerStorage(), opts)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+
+		s := grpc.NewServer()
+		pb.RegisterBrokerServer(s, &replicationServer{b: b})
+		pb.RegisterClusterServer(s, &peerServer{p: b})
+		go func(l net.Listener) { _ = s.Serve(l) }(l)
+
+		var once sync.Once
+		c.stops[id] = func() {
+			once.Do(func() {
+				_ = b.Close()
+				s.Stop()
+			})
+		}
+
+		t.Cleanup(c.stops[id])
+		c.brokers[id] = b
+	}
+
+	return c
+}
+
+// awaitController waits, until the controller is elected and all brokers know it, so they forward to it.
+func (c *testCluster) awaitController(t *testing.T) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		controller, known := int32(-1), 0
+		for _, b := range c.brokers {
+			if id, ok := b.(*broker).cluster.node.Leader(); ok && (controller == -1 || controller == id) {
+				controller, known = id, known+1
+			}
+		}
+
+		if known == len(c.brokers) && c.brokers[controller].(*broker).cluster.node.IsLeader() {
+			return
+		}
+	}
+
+	t.Fatalf("expected the controller to be elected")
+}
+
+// createTopic creates the topic through the broker, which may be not the controller, and waits for all brokers to have it.
+func (c *testCluster) createTopic(t *testing.T, through int32, partitions uint32) *pb.TopicDescription {
+	c.awaitController(t)
+	d, err := c.brokers[through].CreateTopic(context.Background(), &pb.CreateTopicRequest{Name: "topic1", Partitions: partitions})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// The other brokers apply the topic, when the controller tells them it's committed.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		created := true
+		for _, b := range c.brokers {
+			created = created && b.(*broker).cluster.meta.hasTopic("topic1")
+		}
+
+		if created {
+			return d
+		}
+	}
+
+	t.Fatalf("expected the topic to be created on all brokers")
+	return nil
+}
+
+// awaitInsync waits, until all replicas of the partition are in sync with its leader.
+func awaitInsync(t *testing.T, leader Broker, partition int) {
+	awaitIsr(t, leader, partition, func(p *pb.PartitionDescription) bool { return len(p.Isr) == len(p.Replicas) })
+}
+
+// awaitIsr waits, until the in-sync replicas of the partition known by the broker are the expected ones.
+func awaitIsr(t *testing.T, b Broker, partition int, expected func(p *pb.PartitionDescription) bool) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		d, err := b.DescribeTopic(context.Background(), &pb.DescribeTopicRequest{Name: "topic1"})
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+
+		if expected(d.Partitions[partition]) {
+			return
+		}
+	}
+
+	t.Fatalf("expected the in-sync replicas to change")
+}
+
+func TestBroker_Replication(t *testing.T) {
+	c := newTestCluster(t, 3, ClusterOptions{MinInsyncReplicas: 3, AckTimeout: 5 * time.Second})
+	d := c.createTopic(t, 0, 2)
+
+	for _, p := range d.Partitions {
+		leader, follower := c.brokers[int32(p.Leader)], c.brokers[int32(p.Replicas[1])]
+		awaitInsync(t, leader, int(p.Id))
+
+		partition := p.Id
+		in := &pb.PublishRequest{Topic: "topic1", Body: []byte("a"), Partition: &partition, Acks: pb.Acks_ACKS_ALL}
+		if _, err := follower.Publish(context.Background(), in); !errors.Is(err, pkg.ErrorNotLeader) {
+			t.Errorf("expected %v, got %v", pkg.ErrorNotLeader, err)
+		}
+
+		out, err := leader.Publish(context.Background(), in)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+
+		// All acks return after every replica has the message.
+		for _, id := range p.Replicas {
+			m, e := c.brokers[int32(id)].(*broker).storage.Explore("topic1", int32(partition), int64(out.Id))
+			if e != nil || string(m.Content()) != "a" {
+				t.Errorf("expected a on broker %d, got %v and %v", id, m, e)
+			}
+		}
+	}
+}
+
+func TestBroker_PublishAcks(t *testing.T) {
+	testCases := []struct {
+		name     string
+		acks     pb.Acks
+		expected error
+	}{
+		{
+			name: "leader",
+			acks: pb.Acks_ACKS_LEADER,
+		},
+		{
+			name: "none",
+			acks: pb.Acks_ACKS_NONE,
+		},
+		{
+			name:     "all without the follower",
+			acks:     pb.Acks_ACKS_ALL,
+			expected: pkg.ErrorNotEnoughReplicas,
+		},
+	}
+
+	c := newTestCluster(t, 3, ClusterOptions{MinInsyncReplicas: 3, ReplicaLagMax: 200 * time.Millisecond})
+	p := c.createTopic(t, 0, 1).Partitions[0]
+	leader := c.brokers[int32(p.Leader)]
+	awaitInsync(t, leader, 0)
+
+	// The stopped follower falls out of sync, so only two replicas are left.
+	c.stops[int32(p.Replicas[1])]()
+	awaitIsr(t, leader, 0, func(p *pb.PartitionDescription) bool { return len(p.Isr) == 2 })
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := &pb.PublishRequest{Topic: "topic1", Body: []byte("a"), Partition: &p.Id, Acks: tc.acks}
+			if _, err := leader.Publish(context.Background(), in); !errors.Is(err, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, err)
+			}
+
+			stream := &publishStream{requests: []*pb.PublishRequest{in}}
+			if err := leader.PublishStream(stream); !errors.Is(err, tc.expected) {
+				t.Errorf("expected %v from the stream, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestBroker_Failover(t *testing.T) {
+	c := newTestCluster(t, 3, ClusterOptions{SessionTimeout: 500 * time.Millisecond})
+	p := c.createTopic(t, 1, 1).Partitions[0]
+	awaitInsync(t, c.brokers[int32(p.Leader)], 0)
+
+	partition := p.Id
+	in := &pb.PublishRequest{Topic: "topic1", Body: []byte("a"), Partition: &partition, Acks: pb.Acks_ACKS_ALL}
+	if _, err := c.brokers[int32(p.Leader)].Publish(context.Background(), in); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// The partition is led by the next replica, when the controller loses its leader.
+	c.stops[int32(p.Leader)]()
+	survivor := c.brokers[int32(p.Replicas[1])]
+
+	var out *pb.MetadataResponse
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		var err error
+		if out, err = survivor.Metadata(context.Background(), &pb.MetadataRequest{Topics: []string{"topic1"}}); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+
+		if out.Topics[0].Partitions[0].Leader != p.Leader {
+			break
+		}
+	}
+
+	moved := out.Topics[0].Partitions[0]
+	if moved.Leader != p.Replicas[1] || moved.LeaderEpoch != 1 {
+		t.Fatalf("expected broker %d to lead in epoch 1, got %v", p.Replicas[1], moved)
+	}
+
+	if out.Brokers[p.Leader].Alive {
+		t.Errorf("expected broker %d to be lost", p.Leader)
+	}
+
+	in.Body = []byte("b")
+	if _, err := survivor.Publish(context.Background(), in); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	for offset, expected := range []string{"a", "b"} {
+		m, err := survivor.(*broker).storage.Explore("topic1", 0, int64(offset))
+		if err != nil || string(m.Content()) != expected {
+			t.Errorf("expected %s, got %v and %v", expected, m, err)
+		}
+	}
+}
+
+func TestBroker_DeliverDelayedToLeader(t *testing.T) {
+	c := newTestCluster(t, 3, ClusterOptions{})
+	d := c.createTopic(t, 0, 3)
+
+	// The partitions are led by all brokers, so one of them isn't led by the one delivering the delayed messages.
+	delivering, _ := c.brokers[0].(*broker).delayed.leader()
+	p := d.Partitions[0]
+	for _, partition := range d.Partitions {
+		if int32(partition.Leader) != delivering {
+			p = partition
+			break
+		}
+	}
+
+	leader := c.brokers[int32(p.Leader)]
+	awaitInsync(t, leader, int(p.Id))
+
+	partition := p.Id
+	c.brokers[delivering].(*broker).delayed.deliver(&scheduledMessage{
+		id:      []byte("id"),
+		request: &pb.PublishRequest{Topic: "topic1", Body: []byte("a"), Partition: &partition, DeliverAt: timestamppb.Now()},
+	})
+
+	// The message is appended by the leader, instead of the local replica of the delivering broker.
+	m, err := leader.(*broker).storage.Explore("topic1", int32(partition), 0)
+	if err != nil || string(m.Content()) != "a" {
+		t.Fatalf("expected a on the leader, got %v and %v", m, err)
+	}
+}
+
+func TestBroker_DelayedFailover(t *testing.T) {
+	c := newTestCluster(t, 3, ClusterOptions{SessionTimeout: 500 * time.Millisecond})
+	p := c.createTopic(t, 0, 1).Partitions[0]
+	leader := c.brokers[int32(p.Leader)]
+	awaitInsync(t, leader, 0)
+
+	delivering, _ := leader.(*broker).delayed.leader()
+	awaitInternalIsr(t, c.brokers[delivering], delayedPartition, 3)
+
+	partition := p.Id
+	_, err := leader.Publish(context.Background(), &pb.PublishRequest{
+		Topic: "topic1", Body: []byte("a"), Partition: &partition, Acks: pb.Acks_ACKS_ALL, DeliverAfter: durationpb.New(2 * time.Second),
+	})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	// The broker, which received the message, is lost before the delivery, the others deliver it.
+	c.stops[int32(p.Leader)]()
+	for id, b := range c.brokers {
+		if id != int32(p.Leader) {
+			waitForEnd(t, b.(*broker).storage, "topic1", 1)
+		}
+	}
+}
+
+func TestBroker_CommitOffsetFailover(t *testing.T) {
+	c := newTestCluster(t, 3, ClusterOptions{SessionTimeout: 500 * time.Millisecond})
+	c.createTopic(t, 0, 1)
+
+	coordinator, _ := c.brokers[0].(*broker).offsets.coordinator()
+	awaitInternalIsr(t, c.brokers[coordinator], offsetsPartition, 3)
+
+	var others []Broker
+	for id, b := range c.brokers {
+		if id != coordinator {
+			others = append(others, b)
+		}
+	}
+
+	// The commit is forwarded to the coordinator, every broker returns it.
+	in := &pb.CommitOffsetRequest{GroupId: "group", Topic: "topic1", Offset: 5}
+	if _, err := others[0].CommitOffset(context.Background(), in); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	for _, b := range c.brokers {
+		awaitCommitted(t, b, 5)
+	}
+
+	// The next replica of the offsets takes over the commits, when the coordinator is lost.
+	c.stops[coordinator]()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if id, _ := others[0].(*broker).offsets.coordinator(); id != coordinator {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the coordinator to move from broker %d", coordinator)
+		}
+	}
+
+	for _, b := range others {
+		awaitCommitted(t, b, 5)
+	}
+
+	in.Offset = 7
+	if _, err := others[1].CommitOffset(context.Background(), in); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	awaitCommitted(t, others[0], 7)
+}
+
+// awaitInternalIsr waits, until the partition of the internal topic has the in-sync replicas.
+func awaitInternalIsr(t *testing.T, b Broker, key partitionKey, expected int) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if len(b.(*broker).cluster.isr(key)) == expected {
+			return
+		}
+	}
+
+	t.Fatalf("expected %d in-sync replicas of %s", expected, key.topic)
+}
+
+// awaitCommitted waits, until the broker returns the committed offset of the group.
+func awaitCommitted(t *testing.T, b Broker, expected uint64) {
+	in := &pb.FetchCommittedOffsetRequest{GroupId: "group", Topic: "topic1"}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		out, err := b.FetchCommittedOffset(context.Background(), in)
+		if err == nil && out.Committed && out.Offset == expected {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d committed on broker %d, got %v and %v", expected, b.(*broker).cluster.opts.BrokerID, out, err)
+		}
+	}
+}
+
+func TestBroker_FetchDiverged(t *testing.T) {
+	testCases := []struct {
+		name      string
+		offset    uint64
+		lastEpoch uint32
+		diverged  bool
+		end       uint64
+		records   int
+	}{
+		{
+			name:     "diverged, tail of the previous epoch",
+			offset:   4,
+			diverged: true,
+			end:      2,
+		},
+		{
+			name:      "diverged, past the end of the leader",
+			offset:    5,
+			lastEpoch: 1,
+			diverged:  true,
+			end:       3,
+		},
+		{
+			name:    "success, end of the previous epoch",
+			offset:  2,
+			end:     3,
+			records: 1,
+		},
+		{
+			name:      "success, end of the leader",
+			offset:    3,
+			lastEpoch: 1,
+			end:       3,
+		},
+	}
+
+	// The first two messages are appended in the zero epoch, the third one in the first.
+	storage := repo.NewBrokerStorage("topic1")
+	for i, content := range []string{"a", "b", "c"} {
+		if i == 2 {
+			if err := storage.StartLeaderEpoch("topic1", 0, 1); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+		}
+
+		if _, err := storage.Save("topic1", 0, repo.NewMessage(nil, []byte(content))); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+
+	b := newTestBroker(t, storage).(*broker)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := b.Fetch(context.Background(), &pb.FetchRequest{Topic: "topic1", Offset: tc.offset, LastEpoch: tc.lastEpoch})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if tc.diverged {
+				if out.DivergingEndOffset == nil || *out.DivergingEndOffset != tc.end {
+					t.Errorf("expected diverging end %d, got %v", tc.end, out.DivergingEndOffset)
+				}
+			} else if out.DivergingEndOffset != nil || out.EndOffset != tc.end {
+				t.Errorf("expected end %d, got %d and diverging end %v", tc.end, out.EndOffset, out.DivergingEndOffset)
+			}
+
+			if len(out.Records) != tc.records {
+				t.Errorf("expected %d records, got %d", tc.records, len(out.Records))
+			}
+		})
+	}
+}
+
+func TestMetadataState_ElectLeader(t *testing.T) {
+	type election struct{ leader, epoch int32 }
+
+	var elections []election
+	m := newMetadataState([]int32{0, 1, 2}, func(_ partitionKey, leader, epoch int32, _ []int32) {
+		elections = append(elections, election{leader: leader, epoch: epoch})
+	})
+
+	key := partitionKey{topic: "topic1"}
+	m.apply(metadataCommand{Type: commandCreateTopic, Topic: "topic1", Replicas: [][]int32{{0, 1, 2}}})
+
+	// The broker 1 falls out of sync, the same change based on the stale in-sync replicas is dropped.
+	m.apply(metadataCommand{Type: commandIsr, Topic: "topic1", Isr: []int32{0, 2}})
+	m.apply(metadataCommand{Type: commandIsr, Topic: "topic1", Isr: []int32{0}})
+
+	steps := []struct {
+		alive  []int32
+		leader int32
+		epoch  int32
+		isr    []int32
+	}{
+		{alive: []int32{1, 2}, leader: 2, epoch: 1, isr: []int32{2}},
+		{alive: []int32{0, 1}, leader: 2, epoch: 1, isr: []int32{2}},
+		{alive: []int32{0, 1, 2}, leader: 2, epoch: 1, isr: []int32{2}},
+	}
+
+	for _, step := range steps {
+		m.apply(metadataCommand{Type: commandBrokers, Alive: step.alive})
+
+		p, ok := m.partition(key)
+		if !ok || p.leader != step.leader || p.epoch != step.epoch || len(p.isr) != len(step.isr) || !pkg.Subset(p.isr, step.isr) {
+			t.Errorf("expected leader %d in epoch %d with isr %v, got %+v", step.leader, step.epoch, step.isr, p)
+		}
+	}
+
+	expected := []election{{leader: 0, epoch: 0}, {leader: 2, epoch: 1}}
+	if len(elections) != len(expected) || elections[0] != expected[0] || elections[1] != expected[1] {
+		t.Errorf("expected elections %v, got %v", expected, elections)
+	}
+}
@@ -0,0 +1,320 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"sync"
+	"time"
+)
+
+// sendFunc delivers a message of a partition to the subscriber.
+type sendFunc func(partition int32, m *repo.Message) error
+
+func (b *broker) Subscribe(in *pb.SubscribeRequest, stream pb.Broker_SubscribeServer) error {
+	if in.GroupId != "" {
+		return b.subscribeGroup(in, stream)
+	}
+
+	partitions, err := b.partitions(in.Topic, in.Partition)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	send := lockedSend(stream)
+	errs := make(chan error, len(partitions))
+	for _, partition := range partitions {
+		go func(partition int32) {
+			offset, e := b.startOffset(in, partition)
+			if e == nil {
+				e = b.tail(ctx, in.Topic, partition, offset, in.IsolationLevel, func(partition int32, m *repo.Message) error {
+					return send(toMessageResponse(partition, m))
+				})
+			}
+
+			errs <- e
+		}(partition)
+	}
+
+	for range partitions {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			cancel()
+		}
+	}
+
+	return err
+}
+
+// subscribeGroup joins the subscriber to the consumer group and streams the partitions
+// assigned to it, restarting the reading on every rebalance.
+func (b *broker) subscribeGroup(in *pb.SubscribeRequest, stream pb.Broker_SubscribeServer) error {
+	d, err := b.storage.DescribeTopic(in.Topic)
+	if err != nil {
+		return err
+	}
+
+	m := b.groups.join(in.GroupId, in.Topic, len(d.Partitions), in.Strategy)
+	defer b.groups.leave(m)
+
+	ctx, cancel := context.WithCancelCause(stream.Context())
+	defer cancel(nil)
+
+	send := lockedSend(stream)
+	if in.SessionTimeoutMs != 0 {
+		send = expiringSend(send, time.Duration(in.SessionTimeoutMs)*time.Millisecond, func() {
+			// Giving the partitions to the other members right away, the stuck send
+			// will be interrupted only when the connection is closed.
+			b.groups.leave(m)
+			cancel(pkg.ErrorSessionTimeout)
+		})
+	}
+
+	deliver := func(partition int32, message *repo.Message) error {
+		if e := send(toMessageResponse(partition, message)); e != nil {
+			return e
+		}
+
+		b.groups.advance(m, partition, message.Offset())
+		return nil
+	}
+
+	errs := make(chan error, 1)
+	stop := func() {}
+	defer func() { stop() }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if cause := context.Cause(ctx); errors.Is(cause, pkg.ErrorSessionTimeout) {
+				return cause
+			}
+
+			return nil
+		case e := <-errs:
+			return e
+		case a := <-m.assignments:
+			// Stopping the previous generation before announcing the new one,
+			// so the revoked partitions are not delivered after the assignment.
+			stop()
+			if e := send(&pb.MessageResponse{Assignment: a}); e != nil {
+				return e
+			}
+
+			stop = b.tailAssigned(ctx, in, m, a, deliver, errs)
+		}
+	}
+}
+
+// tailAssigned starts reading the assigned partitions, the returned function
+// stops the reading and waits until it's finished.
+func (b *broker) tailAssigned(
+	ctx context.Context, in *pb.SubscribeRequest, m *member, a *pb.Assignment, send sendFunc, errs chan<- error,
+) func() {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	wg.Add(len(a.Partitions))
+	for _, p := range a.Partitions {
+		go func(partition int32) {
+			defer wg.Done()
+
+			// The committed offset goes first, so the messages, which were delivered
+			// but not processed by the previous owner, are delivered once again.
+			offset, ok := b.offsets.fetch(offsetKey{group: in.GroupId, topic: in.Topic, partition: partition})
+			if !ok {
+				offset, ok = b.groups.position(m, partition)
+			}
+
+			if !ok {
+				var e error
+				if offset, e = b.startOffset(in, partition); e != nil {
+					reportError(errs, e)
+					return
+				}
+			}
+
+			if e := b.tail(ctx, in.Topic, partition, offset, in.IsolationLevel, send); e != nil {
+				reportError(errs, e)
+			}
+		}(int32(p))
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// reportError passes the first error only, the rest are dropped, because the subscription
+// is finished after the first one.
+func reportError(errs chan<- error, err error) {
+	select {
+	case errs <- err:
+	default:
+	}
+}
+
+// lockedSend makes the stream safe for the concurrent sends, while the partitions are tailed independently.
+func lockedSend(stream pb.Broker_SubscribeServer) func(*pb.MessageResponse) error {
+	var mu sync.Mutex
+	return func(m *pb.MessageResponse) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return stream.Send(m)
+	}
+}
+
+// expiringSend calls expire, when the send is not finished in time, meaning that the subscriber
+// stopped reading the stream. The idle subscriber doesn't expire, there is nothing to send to it.
+func expiringSend(send func(*pb.MessageResponse) error, timeout time.Duration, expire func()) func(*pb.MessageResponse) error {
+	return func(m *pb.MessageResponse) error {
+		timer := time.AfterFunc(timeout, expire)
+		defer timer.Stop()
+
+		return send(m)
+	}
+}
+
+// partitions returns the requested partition or all partitions of the topic.
+func (b *broker) partitions(topic string, partition *uint32) ([]int32, error) {
+	d, err := b.storage.DescribeTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	if partition != nil {
+		if int(*partition) >= len(d.Partitions) {
+			return nil, pkg.ErrorPartitionNotFound
+		}
+
+		return []int32{int32(*partition)}, nil
+	}
+
+	partitions := make([]int32, 0, len(d.Partitions))
+	for _, p := range d.Partitions {
+		partitions = append(partitions, p.ID)
+	}
+
+	return partitions, nil
+}
+
+// tail sends the messages of a partition one by one starting from the offset,
+// waiting for the new ones, until the context is done.
+func (b *broker) tail(
+	ctx context.Context, topic string, partition int32, offset int64, isolation pb.IsolationLevel, send sendFunc,
+) error {
+	explore := b.explore(isolation)
+	for ctx.Err() == nil {
+		// Taking the notification channel before reading, otherwise a message
+		// saved between the read and the wait will be noticed only with the next one.
+		appended, err := b.storage.Notify(topic, partition)
+		if err != nil {
+			return err
+		}
+
+		message, err := explore(topic, partition, offset)
+		if err == nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			if err = send(partition, message); err != nil {
+				return err
+			}
+
+			offset = message.Offset() + 1
+			continue
+		}
+
+		if !errors.Is(err, pkg.ErrorOffsetOutOfRange) {
+			return err
+		}
+
+		// The offset is either not written yet, or the message is already gone.
+		start, _, err := b.storage.Offsets(topic, partition)
+		if err != nil {
+			return err
+		}
+
+		if offset < start {
+			return deletedOffset(offset, start)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-appended:
+		}
+	}
+
+	return nil
+}
+
+// startOffset resolves the offset policy of the request into the offset of the first message to send.
+func (b *broker) startOffset(in *pb.SubscribeRequest, partition int32) (int64, error) {
+	start, end, err := b.storage.Offsets(in.Topic, partition)
+	if err != nil {
+		return 0, err
+	}
+
+	switch in.Policy {
+	case pb.OffsetPolicy_EARLIEST:
+		return start, nil
+	case pb.OffsetPolicy_EXPLICIT:
+		if int64(in.Offset) < start {
+			return 0, deletedOffset(int64(in.Offset), start)
+		}
+
+		return int64(in.Offset), nil
+	case pb.OffsetPolicy_TIMESTAMP:
+		if in.Timestamp == nil {
+			return 0, pkg.ErrorTimestampRequired
+		}
+
+		return b.storage.OffsetForTime(in.Topic, partition, in.Timestamp.AsTime())
+	default:
+		// The messages of the open transactions are delivered to the read committed subscribers after the commit.
+		if in.IsolationLevel == pb.IsolationLevel_READ_COMMITTED {
+			return b.storage.LastStableOffset(in.Topic, partition)
+		}
+
+		return end, nil
+	}
+}
+
+// deletedOffset tells the consumer, that the offset was removed by the retention
+// and from where it can continue.
+func deletedOffset(offset, start int64) error {
+	return fmt.Errorf("%w: offset %d is deleted, the partition starts at %d", pkg.ErrorOffsetOutOfRange, offset, start)
+}
+
+func toMessageResponse(partition int32, m *repo.Message) *pb.MessageResponse {
+	return &pb.MessageResponse{
+		Body:      m.Content(),
+		Offset:    uint64(m.Offset()),
+		Partition: uint32(partition),
+		Key:       m.Key(),
+		Headers:   m.Headers(),
+		Timestamp: toTimestamp(m.Timestamp()),
+
+		ProducerTimestamp: toTimestamp(m.ProducerTimestamp()),
+		ExpiresAt:         toTimestamp(m.ExpiresAt()),
+	}
+}
+
+// toTimestamp converts the optional time, the zero one is not set.
+func toTimestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+
+	return timestamppb.New(t)
+}
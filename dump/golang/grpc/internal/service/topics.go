@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+)
+
+func (b *broker) CreateTopic(ctx context.Context, in *pb.CreateTopicRequest) (*pb.TopicDescription, error) {
+	if isInternalTopic(in.Name) {
+		return nil, pkg.ErrorInternalTopic
+	}
+
+	partitions := int(in.Partitions)
+	if partitions == 0 {
+		partitions = 1
+	}
+
+	if _, err := NewPartitioner(in.Config[partitionerConfig]); err != nil {
+		return nil, err
+	}
+
+	if err := validateExpiredDeadLetter(in.Name, in.Config); err != nil {
+		return nil, err
+	}
+
+	if b.cluster != nil {
+		if err := repo.ValidateTopic(in.Name, partitions, in.Config); err != nil {
+			return nil, err
+		}
+
+		return b.createClusterTopic(ctx, in, partitions)
+	}
+
+	if err := b.storage.CreateTopic(in.Name, partitions, in.Config); err != nil {
+		return nil, err
+	}
+
+	return b.DescribeTopic(ctx, &pb.DescribeTopicRequest{Name: in.Name})
+}
+
+func (b *broker) DeleteTopic(ctx context.Context, in *pb.DeleteTopicRequest) (*pb.DeleteTopicResponse, error) {
+	if isInternalTopic(in.Name) {
+		return nil, pkg.ErrorInternalTopic
+	}
+
+	if b.cluster != nil {
+		return b.deleteClusterTopic(ctx, in)
+	}
+
+	if _, err := b.storage.DescribeTopic(in.Name); err != nil {
+		return nil, err
+	}
+
+	if err := b.dropTopic(in.Name); err != nil {
+		return nil, err
+	}
+
+	if err := b.storage.DeleteTopic(in.Name); err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteTopicResponse{}, nil
+}
+
+// dropTopic forgets the routing, the consumer groups and the committed offsets of the deleted topic,
+// so the topic created with the same name starts from the scratch.
+func (b *broker) dropTopic(name string) error {
+	b.forget(name)
+	b.groups.dropTopic(name)
+	b.subscriptions.dropTopic(name)
+	return b.offsets.dropTopic(name)
+}
+
+func (b *broker) ListTopics(context.Context, *pb.ListTopicsRequest) (*pb.ListTopicsResponse, error) {
+	return &pb.ListTopicsResponse{Topics: b.storage.Topics()}, nil
+}
+
+func (b *broker) DescribeTopic(_ context.Context, in *pb.DescribeTopicRequest) (*pb.TopicDescription, error) {
+	d, err := b.storage.DescribeTopic(in.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &pb.TopicDescription{
+		Name:       d.Name,
+		Partitions: make([]*pb.PartitionDescription, 0, len(d.Partitions)),
+		Config:     d.Config,
+	}
+
+	for _, p := range d.Partitions {
+		partition := &pb.PartitionDescription{
+			Id:          uint32(p.ID),
+			StartOffset: uint64(p.StartOffset),
+			EndOffset:   uint64(p.EndOffset),
+		}
+
+		if b.cluster != nil {
+			b.describeReplicas(partition, partitionKey{topic: d.Name, partition: p.ID})
+		}
+
+		out.Partitions = append(out.Partitions, partition)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"context"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+)
+
+func (b *broker) BeginTransaction(_ context.Context, in *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	if err := b.storage.BeginTransaction(int64(in.ProducerId), int32(in.ProducerEpoch)); err != nil {
+		return nil, err
+	}
+
+	return &pb.BeginTransactionResponse{}, nil
+}
+
+func (b *broker) Commit(_ context.Context, in *pb.CommitTransactionRequest) (*pb.CommitTransactionResponse, error) {
+	if err := b.storage.EndTransaction(int64(in.ProducerId), int32(in.ProducerEpoch), true); err != nil {
+		return nil, err
+	}
+
+	return &pb.CommitTransactionResponse{}, nil
+}
+
+func (b *broker) Abort(_ context.Context, in *pb.AbortTransactionRequest) (*pb.AbortTransactionResponse, error) {
+	if err := b.storage.EndTransaction(int64(in.ProducerId), int32(in.ProducerEpoch), false); err != nil {
+		return nil, err
+	}
+
+	return &pb.AbortTransactionResponse{}, nil
+}
+
+// explore returns the reading of the partition messages for the isolation level of the consumer.
+func (b *broker) explore(isolation pb.IsolationLevel) func(topic string, partition int32, offset int64) (*repo.Message, error) {
+	if isolation == pb.IsolationLevel_READ_COMMITTED {
+		return b.storage.ExploreCommitted
+	}
+
+	return b.storage.Explore
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBroker_SubscribeReadCommitted(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy pb.OffsetPolicy
+	}{
+		{
+			name:   "earliest",
+			policy: pb.OffsetPolicy_EARLIEST,
+		},
+		{
+			name:   "latest starts before the open transaction",
+			policy: pb.OffsetPolicy_LATEST,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBroker(t, repo.NewBrokerStorage("topic1"))
+			producer, err := b.InitProducer(context.Background(), &pb.InitProducerRequest{})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			begin := &pb.BeginTransactionRequest{ProducerId: producer.ProducerId, ProducerEpoch: producer.Epoch}
+			transactional := func(sequence uint32, body string) {
+				_, e := b.Publish(context.Background(), &pb.PublishRequest{
+					Topic: "topic1", Body: []byte(body),
+					ProducerId: producer.ProducerId, ProducerEpoch: producer.Epoch, Sequence: sequence,
+				})
+				if e != nil {
+					t.Fatalf("expected nil, got %v", e)
+				}
+			}
+
+			if _, err = b.BeginTransaction(context.Background(), begin); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			transactional(0, "aborted")
+			_, err = b.Abort(context.Background(), &pb.AbortTransactionRequest{
+				ProducerId: producer.ProducerId, ProducerEpoch: producer.Epoch,
+			})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if _, err = b.BeginTransaction(context.Background(), begin); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			transactional(1, "a")
+			publish(t, b, "b")
+
+			stream := newSubscribeStream(2)
+			defer stream.cancel()
+
+			done := make(chan error)
+			request := &pb.SubscribeRequest{Topic: "topic1", Policy: tc.policy, IsolationLevel: pb.IsolationLevel_READ_COMMITTED}
+			go func() { done <- b.Subscribe(request, stream) }()
+
+			time.Sleep(10 * time.Millisecond)
+			_, err = b.Commit(context.Background(), &pb.CommitTransactionRequest{
+				ProducerId: producer.ProducerId, ProducerEpoch: producer.Epoch,
+			})
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if err = <-done; err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if errors.Is(stream.ctx.Err(), context.DeadlineExceeded) {
+				t.Fatalf("expected 2 messages, got %d", len(stream.received))
+			}
+
+			var got []string
+			for _, m := range stream.received {
+				got = append(got, string(m.Body))
+			}
+
+			if !reflect.DeepEqual(got, []string{"a", "b"}) {
+				t.Errorf("expected [a b], got %v", got)
+			}
+		})
+	}
+}
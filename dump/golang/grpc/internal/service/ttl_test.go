@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fadyat/grpc-broker/api/pb"
+	"github.com/fadyat/grpc-broker/internal/repo"
+	"github.com/fadyat/grpc-broker/pkg"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"testing"
+	"time"
+)
+
+func TestBroker_PublishTTL(t *testing.T) {
+	testCases := []struct {
+		name        string
+		ttl         *durationpb.Duration
+		expiring    bool
+		expectedErr error
+	}{
+		{
+			name:     "success, ttl",
+			ttl:      durationpb.New(time.Minute),
+			expiring: true,
+		},
+		{
+			name: "success, no ttl",
+		},
+		{
+			name:        "failure, negative ttl",
+			ttl:         durationpb.New(-time.Minute),
+			expectedErr: pkg.ErrorInvalidTTL,
+		},
+		{
+			name:        "failure, less than a millisecond",
+			ttl:         durationpb.New(time.Microsecond),
+			expectedErr: pkg.ErrorInvalidTTL,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			storage := repo.NewBrokerStorage("topic1")
+			b := newTestBroker(t, storage)
+
+			_, err := b.Publish(context.Background(), &pb.PublishRequest{Topic: "topic1", Body: []byte("a"), Ttl: tc.ttl})
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected %v, got %v", tc.expectedErr, err)
+			}
+
+			if tc.expectedErr != nil {
+				return
+			}
+
+			m, err := storage.Explore("topic1", 0, 0)
+			if err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			out := toMessageResponse(0, m)
+			if tc.expiring != (out.ExpiresAt != nil) {
+				t.Fatalf("expected expiring %v, got %v", tc.expiring, out.ExpiresAt)
+			}
+
+			if tc.expiring && !out.ExpiresAt.AsTime().Equal(m.Timestamp().Add(tc.ttl.AsDuration())) {
+				t.Errorf("expected the expiration after %v, got %v", tc.ttl.AsDuration(), out.ExpiresAt.AsTime())
+			}
+		})
+	}
+}
+
+func TestBroker_ExpiredDeadLetter(t *testing.T) {
+	storage := repo.NewBrokerStorage()
+	defer storage.Close()
+
+	b := newTestBroker(t, storage)
+	_, err := b.CreateTopic(context.Background(), &pb.CreateTopicRequest{
+		Name:   "topic1",
+		Config: map[string]string{"message.ttl.ms": "20", expiredDeadLetterConfig: "topic1-expired"},
+	})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	publish(t, b, "a", "b")
+	_, err = b.Publish(context.Background(), &pb.PublishRequest{
+		Topic: "topic1", Body: []byte("c"), Ttl: durationpb.New(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	storage.StartCleaner(10 * time.Millisecond)
+	waitForEnd(t, storage, "topic1-expired", 2)
+
+	for offset, body := range []string{"a", "b"} {
+		dead, e := storage.Explore("topic1-expired", 0, int64(offset))
+		if e != nil {
+			t.Fatalf("expected nil, got %v", e)
+		}
+
+		headers := dead.Headers()
+		if string(dead.Content()) != body || string(headers[deadLetterErrorHeader]) != expiredError {
+			t.Errorf("expected %s with %q, got %s with %v", body, expiredError, dead.Content(), headers)
+		}
+
+		if _, ok := headers[deadLetterAttemptsHeader]; ok {
+			t.Errorf("expected no delivery attempts, got %s", headers[deadLetterAttemptsHeader])
+		}
+	}
+
+	// The expired messages are removed after they are moved, the message with its own ttl is still delivered.
+	var start int64
+	for deadline := time.Now().Add(5 * time.Second); start != 2 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		if start, _, err = storage.Offsets("topic1", 0); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+
+	m, err := storage.Explore("topic1", 0, start)
+	if start != 2 || err != nil || string(m.Content()) != "c" {
+		t.Errorf("expected c at 2, got %v and %v at %d", m, err, start)
+	}
+}
+
+func TestBroker_CreateTopicExpiredDeadLetter(t *testing.T) {
+	testCases := []struct {
+		name        string
+		deadLetter  string
+		expectedErr error
+	}{
+		{
+			name:       "success",
+			deadLetter: "topic1-expired",
+		},
+		{
+			name:        "failure, the topic itself",
+			deadLetter:  "topic1",
+			expectedErr: pkg.ErrorInvalidDeadLetter,
+		},
+		{
+			name:        "failure, internal topic",
+			deadLetter:  offsetsTopic,
+			expectedErr: pkg.ErrorInternalTopic,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBroker(t, repo.NewBrokerStorage())
+			_, err := b.CreateTopic(context.Background(), &pb.CreateTopicRequest{
+				Name:   "topic1",
+				Config: map[string]string{expiredDeadLetterConfig: tc.deadLetter},
+			})
+
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("expected %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
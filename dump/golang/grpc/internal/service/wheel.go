@@ -0,0 +1,124 @@
+package service
+
+// timingWheel is the hierarchical timing wheel of the delayed messages.
+//
+// Every level is a ring of buckets, each bucket holds the messages due within its tick.
+// The messages, which are too far for the level, go to the next one with the tick
+// as long as the whole level, and cascade down, when their bucket comes. So the adding
+// and the releasing don't depend on the number of the held messages.
+type timingWheel struct {
+
+	// tick is the time span of a bucket in milliseconds.
+	tick int64
+
+	// interval is the time span of the whole level, the tick multiplied by the number of buckets.
+	interval int64
+
+	// current is the start of the current tick, it's a multiple of the tick.
+	current int64
+
+	// lowest is set for the first level, its buckets are released only after their tick,
+	// so the messages are never released early.
+	lowest bool
+
+	buckets  []*bucket
+	overflow *timingWheel
+}
+
+type bucket struct {
+
+	// expiration is the time, when the bucket is released or cascaded, zero for the empty bucket.
+	expiration int64
+
+	messages []*scheduledMessage
+}
+
+func newTimingWheel(tick int64, size int, now int64) *timingWheel {
+	w := newLevel(tick, size, now)
+	w.lowest = true
+	return w
+}
+
+func newLevel(tick int64, size int, now int64) *timingWheel {
+	w := &timingWheel{
+		tick:     tick,
+		interval: tick * int64(size),
+		current:  now - now%tick,
+		buckets:  make([]*bucket, size),
+	}
+
+	for i := range w.buckets {
+		w.buckets[i] = &bucket{}
+	}
+
+	return w
+}
+
+// add puts the message into the wheel and returns false, when it's already due at the time.
+func (w *timingWheel) add(m *scheduledMessage, now int64) bool {
+	if m.at <= now {
+		return false
+	}
+
+	if m.at >= w.current+w.interval {
+		if w.overflow == nil {
+			w.overflow = newLevel(w.interval, len(w.buckets), w.current)
+		}
+
+		return w.overflow.add(m, now)
+	}
+
+	virtual := m.at / w.tick
+	b := w.buckets[virtual%int64(len(w.buckets))]
+	b.messages = append(b.messages, m)
+
+	b.expiration = virtual * w.tick
+	if w.lowest {
+		b.expiration += w.tick
+	}
+
+	return true
+}
+
+// advance moves the wheel to the time and returns the messages, which are due.
+// The messages of the expired buckets of the upper levels are moved to the lower ones.
+func (w *timingWheel) advance(now int64) []*scheduledMessage {
+	for level := w; level != nil; level = level.overflow {
+		if now >= level.current+level.tick {
+			level.current = now - now%level.tick
+		}
+	}
+
+	var due []*scheduledMessage
+	for level := w; level != nil; level = level.overflow {
+		for _, b := range level.buckets {
+			if b.expiration == 0 || b.expiration > now {
+				continue
+			}
+
+			messages := b.messages
+			b.messages, b.expiration = nil, 0
+			for _, m := range messages {
+				if !w.add(m, now) {
+					due = append(due, m)
+				}
+			}
+		}
+	}
+
+	return due
+}
+
+// next returns the nearest time, when the wheel has to be advanced, or zero, when it's empty.
+func (w *timingWheel) next() int64 {
+	var next int64
+	for level := w; level != nil; level = level.overflow {
+		for _, b := range level.buckets {
+			if b.expiration != 0 && (next == 0 || b.expiration < next) {
+				next = b.expiration
+			}
+		}
+	}
+
+	return next
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestTimingWheel(t *testing.T) {
+	const tick, size = 10, 8
+
+	testCases := []struct {
+		name   string
+		delays []int64
+		step   int64
+	}{
+		{
+			name:   "success, first level",
+			delays: []int64{1, 9, 10, 11, 35, 79},
+			step:   3,
+		},
+		{
+			name:   "success, cascading from the upper levels",
+			delays: []int64{80, 81, 640, 700, 5119, 5120, 40000},
+			step:   7,
+		},
+		{
+			name:   "success, advancing over many ticks at once",
+			delays: []int64{5, 100, 1000, 10000},
+			step:   2500,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			const start = 1000003
+			w := newTimingWheel(tick, size, start)
+
+			pending := make(map[*scheduledMessage]bool)
+			for _, delay := range tc.delays {
+				m := &scheduledMessage{at: start + delay}
+				if !w.add(m, start) {
+					t.Fatalf("expected the message at %d to be added", m.at)
+				}
+
+				pending[m] = true
+			}
+
+			for now := int64(start); len(pending) > 0; now += tc.step {
+				if next := w.next(); next == 0 {
+					t.Fatalf("expected the next tick, got none with %d pending", len(pending))
+				}
+
+				for _, m := range w.advance(now) {
+					if !pending[m] {
+						t.Fatalf("expected the message at %d to be released once", m.at)
+					}
+
+					// Never early and at most a tick late, besides the time between the advances.
+					if now < m.at || now > m.at+tick+tc.step {
+						t.Errorf("expected the message at %d to be released at %d", m.at, now)
+					}
+
+					delete(pending, m)
+				}
+			}
+
+			if next := w.next(); next != 0 {
+				t.Errorf("expected the empty wheel, got the next tick at %d", next)
+			}
+		})
+	}
+}
+
+func TestTimingWheel_Random(t *testing.T) {
+	const tick, size = 10, 16
+
+	r := rand.New(rand.NewSource(1))
+	w := newTimingWheel(tick, size, 0)
+
+	pending := make(map[*scheduledMessage]bool)
+	for now := int64(0); now < 200000; now += r.Int63n(3 * tick) {
+		for i := r.Intn(3); i > 0; i-- {
+			m := &scheduledMessage{at: now + 1 + r.Int63n(50000)}
+			if w.add(m, now) {
+				pending[m] = true
+			}
+		}
+
+		for _, m := range w.advance(now) {
+			if !pending[m] || now < m.at || now > m.at+4*tick {
+				t.Fatalf("expected the message at %d to be released once in time, got at %d", m.at, now)
+			}
+
+			delete(pending, m)
+		}
+	}
+}
@@ -3,5 +3,42 @@ package pkg
 import "errors"
 
 var (
-	ErrorTopicNotFound = errors.New("topic not found")
+	ErrorTopicNotFound      = errors.New("topic not found")
+	ErrorTopicAlreadyExists = errors.New("topic already exists")
+	ErrorInvalidTopic       = errors.New("invalid topic name")
+	ErrorInvalidPartitions  = errors.New("number of partitions must be positive")
+	ErrorPartitionNotFound  = errors.New("partition not found")
+	ErrorPartitionRequired  = errors.New("partition is required by the topic partitioner")
+	ErrorInvalidConfig      = errors.New("invalid topic config")
+	ErrorNoMessages         = errors.New("no messages available")
+	ErrorOffsetOutOfRange   = errors.New("offset out of range")
+	ErrorSessionTimeout     = errors.New("consumer group session timed out")
+	ErrorGroupRequired      = errors.New("consumer group is required")
+	ErrorInvalidGroup       = errors.New("consumer group can't contain the NUL character")
+	ErrorInternalTopic      = errors.New("internal topics can't be changed by clients")
+	ErrorTimestampRequired  = errors.New("timestamp is required")
+	ErrorEmptyBatch         = errors.New("batch has no messages")
+	ErrorConsumeNotStarted  = errors.New("consume must be started first")
+	ErrorInvalidDeadLetter  = errors.New("invalid dead letter topic")
+	ErrorInvalidDelay       = errors.New("invalid delivery delay")
+	ErrorInvalidTTL         = errors.New("invalid message ttl")
+	ErrorUnknownProducer    = errors.New("unknown producer")
+	ErrorProducerFenced     = errors.New("producer is fenced by a newer epoch")
+	ErrorDuplicateSequence  = errors.New("duplicate sequence number")
+	ErrorOutOfOrderSequence = errors.New("out of order sequence number")
+
+	ErrorInvalidTransactionState = errors.New("invalid transaction state")
+
+	ErrorNotLeader          = errors.New("broker is not the leader of the partition")
+	ErrorNotEnoughReplicas  = errors.New("not enough in-sync replicas")
+	ErrorReplicationTimeout = errors.New("replication timed out")
+	ErrorStaleIsr           = errors.New("in-sync replicas were changed by another proposal")
+	ErrorInvalidIsr         = errors.New("in-sync replicas must be the replicas with the leader")
+
+	ErrorNotController = errors.New("broker is not the metadata controller")
+	ErrorNoController  = errors.New("metadata controller is not elected")
+
+	ErrorConsumerTooSlow = errors.New("consumer group fell too far behind")
+
+	ErrorBrokerClosed = errors.New("broker is closed")
 )
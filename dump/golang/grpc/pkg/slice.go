@@ -9,3 +9,14 @@ func In[T comparable](s []T, e T) bool {
 
 	return false
 }
+
+// Subset reports, whether all elements of the s are in the of.
+func Subset[T comparable](s, of []T) bool {
+	for _, v := range s {
+		if !In(of, v) {
+			return false
+		}
+	}
+
+	return true
+}